@@ -9,13 +9,19 @@ import (
 	"log"
 	"os/exec"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudfoundry-incubator/garden/warden"
 	"github.com/cloudfoundry/gunk/command_runner"
+	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/nat"
+	"github.com/dotcloud/docker/runconfig"
+	"github.com/dotcloud/docker/utils"
 
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/bandwidth_manager"
@@ -24,6 +30,8 @@ import (
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/quota_manager"
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/uid_pool"
 
+	"github.com/vito/warden-docker/container_pool/graph_checker"
+	"github.com/vito/warden-docker/container_pool/image_collector"
 	"github.com/vito/warden-docker/container_pool/repository_fetcher"
 )
 
@@ -35,8 +43,22 @@ type LinuxContainerPool struct {
 	denyNetworks  []string
 	allowNetworks []string
 
-	repoFetcher repository_fetcher.RepositoryFetcher
-	graphDriver graphdriver.Driver
+	// the host of the registry that images without one are pulled from
+	defaultRegistry string
+
+	repoFetcher    repository_fetcher.PolicyFetcher
+	repoPusher     repository_fetcher.RepositoryPusher
+	graphDriver    graphdriver.Driver
+	imageGraph     ImageGraph
+	tagStore       repository_fetcher.TagStore
+	committedTags  repository_fetcher.TagStore
+	imageCollector image_collector.ImageCollector
+	graphChecker   graph_checker.GraphChecker
+
+	// images pulled on setup, and re-pulled on an interval
+	warmImages        []WarmImage
+	warmImageInterval time.Duration
+	warmImagesMutex   *sync.RWMutex
 
 	uidPool     uid_pool.UIDPool
 	networkPool network_pool.NetworkPool
@@ -47,14 +69,52 @@ type LinuxContainerPool struct {
 	quotaManager quota_manager.QuotaManager
 
 	containerIDs chan string
+
+	// progress of the images being pulled for containers being created, by
+	// the handle the client gave
+	pulls      map[string]*repository_fetcher.PullProgress
+	pullsMutex *sync.RWMutex
 }
 
 const imagePrefix = "image:"
 
+// how many times to fetch an image that keeps being collected before it can
+// be retained, e.g. by a graph that is far beyond its thresholds
+const maxRetainAttempts = 3
+
+// containers may override the server's pull policy for their image with this
+// property, e.g. "never" to only use images already on the host
+const pullPolicyProperty = "pull_policy"
+
+// containers created from an image may set this property to "true" to have a
+// host port mapped to each port their image exposes
+const exposePortsProperty = "expose_ports"
+
+// ImageGraph is the graph that containers' images are fetched into, and
+// committed and exported from; it apes docker's *graph.Graph.
+type ImageGraph interface {
+	repository_fetcher.Graph
+
+	TempLayerArchive(id string, compression archive.Compression, sf *utils.StreamFormatter, output io.Writer) (*archive.TempArchive, error)
+}
+
+type resourcedContainer interface {
+	Resources() *linux_backend.Resources
+}
+
 func New(
 	binPath, depotPath, rootFSPath string,
-	repoFetcher repository_fetcher.RepositoryFetcher,
+	defaultRegistry string,
+	repoFetcher repository_fetcher.PolicyFetcher,
+	repoPusher repository_fetcher.RepositoryPusher,
 	graph graphdriver.Driver,
+	imageGraph ImageGraph,
+	tagStore repository_fetcher.TagStore,
+	committedTags repository_fetcher.TagStore,
+	imageCollector image_collector.ImageCollector,
+	graphChecker graph_checker.GraphChecker,
+	warmImages []string,
+	warmImageInterval time.Duration,
 	uidPool uid_pool.UIDPool,
 	networkPool network_pool.NetworkPool,
 	portPool linux_backend.PortPool,
@@ -70,8 +130,19 @@ func New(
 		allowNetworks: allowNetworks,
 		denyNetworks:  denyNetworks,
 
-		repoFetcher: repoFetcher,
-		graphDriver: graph,
+		defaultRegistry: defaultRegistry,
+
+		repoFetcher:    repoFetcher,
+		repoPusher:     repoPusher,
+		graphDriver:    graph,
+		imageGraph:     imageGraph,
+		tagStore:       tagStore,
+		committedTags:  committedTags,
+		imageCollector: imageCollector,
+		graphChecker:   graphChecker,
+
+		warmImageInterval: warmImageInterval,
+		warmImagesMutex:   new(sync.RWMutex),
 
 		uidPool:     uidPool,
 		networkPool: networkPool,
@@ -82,6 +153,13 @@ func New(
 		quotaManager: quotaManager,
 
 		containerIDs: make(chan string),
+
+		pulls:      make(map[string]*repository_fetcher.PullProgress),
+		pullsMutex: new(sync.RWMutex),
+	}
+
+	for _, ref := range warmImages {
+		pool.warmImages = append(pool.warmImages, WarmImage{Reference: ref})
 	}
 
 	go pool.generateContainerIDs()
@@ -109,6 +187,20 @@ func (p *LinuxContainerPool) Setup() error {
 		return err
 	}
 
+	err = p.checkGraph()
+	if err != nil {
+		return err
+	}
+
+	warmRefs, err := p.parseWarmImages()
+	if err != nil {
+		return err
+	}
+
+	if len(warmRefs) > 0 {
+		go p.warmUp(warmRefs)
+	}
+
 	return nil
 }
 
@@ -116,7 +208,58 @@ func formatNetworks(networks []string) string {
 	return strings.Join(networks, " ")
 }
 
+// checkGraph repairs what was left in the graph by the server being killed,
+// leaving the layers of the containers in the depot for them to be restored.
+func (p *LinuxContainerPool) checkGraph() error {
+	ids, err := p.depotContainers()
+	if err != nil {
+		return err
+	}
+
+	containers := map[string]bool{}
+	for _, id := range ids {
+		containers[id] = true
+	}
+
+	_, err = p.graphChecker.Check(containers)
+	return err
+}
+
 func (p *LinuxContainerPool) Prune(keep map[string]bool) error {
+	ids, err := p.depotContainers()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		_, found := keep[id]
+		if found {
+			continue
+		}
+
+		log.Println("pruning", id)
+
+		err = p.destroy(id)
+		if err != nil {
+			return err
+		}
+
+		// the container may have been created from an image
+		if p.graphDriver.Exists(id) {
+			p.graphDriver.Put(id)
+
+			err = p.graphDriver.Remove(id)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// depotContainers lists the IDs of the containers in the depot.
+func (p *LinuxContainerPool) depotContainers() ([]string, error) {
 	ls := &exec.Cmd{
 		Path: "ls",
 		Args: []string{p.depotPath},
@@ -128,11 +271,13 @@ func (p *LinuxContainerPool) Prune(keep map[string]bool) error {
 
 	err := p.runner.Run(ls)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	reader := bufio.NewReader(out)
 
+	ids := []string{}
+
 	for {
 		container, err := reader.ReadString('\n')
 		if err != nil {
@@ -146,34 +291,13 @@ func (p *LinuxContainerPool) Prune(keep map[string]bool) error {
 			continue
 		}
 
-		_, found := keep[id]
-		if found {
-			continue
-		}
-
-		log.Println("pruning", id)
-
-		err = p.destroy(id)
-		if err != nil {
-			return err
-		}
+		ids = append(ids, id)
 	}
 
-	return nil
+	return ids, nil
 }
 
 func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Container, error) {
-	uid, err := p.uidPool.Acquire()
-	if err != nil {
-		return nil, err
-	}
-
-	network, err := p.networkPool.Acquire()
-	if err != nil {
-		p.uidPool.Release(uid)
-		return nil, err
-	}
-
 	id := <-p.containerIDs
 
 	containerPath := path.Join(p.depotPath, id)
@@ -190,28 +314,63 @@ func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Co
 	rootFSPath := p.rootFSPath
 	rootFSRaw := false
 
+	var imageID string
+	var imageConfig *runconfig.Config
+	var imageProvenance *ImageProvenance
+	var imageEvents []string
+	var imagePorts []uint32
+
 	if strings.HasPrefix(spec.RootFSPath, imagePrefix) {
-		repoSegments := strings.SplitN(spec.RootFSPath[len(imagePrefix):], ":", 2)
+		ref, err := ParseImageReference(spec.RootFSPath[len(imagePrefix):])
+		if err != nil {
+			return nil, err
+		}
+
+		progress := repository_fetcher.NewPullProgress()
 
-		repoName := repoSegments[0]
+		// the pull is only tracked by a handle the client chose, as one
+		// generated here isn't known to it until the create returns
+		if spec.Handle != "" {
+			p.startPull(spec.Handle, progress)
+		}
+
+		image, err := p.fetchRetainedImage(ref, spec.Properties, progress)
 
-		tag := "latest"
-		if len(repoSegments) >= 2 {
-			tag = repoSegments[1]
+		if spec.Handle != "" {
+			p.finishPull(spec.Handle, progress)
 		}
 
-		imageID, err := p.repoFetcher.Fetch(repoName, tag)
 		if err != nil {
 			return nil, err
 		}
 
+		pulled := "pulled " + ref.String() + ": " + progress.Summary()
+
+		log.Println(id, pulled)
+
+		imageEvents = []string{pulled}
+
+		imageID = image.ID
+		imageConfig = image.Config
+		imageProvenance = p.provenance(ref)
+
+		if spec.Properties[exposePortsProperty] == "true" {
+			imagePorts, err = exposedPorts(id, imageConfig)
+			if err != nil {
+				p.imageCollector.Release(imageID)
+				return nil, err
+			}
+		}
+
 		err = p.graphDriver.Create(id, imageID)
 		if err != nil {
+			p.imageCollector.Release(imageID)
 			return nil, err
 		}
 
 		rootFSPath, err = p.graphDriver.Get(id, "")
 		if err != nil {
+			p.imageCollector.Release(imageID)
 			return nil, err
 		}
 
@@ -220,7 +379,29 @@ func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Co
 		rootFSPath = spec.RootFSPath
 	}
 
-	container := linux_backend.NewLinuxContainer(
+	// acquired only once the image is resolved, so that failing to resolve it
+	// has nothing to release, and pulls don't hold on to them
+	uid, err := p.uidPool.Acquire()
+	if err != nil {
+		if imageID != "" {
+			p.imageCollector.Release(imageID)
+		}
+
+		return nil, err
+	}
+
+	network, err := p.networkPool.Acquire()
+	if err != nil {
+		p.uidPool.Release(uid)
+
+		if imageID != "" {
+			p.imageCollector.Release(imageID)
+		}
+
+		return nil, err
+	}
+
+	linuxContainer := linux_backend.NewLinuxContainer(
 		id,
 		handle,
 		containerPath,
@@ -234,6 +415,8 @@ func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Co
 		bandwidthManager,
 	)
 
+	container := p.wrapContainer(linuxContainer, imageID, imageConfig, imageProvenance, imageEvents, imagePorts)
+
 	create := &exec.Cmd{
 		Path: path.Join(p.binPath, "create.sh"),
 		Args: []string{containerPath},
@@ -253,6 +436,11 @@ func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Co
 	if err != nil {
 		p.uidPool.Release(uid)
 		p.networkPool.Release(network)
+
+		if imageID != "" {
+			p.imageCollector.Release(imageID)
+		}
+
 		return nil, err
 	}
 
@@ -264,8 +452,134 @@ func (p *LinuxContainerPool) Create(spec warden.ContainerSpec) (linux_backend.Co
 	return container, nil
 }
 
+// exposedPorts returns the TCP ports the image exposes, in order, for the
+// container to map a host port to once it has started.
+func exposedPorts(id string, config *runconfig.Config) ([]uint32, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	ports := []int{}
+
+	for exposed := range config.ExposedPorts {
+		// net.sh only forwards TCP
+		if exposed.Proto() != "tcp" {
+			log.Println(id, "not mapping exposed port", exposed, "(only TCP ports are mapped)")
+			continue
+		}
+
+		port, err := nat.ParsePort(exposed.Port())
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid exposed port: %s", exposed)
+		}
+
+		ports = append(ports, port)
+	}
+
+	sort.Ints(ports)
+
+	mapped := make([]uint32, len(ports))
+	for i, port := range ports {
+		mapped[i] = uint32(port)
+	}
+
+	return mapped, nil
+}
+
+// fetchRetainedImage fetches the image and retains it for the container. An
+// image collected between being fetched and being retained is fetched again.
+func (p *LinuxContainerPool) fetchRetainedImage(
+	ref ImageReference,
+	properties warden.Properties,
+	progress repository_fetcher.ProgressReporter,
+) (*repository_fetcher.Image, error) {
+	for attempt := 1; ; attempt++ {
+		image, err := p.fetchImage(ref, properties, progress)
+		if err != nil {
+			return nil, err
+		}
+
+		err = p.imageCollector.RetainFetched(image.ID)
+		if err == nil {
+			return image, nil
+		}
+
+		if attempt == maxRetainAttempts {
+			return nil, err
+		}
+
+		log.Println("fetching", ref.String(), "again:", err)
+	}
+}
+
+func (p *LinuxContainerPool) fetchImage(
+	ref ImageReference,
+	properties warden.Properties,
+	progress repository_fetcher.ProgressReporter,
+) (*repository_fetcher.Image, error) {
+	policyName, found := properties[pullPolicyProperty]
+	if !found {
+		return p.repoFetcher.FetchWithProgress(ref.Name(), ref.Reference(), progress)
+	}
+
+	policy, err := repository_fetcher.ParsePullPolicy(policyName)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.repoFetcher.FetchWithPolicy(ref.Name(), ref.Reference(), policy, progress)
+}
+
+// provenance records the reference an image was pulled from, resolving the
+// registry of images on the default registry.
+func (p *LinuxContainerPool) provenance(ref ImageReference) *ImageProvenance {
+	registry := ref.Registry
+	if registry == "" {
+		registry = p.defaultRegistry
+	}
+
+	return &ImageProvenance{
+		Registry:   registry,
+		Repository: ref.Repository,
+		Tag:        ref.Tag,
+		Digest:     ref.Digest,
+	}
+}
+
+// PullProgress returns the progress of each layer of the image being pulled
+// for the container being created with the given handle. Containers created
+// without a handle have no progress to query.
+func (p *LinuxContainerPool) PullProgress(handle string) ([]repository_fetcher.LayerProgress, bool) {
+	p.pullsMutex.RLock()
+	defer p.pullsMutex.RUnlock()
+
+	pull, found := p.pulls[handle]
+	if !found {
+		return nil, false
+	}
+
+	return pull.Layers(), true
+}
+
+func (p *LinuxContainerPool) startPull(handle string, pull *repository_fetcher.PullProgress) {
+	p.pullsMutex.Lock()
+	p.pulls[handle] = pull
+	p.pullsMutex.Unlock()
+}
+
+// finishPull stops tracking the pull, unless another create with the same
+// handle has started one since.
+func (p *LinuxContainerPool) finishPull(handle string, pull *repository_fetcher.PullProgress) {
+	p.pullsMutex.Lock()
+	defer p.pullsMutex.Unlock()
+
+	if p.pulls[handle] == pull {
+		delete(p.pulls, handle)
+	}
+}
+
 func (p *LinuxContainerPool) Restore(snapshot io.Reader) (linux_backend.Container, error) {
-	var containerSnapshot linux_backend.ContainerSnapshot
+	var containerSnapshot ContainerSnapshot
 
 	err := json.NewDecoder(snapshot).Decode(&containerSnapshot)
 	if err != nil {
@@ -309,7 +623,7 @@ func (p *LinuxContainerPool) Restore(snapshot io.Reader) (linux_backend.Containe
 
 	bandwidthManager := bandwidth_manager.New(containerPath, id, p.runner)
 
-	container := linux_backend.NewLinuxContainer(
+	linuxContainer := linux_backend.NewLinuxContainer(
 		id,
 		containerSnapshot.Handle,
 		containerPath,
@@ -327,12 +641,23 @@ func (p *LinuxContainerPool) Restore(snapshot io.Reader) (linux_backend.Containe
 		bandwidthManager,
 	)
 
-	err = container.Restore(containerSnapshot)
+	err = linuxContainer.Restore(containerSnapshot.ContainerSnapshot)
 	if err != nil {
 		return nil, err
 	}
 
-	return container, nil
+	if containerSnapshot.ImageID != "" {
+		p.imageCollector.Retain(containerSnapshot.ImageID)
+	}
+
+	return p.wrapContainer(
+		linuxContainer,
+		containerSnapshot.ImageID,
+		containerSnapshot.ImageConfig,
+		containerSnapshot.Image,
+		nil,
+		nil,
+	), nil
 }
 
 func (p *LinuxContainerPool) Destroy(container linux_backend.Container) error {
@@ -348,9 +673,11 @@ func (p *LinuxContainerPool) Destroy(container linux_backend.Container) error {
 		return err
 	}
 
-	linuxContainer := container.(*linux_backend.LinuxContainer)
+	if imageBased, ok := container.(*imageContainer); ok {
+		p.imageCollector.Release(imageBased.imageID)
+	}
 
-	resources := linuxContainer.Resources()
+	resources := container.(resourcedContainer).Resources()
 
 	for _, port := range resources.Ports {
 		p.portPool.Release(port)
@@ -363,6 +690,29 @@ func (p *LinuxContainerPool) Destroy(container linux_backend.Container) error {
 	return nil
 }
 
+func (p *LinuxContainerPool) wrapContainer(
+	container *linux_backend.LinuxContainer,
+	imageID string,
+	imageConfig *runconfig.Config,
+	imageProvenance *ImageProvenance,
+	imageEvents []string,
+	imagePorts []uint32,
+) linux_backend.Container {
+	if imageID == "" {
+		return container
+	}
+
+	return &imageContainer{
+		LinuxContainer: container,
+		imageID:        imageID,
+		config:         imageConfig,
+		provenance:     imageProvenance,
+		rootFSPath:     path.Join(p.depotPath, container.ID(), "mnt"),
+		events:         imageEvents,
+		exposedPorts:   imagePorts,
+	}
+}
+
 func (p *LinuxContainerPool) MaxContainers() int {
 	maxNet := p.networkPool.InitialSize()
 	maxUid := p.uidPool.InitialSize()
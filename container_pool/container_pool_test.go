@@ -1,12 +1,17 @@
 package container_pool_test
 
 import (
+	"archive/tar"
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"time"
 
 	. "github.com/onsi/ginkgo"
@@ -21,10 +26,22 @@ import (
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/uid_pool/fake_uid_pool"
 	"github.com/cloudfoundry/gunk/command_runner/fake_command_runner"
 	. "github.com/cloudfoundry/gunk/command_runner/fake_command_runner/matchers"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/nat"
+	"github.com/dotcloud/docker/runconfig"
 
 	"github.com/vito/warden-docker/container_pool"
 	"github.com/vito/warden-docker/container_pool/fake_graph_driver"
+	"github.com/vito/warden-docker/container_pool/graph_checker"
+	"github.com/vito/warden-docker/container_pool/graph_checker/fake_graph_checker"
+	"github.com/vito/warden-docker/container_pool/image_collector"
+	"github.com/vito/warden-docker/container_pool/image_collector/fake_image_collector"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher"
 	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_pusher"
+	"github.com/vito/warden-docker/fake_graph"
+	"github.com/vito/warden-docker/fake_tag_store"
 )
 
 var _ = Describe("Container pool", func() {
@@ -34,27 +51,31 @@ var _ = Describe("Container pool", func() {
 	var fakeQuotaManager *fake_quota_manager.FakeQuotaManager
 	var fakePortPool *fake_port_pool.FakePortPool
 	var fakeRepositoryFetcher *fake_repository_fetcher.FakeRepositoryFetcher
+	var fakeRepositoryPusher *fake_repository_pusher.FakeRepositoryPusher
 	var fakeGraphDriver *fake_graph_driver.FakeGraphDriver
+	var fakeImageCollector *fake_image_collector.FakeImageCollector
+	var fakeGraphChecker *fake_graph_checker.FakeGraphChecker
+	var fakeGraph *fake_graph.FakeGraph
+	var fakeTagStore *fake_tag_store.FakeTagStore
+	var fakeCommittedTagStore *fake_tag_store.FakeTagStore
 	var pool *container_pool.LinuxContainerPool
 
-	BeforeEach(func() {
-		_, ipNet, err := net.ParseCIDR("1.2.0.0/20")
-		Expect(err).ToNot(HaveOccurred())
-
-		fakeRepositoryFetcher = fake_repository_fetcher.New()
-		fakeGraphDriver = fake_graph_driver.New()
-		fakeUIDPool = fake_uid_pool.New(10000)
-		fakeNetworkPool = fake_network_pool.New(ipNet)
-		fakeRunner = fake_command_runner.New()
-		fakeQuotaManager = fake_quota_manager.New()
-		fakePortPool = fake_port_pool.New(1000)
-
-		pool = container_pool.New(
+	newPool := func(depotPath string) *container_pool.LinuxContainerPool {
+		return container_pool.New(
 			"/root/path",
-			"/depot/path",
+			depotPath,
 			"/rootfs/path",
+			"index.docker.io",
 			fakeRepositoryFetcher,
+			fakeRepositoryPusher,
 			fakeGraphDriver,
+			fakeGraph,
+			fakeTagStore,
+			fakeCommittedTagStore,
+			fakeImageCollector,
+			fakeGraphChecker,
+			nil,
+			0,
 			fakeUIDPool,
 			fakeNetworkPool,
 			fakePortPool,
@@ -63,6 +84,27 @@ var _ = Describe("Container pool", func() {
 			fakeRunner,
 			fakeQuotaManager,
 		)
+	}
+
+	BeforeEach(func() {
+		_, ipNet, err := net.ParseCIDR("1.2.0.0/20")
+		Expect(err).ToNot(HaveOccurred())
+
+		fakeRepositoryFetcher = fake_repository_fetcher.New()
+		fakeRepositoryPusher = fake_repository_pusher.New()
+		fakeGraphDriver = fake_graph_driver.New()
+		fakeImageCollector = fake_image_collector.New()
+		fakeGraphChecker = fake_graph_checker.New()
+		fakeGraph = fake_graph.New()
+		fakeTagStore = fake_tag_store.New()
+		fakeCommittedTagStore = fake_tag_store.New()
+		fakeUIDPool = fake_uid_pool.New(10000)
+		fakeNetworkPool = fake_network_pool.New(ipNet)
+		fakeRunner = fake_command_runner.New()
+		fakeQuotaManager = fake_quota_manager.New()
+		fakePortPool = fake_port_pool.New(1000)
+
+		pool = newPool("/depot/path")
 	})
 
 	Describe("setup", func() {
@@ -107,10 +149,266 @@ var _ = Describe("Container pool", func() {
 				err := pool.Setup()
 				Expect(err).To(Equal(nastyError))
 			})
+
+			It("does not check the graph", func() {
+				pool.Setup()
+				Expect(fakeGraphChecker.Checked()).To(BeEmpty())
+			})
+		})
+
+		It("checks the graph, leaving the depot's containers' layers alone", func() {
+			fakeRunner.WhenRunning(
+				fake_command_runner.CommandSpec{
+					Path: "ls",
+					Args: []string{"/depot/path"},
+				}, func(cmd *exec.Cmd) error {
+					cmd.Stdout.Write([]byte("container-1\n"))
+					cmd.Stdout.Write([]byte("tmp\n"))
+					cmd.Stdout.Write([]byte("container-2\n"))
+					return nil
+				},
+			)
+
+			err := pool.Setup()
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fakeGraphChecker.Checked()).To(Equal([]map[string]bool{
+				{"container-1": true, "container-2": true},
+			}))
+		})
+
+		Context("when the graph check fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeGraphChecker.CheckError = disaster
+			})
+
+			It("returns the error", func() {
+				err := pool.Setup()
+				Expect(err).To(Equal(disaster))
+			})
+		})
+
+		Context("when the graph check repairs the graph", func() {
+			BeforeEach(func() {
+				fakeGraphChecker.CheckResult = []graph_checker.Repair{
+					{Problem: graph_checker.OrphanedContainer, ID: "some-id", Action: graph_checker.Removed},
+				}
+			})
+
+			It("succeeds", func() {
+				err := pool.Setup()
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+
+		Context("with warm images", func() {
+			var warmImageInterval time.Duration
+
+			BeforeEach(func() {
+				warmImageInterval = 0
+			})
+
+			JustBeforeEach(func() {
+				_, ipNet, err := net.ParseCIDR("1.2.0.0/20")
+				Expect(err).ToNot(HaveOccurred())
+
+				pool = container_pool.New(
+					"/root/path",
+					"/depot/path",
+					"/rootfs/path",
+					"index.docker.io",
+					fakeRepositoryFetcher,
+					fakeRepositoryPusher,
+					fakeGraphDriver,
+					fakeGraph,
+					fakeTagStore,
+					fakeCommittedTagStore,
+					fakeImageCollector,
+					fakeGraphChecker,
+					[]string{"some-repo:some-tag", "localhost:5000/team/app"},
+					warmImageInterval,
+					fakeUIDPool,
+					fake_network_pool.New(ipNet),
+					fakePortPool,
+					[]string{},
+					[]string{},
+					fakeRunner,
+					fakeQuotaManager,
+				)
+			})
+
+			It("pulls them, and retains them so they are not collected", func() {
+				fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+				err := pool.Setup()
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(fakeImageCollector.Retained).Should(Equal([]string{"some-image-id", "some-image-id"}))
+
+				Expect(fakeRepositoryFetcher.Fetched()).To(Equal([]fake_repository_fetcher.FetchSpec{
+					{Repository: "some-repo", Tag: "some-tag"},
+					{Repository: "localhost:5000/team/app", Tag: "latest"},
+				}))
+			})
+
+			It("does not wait for them to be pulled", func() {
+				pulling := make(chan struct{})
+				defer close(pulling)
+
+				fakeRepositoryFetcher.WhenFetching = func(string, string) {
+					<-pulling
+				}
+
+				err := pool.Setup()
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(pool.WarmImages()[0].Ready).To(BeFalse())
+			})
+
+			It("reports them as ready", func() {
+				fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+				Expect(pool.WarmImages()).To(HaveLen(2))
+				Expect(pool.WarmImages()[0].Ready).To(BeFalse())
+
+				err := pool.Setup()
+				Expect(err).ToNot(HaveOccurred())
+
+				Eventually(func() bool {
+					return pool.WarmImages()[1].Ready
+				}).Should(BeTrue())
+
+				warm := pool.WarmImages()
+				Expect(warm).To(HaveLen(2))
+
+				Expect(warm[0].Reference).To(Equal("some-repo:some-tag"))
+				Expect(warm[0].ImageID).To(Equal("some-image-id"))
+				Expect(warm[0].Ready).To(BeTrue())
+				Expect(warm[0].PulledAt).ToNot(BeZero())
+
+				Expect(warm[1].Reference).To(Equal("localhost:5000/team/app"))
+			})
+
+			Context("when pulling one fails", func() {
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchError = errors.New("oh no!")
+				})
+
+				It("reports it as not ready, without failing setup", func() {
+					err := pool.Setup()
+					Expect(err).ToNot(HaveOccurred())
+
+					Eventually(func() string {
+						return pool.WarmImages()[0].Error
+					}).Should(Equal("oh no!"))
+
+					Expect(pool.WarmImages()[0].Ready).To(BeFalse())
+				})
+			})
+
+			Context("when an image is collected before it can be retained", func() {
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					collected := false
+					fakeImageCollector.WhenRetainingFetched = func(imageID string) error {
+						if !collected {
+							collected = true
+							return image_collector.ErrImageCollected
+						}
+
+						return nil
+					}
+				})
+
+				It("pulls it again", func() {
+					err := pool.Setup()
+					Expect(err).ToNot(HaveOccurred())
+
+					Eventually(fakeImageCollector.Retained).Should(HaveLen(2))
+
+					Expect(fakeRepositoryFetcher.Fetched()).To(Equal([]fake_repository_fetcher.FetchSpec{
+						{Repository: "some-repo", Tag: "some-tag"},
+						{Repository: "some-repo", Tag: "some-tag"},
+						{Repository: "localhost:5000/team/app", Tag: "latest"},
+					}))
+
+					Expect(pool.WarmImages()[0].Ready).To(BeTrue())
+				})
+			})
+
+			Context("when images are always collected before they can be retained", func() {
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					fakeImageCollector.WhenRetainingFetched = func(imageID string) error {
+						return image_collector.ErrImageCollected
+					}
+				})
+
+				It("reports them as not ready", func() {
+					err := pool.Setup()
+					Expect(err).ToNot(HaveOccurred())
+
+					Eventually(func() string {
+						return pool.WarmImages()[1].Error
+					}).Should(Equal(image_collector.ErrImageCollected.Error()))
+
+					Expect(pool.WarmImages()[0].Ready).To(BeFalse())
+					Expect(fakeImageCollector.Retained()).To(BeEmpty())
+				})
+			})
+
+			Context("when a re-pull interval is given", func() {
+				BeforeEach(func() {
+					warmImageInterval = 10 * time.Millisecond
+				})
+
+				It("re-pulls them, always going to the registry", func() {
+					err := pool.Setup()
+					Expect(err).ToNot(HaveOccurred())
+
+					Eventually(fakeRepositoryFetcher.Fetched).Should(ContainElement(
+						fake_repository_fetcher.FetchSpec{
+							Repository: "some-repo",
+							Tag:        "some-tag",
+							Policy:     repository_fetcher.PullAlways,
+						},
+					))
+				})
+
+				It("retains the new image and releases the old one when the tag moves", func() {
+					fakeRepositoryFetcher.FetchResult = "old-image-id"
+
+					err := pool.Setup()
+					Expect(err).ToNot(HaveOccurred())
+
+					Eventually(fakeImageCollector.Retained).Should(ContainElement("old-image-id"))
+
+					fakeRepositoryFetcher.SetFetchResult("new-image-id")
+
+					Eventually(fakeImageCollector.Released).Should(ContainElement("old-image-id"))
+					Expect(fakeImageCollector.Retained()).To(ContainElement("new-image-id"))
+				})
+			})
 		})
 	})
 
 	Describe("creating", func() {
+		// a failed create must not hold on to the uid or network, so the
+		// pools still hand out their first ones
+		expectPoolsUnchanged := func() {
+			uid, err := fakeUIDPool.Acquire()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(uid).To(Equal(uint32(10000)))
+
+			network, err := fakeNetworkPool.Acquire()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(network.String()).To(Equal("1.2.0.0/30"))
+		}
+
 		It("returns containers with unique IDs", func() {
 			container1, err := pool.Create(warden.ContainerSpec{})
 			Expect(err).ToNot(HaveOccurred())
@@ -135,116 +433,796 @@ var _ = Describe("Container pool", func() {
 				"foo": "bar",
 			})
 
-			container, err := pool.Create(warden.ContainerSpec{
-				Properties: properties,
-			})
-			Expect(err).ToNot(HaveOccurred())
+			container, err := pool.Create(warden.ContainerSpec{
+				Properties: properties,
+			})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(container.Properties()).To(Equal(properties))
+		})
+
+		It("executes create.sh with the correct args and environment", func() {
+			container, err := pool.Create(warden.ContainerSpec{})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fakeRunner).To(HaveExecutedSerially(
+				fake_command_runner.CommandSpec{
+					Path: "/root/path/create.sh",
+					Args: []string{"/depot/path/" + container.ID()},
+					Env: []string{
+						"id=" + container.ID(),
+						"rootfs_path=/rootfs/path",
+						"rootfs_raw=false",
+						"user_uid=10000",
+						"network_host_ip=1.2.0.1",
+						"network_container_ip=1.2.0.2",
+
+						"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+					},
+				},
+			))
+		})
+
+		Context("when a rootfs path is specified", func() {
+			It("is passed as $rootfs_path to create.sh", func() {
+				container, err := pool.Create(warden.ContainerSpec{
+					RootFSPath: "/path/to/custom-rootfs",
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fakeRunner).To(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "/root/path/create.sh",
+						Args: []string{"/depot/path/" + container.ID()},
+						Env: []string{
+							"id=" + container.ID(),
+							"rootfs_path=/path/to/custom-rootfs",
+							"rootfs_raw=false",
+							"user_uid=10000",
+							"network_host_ip=1.2.0.1",
+							"network_container_ip=1.2.0.2",
+
+							"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+						},
+					},
+				))
+			})
+		})
+
+		Context("when a rootfs image is specified", func() {
+			It("fetches it and creates a graph entry with it as the parent", func() {
+				fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+				container, err := pool.Create(warden.ContainerSpec{
+					RootFSPath: "image:some-repository-name",
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fakeGraphDriver.Created()).To(ContainElement(
+					fake_graph_driver.CreatedGraph{
+						ID:     container.Handle(),
+						Parent: "some-image-id",
+					},
+				))
+
+				Expect(fakeRepositoryFetcher.Fetched()).To(ContainElement(
+					fake_repository_fetcher.FetchSpec{
+						Repository: "some-repository-name",
+						Tag:        "latest",
+					},
+				))
+			})
+
+			It("retains the image until the container is destroyed", func() {
+				fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+				container, err := pool.Create(warden.ContainerSpec{
+					RootFSPath: "image:some-repository-name",
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fakeImageCollector.Retained()).To(Equal([]string{"some-image-id"}))
+				Expect(fakeImageCollector.Released()).To(BeEmpty())
+
+				err = pool.Destroy(container)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fakeImageCollector.Released()).To(Equal([]string{"some-image-id"}))
+			})
+
+			Context("when the image is collected before it can be retained", func() {
+				var attempts int
+
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					attempts = 0
+
+					fakeImageCollector.WhenRetainingFetched = func(string) error {
+						attempts++
+
+						if attempts == 1 {
+							return image_collector.ErrImageCollected
+						}
+
+						return nil
+					}
+				})
+
+				It("fetches it again", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(fakeRepositoryFetcher.Fetched()).To(HaveLen(2))
+					Expect(fakeImageCollector.Retained()).To(Equal([]string{"some-image-id"}))
+				})
+
+				Context("every time", func() {
+					BeforeEach(func() {
+						fakeImageCollector.WhenRetainingFetched = func(string) error {
+							return image_collector.ErrImageCollected
+						}
+					})
+
+					It("gives up, returning the error", func() {
+						_, err := pool.Create(warden.ContainerSpec{
+							RootFSPath: "image:some-repository-name",
+						})
+						Expect(err).To(Equal(image_collector.ErrImageCollected))
+
+						Expect(fakeRepositoryFetcher.Fetched()).To(HaveLen(3))
+						Expect(fakeGraphDriver.Created()).To(BeEmpty())
+					})
+
+					It("leaves the uid and network pools unchanged", func() {
+						_, err := pool.Create(warden.ContainerSpec{
+							RootFSPath: "image:some-repository-name",
+						})
+						Expect(err).To(HaveOccurred())
+
+						expectPoolsUnchanged()
+					})
+				})
+			})
+
+			Context("while the image is being pulled", func() {
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+					fakeRepositoryFetcher.FetchProgress = []repository_fetcher.LayerProgress{
+						{LayerID: "some-layer", Cached: true, Complete: true},
+						{LayerID: "some-other-layer", Current: 1, Total: 2},
+					}
+				})
+
+				It("reports its progress by the container's handle", func() {
+					var progress []repository_fetcher.LayerProgress
+					var found bool
+
+					fakeRepositoryFetcher.WhenFetching = func(string, string) {
+						progress, found = pool.PullProgress("some-handle")
+					}
+
+					_, err := pool.Create(warden.ContainerSpec{
+						Handle:     "some-handle",
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(found).To(BeTrue())
+					Expect(progress).To(Equal(fakeRepositoryFetcher.FetchProgress))
+
+					_, found = pool.PullProgress("some-handle")
+					Expect(found).To(BeFalse())
+				})
+
+				It("records a summary of the pull in the container's events", func() {
+					container, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					events := container.(interface {
+						Events() []string
+					}).Events()
+
+					Expect(events).To(HaveLen(1))
+					Expect(events[0]).To(MatchRegexp(`^pulled some-repository-name:latest: 1 layers downloaded \(1 bytes\), 1 cached, in \S+$`))
+				})
+
+				It("includes the summary in the container's snapshot", func() {
+					container, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					snapshot := new(bytes.Buffer)
+
+					err = container.Snapshot(snapshot)
+					Expect(err).ToNot(HaveOccurred())
+
+					var containerSnapshot container_pool.ContainerSnapshot
+
+					err = json.NewDecoder(snapshot).Decode(&containerSnapshot)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(containerSnapshot.Events).To(HaveLen(1))
+					Expect(containerSnapshot.Events[0]).To(MatchRegexp(`^pulled some-repository-name:latest: `))
+				})
+			})
+
+			Context("when it has been created", func() {
+				var container linux_backend.Container
+
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					var err error
+
+					container, err = pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name:some-tag",
+						Properties: warden.Properties{
+							"some-key": "some-value",
+						},
+					})
+					Expect(err).ToNot(HaveOccurred())
+				})
+
+				It("reports where its image came from in its properties", func() {
+					Expect(container.Properties()).To(Equal(warden.Properties{
+						"some-key":         "some-value",
+						"image_registry":   "index.docker.io",
+						"image_repository": "some-repository-name",
+						"image_tag":        "some-tag",
+						"image_id":         "some-image-id",
+					}))
+				})
+
+				It("records where its image came from in its snapshot, apart from its properties", func() {
+					snapshot := new(bytes.Buffer)
+
+					err := container.Snapshot(snapshot)
+					Expect(err).ToNot(HaveOccurred())
+
+					var containerSnapshot container_pool.ContainerSnapshot
+
+					err = json.NewDecoder(snapshot).Decode(&containerSnapshot)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(containerSnapshot.ImageID).To(Equal("some-image-id"))
+					Expect(containerSnapshot.Image).To(Equal(&container_pool.ImageProvenance{
+						Registry:   "index.docker.io",
+						Repository: "some-repository-name",
+						Tag:        "some-tag",
+					}))
+
+					Expect(containerSnapshot.Properties).To(Equal(warden.Properties{
+						"some-key": "some-value",
+					}))
+				})
+			})
+
+			It("passes $rootfs_path as the created rootfs and $rootfs_raw as true to create.sh", func() {
+				fakeGraphDriver.GetResult = "/path/to/created-rootfs"
+
+				container, err := pool.Create(warden.ContainerSpec{
+					RootFSPath: "image:some-repository-name",
+				})
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fakeRunner).To(HaveExecutedSerially(
+					fake_command_runner.CommandSpec{
+						Path: "/root/path/create.sh",
+						Args: []string{"/depot/path/" + container.ID()},
+						Env: []string{
+							"id=" + container.ID(),
+							"rootfs_path=/path/to/created-rootfs",
+							"rootfs_raw=true",
+							"user_uid=10000",
+							"network_host_ip=1.2.0.1",
+							"network_container_ip=1.2.0.2",
+
+							"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+						},
+					},
+				))
+			})
+
+			Context("when the image has a config", func() {
+				var depotPath string
+
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+					fakeRepositoryFetcher.FetchConfig = &runconfig.Config{
+						Env:        []string{"PATH=/usr/local/bin:/usr/bin:/bin", "FOO=bar"},
+						WorkingDir: "/some/work/dir",
+						User:       "someuser",
+						Entrypoint: []string{"/entrypoint"},
+						Cmd:        []string{"some", "arg's"},
+					}
+
+					var err error
+
+					// processes resolve the image's user against the passwd and
+					// group files in the container's root filesystem
+					depotPath, err = ioutil.TempDir("", "depot")
+					Expect(err).ToNot(HaveOccurred())
+
+					pool = newPool(depotPath)
+				})
+
+				AfterEach(func() {
+					os.RemoveAll(depotPath)
+				})
+
+				create := func() linux_backend.Container {
+					container, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					etc := filepath.Join(depotPath, container.ID(), "mnt", "etc")
+
+					err = os.MkdirAll(etc, 0755)
+					Expect(err).ToNot(HaveOccurred())
+
+					err = ioutil.WriteFile(filepath.Join(etc, "passwd"), []byte(
+						"root:x:0:0:root:/root:/bin/bash\n"+
+							"toor:x:0:0:root:/root:/bin/bash\n"+
+							"vcap:x:1000:1000::/home/vcap:/bin/bash\n"+
+							"someuser:x:1001:1001::/home/someuser:/bin/bash\n",
+					), 0644)
+					Expect(err).ToNot(HaveOccurred())
+
+					err = ioutil.WriteFile(filepath.Join(etc, "group"), []byte(
+						"root:x:0:\n"+
+							"vcap:x:1000:\n"+
+							"somegroup:x:1001:\n"+
+							"othergroup:x:1002:someuser\n",
+					), 0644)
+					Expect(err).ToNot(HaveOccurred())
+
+					fakeRunner.WhenRunning(
+						fake_command_runner.CommandSpec{
+							Path: depotPath + "/" + container.ID() + "/bin/iomux-spawn",
+						},
+						func(cmd *exec.Cmd) error {
+							cmd.Stdout.Write([]byte("ready\n"))
+							cmd.Stdout.Write([]byte("active\n"))
+							return nil
+						},
+					)
+
+					return container
+				}
+
+				spawned := func(container linux_backend.Container, processID uint32, user string, stdin string) fake_command_runner.CommandSpec {
+					containerPath := depotPath + "/" + container.ID()
+
+					return fake_command_runner.CommandSpec{
+						Path: containerPath + "/bin/iomux-spawn",
+						Args: []string{
+							fmt.Sprintf("%s/processes/%d", containerPath, processID),
+							containerPath + "/bin/wsh",
+							"--socket", containerPath + "/run/wshd.sock",
+							"--user", user,
+							"/bin/bash",
+						},
+						Stdin: stdin,
+					}
+				}
+
+				It("runs privileged processes with the image's env, working dir, and user", func() {
+					container := create()
+
+					processID, _, err := container.Run(warden.ProcessSpec{
+						Script:     "/some/script",
+						Privileged: true,
+						EnvironmentVariables: []warden.EnvironmentVariable{
+							{Key: "FOO", Value: "baz"},
+						},
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					Eventually(fakeRunner).Should(HaveBackgrounded(spawned(container, processID, "root", `export PATH="/usr/local/bin:/usr/bin:/bin"
+export FOO="bar"
+export FOO="baz"
+exec su -s /bin/bash 'someuser'
+cd '/some/work/dir'
+/some/script`)))
+				})
+
+				Context("and the process is not privileged", func() {
+					It("refuses to switch to the image's user, rather than running as root", func() {
+						container := create()
+
+						_, _, err := container.Run(warden.ProcessSpec{
+							Script: "/some/script",
+						})
+						Expect(err).To(Equal(container_pool.ImageUserError{
+							User:   "someuser",
+							Reason: "switching to it requires a privileged run",
+						}))
+
+						Expect(fakeRunner).ToNot(HaveBackgrounded(fake_command_runner.CommandSpec{
+							Path: depotPath + "/" + container.ID() + "/bin/iomux-spawn",
+						}))
+					})
+
+					for _, root := range []string{"root", "0", "toor"} {
+						root := root
+
+						Context("and the image's user is "+root, func() {
+							BeforeEach(func() {
+								fakeRepositoryFetcher.FetchConfig.User = root
+							})
+
+							It("runs as vcap", func() {
+								container := create()
+
+								processID, _, err := container.Run(warden.ProcessSpec{
+									Script: "/some/script",
+								})
+								Expect(err).ToNot(HaveOccurred())
+
+								Eventually(fakeRunner).Should(HaveBackgrounded(spawned(container, processID, "vcap", `export PATH="/usr/local/bin:/usr/bin:/bin"
+export FOO="bar"
+cd '/some/work/dir'
+/some/script`)))
+							})
+						})
+					}
+
+					Context("and the image's user is vcap", func() {
+						BeforeEach(func() {
+							fakeRepositoryFetcher.FetchConfig.User = "1000:vcap"
+						})
+
+						It("runs as vcap", func() {
+							container := create()
+
+							processID, _, err := container.Run(warden.ProcessSpec{
+								Script: "/some/script",
+							})
+							Expect(err).ToNot(HaveOccurred())
+
+							Eventually(fakeRunner).Should(HaveBackgrounded(spawned(container, processID, "vcap", `export PATH="/usr/local/bin:/usr/bin:/bin"
+export FOO="bar"
+cd '/some/work/dir'
+/some/script`)))
+						})
+					})
+				})
+
+				Context("when the image's user is a uid and gid", func() {
+					BeforeEach(func() {
+						fakeRepositoryFetcher.FetchConfig.User = "1001:1001"
+					})
+
+					It("switches to the user they belong to", func() {
+						container := create()
+
+						processID, _, err := container.Run(warden.ProcessSpec{
+							Script:     "/some/script",
+							Privileged: true,
+						})
+						Expect(err).ToNot(HaveOccurred())
+
+						Eventually(fakeRunner).Should(HaveBackgrounded(spawned(container, processID, "root", `export PATH="/usr/local/bin:/usr/bin:/bin"
+export FOO="bar"
+exec su -s /bin/bash 'someuser'
+cd '/some/work/dir'
+/some/script`)))
+					})
+				})
+
+				for user, reason := range map[string]string{
+					"nobody":              "no such user in the image's /etc/passwd",
+					"2000":                "no such user in the image's /etc/passwd",
+					"someuser:nogroup":    "no such group in the image's /etc/group",
+					"someuser:othergroup": "only the user's primary group is supported",
+				} {
+					user := user
+					reason := reason
+
+					Context("when the image's user is "+user, func() {
+						BeforeEach(func() {
+							fakeRepositoryFetcher.FetchConfig.User = user
+						})
+
+						It("fails to run, saying why", func() {
+							container := create()
+
+							_, _, err := container.Run(warden.ProcessSpec{
+								Script:     "/some/script",
+								Privileged: true,
+							})
+							Expect(err).To(Equal(container_pool.ImageUserError{User: user, Reason: reason}))
+						})
+					})
+				}
+
+				Context("and the script is empty", func() {
+					It("runs the image's entrypoint and command", func() {
+						fakeRepositoryFetcher.FetchConfig.User = ""
+
+						container := create()
+
+						processID, _, err := container.Run(warden.ProcessSpec{})
+						Expect(err).ToNot(HaveOccurred())
+
+						Eventually(fakeRunner).Should(HaveBackgrounded(spawned(container, processID, "vcap", `export PATH="/usr/local/bin:/usr/bin:/bin"
+export FOO="bar"
+cd '/some/work/dir'
+exec '/entrypoint' 'some' 'arg'"'"'s'`)))
+					})
+				})
+
+				It("includes the config in the container's snapshot", func() {
+					container := create()
+
+					snapshot := new(bytes.Buffer)
+
+					err := container.Snapshot(snapshot)
+					Expect(err).ToNot(HaveOccurred())
+
+					var containerSnapshot container_pool.ContainerSnapshot
+
+					err = json.NewDecoder(snapshot).Decode(&containerSnapshot)
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(containerSnapshot.ID).To(Equal(container.ID()))
+					Expect(containerSnapshot.ImageConfig).To(Equal(fakeRepositoryFetcher.FetchConfig))
+				})
+			})
+
+			Context("when the image exposes ports", func() {
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+					fakeRepositoryFetcher.FetchConfig = &runconfig.Config{
+						ExposedPorts: map[nat.Port]struct{}{
+							"8080/tcp": struct{}{},
+							"53/udp":   struct{}{},
+							"80/tcp":   struct{}{},
+						},
+					}
+				})
+
+				Context("and the container asks for them to be exposed", func() {
+					spec := warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+						Properties: warden.Properties{
+							"expose_ports": "true",
+						},
+					}
+
+					It("maps a port from the pool to each TCP port once the container has started", func() {
+						container, err := pool.Create(spec)
+						Expect(err).ToNot(HaveOccurred())
+
+						Expect(fakeRunner).ToNot(HaveExecutedSerially(
+							fake_command_runner.CommandSpec{
+								Args: []string{"in"},
+							},
+						))
+
+						err = container.Start()
+						Expect(err).ToNot(HaveOccurred())
+
+						Expect(fakeRunner).To(HaveExecutedSerially(
+							fake_command_runner.CommandSpec{
+								Path: "/depot/path/" + container.ID() + "/start.sh",
+							},
+							fake_command_runner.CommandSpec{
+								Path: "/depot/path/" + container.ID() + "/net.sh",
+								Args: []string{"in"},
+								Env:  []string{"HOST_PORT=1000", "CONTAINER_PORT=80"},
+							},
+							fake_command_runner.CommandSpec{
+								Path: "/depot/path/" + container.ID() + "/net.sh",
+								Args: []string{"in"},
+								Env:  []string{"HOST_PORT=1001", "CONTAINER_PORT=8080"},
+							},
+						))
+					})
+
+					It("records the mappings in the container's snapshot", func() {
+						container, err := pool.Create(spec)
+						Expect(err).ToNot(HaveOccurred())
+
+						err = container.Start()
+						Expect(err).ToNot(HaveOccurred())
+
+						snapshot := new(bytes.Buffer)
+
+						err = container.Snapshot(snapshot)
+						Expect(err).ToNot(HaveOccurred())
+
+						var containerSnapshot container_pool.ContainerSnapshot
+
+						err = json.NewDecoder(snapshot).Decode(&containerSnapshot)
+						Expect(err).ToNot(HaveOccurred())
+
+						Expect(containerSnapshot.NetIns).To(Equal([]linux_backend.NetInSpec{
+							{HostPort: 1000, ContainerPort: 80},
+							{HostPort: 1001, ContainerPort: 8080},
+						}))
+
+						Expect(containerSnapshot.Resources.Ports).To(Equal([]uint32{1000, 1001}))
+					})
+
+					Context("but mapping a port fails", func() {
+						disaster := errors.New("oh no!")
+
+						BeforeEach(func() {
+							fakeRunner.WhenRunning(
+								fake_command_runner.CommandSpec{
+									Args: []string{"in"},
+								},
+								func(cmd *exec.Cmd) error {
+									return disaster
+								},
+							)
+						})
+
+						It("returns the error from starting the container", func() {
+							container, err := pool.Create(spec)
+							Expect(err).ToNot(HaveOccurred())
+
+							err = container.Start()
+							Expect(err).To(Equal(disaster))
+						})
+
+						It("releases the port when the container is destroyed", func() {
+							container, err := pool.Create(spec)
+							Expect(err).ToNot(HaveOccurred())
+
+							container.Start()
+
+							err = pool.Destroy(container)
+							Expect(err).ToNot(HaveOccurred())
+
+							Expect(fakePortPool.Released).To(Equal([]uint32{1000}))
+						})
+					})
+				})
+
+				Context("and one of them is invalid", func() {
+					BeforeEach(func() {
+						fakeRepositoryFetcher.FetchConfig.ExposedPorts["0/tcp"] = struct{}{}
+					})
+
+					spec := warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+						Properties: warden.Properties{
+							"expose_ports": "true",
+						},
+					}
+
+					It("returns an error, releasing the image", func() {
+						_, err := pool.Create(spec)
+						Expect(err).To(HaveOccurred())
 
-			Expect(container.Properties()).To(Equal(properties))
-		})
+						Expect(fakeImageCollector.Released()).To(Equal([]string{"some-image-id"}))
+					})
 
-		It("executes create.sh with the correct args and environment", func() {
-			container, err := pool.Create(warden.ContainerSpec{})
-			Expect(err).ToNot(HaveOccurred())
+					It("leaves the uid and network pools unchanged", func() {
+						_, err := pool.Create(spec)
+						Expect(err).To(HaveOccurred())
 
-			Expect(fakeRunner).To(HaveExecutedSerially(
-				fake_command_runner.CommandSpec{
-					Path: "/root/path/create.sh",
-					Args: []string{"/depot/path/" + container.ID()},
-					Env: []string{
-						"id=" + container.ID(),
-						"rootfs_path=/rootfs/path",
-						"rootfs_raw=false",
-						"user_uid=10000",
-						"network_host_ip=1.2.0.1",
-						"network_container_ip=1.2.0.2",
+						expectPoolsUnchanged()
+					})
+				})
 
-						"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-					},
-				},
-			))
-		})
+				Context("and the container does not ask for them to be exposed", func() {
+					It("maps no ports", func() {
+						container, err := pool.Create(warden.ContainerSpec{
+							RootFSPath: "image:some-repository-name",
+						})
+						Expect(err).ToNot(HaveOccurred())
 
-		Context("when a rootfs path is specified", func() {
-			It("is passed as $rootfs_path to create.sh", func() {
-				container, err := pool.Create(warden.ContainerSpec{
-					RootFSPath: "/path/to/custom-rootfs",
+						err = container.Start()
+						Expect(err).ToNot(HaveOccurred())
+
+						Expect(fakeRunner).ToNot(HaveExecutedSerially(
+							fake_command_runner.CommandSpec{
+								Args: []string{"in"},
+							},
+						))
+					})
 				})
-				Expect(err).ToNot(HaveOccurred())
+			})
 
-				Expect(fakeRunner).To(HaveExecutedSerially(
-					fake_command_runner.CommandSpec{
-						Path: "/root/path/create.sh",
-						Args: []string{"/depot/path/" + container.ID()},
-						Env: []string{
-							"id=" + container.ID(),
-							"rootfs_path=/path/to/custom-rootfs",
-							"rootfs_raw=false",
-							"user_uid=10000",
-							"network_host_ip=1.2.0.1",
-							"network_container_ip=1.2.0.2",
+			Context("when a tag is specified", func() {
+				It("uses it when fetching the repository", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name:some-tag",
+					})
+					Expect(err).ToNot(HaveOccurred())
 
-							"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+					Expect(fakeRepositoryFetcher.Fetched()).To(ContainElement(
+						fake_repository_fetcher.FetchSpec{
+							Repository: "some-repository-name",
+							Tag:        "some-tag",
 						},
-					},
-				))
+					))
+				})
 			})
-		})
 
-		Context("when a rootfs image is specified", func() {
-			It("fetches it and creates a graph entry with it as the parent", func() {
-				fakeRepositoryFetcher.FetchResult = "some-image-id"
+			Context("when the image is on another registry", func() {
+				It("fetches the repository qualified with the registry", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:localhost:5000/team/app:v2",
+					})
+					Expect(err).ToNot(HaveOccurred())
 
-				container, err := pool.Create(warden.ContainerSpec{
-					RootFSPath: "image:some-repository-name",
+					Expect(fakeRepositoryFetcher.Fetched()).To(ContainElement(
+						fake_repository_fetcher.FetchSpec{
+							Repository: "localhost:5000/team/app",
+							Tag:        "v2",
+						},
+					))
 				})
-				Expect(err).ToNot(HaveOccurred())
 
-				Expect(fakeGraphDriver.Created()).To(ContainElement(
-					fake_graph_driver.CreatedGraph{
-						ID:     container.Handle(),
-						Parent: "some-image-id",
-					},
-				))
+				It("reports the registry in its provenance", func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
 
-				Expect(fakeRepositoryFetcher.Fetched()).To(ContainElement(
-					fake_repository_fetcher.FetchSpec{
-						Repository: "some-repository-name",
-						Tag:        "latest",
-					},
-				))
+					container, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:localhost:5000/team/app:v2",
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(container.Properties()).To(Equal(warden.Properties{
+						"image_registry":   "localhost:5000",
+						"image_repository": "team/app",
+						"image_tag":        "v2",
+						"image_id":         "some-image-id",
+					}))
+				})
 			})
 
-			It("passes $rootfs_path as the created rootfs and $rootfs_raw as true to create.sh", func() {
-				fakeGraphDriver.GetResult = "/path/to/created-rootfs"
+			Context("when a digest is specified", func() {
+				digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
 
-				container, err := pool.Create(warden.ContainerSpec{
-					RootFSPath: "image:some-repository-name",
+				It("fetches the digest rather than a tag", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:team/app@" + digest,
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(fakeRepositoryFetcher.Fetched()).To(ContainElement(
+						fake_repository_fetcher.FetchSpec{
+							Repository: "team/app",
+							Tag:        digest,
+						},
+					))
 				})
-				Expect(err).ToNot(HaveOccurred())
 
-				Expect(fakeRunner).To(HaveExecutedSerially(
-					fake_command_runner.CommandSpec{
-						Path: "/root/path/create.sh",
-						Args: []string{"/depot/path/" + container.ID()},
-						Env: []string{
-							"id=" + container.ID(),
-							"rootfs_path=/path/to/created-rootfs",
-							"rootfs_raw=true",
-							"user_uid=10000",
-							"network_host_ip=1.2.0.1",
-							"network_container_ip=1.2.0.2",
+				It("reports the digest in its provenance, rather than a tag", func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
 
-							"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
-						},
-					},
-				))
+					container, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:team/app@" + digest,
+					})
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(container.Properties()).To(Equal(warden.Properties{
+						"image_registry":   "index.docker.io",
+						"image_repository": "team/app",
+						"image_digest":     digest,
+						"image_id":         "some-image-id",
+					}))
+				})
 			})
 
-			Context("when a tag is specified", func() {
-				It("uses it when fetching the repository", func() {
+			Context("when a pull policy is specified", func() {
+				It("fetches with it", func() {
 					_, err := pool.Create(warden.ContainerSpec{
 						RootFSPath: "image:some-repository-name:some-tag",
+						Properties: warden.Properties{
+							"pull_policy": "never",
+						},
 					})
 					Expect(err).ToNot(HaveOccurred())
 
@@ -252,9 +1230,44 @@ var _ = Describe("Container pool", func() {
 						fake_repository_fetcher.FetchSpec{
 							Repository: "some-repository-name",
 							Tag:        "some-tag",
+							Policy:     repository_fetcher.PullNever,
 						},
 					))
 				})
+
+				Context("and it is unknown", func() {
+					It("returns an error without fetching", func() {
+						_, err := pool.Create(warden.ContainerSpec{
+							RootFSPath: "image:some-repository-name:some-tag",
+							Properties: warden.Properties{
+								"pull_policy": "sometimes",
+							},
+						})
+						Expect(err).To(HaveOccurred())
+
+						Expect(fakeRepositoryFetcher.Fetched()).To(BeEmpty())
+					})
+				})
+			})
+
+			Context("when the reference is malformed", func() {
+				It("returns an error without fetching", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:Not/Valid",
+					})
+					Expect(err).To(BeAssignableToTypeOf(container_pool.InvalidImageReferenceError{}))
+
+					Expect(fakeRepositoryFetcher.Fetched()).To(BeEmpty())
+				})
+
+				It("leaves the uid and network pools unchanged", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:Not/Valid",
+					})
+					Expect(err).To(HaveOccurred())
+
+					expectPoolsUnchanged()
+				})
 			})
 
 			Context("but fetching it fails", func() {
@@ -270,6 +1283,48 @@ var _ = Describe("Container pool", func() {
 					})
 					Expect(err).To(Equal(disaster))
 				})
+
+				It("leaves the uid and network pools unchanged", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-graph-id",
+					})
+					Expect(err).To(HaveOccurred())
+
+					expectPoolsUnchanged()
+				})
+			})
+
+			Context("but the trust policy denies it", func() {
+				denied := repository_fetcher.UntrustedImageError{
+					Repository: "some-repository-name",
+					Reference:  "latest",
+					Reason:     "not from an allowed source",
+				}
+
+				BeforeEach(func() {
+					fakeRepositoryFetcher.FetchError = denied
+				})
+
+				It("returns the error without creating a graph entry", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).To(Equal(denied))
+
+					Expect(fakeGraphDriver.Created()).To(BeEmpty())
+				})
+
+				It("leaves the uid and network pools unchanged", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).To(HaveOccurred())
+
+					expectPoolsUnchanged()
+
+					Expect(fakeUIDPool.Released).To(BeEmpty())
+					Expect(fakeNetworkPool.Released).To(BeEmpty())
+				})
 			})
 
 			Context("but creating the graph entry fails", func() {
@@ -285,6 +1340,26 @@ var _ = Describe("Container pool", func() {
 					})
 					Expect(err).To(Equal(disaster))
 				})
+
+				It("releases the image", func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-graph-id",
+					})
+					Expect(err).To(HaveOccurred())
+
+					Expect(fakeImageCollector.Released()).To(Equal([]string{"some-image-id"}))
+				})
+
+				It("leaves the uid and network pools unchanged", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-graph-id",
+					})
+					Expect(err).To(HaveOccurred())
+
+					expectPoolsUnchanged()
+				})
 			})
 
 			Context("but getting the graph entry fails", func() {
@@ -300,6 +1375,26 @@ var _ = Describe("Container pool", func() {
 					})
 					Expect(err).To(Equal(disaster))
 				})
+
+				It("releases the image", func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-graph-id",
+					})
+					Expect(err).To(HaveOccurred())
+
+					Expect(fakeImageCollector.Released()).To(Equal([]string{"some-image-id"}))
+				})
+
+				It("leaves the uid and network pools unchanged", func() {
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-graph-id",
+					})
+					Expect(err).To(HaveOccurred())
+
+					expectPoolsUnchanged()
+				})
 			})
 		})
 
@@ -463,6 +1558,19 @@ var _ = Describe("Container pool", func() {
 				_, err := pool.Create(warden.ContainerSpec{})
 				Expect(err).To(Equal(nastyError))
 			})
+
+			Context("with a rootfs image", func() {
+				It("releases the image", func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).To(Equal(nastyError))
+
+					Expect(fakeImageCollector.Released()).To(Equal([]string{"some-image-id"}))
+				})
+			})
 		})
 
 		Context("when acquiring a network fails", func() {
@@ -478,6 +1586,19 @@ var _ = Describe("Container pool", func() {
 
 				Expect(fakeUIDPool.Released).To(ContainElement(uint32(10000)))
 			})
+
+			Context("with a rootfs image", func() {
+				It("releases the image", func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).To(Equal(nastyError))
+
+					Expect(fakeImageCollector.Released()).To(Equal([]string{"some-image-id"}))
+				})
+			})
 		})
 
 		Context("when executing create.sh fails", func() {
@@ -500,6 +1621,19 @@ var _ = Describe("Container pool", func() {
 				Expect(fakeUIDPool.Released).To(ContainElement(uint32(10000)))
 				Expect(fakeNetworkPool.Released).To(ContainElement("1.2.0.0/30"))
 			})
+
+			Context("with a rootfs image", func() {
+				It("releases the image", func() {
+					fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+					_, err := pool.Create(warden.ContainerSpec{
+						RootFSPath: "image:some-repository-name",
+					})
+					Expect(err).To(Equal(nastyError))
+
+					Expect(fakeImageCollector.Released()).To(Equal([]string{"some-image-id"}))
+				})
+			})
 		})
 	})
 
@@ -545,24 +1679,97 @@ var _ = Describe("Container pool", func() {
 			Expect(err).ToNot(HaveOccurred())
 		})
 
-		It("constructs a container from the snapshot", func() {
-			container, err := pool.Restore(snapshot)
-			Expect(err).ToNot(HaveOccurred())
+		It("constructs a container from the snapshot", func() {
+			container, err := pool.Restore(snapshot)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(container.ID()).To(Equal("some-restored-id"))
+			Expect(container.Handle()).To(Equal("some-restored-handle"))
+			Expect(container.GraceTime()).To(Equal(1 * time.Second))
+			Expect(container.Properties()).To(Equal(warden.Properties(map[string]string{
+				"foo": "bar",
+			})))
+
+			linuxContainer := container.(*linux_backend.LinuxContainer)
+
+			Expect(linuxContainer.State()).To(Equal(linux_backend.State("some-restored-state")))
+			Expect(linuxContainer.Events()).To(Equal([]string{
+				"some-restored-event",
+				"some-other-restored-event",
+			}))
+		})
+
+		Context("when the snapshot has an image", func() {
+			BeforeEach(func() {
+				buf := new(bytes.Buffer)
+
+				snapshot = buf
+
+				err := json.NewEncoder(buf).Encode(
+					container_pool.ContainerSnapshot{
+						ContainerSnapshot: linux_backend.ContainerSnapshot{
+							ID:     "some-restored-id",
+							Handle: "some-restored-handle",
+
+							Resources: linux_backend.ResourcesSnapshot{
+								UID:     10000,
+								Network: restoredNetwork,
+							},
+						},
+
+						ImageID: "some-image-id",
+						ImageConfig: &runconfig.Config{
+							Env: []string{"FOO=bar"},
+						},
+						Image: &container_pool.ImageProvenance{
+							Registry:   "index.docker.io",
+							Repository: "some-repository-name",
+							Tag:        "some-tag",
+						},
+					},
+				)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("retains the image", func() {
+				_, err := pool.Restore(snapshot)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fakeImageCollector.Retained()).To(Equal([]string{"some-image-id"}))
+			})
+
+			It("keeps the image with the restored container", func() {
+				container, err := pool.Restore(snapshot)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(container.Handle()).To(Equal("some-restored-handle"))
 
-			Expect(container.ID()).To(Equal("some-restored-id"))
-			Expect(container.Handle()).To(Equal("some-restored-handle"))
-			Expect(container.GraceTime()).To(Equal(1 * time.Second))
-			Expect(container.Properties()).To(Equal(warden.Properties(map[string]string{
-				"foo": "bar",
-			})))
+				resnapshot := new(bytes.Buffer)
 
-			linuxContainer := container.(*linux_backend.LinuxContainer)
+				err = container.Snapshot(resnapshot)
+				Expect(err).ToNot(HaveOccurred())
 
-			Expect(linuxContainer.State()).To(Equal(linux_backend.State("some-restored-state")))
-			Expect(linuxContainer.Events()).To(Equal([]string{
-				"some-restored-event",
-				"some-other-restored-event",
-			}))
+				var containerSnapshot container_pool.ContainerSnapshot
+
+				err = json.NewDecoder(resnapshot).Decode(&containerSnapshot)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(containerSnapshot.ImageID).To(Equal("some-image-id"))
+				Expect(containerSnapshot.ImageConfig.Env).To(Equal([]string{"FOO=bar"}))
+				Expect(containerSnapshot.Image.Repository).To(Equal("some-repository-name"))
+			})
+
+			It("reports where the image came from in the restored container's properties", func() {
+				container, err := pool.Restore(snapshot)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(container.Properties()).To(Equal(warden.Properties{
+					"image_registry":   "index.docker.io",
+					"image_repository": "some-repository-name",
+					"image_tag":        "some-tag",
+					"image_id":         "some-image-id",
+				}))
+			})
 		})
 
 		It("removes its UID from the pool", func() {
@@ -687,6 +1894,53 @@ var _ = Describe("Container pool", func() {
 			))
 		})
 
+		It("removes the layers of pruned containers created from images", func() {
+			fakeRunner.WhenRunning(
+				fake_command_runner.CommandSpec{
+					Path: "ls",
+					Args: []string{"/depot/path"},
+				}, func(cmd *exec.Cmd) error {
+					cmd.Stdout.Write([]byte("container-1\n"))
+					cmd.Stdout.Write([]byte("container-2\n"))
+					cmd.Stdout.Write([]byte("container-3\n"))
+					return nil
+				},
+			)
+
+			fakeGraphDriver.SetExists("container-1", true)
+			fakeGraphDriver.SetExists("container-2", true)
+
+			err := pool.Prune(map[string]bool{"container-2": true})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fakeGraphDriver.Putted()).To(Equal([]string{"container-1"}))
+			Expect(fakeGraphDriver.Removed()).To(Equal([]string{"container-1"}))
+		})
+
+		Context("when removing a pruned container's layer fails", func() {
+			disaster := errors.New("remove failed")
+
+			BeforeEach(func() {
+				fakeRunner.WhenRunning(
+					fake_command_runner.CommandSpec{
+						Path: "ls",
+						Args: []string{"/depot/path"},
+					}, func(cmd *exec.Cmd) error {
+						cmd.Stdout.Write([]byte("container-1\n"))
+						return nil
+					},
+				)
+
+				fakeGraphDriver.SetExists("container-1", true)
+				fakeGraphDriver.RemoveError = disaster
+			})
+
+			It("returns the error", func() {
+				err := pool.Prune(map[string]bool{})
+				Expect(err).To(Equal(disaster))
+			})
+		})
+
 		Context("when ls fails", func() {
 			disaster := errors.New("ls failed")
 
@@ -845,4 +2099,379 @@ var _ = Describe("Container pool", func() {
 			})
 		})
 	})
+
+	Describe("committing", func() {
+		var createdContainer linux_backend.Container
+
+		BeforeEach(func() {
+			fakeRepositoryFetcher.FetchResult = "some-image-id"
+			fakeRepositoryFetcher.FetchConfig = &runconfig.Config{
+				Env: []string{"FOO=bar"},
+			}
+
+			fakeGraphDriver.DiffResult = "some-changes"
+
+			var err error
+			createdContainer, err = pool.Create(warden.ContainerSpec{
+				RootFSPath: "image:some-repository-name",
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("registers the container's changes as a child of its image", func() {
+			var registered *image.Image
+			var changes string
+
+			fakeGraph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, img *image.Image) error {
+				layerData, err := ioutil.ReadAll(layer)
+				Expect(err).ToNot(HaveOccurred())
+
+				registered = img
+				changes = string(layerData)
+
+				return nil
+			}
+
+			imageID, err := pool.Commit(createdContainer, "")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fakeGraphDriver.Diffed()).To(Equal([]string{createdContainer.ID()}))
+
+			Expect(registered.ID).To(Equal(imageID))
+			Expect(registered.Parent).To(Equal("some-image-id"))
+			Expect(registered.Container).To(Equal(createdContainer.ID()))
+			Expect(registered.Config).To(Equal(fakeRepositoryFetcher.FetchConfig))
+			Expect(changes).To(Equal("some-changes"))
+		})
+
+		Context("with a reference", func() {
+			It("tags the new image with it", func() {
+				imageID, err := pool.Commit(createdContainer, "our-name:some-tag")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fakeTagStore.Tagged("our-name", "some-tag")).To(Equal(imageID))
+			})
+
+			It("records the tag as committed, so that it is never pulled", func() {
+				imageID, err := pool.Commit(createdContainer, "our-name:some-tag")
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(fakeCommittedTagStore.Tagged("our-name", "some-tag")).To(Equal(imageID))
+			})
+
+			Context("without a tag", func() {
+				It("tags it as latest", func() {
+					imageID, err := pool.Commit(createdContainer, "our-name")
+					Expect(err).ToNot(HaveOccurred())
+
+					Expect(fakeTagStore.Tagged("our-name", "latest")).To(Equal(imageID))
+				})
+			})
+
+			Context("that is a digest", func() {
+				It("returns an error without registering", func() {
+					_, err := pool.Commit(createdContainer, "our-name@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+					Expect(err).To(Equal(container_pool.ErrCommitToDigest))
+
+					Expect(fakeGraphDriver.Diffed()).To(BeEmpty())
+				})
+			})
+		})
+
+		Context("when registering fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeGraph.WhenRegistering = func([]byte, archive.ArchiveReader, *image.Image) error {
+					return disaster
+				}
+			})
+
+			It("returns the error without tagging", func() {
+				_, err := pool.Commit(createdContainer, "our-name:some-tag")
+				Expect(err).To(Equal(disaster))
+
+				Expect(fakeTagStore.Tagged("our-name", "some-tag")).To(BeEmpty())
+				Expect(fakeCommittedTagStore.Tagged("our-name", "some-tag")).To(BeEmpty())
+			})
+		})
+
+		Context("when diffing fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeGraphDriver.DiffError = disaster
+			})
+
+			It("returns the error", func() {
+				_, err := pool.Commit(createdContainer, "")
+				Expect(err).To(Equal(disaster))
+			})
+		})
+
+		Context("when the container was not created from an image", func() {
+			It("returns an error", func() {
+				container, err := pool.Create(warden.ContainerSpec{})
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = pool.Commit(container, "")
+				Expect(err).To(Equal(container_pool.ErrNotImageBased))
+			})
+		})
+	})
+
+	Describe("exporting", func() {
+		var createdContainer linux_backend.Container
+
+		BeforeEach(func() {
+			fakeRepositoryFetcher.FetchResult = "some-image-id"
+
+			fakeGraph.SetImage(&image.Image{ID: "some-base-image-id"})
+			fakeGraph.SetLayer("some-base-image-id", "some-base-layer")
+
+			fakeGraph.SetImage(&image.Image{ID: "some-image-id", Parent: "some-base-image-id"})
+			fakeGraph.SetLayer("some-image-id", "some-image-layer")
+
+			fakeGraphDriver.DiffResult = "some-changes"
+
+			var err error
+			createdContainer, err = pool.Create(warden.ContainerSpec{
+				RootFSPath: "image:some-repository-name",
+			})
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		// readTarball maps the names of the tarball's files to their contents
+		readTarball := func(tarball io.Reader) map[string]string {
+			files := map[string]string{}
+
+			reader := tar.NewReader(tarball)
+
+			for {
+				header, err := reader.Next()
+				if err == io.EOF {
+					break
+				}
+
+				Expect(err).ToNot(HaveOccurred())
+
+				if header.Typeflag == tar.TypeDir {
+					continue
+				}
+
+				contents, err := ioutil.ReadAll(reader)
+				Expect(err).ToNot(HaveOccurred())
+
+				files[header.Name] = string(contents)
+			}
+
+			return files
+		}
+
+		Describe("the root filesystem", func() {
+			var rootFSPath string
+
+			BeforeEach(func() {
+				var err error
+
+				rootFSPath, err = ioutil.TempDir("", "exported-rootfs")
+				Expect(err).ToNot(HaveOccurred())
+
+				err = ioutil.WriteFile(filepath.Join(rootFSPath, "some-file"), []byte("some-contents"), 0600)
+				Expect(err).ToNot(HaveOccurred())
+
+				fakeGraphDriver.GetResult = rootFSPath
+			})
+
+			AfterEach(func() {
+				os.RemoveAll(rootFSPath)
+			})
+
+			It("writes a tarball of the container's graph entry", func() {
+				tarball := new(bytes.Buffer)
+
+				err := pool.ExportRootFS(createdContainer, tarball)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(readTarball(tarball)["some-file"]).To(Equal("some-contents"))
+
+				Expect(fakeGraphDriver.Putted()).To(ContainElement(createdContainer.ID()))
+			})
+
+			Context("when getting the graph entry fails", func() {
+				disaster := errors.New("oh no!")
+
+				BeforeEach(func() {
+					fakeGraphDriver.GetError = disaster
+				})
+
+				It("returns the error", func() {
+					err := pool.ExportRootFS(createdContainer, new(bytes.Buffer))
+					Expect(err).To(Equal(disaster))
+				})
+			})
+		})
+
+		Describe("as an image", func() {
+			It("writes the image's ancestry and the container's changes as docker would save them", func() {
+				tarball := new(bytes.Buffer)
+
+				err := pool.ExportImage(createdContainer, "", tarball)
+				Expect(err).ToNot(HaveOccurred())
+
+				files := readTarball(tarball)
+
+				Expect(files["some-base-image-id/VERSION"]).To(Equal("1.0"))
+				Expect(files["some-base-image-id/layer.tar"]).To(Equal("some-base-layer"))
+				Expect(files["some-image-id/layer.tar"]).To(Equal("some-image-layer"))
+				Expect(files).ToNot(HaveKey("repositories"))
+
+				var changesID string
+
+				for name, contents := range files {
+					if name != "some-base-image-id/json" && name != "some-image-id/json" && filepath.Base(name) == "json" {
+						var img image.Image
+
+						err := json.Unmarshal([]byte(contents), &img)
+						Expect(err).ToNot(HaveOccurred())
+
+						Expect(img.Parent).To(Equal("some-image-id"))
+						Expect(img.Container).To(Equal(createdContainer.ID()))
+
+						changesID = img.ID
+					}
+				}
+
+				Expect(changesID).ToNot(BeEmpty())
+				Expect(files[changesID+"/layer.tar"]).To(Equal("some-changes"))
+			})
+
+			It("closes the layers it reads from the graph", func() {
+				openFiles := func() int {
+					fds, err := ioutil.ReadDir("/proc/self/fd")
+					Expect(err).ToNot(HaveOccurred())
+
+					return len(fds)
+				}
+
+				before := openFiles()
+
+				err := pool.ExportImage(createdContainer, "", new(bytes.Buffer))
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(openFiles()).To(Equal(before))
+			})
+
+			It("can be imported", func() {
+				tarball := new(bytes.Buffer)
+
+				err := pool.ExportImage(createdContainer, "our-name:some-tag", tarball)
+				Expect(err).ToNot(HaveOccurred())
+
+				importedGraph := fake_graph.New()
+				importedTags := fake_tag_store.New()
+
+				registered := []string{}
+
+				importedGraph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, img *image.Image) error {
+					registered = append(registered, img.ID)
+					return nil
+				}
+
+				err = repository_fetcher.NewImporter(importedGraph, importedTags).Import(tarball)
+				Expect(err).ToNot(HaveOccurred())
+
+				imageID := importedTags.Tagged("our-name", "some-tag")
+				Expect(imageID).ToNot(BeEmpty())
+
+				Expect(registered).To(Equal([]string{"some-base-image-id", "some-image-id", imageID}))
+			})
+
+			Context("with a digest reference", func() {
+				It("returns an error without diffing", func() {
+					err := pool.ExportImage(createdContainer, "our-name@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", new(bytes.Buffer))
+					Expect(err).To(Equal(container_pool.ErrExportToDigest))
+
+					Expect(fakeGraphDriver.Diffed()).To(BeEmpty())
+				})
+			})
+
+			Context("when diffing fails", func() {
+				disaster := errors.New("oh no!")
+
+				BeforeEach(func() {
+					fakeGraphDriver.DiffError = disaster
+				})
+
+				It("returns the error", func() {
+					err := pool.ExportImage(createdContainer, "", new(bytes.Buffer))
+					Expect(err).To(Equal(disaster))
+				})
+			})
+
+			Context("when the container was not created from an image", func() {
+				It("returns an error", func() {
+					container, err := pool.Create(warden.ContainerSpec{})
+					Expect(err).ToNot(HaveOccurred())
+
+					err = pool.ExportImage(container, "", new(bytes.Buffer))
+					Expect(err).To(Equal(container_pool.ErrNotImageBased))
+				})
+			})
+		})
+	})
+
+	Describe("pushing", func() {
+		BeforeEach(func() {
+			err := fakeTagStore.Set("localhost:5000/our-name", "some-tag", "some-image-id", true)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		It("pushes the image the tag refers to", func() {
+			err := pool.Push("localhost:5000/our-name:some-tag")
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(fakeRepositoryPusher.Pushed()).To(Equal([]fake_repository_pusher.PushSpec{
+				{
+					Repository: "localhost:5000/our-name",
+					Tag:        "some-tag",
+					ImageID:    "some-image-id",
+				},
+			}))
+		})
+
+		Context("when the tag is not known", func() {
+			It("returns an error without pushing", func() {
+				err := pool.Push("localhost:5000/our-name:bogus-tag")
+				Expect(err).To(Equal(repository_fetcher.ImageNotPresentError{
+					Repository: "localhost:5000/our-name",
+					Tag:        "bogus-tag",
+				}))
+
+				Expect(fakeRepositoryPusher.Pushed()).To(BeEmpty())
+			})
+		})
+
+		Context("when the reference is a digest", func() {
+			It("returns an error without pushing", func() {
+				err := pool.Push("our-name@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+				Expect(err).To(Equal(container_pool.ErrPushDigest))
+
+				Expect(fakeRepositoryPusher.Pushed()).To(BeEmpty())
+			})
+		})
+
+		Context("when pushing fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				fakeRepositoryPusher.PushError = disaster
+			})
+
+			It("returns the error", func() {
+				err := pool.Push("localhost:5000/our-name:some-tag")
+				Expect(err).To(Equal(disaster))
+			})
+		})
+	})
 })
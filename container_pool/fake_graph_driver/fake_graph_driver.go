@@ -1,6 +1,12 @@
 package fake_graph_driver
 
-import "sync"
+import (
+	"bytes"
+	"io/ioutil"
+	"sync"
+
+	"github.com/dotcloud/docker/archive"
+)
 
 type FakeGraphDriver struct {
 	created     []CreatedGraph
@@ -21,6 +27,10 @@ type FakeGraphDriver struct {
 	CleanupError error
 	cleanedUp    bool
 
+	diffed     []string
+	DiffResult string
+	DiffError  error
+
 	sync.RWMutex
 }
 
@@ -169,3 +179,40 @@ func (graph *FakeGraphDriver) CleanedUp() bool {
 
 	return graph.cleanedUp
 }
+
+func (graph *FakeGraphDriver) Diff(id string) (archive.Archive, error) {
+	if graph.DiffError != nil {
+		return nil, graph.DiffError
+	}
+
+	graph.Lock()
+
+	graph.diffed = append(graph.diffed, id)
+
+	graph.Unlock()
+
+	return ioutil.NopCloser(bytes.NewBufferString(graph.DiffResult)), nil
+}
+
+func (graph *FakeGraphDriver) Diffed() []string {
+	graph.RLock()
+
+	diffed := make([]string, len(graph.diffed))
+	copy(diffed, graph.diffed)
+
+	graph.RUnlock()
+
+	return diffed
+}
+
+func (graph *FakeGraphDriver) Changes(id string) ([]archive.Change, error) {
+	return nil, nil
+}
+
+func (graph *FakeGraphDriver) ApplyDiff(id string, diff archive.ArchiveReader) error {
+	return nil
+}
+
+func (graph *FakeGraphDriver) DiffSize(id string) (int64, error) {
+	return int64(len(graph.DiffResult)), nil
+}
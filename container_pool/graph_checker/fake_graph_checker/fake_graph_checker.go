@@ -0,0 +1,42 @@
+package fake_graph_checker
+
+import (
+	"sync"
+
+	"github.com/vito/warden-docker/container_pool/graph_checker"
+)
+
+type FakeGraphChecker struct {
+	CheckResult []graph_checker.Repair
+	CheckError  error
+
+	checked []map[string]bool
+
+	sync.RWMutex
+}
+
+func New() *FakeGraphChecker {
+	return &FakeGraphChecker{}
+}
+
+func (checker *FakeGraphChecker) Check(containers map[string]bool) ([]graph_checker.Repair, error) {
+	if checker.CheckError != nil {
+		return nil, checker.CheckError
+	}
+
+	checker.Lock()
+	checker.checked = append(checker.checked, containers)
+	checker.Unlock()
+
+	return checker.CheckResult, nil
+}
+
+func (checker *FakeGraphChecker) Checked() []map[string]bool {
+	checker.RLock()
+	defer checker.RUnlock()
+
+	checked := make([]map[string]bool, len(checker.checked))
+	copy(checked, checker.checked)
+
+	return checked
+}
@@ -0,0 +1,370 @@
+package graph_checker
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/pkg/mount"
+)
+
+// GraphChecker finds what's left behind in the graph when the server is killed
+// part way through registering a layer or creating a container, and repairs or
+// quarantines it before anything trips over it.
+type GraphChecker interface {
+	// Check is given the IDs of the containers in the depot, whose layers are
+	// left alone.
+	Check(containers map[string]bool) ([]Repair, error)
+}
+
+type Problem string
+
+const (
+	// a layer the graph never finished registering, or whose metadata can't
+	// be read
+	IncompleteLayer Problem = "incomplete layer"
+
+	// an image whose parent (or an ancestor) is not in the graph
+	MissingParent Problem = "missing parent"
+
+	// a container's layer left in the graph driver without the container
+	OrphanedContainer Problem = "orphaned container"
+
+	// a layer mounted by the graph driver before the server stopped
+	StaleMount Problem = "stale mount"
+)
+
+type Action string
+
+const (
+	Removed     Action = "removed"
+	Quarantined Action = "quarantined"
+	Unmounted   Action = "unmounted"
+)
+
+type Repair struct {
+	Problem Problem
+	ID      string
+	Action  Action
+}
+
+// quarantined images are moved here, under the graph root, for inspection;
+// like "_tmp", the graph ignores it
+const quarantineDir = "_quarantine"
+
+// driverLayers names the directory under each graph driver's home that holds
+// an entry per layer; drivers not listed here are not checked for orphaned
+// layers
+var driverLayers = map[string]string{
+	"aufs":         "layers",
+	"btrfs":        "subvolumes",
+	"devicemapper": "metadata",
+	"overlay":      "",
+	"vfs":          "dir",
+}
+
+type DiskGraphChecker struct {
+	graphRoot string
+	driver    graphdriver.Driver
+}
+
+// New constructs a checker of the graph at graphRoot, whose layers are stored
+// by the driver under graphRoot/<driver name>.
+func New(graphRoot string, driver graphdriver.Driver) *DiskGraphChecker {
+	return &DiskGraphChecker{
+		graphRoot: graphRoot,
+		driver:    driver,
+	}
+}
+
+func (checker *DiskGraphChecker) Check(containers map[string]bool) ([]Repair, error) {
+	repairs := []Repair{}
+
+	steps := []func(map[string]bool) ([]Repair, error){
+		checker.unmountStale,
+		checker.removeTemporary,
+		checker.checkImages,
+		checker.checkDriverLayers,
+	}
+
+	for _, step := range steps {
+		stepRepairs, err := step(containers)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, repair := range stepRepairs {
+			log.Printf("graph check: %s %s: %s\n", repair.Problem, repair.ID, repair.Action)
+		}
+
+		repairs = append(repairs, stepRepairs...)
+	}
+
+	return repairs, nil
+}
+
+func (checker *DiskGraphChecker) driverHome() string {
+	return path.Join(checker.graphRoot, checker.driver.String())
+}
+
+// unmountStale unmounts layers mounted under the driver's home, except those of
+// live containers. The graph driver's reference counts start from zero, so
+// anything else mounted is left over, and would keep its layer from being
+// removed.
+func (checker *DiskGraphChecker) unmountStale(containers map[string]bool) ([]Repair, error) {
+	mounts, err := mount.GetMounts()
+	if err != nil {
+		return nil, err
+	}
+
+	home := checker.driverHome()
+
+	mountPoints := []string{}
+
+	for _, info := range mounts {
+		if strings.HasPrefix(info.Mountpoint, home+"/") {
+			mountPoints = append(mountPoints, info.Mountpoint)
+		}
+	}
+
+	repairs := []Repair{}
+
+	// unmount the most nested first
+	for i := len(mountPoints) - 1; i >= 0; i-- {
+		mountPoint := mountPoints[i]
+
+		id := layerIDIn(home, mountPoint)
+		if id == "" || containers[id] {
+			continue
+		}
+
+		err := mount.Unmount(mountPoint)
+		if err != nil {
+			return nil, err
+		}
+
+		repairs = append(repairs, Repair{Problem: StaleMount, ID: id, Action: Unmounted})
+	}
+
+	return repairs, nil
+}
+
+// removeTemporary removes the metadata of layers whose registration never
+// finished; the graph writes it to "_tmp" and only moves it into place once
+// the layer is complete.
+func (checker *DiskGraphChecker) removeTemporary(map[string]bool) ([]Repair, error) {
+	tmpDir := path.Join(checker.graphRoot, "_tmp")
+
+	entries, err := ioutil.ReadDir(tmpDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := []Repair{}
+
+	for _, entry := range entries {
+		err := os.RemoveAll(path.Join(tmpDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		repairs = append(repairs, Repair{Problem: IncompleteLayer, ID: entry.Name(), Action: Removed})
+	}
+
+	return repairs, nil
+}
+
+// checkImages removes images whose layer the driver doesn't have, which the
+// graph ignores anyway, and quarantines images that can't be loaded or that
+// descend from an image that isn't in the graph, which it would otherwise use.
+func (checker *DiskGraphChecker) checkImages(map[string]bool) ([]Repair, error) {
+	entries, err := ioutil.ReadDir(checker.graphRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := []Repair{}
+
+	parents := map[string]string{}
+
+	for _, entry := range entries {
+		id := entry.Name()
+		if !entry.IsDir() || !isImageID(id) {
+			continue
+		}
+
+		if !checker.driver.Exists(id) {
+			err := os.RemoveAll(path.Join(checker.graphRoot, id))
+			if err != nil {
+				return nil, err
+			}
+
+			repairs = append(repairs, Repair{Problem: IncompleteLayer, ID: id, Action: Removed})
+			continue
+		}
+
+		img, err := image.LoadImage(path.Join(checker.graphRoot, id))
+		if err != nil || img.ID != id {
+			err := checker.quarantine(id)
+			if err != nil {
+				return nil, err
+			}
+
+			repairs = append(repairs, Repair{Problem: IncompleteLayer, ID: id, Action: Quarantined})
+			continue
+		}
+
+		parents[id] = img.Parent
+	}
+
+	for id := range parents {
+		if checker.hasAncestry(id, parents) {
+			continue
+		}
+
+		err := checker.quarantine(id)
+		if err != nil {
+			return nil, err
+		}
+
+		repairs = append(repairs, Repair{Problem: MissingParent, ID: id, Action: Quarantined})
+	}
+
+	return repairs, nil
+}
+
+func (checker *DiskGraphChecker) hasAncestry(id string, parents map[string]string) bool {
+	for ancestor := parents[id]; ancestor != ""; ancestor = parents[ancestor] {
+		if _, found := parents[ancestor]; !found {
+			return false
+		}
+	}
+
+	return true
+}
+
+// quarantine moves an image's metadata out of the graph and removes its layer,
+// which is of no use without the rest of its ancestry.
+func (checker *DiskGraphChecker) quarantine(id string) error {
+	quarantine := path.Join(checker.graphRoot, quarantineDir)
+
+	err := os.MkdirAll(quarantine, 0700)
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(path.Join(quarantine, id))
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(path.Join(checker.graphRoot, id), path.Join(quarantine, id))
+	if err != nil {
+		return err
+	}
+
+	return checker.driver.Remove(id)
+}
+
+// checkDriverLayers removes layers that the driver has but nothing uses:
+// image layers that aren't in the graph, and container layers without a
+// container.
+func (checker *DiskGraphChecker) checkDriverLayers(containers map[string]bool) ([]Repair, error) {
+	layersDir, known := driverLayers[checker.driver.String()]
+	if !known {
+		return nil, nil
+	}
+
+	entries, err := ioutil.ReadDir(path.Join(checker.driverHome(), layersDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	repairs := []Repair{}
+
+	for _, entry := range entries {
+		id := entry.Name()
+
+		var problem Problem
+
+		switch {
+		case isImageID(id):
+			if _, err := os.Stat(path.Join(checker.graphRoot, id)); err == nil {
+				continue
+			}
+
+			problem = IncompleteLayer
+
+		case isContainerID(id):
+			if containers[id] {
+				continue
+			}
+
+			problem = OrphanedContainer
+
+		default:
+			continue
+		}
+
+		err := checker.driver.Remove(id)
+		if err != nil {
+			return nil, err
+		}
+
+		repairs = append(repairs, Repair{Problem: problem, ID: id, Action: Removed})
+	}
+
+	return repairs, nil
+}
+
+// layerIDIn finds the layer that a path under the driver's home belongs to,
+// e.g. <home>/mnt/<id> for aufs, or <home>/<id>/merged for overlay.
+func layerIDIn(home string, layerPath string) string {
+	rel, err := filepath.Rel(home, layerPath)
+	if err != nil {
+		return ""
+	}
+
+	for _, segment := range strings.Split(rel, "/") {
+		if isImageID(segment) || isContainerID(segment) {
+			return segment
+		}
+	}
+
+	return ""
+}
+
+// images are named by 64 hex characters
+func isImageID(id string) bool {
+	return len(id) == 64 && onlyDigitsOf(id, 16)
+}
+
+// the pool names containers by 11 base-32 characters
+func isContainerID(id string) bool {
+	return len(id) == 11 && onlyDigitsOf(id, 32)
+}
+
+func onlyDigitsOf(str string, base int) bool {
+	digits := "0123456789abcdefghijklmnopqrstuv"[:base]
+
+	for _, c := range str {
+		if !strings.ContainsRune(digits, c) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,13 @@
+package graph_checker_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestGraphChecker(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "GraphChecker Suite")
+}
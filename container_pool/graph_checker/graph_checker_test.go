@@ -0,0 +1,255 @@
+package graph_checker_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"syscall"
+
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	_ "github.com/dotcloud/docker/daemon/graphdriver/vfs"
+	"github.com/dotcloud/docker/graph"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/pkg/mount"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/graph_checker"
+)
+
+var _ = Describe("DiskGraphChecker", func() {
+	var graphRoot string
+	var driver graphdriver.Driver
+	var dockerGraph *graph.Graph
+
+	var checker *DiskGraphChecker
+
+	baseID := strings.Repeat("a", 64)
+	childID := strings.Repeat("b", 64)
+	grandchildID := strings.Repeat("c", 64)
+
+	register := func(id string, parent string) {
+		layer := new(bytes.Buffer)
+
+		w := tar.NewWriter(layer)
+		Ω(w.WriteHeader(&tar.Header{Name: id, Mode: 0644, Typeflag: tar.TypeReg})).ShouldNot(HaveOccurred())
+		Ω(w.Close()).ShouldNot(HaveOccurred())
+
+		err := dockerGraph.Register(nil, layer, &image.Image{ID: id, Parent: parent})
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	BeforeEach(func() {
+		var err error
+
+		graphRoot, err = ioutil.TempDir("", "graph-root")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		driver, err = graphdriver.GetDriver("vfs", graphRoot)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		dockerGraph, err = graph.NewGraph(graphRoot, driver)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// base <- child <- grandchild
+		register(baseID, "")
+		register(childID, baseID)
+		register(grandchildID, childID)
+
+		checker = New(graphRoot, driver)
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(graphRoot)
+	})
+
+	Context("when the graph is consistent", func() {
+		BeforeEach(func() {
+			Ω(driver.Create("abcdefghijk", grandchildID)).ShouldNot(HaveOccurred())
+		})
+
+		It("repairs nothing", func() {
+			repairs, err := checker.Check(map[string]bool{"abcdefghijk": true})
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(repairs).Should(BeEmpty())
+
+			Ω(dockerGraph.Exists(grandchildID)).Should(BeTrue())
+			Ω(driver.Exists("abcdefghijk")).Should(BeTrue())
+		})
+	})
+
+	Context("when a layer was left part way through registering", func() {
+		incompleteID := strings.Repeat("d", 64)
+
+		BeforeEach(func() {
+			Ω(driver.Create(incompleteID, baseID)).ShouldNot(HaveOccurred())
+			Ω(os.MkdirAll(path.Join(graphRoot, "_tmp", "some-tmp-id"), 0700)).ShouldNot(HaveOccurred())
+		})
+
+		It("removes the layer and its metadata", func() {
+			repairs, err := checker.Check(map[string]bool{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(repairs).Should(ContainElement(Repair{Problem: IncompleteLayer, ID: incompleteID, Action: Removed}))
+			Ω(repairs).Should(ContainElement(Repair{Problem: IncompleteLayer, ID: "some-tmp-id", Action: Removed}))
+
+			Ω(driver.Exists(incompleteID)).Should(BeFalse())
+
+			_, err = os.Stat(path.Join(graphRoot, "_tmp", "some-tmp-id"))
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+		})
+
+		It("leaves complete images alone", func() {
+			_, err := checker.Check(map[string]bool{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(dockerGraph.Exists(baseID)).Should(BeTrue())
+		})
+	})
+
+	Context("when an image's layer is missing from the driver", func() {
+		BeforeEach(func() {
+			Ω(driver.Remove(grandchildID)).ShouldNot(HaveOccurred())
+		})
+
+		It("removes the image", func() {
+			repairs, err := checker.Check(map[string]bool{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(repairs).Should(Equal([]Repair{{Problem: IncompleteLayer, ID: grandchildID, Action: Removed}}))
+
+			_, err = os.Stat(path.Join(graphRoot, grandchildID))
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+		})
+	})
+
+	Context("when an image's metadata can't be read", func() {
+		BeforeEach(func() {
+			Ω(ioutil.WriteFile(path.Join(graphRoot, grandchildID, "json"), []byte("{"), 0600)).ShouldNot(HaveOccurred())
+		})
+
+		It("quarantines the image", func() {
+			repairs, err := checker.Check(map[string]bool{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(repairs).Should(Equal([]Repair{{Problem: IncompleteLayer, ID: grandchildID, Action: Quarantined}}))
+
+			_, err = os.Stat(path.Join(graphRoot, "_quarantine", grandchildID, "json"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(driver.Exists(grandchildID)).Should(BeFalse())
+		})
+	})
+
+	Context("when an image's parent is missing", func() {
+		BeforeEach(func() {
+			Ω(os.RemoveAll(path.Join(graphRoot, baseID))).ShouldNot(HaveOccurred())
+			Ω(driver.Remove(baseID)).ShouldNot(HaveOccurred())
+		})
+
+		It("quarantines it and its descendants", func() {
+			repairs, err := checker.Check(map[string]bool{})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(repairs).Should(HaveLen(2))
+			Ω(repairs).Should(ContainElement(Repair{Problem: MissingParent, ID: childID, Action: Quarantined}))
+			Ω(repairs).Should(ContainElement(Repair{Problem: MissingParent, ID: grandchildID, Action: Quarantined}))
+
+			for _, id := range []string{childID, grandchildID} {
+				_, err = os.Stat(path.Join(graphRoot, "_quarantine", id, "json"))
+				Ω(err).ShouldNot(HaveOccurred())
+
+				_, err = os.Stat(path.Join(graphRoot, id))
+				Ω(os.IsNotExist(err)).Should(BeTrue())
+
+				Ω(driver.Exists(id)).Should(BeFalse())
+				Ω(dockerGraph.Exists(id)).Should(BeFalse())
+			}
+		})
+
+		Context("and the image was quarantined before", func() {
+			BeforeEach(func() {
+				_, err := checker.Check(map[string]bool{})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				register(baseID, "")
+				register(childID, baseID)
+
+				Ω(os.RemoveAll(path.Join(graphRoot, baseID))).ShouldNot(HaveOccurred())
+				Ω(driver.Remove(baseID)).ShouldNot(HaveOccurred())
+			})
+
+			It("replaces it in quarantine", func() {
+				repairs, err := checker.Check(map[string]bool{})
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(repairs).Should(Equal([]Repair{{Problem: MissingParent, ID: childID, Action: Quarantined}}))
+			})
+		})
+	})
+
+	Context("when a container's layer is left without its container", func() {
+		BeforeEach(func() {
+			Ω(driver.Create("0123456789v", grandchildID)).ShouldNot(HaveOccurred())
+			Ω(driver.Create("abcdefghijk", grandchildID)).ShouldNot(HaveOccurred())
+		})
+
+		It("removes the layer", func() {
+			repairs, err := checker.Check(map[string]bool{"abcdefghijk": true})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(repairs).Should(Equal([]Repair{{Problem: OrphanedContainer, ID: "0123456789v", Action: Removed}}))
+
+			Ω(driver.Exists("0123456789v")).Should(BeFalse())
+			Ω(driver.Exists("abcdefghijk")).Should(BeTrue())
+		})
+	})
+
+	Context("when layers are still mounted", func() {
+		// mounting requires root
+		if os.Getuid() != 0 {
+			return
+		}
+
+		mountedLayer := func(id string) string {
+			layerPath := path.Join(graphRoot, "vfs", "dir", id)
+			Ω(syscall.Mount("tmpfs", layerPath, "tmpfs", 0, "")).ShouldNot(HaveOccurred())
+			return layerPath
+		}
+
+		var imageMount, containerMount string
+
+		BeforeEach(func() {
+			Ω(driver.Create("abcdefghijk", grandchildID)).ShouldNot(HaveOccurred())
+
+			imageMount = mountedLayer(grandchildID)
+			containerMount = mountedLayer("abcdefghijk")
+		})
+
+		AfterEach(func() {
+			mount.Unmount(imageMount)
+			mount.Unmount(containerMount)
+		})
+
+		It("unmounts all but live containers' layers", func() {
+			repairs, err := checker.Check(map[string]bool{"abcdefghijk": true})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(repairs).Should(Equal([]Repair{{Problem: StaleMount, ID: grandchildID, Action: Unmounted}}))
+
+			mounted, err := mount.Mounted(imageMount)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mounted).Should(BeFalse())
+
+			mounted, err = mount.Mounted(containerMount)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mounted).Should(BeTrue())
+
+			Ω(dockerGraph.Exists(grandchildID)).Should(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,83 @@
+package fake_image_collector
+
+import "sync"
+
+type FakeImageCollector struct {
+	retained []string
+	released []string
+
+	WhenRetainingFetched func(imageID string) error
+
+	CollectError error
+	collected    int
+
+	sync.RWMutex
+}
+
+func New() *FakeImageCollector {
+	return &FakeImageCollector{}
+}
+
+func (collector *FakeImageCollector) Retain(imageID string) {
+	collector.Lock()
+	collector.retained = append(collector.retained, imageID)
+	collector.Unlock()
+}
+
+func (collector *FakeImageCollector) RetainFetched(imageID string) error {
+	if collector.WhenRetainingFetched != nil {
+		err := collector.WhenRetainingFetched(imageID)
+		if err != nil {
+			return err
+		}
+	}
+
+	collector.Retain(imageID)
+
+	return nil
+}
+
+func (collector *FakeImageCollector) Retained() []string {
+	collector.RLock()
+	defer collector.RUnlock()
+
+	retained := make([]string, len(collector.retained))
+	copy(retained, collector.retained)
+
+	return retained
+}
+
+func (collector *FakeImageCollector) Release(imageID string) {
+	collector.Lock()
+	collector.released = append(collector.released, imageID)
+	collector.Unlock()
+}
+
+func (collector *FakeImageCollector) Released() []string {
+	collector.RLock()
+	defer collector.RUnlock()
+
+	released := make([]string, len(collector.released))
+	copy(released, collector.released)
+
+	return released
+}
+
+func (collector *FakeImageCollector) Collect() error {
+	if collector.CollectError != nil {
+		return collector.CollectError
+	}
+
+	collector.Lock()
+	collector.collected++
+	collector.Unlock()
+
+	return nil
+}
+
+func (collector *FakeImageCollector) Collected() int {
+	collector.RLock()
+	defer collector.RUnlock()
+
+	return collector.collected
+}
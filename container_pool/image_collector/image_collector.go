@@ -0,0 +1,270 @@
+package image_collector
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dotcloud/docker/image"
+)
+
+// ErrImageCollected is returned when retaining a fetched image that was
+// collected before it could be retained, and has to be fetched again.
+var ErrImageCollected = errors.New("image was collected before it could be retained")
+
+// ImageCollector keeps track of which images are in use by containers, and
+// deletes unused images from the graph when it grows too large.
+type ImageCollector interface {
+	Retain(imageID string)
+	Release(imageID string)
+
+	// RetainFetched retains an image that has just been fetched, unless it,
+	// or any of its ancestors, was collected in the meantime.
+	RetainFetched(imageID string) error
+
+	Collect() error
+}
+
+// apes docker's *graph.Graph
+type Graph interface {
+	Get(imageID string) (*image.Image, error)
+	Map() (map[string]*image.Image, error)
+	Delete(imageID string) error
+}
+
+// apes docker's *graph.TagStore
+type TagStore interface {
+	Delete(repoName string, tag string) (bool, error)
+	ByID() map[string][]string
+}
+
+type Thresholds struct {
+	// collect when the total size of all images exceeds this many bytes
+	MaxSize int64
+
+	// collect when the graph's filesystem has fewer than this many bytes free
+	MinFree uint64
+
+	// never collect images that have been used more recently than this
+	GracePeriod time.Duration
+}
+
+type GraphImageCollector struct {
+	graph     Graph
+	tags      TagStore
+	graphRoot string
+
+	thresholds Thresholds
+
+	refs     map[string]int
+	lastUsed map[string]time.Time
+
+	mutex *sync.Mutex
+}
+
+func New(graph Graph, tags TagStore, graphRoot string, thresholds Thresholds) *GraphImageCollector {
+	return &GraphImageCollector{
+		graph:     graph,
+		tags:      tags,
+		graphRoot: graphRoot,
+
+		thresholds: thresholds,
+
+		refs:     make(map[string]int),
+		lastUsed: make(map[string]time.Time),
+
+		mutex: new(sync.Mutex),
+	}
+}
+
+func (collector *GraphImageCollector) Retain(imageID string) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.refs[imageID]++
+	collector.lastUsed[imageID] = time.Now()
+}
+
+// RetainFetched checks that the image and its ancestors are still in the
+// graph while holding the lock that Collect holds, so that once it returns
+// the image can't be collected out from under the container it was fetched
+// for.
+func (collector *GraphImageCollector) RetainFetched(imageID string) error {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	for id := imageID; id != ""; {
+		img, err := collector.graph.Get(id)
+		if err != nil || img == nil {
+			return ErrImageCollected
+		}
+
+		id = img.Parent
+	}
+
+	collector.refs[imageID]++
+	collector.lastUsed[imageID] = time.Now()
+
+	return nil
+}
+
+func (collector *GraphImageCollector) Release(imageID string) {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	collector.refs[imageID]--
+	if collector.refs[imageID] <= 0 {
+		delete(collector.refs, imageID)
+	}
+
+	collector.lastUsed[imageID] = time.Now()
+}
+
+// Collect deletes unused images, least recently used first, until the graph
+// is back within its thresholds. Images are only deleted once none of their
+// children remain, so the ancestry of every image in use stays intact, and
+// are untagged first, so that no tag refers to a deleted image.
+func (collector *GraphImageCollector) Collect() error {
+	collector.mutex.Lock()
+	defer collector.mutex.Unlock()
+
+	images, err := collector.graph.Map()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	for id := range collector.lastUsed {
+		if _, found := images[id]; !found {
+			delete(collector.lastUsed, id)
+		}
+	}
+
+	inUse := map[string]bool{}
+	children := map[string]int{}
+	lastUsed := map[string]time.Time{}
+
+	var totalSize int64
+
+	for id, img := range images {
+		if img.Size > 0 {
+			totalSize += img.Size
+		}
+
+		if _, found := images[img.Parent]; found {
+			children[img.Parent]++
+		}
+
+		used, recorded := collector.lastUsed[id]
+
+		// an image is used whenever any of its descendants are
+		for ancestor := img; ancestor != nil; ancestor = images[ancestor.Parent] {
+			if collector.refs[id] > 0 {
+				inUse[ancestor.ID] = true
+			}
+
+			if recorded && used.After(lastUsed[ancestor.ID]) {
+				lastUsed[ancestor.ID] = used
+			}
+		}
+	}
+
+	// images never used before (e.g. just pulled, or left over from before a
+	// restart) count as used now, so they get a full grace period
+	for id := range images {
+		if lastUsed[id].IsZero() {
+			lastUsed[id] = now
+			collector.lastUsed[id] = now
+		}
+	}
+
+	for {
+		exceeded, err := collector.exceeded(totalSize)
+		if err != nil {
+			return err
+		}
+
+		if !exceeded {
+			return nil
+		}
+
+		var victim *image.Image
+
+		for id, img := range images {
+			if inUse[id] || children[id] > 0 {
+				continue
+			}
+
+			if now.Sub(lastUsed[id]) < collector.thresholds.GracePeriod {
+				continue
+			}
+
+			if victim == nil || lastUsed[id].Before(lastUsed[victim.ID]) {
+				victim = img
+			}
+		}
+
+		if victim == nil {
+			log.Println("graph exceeds thresholds, but no images can be collected")
+			return nil
+		}
+
+		log.Println("collecting image:", victim.ID)
+
+		collector.untag(victim.ID)
+
+		err = collector.graph.Delete(victim.ID)
+		if err != nil {
+			return err
+		}
+
+		delete(images, victim.ID)
+		delete(collector.lastUsed, victim.ID)
+
+		children[victim.Parent]--
+
+		if victim.Size > 0 {
+			totalSize -= victim.Size
+		}
+	}
+}
+
+// untag deletes the image's tags. Failing to is only logged; a tag left
+// referring to a deleted image is treated as if it were not there.
+func (collector *GraphImageCollector) untag(imageID string) {
+	for _, name := range collector.tags.ByID()[imageID] {
+		// the repository may name a registry with a port, but the tag can't
+		// contain a colon
+		split := strings.LastIndex(name, ":")
+
+		_, err := collector.tags.Delete(name[:split], name[split+1:])
+		if err != nil {
+			log.Println("failed to untag", name+":", err)
+		}
+	}
+}
+
+func (collector *GraphImageCollector) exceeded(totalSize int64) (bool, error) {
+	if collector.thresholds.MaxSize > 0 && totalSize > collector.thresholds.MaxSize {
+		return true, nil
+	}
+
+	if collector.thresholds.MinFree > 0 {
+		var stat syscall.Statfs_t
+
+		err := syscall.Statfs(collector.graphRoot, &stat)
+		if err != nil {
+			return false, err
+		}
+
+		if stat.Bavail*uint64(stat.Bsize) < collector.thresholds.MinFree {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
@@ -0,0 +1,13 @@
+package image_collector_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestImageCollector(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ImageCollector Suite")
+}
@@ -0,0 +1,295 @@
+package image_collector_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/image_collector"
+	"github.com/vito/warden-docker/fake_graph"
+	"github.com/vito/warden-docker/fake_tag_store"
+)
+
+var _ = Describe("GraphImageCollector", func() {
+	var graph *fake_graph.FakeGraph
+	var tags *fake_tag_store.FakeTagStore
+	var graphRoot string
+	var thresholds Thresholds
+
+	var collector *GraphImageCollector
+
+	BeforeEach(func() {
+		var err error
+
+		graph = fake_graph.New()
+		tags = fake_tag_store.New()
+
+		graphRoot, err = ioutil.TempDir("", "graph-root")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		// base <- app-1
+		//      <- app-2 <- app-2-child
+		graph.SetImage(&image.Image{ID: "base", Size: 100})
+		graph.SetImage(&image.Image{ID: "app-1", Parent: "base", Size: 10})
+		graph.SetImage(&image.Image{ID: "app-2", Parent: "base", Size: 20})
+		graph.SetImage(&image.Image{ID: "app-2-child", Parent: "app-2", Size: 30})
+
+		thresholds = Thresholds{}
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(graphRoot)
+	})
+
+	JustBeforeEach(func() {
+		collector = New(graph, tags, graphRoot, thresholds)
+	})
+
+	Context("when the graph is within its thresholds", func() {
+		BeforeEach(func() {
+			thresholds.MaxSize = 160
+		})
+
+		It("does not delete anything", func() {
+			err := collector.Collect()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(graph.Deleted()).Should(BeEmpty())
+		})
+	})
+
+	Context("when the graph exceeds its max size", func() {
+		BeforeEach(func() {
+			thresholds.MaxSize = 125
+		})
+
+		It("deletes unused images, least recently used first, until it is within the max size", func() {
+			collector.Retain("app-2-child")
+			collector.Release("app-2-child")
+
+			collector.Retain("app-1")
+			collector.Release("app-1")
+
+			err := collector.Collect()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(graph.Deleted()).Should(Equal([]string{"app-2-child", "app-2"}))
+		})
+
+		It("never deletes images in use, or their ancestors", func() {
+			collector.Retain("app-2-child")
+
+			err := collector.Collect()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(graph.Deleted()).Should(Equal([]string{"app-1"}))
+		})
+
+		It("deletes images once every container using them has released them", func() {
+			collector.Retain("app-1")
+			collector.Retain("app-1")
+			collector.Release("app-1")
+
+			collector.Retain("app-2-child")
+
+			err := collector.Collect()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(graph.Deleted()).Should(BeEmpty())
+
+			collector.Release("app-1")
+
+			err = collector.Collect()
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(graph.Deleted()).Should(Equal([]string{"app-1"}))
+		})
+
+		Context("and the images have been used within the grace period", func() {
+			BeforeEach(func() {
+				thresholds.GracePeriod = time.Hour
+			})
+
+			It("does not delete them", func() {
+				err := collector.Collect()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(graph.Deleted()).Should(BeEmpty())
+			})
+		})
+
+		Context("and an unused image is tagged", func() {
+			BeforeEach(func() {
+				thresholds.GracePeriod = 10 * time.Millisecond
+
+				err := tags.Set("some-registry:5000/some-repo", "some-tag", "app-1", true)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = tags.Set("some-other-repo", "latest", "app-1", true)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = tags.Set("some-repo-in-use", "latest", "app-2-child", true)
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("deletes and untags it once it has been unused for the grace period", func() {
+				collector.Retain("app-2-child")
+
+				collector.Retain("app-1")
+				collector.Release("app-1")
+
+				err := collector.Collect()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(graph.Deleted()).Should(BeEmpty())
+
+				time.Sleep(20 * time.Millisecond)
+
+				err = collector.Collect()
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(graph.Deleted()).Should(Equal([]string{"app-1"}))
+
+				Ω(tags.Tagged("some-registry:5000/some-repo", "some-tag")).Should(BeEmpty())
+				Ω(tags.Tagged("some-other-repo", "latest")).Should(BeEmpty())
+				Ω(tags.Tagged("some-repo-in-use", "latest")).Should(Equal("app-2-child"))
+			})
+
+			Context("and untagging fails", func() {
+				BeforeEach(func() {
+					tags.DeleteError = errors.New("oh no!")
+				})
+
+				It("deletes it anyway", func() {
+					collector.Retain("app-2-child")
+
+					collector.Retain("app-1")
+					collector.Release("app-1")
+
+					time.Sleep(20 * time.Millisecond)
+
+					err := collector.Collect()
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(graph.Deleted()).Should(Equal([]string{"app-1"}))
+				})
+			})
+		})
+
+		Context("and deleting fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				graph.DeleteError = disaster
+			})
+
+			It("returns the error", func() {
+				err := collector.Collect()
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
+	Context("when the graph's filesystem has too little free space", func() {
+		BeforeEach(func() {
+			thresholds.MinFree = 1 << 62
+		})
+
+		It("deletes every unused image", func() {
+			collector.Retain("app-1")
+
+			err := collector.Collect()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(graph.Deleted()).Should(HaveLen(2))
+			Ω(graph.Deleted()).Should(ContainElement("app-2-child"))
+			Ω(graph.Deleted()).Should(ContainElement("app-2"))
+		})
+	})
+
+	Describe("retaining a fetched image", func() {
+		BeforeEach(func() {
+			thresholds.MaxSize = 1
+		})
+
+		It("keeps it from being collected", func() {
+			err := collector.RetainFetched("app-2-child")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = collector.Collect()
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(graph.Deleted()).Should(Equal([]string{"app-1"}))
+		})
+
+		Context("when it was collected after being fetched", func() {
+			It("returns ErrImageCollected without retaining it", func() {
+				err := collector.Collect()
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = collector.RetainFetched("app-2-child")
+				Ω(err).Should(Equal(ErrImageCollected))
+
+				// fetched again, with its parent still missing
+				graph.SetImage(&image.Image{ID: "app-2-child", Parent: "app-2", Size: 30})
+
+				err = collector.RetainFetched("app-2-child")
+				Ω(err).Should(Equal(ErrImageCollected))
+			})
+		})
+
+		Context("while collections are running", func() {
+			It("either retains it and its ancestors, or returns ErrImageCollected", func() {
+				for i := 0; i < 20; i++ {
+					base := fmt.Sprintf("fetched-base-%d", i)
+					top := fmt.Sprintf("fetched-top-%d", i)
+
+					done := make(chan struct{})
+					wg := new(sync.WaitGroup)
+
+					wg.Add(1)
+					go func() {
+						defer GinkgoRecover()
+						defer wg.Done()
+
+						for {
+							select {
+							case <-done:
+								return
+							default:
+							}
+
+							err := collector.Collect()
+							Ω(err).ShouldNot(HaveOccurred())
+						}
+					}()
+
+					// register the layers one at a time, as a fetch does
+					graph.SetImage(&image.Image{ID: base, Size: 10})
+					graph.SetImage(&image.Image{ID: top, Parent: base, Size: 10})
+
+					retainErr := collector.RetainFetched(top)
+
+					close(done)
+					wg.Wait()
+
+					if retainErr != nil {
+						Ω(retainErr).Should(Equal(ErrImageCollected))
+						continue
+					}
+
+					err := collector.Collect()
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(graph.Deleted()).ShouldNot(ContainElement(top))
+					Ω(graph.Deleted()).ShouldNot(ContainElement(base))
+
+					collector.Release(top)
+				}
+			})
+		})
+	})
+})
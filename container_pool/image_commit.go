@@ -0,0 +1,132 @@
+package container_pool
+
+import (
+	"errors"
+	"runtime"
+	"time"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/utils"
+)
+
+var ErrNotImageBased = errors.New("container was not created from an image")
+
+var ErrCommitToDigest = errors.New("cannot tag a committed image with a digest")
+
+// Commit registers the changes made to an image-based container's filesystem
+// as a new image whose parent is the container's image, and returns its ID.
+// If a reference (e.g. "ourname:tag") is given, the image is tagged with it.
+//
+// Committed images exist only on this host, so their tags are also recorded
+// as committed, which resolves them from the graph whatever the pull policy.
+// They shadow any tag of the same name on the registry.
+func (p *LinuxContainerPool) Commit(container linux_backend.Container, reference string) (string, error) {
+	imageBased, ok := container.(*imageContainer)
+	if !ok {
+		return "", ErrNotImageBased
+	}
+
+	var ref ImageReference
+
+	if reference != "" {
+		var err error
+
+		ref, err = ParseImageReference(reference)
+		if err != nil {
+			return "", err
+		}
+
+		if ref.Digest != "" {
+			return "", ErrCommitToDigest
+		}
+	}
+
+	changes, err := p.diff(container.ID(), imageBased.imageID)
+	if err != nil {
+		return "", err
+	}
+
+	defer changes.Close()
+
+	img := p.changesImage(container, imageBased)
+
+	err = p.imageGraph.Register(nil, changes, img)
+	if err != nil {
+		return "", err
+	}
+
+	if reference != "" {
+		err := p.tagStore.Set(ref.Name(), ref.Tag, img.ID, true)
+		if err != nil {
+			return "", err
+		}
+
+		err = p.committedTags.Set(ref.Name(), ref.Tag, img.ID, true)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return img.ID, nil
+}
+
+// changesImage describes a new image of the changes made to an image-based
+// container's filesystem, whose parent is the container's image.
+func (p *LinuxContainerPool) changesImage(container linux_backend.Container, imageBased *imageContainer) *image.Image {
+	return &image.Image{
+		ID:           utils.GenerateRandomID(),
+		Parent:       imageBased.imageID,
+		Created:      time.Now().UTC(),
+		Container:    container.ID(),
+		Config:       imageBased.config,
+		Architecture: runtime.GOARCH,
+		OS:           runtime.GOOS,
+	}
+}
+
+// diff archives the changes made to the container's layer since it was
+// created from its parent.
+func (p *LinuxContainerPool) diff(id string, parent string) (archive.Archive, error) {
+	if differ, ok := p.graphDriver.(graphdriver.Differ); ok {
+		return differ.Diff(id)
+	}
+
+	// the driver cannot diff layers itself; compare them as docker does
+	containerFS, err := p.graphDriver.Get(id, "")
+	if err != nil {
+		return nil, err
+	}
+
+	parentFS, err := p.graphDriver.Get(parent, "")
+	if err != nil {
+		p.graphDriver.Put(id)
+		return nil, err
+	}
+
+	put := func() {
+		p.graphDriver.Put(parent)
+		p.graphDriver.Put(id)
+	}
+
+	changes, err := archive.ChangesDirs(containerFS, parentFS)
+	if err != nil {
+		put()
+		return nil, err
+	}
+
+	exported, err := archive.ExportChanges(containerFS, changes)
+	if err != nil {
+		put()
+		return nil, err
+	}
+
+	// keep both mounted until the archive has been read
+	return utils.NewReadCloserWrapper(exported, func() error {
+		err := exported.Close()
+		put()
+		return err
+	}), nil
+}
@@ -0,0 +1,243 @@
+package container_pool
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/garden/warden"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
+	"github.com/dotcloud/docker/runconfig"
+)
+
+// ContainerSnapshot extends linux_backend's snapshot with the image the
+// container was created from, if any.
+type ContainerSnapshot struct {
+	linux_backend.ContainerSnapshot
+
+	ImageID     string            `json:",omitempty"`
+	ImageConfig *runconfig.Config `json:",omitempty"`
+	Image       *ImageProvenance  `json:",omitempty"`
+}
+
+// ImageProvenance records where a container's image came from: the
+// reference it was created from, with the registry resolved.
+type ImageProvenance struct {
+	Registry   string
+	Repository string
+	Tag        string `json:",omitempty"`
+	Digest     string `json:",omitempty"`
+}
+
+// properties that an image-based container's Properties and Info report its
+// image with, so that e.g. the containers using an image can be listed
+const (
+	imageRegistryProperty   = "image_registry"
+	imageRepositoryProperty = "image_repository"
+	imageTagProperty        = "image_tag"
+	imageDigestProperty     = "image_digest"
+	imageIDProperty         = "image_id"
+)
+
+// imageContainer is a container created from a docker image. Processes run
+// in it default to the image's environment, working directory, and user, and
+// running an empty script runs the image's entrypoint and command.
+type imageContainer struct {
+	*linux_backend.LinuxContainer
+
+	imageID    string
+	config     *runconfig.Config
+	provenance *ImageProvenance
+
+	// the container's view of its root filesystem, whose passwd and group
+	// files the image's user is resolved against
+	rootFSPath string
+
+	// events from creating the container, e.g. pulling its image, which
+	// precede the container's own
+	events []string
+
+	// the image's ports to map a host port to once the container has
+	// started, if it was created with the expose_ports property
+	exposedPorts []uint32
+}
+
+// Start starts the container and then maps a port from the pool to each port
+// its image exposes, as NetIn does, so that clients needn't know which ports
+// each image listens on. The mappings have to wait for the container to
+// start, as starting it sets up its networking from scratch.
+//
+// The mappings are the container's own, so Info reports them and snapshots
+// restore them; restored containers aren't started again.
+func (c *imageContainer) Start() error {
+	err := c.LinuxContainer.Start()
+	if err != nil {
+		return err
+	}
+
+	for _, port := range c.exposedPorts {
+		_, _, err := c.NetIn(0, port)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *imageContainer) Events() []string {
+	return append(append([]string{}, c.events...), c.LinuxContainer.Events()...)
+}
+
+// Properties are the container's own, along with its image's; the image's
+// take precedence, and are not persisted with the container's own.
+func (c *imageContainer) Properties() warden.Properties {
+	properties := warden.Properties{}
+
+	for key, value := range c.LinuxContainer.Properties() {
+		properties[key] = value
+	}
+
+	properties[imageIDProperty] = c.imageID
+
+	// containers restored from snapshots that predate provenance only know
+	// their image's ID
+	if c.provenance != nil {
+		properties[imageRegistryProperty] = c.provenance.Registry
+		properties[imageRepositoryProperty] = c.provenance.Repository
+
+		if c.provenance.Tag != "" {
+			properties[imageTagProperty] = c.provenance.Tag
+		}
+
+		if c.provenance.Digest != "" {
+			properties[imageDigestProperty] = c.provenance.Digest
+		}
+	}
+
+	return properties
+}
+
+func (c *imageContainer) Info() (warden.ContainerInfo, error) {
+	info, err := c.LinuxContainer.Info()
+	if err != nil {
+		return warden.ContainerInfo{}, err
+	}
+
+	info.Events = c.Events()
+	info.Properties = c.Properties()
+
+	return info, nil
+}
+
+func (c *imageContainer) Run(spec warden.ProcessSpec) (uint32, <-chan warden.ProcessStream, error) {
+	spec, err := imageProcessSpec(c.config, spec, c.rootFSPath)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return c.LinuxContainer.Run(spec)
+}
+
+func (c *imageContainer) Snapshot(out io.Writer) error {
+	buf := new(bytes.Buffer)
+
+	err := c.LinuxContainer.Snapshot(buf)
+	if err != nil {
+		return err
+	}
+
+	var snapshot ContainerSnapshot
+
+	err = json.NewDecoder(buf).Decode(&snapshot.ContainerSnapshot)
+	if err != nil {
+		return err
+	}
+
+	// the container's events are restored as its own
+	snapshot.Events = c.Events()
+
+	snapshot.ImageID = c.imageID
+	snapshot.ImageConfig = c.config
+	snapshot.Image = c.provenance
+
+	return json.NewEncoder(out).Encode(snapshot)
+}
+
+func imageProcessSpec(config *runconfig.Config, spec warden.ProcessSpec, rootFSPath string) (warden.ProcessSpec, error) {
+	if config == nil {
+		return spec, nil
+	}
+
+	env := []warden.EnvironmentVariable{}
+
+	for _, kv := range config.Env {
+		segs := strings.SplitN(kv, "=", 2)
+		if len(segs) != 2 {
+			continue
+		}
+
+		env = append(env, warden.EnvironmentVariable{Key: segs[0], Value: segs[1]})
+	}
+
+	// the spec's variables are exported last so that they take precedence
+	spec.EnvironmentVariables = append(env, spec.EnvironmentVariables...)
+
+	script := spec.Script
+	if script == "" {
+		script = defaultCommand(config)
+	}
+
+	if config.WorkingDir != "" {
+		script = "cd " + shellQuote(config.WorkingDir) + "\n" + script
+	}
+
+	// processes only run as root if the client asked for a privileged run;
+	// the image's user can't grant it
+	if config.User != "" {
+		user, err := resolveImageUser(rootFSPath, config.User)
+		if err != nil {
+			return warden.ProcessSpec{}, err
+		}
+
+		switch {
+		case user.UID == 0:
+			// root in the image is root in the container if privileged, and
+			// vcap otherwise, as if the image named no user
+		case user.Name == "vcap":
+			spec.Privileged = false
+		case spec.Privileged:
+			// wsh only knows about vcap and root, so switch users from root;
+			// the new shell continues reading the script from stdin
+			script = "exec su -s /bin/bash " + shellQuote(user.Name) + "\n" + script
+		default:
+			return warden.ProcessSpec{}, ImageUserError{
+				User:   config.User,
+				Reason: "switching to it requires a privileged run",
+			}
+		}
+	}
+
+	spec.Script = script
+
+	return spec, nil
+}
+
+func defaultCommand(config *runconfig.Config) string {
+	argv := append(append([]string{}, config.Entrypoint...), config.Cmd...)
+	if len(argv) == 0 {
+		return ""
+	}
+
+	quoted := make([]string, len(argv))
+	for i, arg := range argv {
+		quoted[i] = shellQuote(arg)
+	}
+
+	return "exec " + strings.Join(quoted, " ")
+}
+
+func shellQuote(str string) string {
+	return "'" + strings.Replace(str, "'", `'"'"'`, -1) + "'"
+}
@@ -0,0 +1,252 @@
+package container_pool
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"time"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/utils"
+)
+
+var ErrExportToDigest = errors.New("cannot tag an exported image with a digest")
+
+// ExportRootFS writes a tarball of the container's root filesystem as it is
+// now, i.e. its image's layers with its own changes on top.
+//
+// Unlike streaming out of the container, which runs as its unprivileged user,
+// this reads the filesystem from the host, so files owned by root and their
+// ownership are included.
+func (p *LinuxContainerPool) ExportRootFS(container linux_backend.Container, out io.Writer) error {
+	rootFSPath := path.Join(p.depotPath, container.ID(), "mnt")
+
+	if _, ok := container.(*imageContainer); ok {
+		var err error
+
+		rootFSPath, err = p.graphDriver.Get(container.ID(), "")
+		if err != nil {
+			return err
+		}
+
+		defer p.graphDriver.Put(container.ID())
+	}
+
+	rootFS, err := archive.Tar(rootFSPath, archive.Uncompressed)
+	if err != nil {
+		return err
+	}
+
+	defer rootFS.Close()
+
+	_, err = io.Copy(out, rootFS)
+	return err
+}
+
+// ExportImage writes a tarball in the format written by `docker save` holding
+// an image-based container's image, its ancestors from the graph, and a layer
+// of the changes made to its filesystem, as Commit would register. If a
+// reference (e.g. "ourname:tag") is given, the archive tags the image with it.
+//
+// The tarball can be loaded by `docker load`, or imported by another host.
+func (p *LinuxContainerPool) ExportImage(container linux_backend.Container, reference string, out io.Writer) error {
+	imageBased, ok := container.(*imageContainer)
+	if !ok {
+		return ErrNotImageBased
+	}
+
+	var ref ImageReference
+
+	if reference != "" {
+		var err error
+
+		ref, err = ParseImageReference(reference)
+		if err != nil {
+			return err
+		}
+
+		if ref.Digest != "" {
+			return ErrExportToDigest
+		}
+	}
+
+	history, err := p.imageHistory(imageBased.imageID)
+	if err != nil {
+		return err
+	}
+
+	// the changes are spooled so that their size is known before they're
+	// written to the tarball
+	changes, err := p.spoolChanges(container.ID(), imageBased.imageID)
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(changes.Name())
+	defer changes.Close()
+
+	saved := tar.NewWriter(out)
+
+	for _, img := range history {
+		layer, err := p.imageGraph.TempLayerArchive(
+			img.ID,
+			archive.Uncompressed,
+			utils.NewStreamFormatter(false),
+			ioutil.Discard,
+		)
+		if err != nil {
+			return err
+		}
+
+		err = writeSavedLayer(saved, img, layer, layer.Size)
+
+		// the archive removes itself once read in full, but not if writing it
+		// fails part way, and never closes itself
+		layer.Close()
+		os.Remove(layer.Name())
+
+		if err != nil {
+			return err
+		}
+	}
+
+	top := p.changesImage(container, imageBased)
+
+	changesInfo, err := changes.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = writeSavedLayer(saved, top, changes, changesInfo.Size())
+	if err != nil {
+		return err
+	}
+
+	if reference != "" {
+		repositories, err := json.Marshal(map[string]map[string]string{
+			ref.Name(): {ref.Tag: top.ID},
+		})
+		if err != nil {
+			return err
+		}
+
+		err = writeSavedFile(saved, "repositories", repositories)
+		if err != nil {
+			return err
+		}
+	}
+
+	return saved.Close()
+}
+
+// imageHistory returns the image and its ancestors, parent-first.
+func (p *LinuxContainerPool) imageHistory(imageID string) ([]*image.Image, error) {
+	history := []*image.Image{}
+
+	for id := imageID; id != ""; {
+		img, err := p.imageGraph.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		history = append([]*image.Image{img}, history...)
+
+		id = img.Parent
+	}
+
+	return history, nil
+}
+
+// spoolChanges archives the changes made to the container's layer into a
+// temporary file, rewound for reading.
+func (p *LinuxContainerPool) spoolChanges(id string, parent string) (*os.File, error) {
+	changes, err := p.diff(id, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	defer changes.Close()
+
+	spool, err := ioutil.TempFile("", "export-")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.Copy(spool, changes)
+	if err == nil {
+		_, err = spool.Seek(0, 0)
+	}
+
+	if err != nil {
+		spool.Close()
+		os.Remove(spool.Name())
+		return nil, err
+	}
+
+	return spool, nil
+}
+
+// writeSavedLayer writes a layer as `docker save` does: a directory named
+// after it, holding its version, json, and layer.tar.
+func writeSavedLayer(saved *tar.Writer, img *image.Image, layer io.Reader, size int64) error {
+	imgJSON, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+
+	err = saved.WriteHeader(&tar.Header{
+		Name:     img.ID + "/",
+		Typeflag: tar.TypeDir,
+		Mode:     0755,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeSavedFile(saved, path.Join(img.ID, "VERSION"), []byte("1.0"))
+	if err != nil {
+		return err
+	}
+
+	err = writeSavedFile(saved, path.Join(img.ID, "json"), imgJSON)
+	if err != nil {
+		return err
+	}
+
+	err = saved.WriteHeader(&tar.Header{
+		Name:     path.Join(img.ID, "layer.tar"),
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.CopyN(saved, layer, size)
+	return err
+}
+
+func writeSavedFile(saved *tar.Writer, name string, contents []byte) error {
+	err := saved.WriteHeader(&tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = saved.Write(contents)
+	return err
+}
@@ -0,0 +1,37 @@
+package container_pool
+
+import (
+	"errors"
+
+	"github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
+
+var ErrPushDigest = errors.New("cannot push to a digest; push a tag instead")
+
+// Push publishes a tagged image from the graph, such as one made by Commit,
+// to the registry named by the reference.
+func (p *LinuxContainerPool) Push(reference string) error {
+	ref, err := ParseImageReference(reference)
+	if err != nil {
+		return err
+	}
+
+	if ref.Digest != "" {
+		return ErrPushDigest
+	}
+
+	repo, err := p.tagStore.Get(ref.Name())
+	if err != nil {
+		return err
+	}
+
+	imageID, found := repo[ref.Tag]
+	if !found {
+		return repository_fetcher.ImageNotPresentError{
+			Repository: ref.Name(),
+			Tag:        ref.Tag,
+		}
+	}
+
+	return p.repoPusher.Push(ref.Name(), ref.Tag, imageID)
+}
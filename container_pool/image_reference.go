@@ -0,0 +1,124 @@
+package container_pool
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
+
+// ImageReference identifies an image by the repository it lives in and either
+// a tag or a content digest, e.g.:
+//
+//	ubuntu
+//	ubuntu:14.04
+//	localhost:5000/team/app:v2
+//	registry.example.com/team/app@sha256:<hex>
+type ImageReference struct {
+	// registry host[:port]; empty for the default registry
+	Registry string
+
+	Repository string
+
+	Tag    string
+	Digest string
+}
+
+type InvalidImageReferenceError struct {
+	Reference string
+	Reason    string
+}
+
+func (e InvalidImageReferenceError) Error() string {
+	return fmt.Sprintf("invalid image reference %q: %s", e.Reference, e.Reason)
+}
+
+var (
+	pathComponentPattern = regexp.MustCompile(`^[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*$`)
+	tagPattern           = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	digestPattern        = regexp.MustCompile(`^[a-z0-9]+(?:[+._-][a-z0-9]+)*:[a-fA-F0-9]{32,}$`)
+)
+
+func ParseImageReference(reference string) (ImageReference, error) {
+	invalid := func(reason string) (ImageReference, error) {
+		return ImageReference{}, InvalidImageReferenceError{
+			Reference: reference,
+			Reason:    reason,
+		}
+	}
+
+	var ref ImageReference
+
+	name := reference
+
+	if at := strings.Index(name, "@"); at != -1 {
+		ref.Digest = name[at+1:]
+		name = name[:at]
+
+		if !digestPattern.MatchString(ref.Digest) {
+			return invalid("malformed digest")
+		}
+	}
+
+	// a tag follows the last ':' that is not part of the registry host
+	if colon := strings.LastIndex(name, ":"); colon > strings.LastIndex(name, "/") {
+		ref.Tag = name[colon+1:]
+		name = name[:colon]
+
+		if !tagPattern.MatchString(ref.Tag) {
+			return invalid("malformed tag")
+		}
+	}
+
+	ref.Registry, ref.Repository = repository_fetcher.SplitRegistryHost(name)
+
+	if ref.Repository == "" {
+		return invalid("missing repository")
+	}
+
+	for _, component := range strings.Split(ref.Repository, "/") {
+		if !pathComponentPattern.MatchString(component) {
+			return invalid("malformed repository name")
+		}
+	}
+
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+
+	return ref, nil
+}
+
+// Name is the repository name qualified with its registry, if any.
+func (ref ImageReference) Name() string {
+	if ref.Registry == "" {
+		return ref.Repository
+	}
+
+	return ref.Registry + "/" + ref.Repository
+}
+
+// Reference is what to resolve in the repository: the digest if the image is
+// pinned to one, and the tag otherwise.
+func (ref ImageReference) Reference() string {
+	if ref.Digest != "" {
+		return ref.Digest
+	}
+
+	return ref.Tag
+}
+
+func (ref ImageReference) String() string {
+	str := ref.Name()
+
+	if ref.Tag != "" {
+		str += ":" + ref.Tag
+	}
+
+	if ref.Digest != "" {
+		str += "@" + ref.Digest
+	}
+
+	return str
+}
@@ -0,0 +1,114 @@
+package container_pool_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/vito/warden-docker/container_pool"
+)
+
+var _ = Describe("ParseImageReference", func() {
+	digest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	valid := func(reference string, expected container_pool.ImageReference) {
+		ref, err := container_pool.ParseImageReference(reference)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ref).To(Equal(expected))
+	}
+
+	invalid := func(reference string) {
+		_, err := container_pool.ParseImageReference(reference)
+		Expect(err).To(BeAssignableToTypeOf(container_pool.InvalidImageReferenceError{}))
+	}
+
+	It("defaults the tag to latest", func() {
+		valid("ubuntu", container_pool.ImageReference{
+			Repository: "ubuntu",
+			Tag:        "latest",
+		})
+	})
+
+	It("parses a tag", func() {
+		valid("team/app:v2", container_pool.ImageReference{
+			Repository: "team/app",
+			Tag:        "v2",
+		})
+	})
+
+	It("parses a registry host with a port", func() {
+		valid("localhost:5000/team/app:v2", container_pool.ImageReference{
+			Registry:   "localhost:5000",
+			Repository: "team/app",
+			Tag:        "v2",
+		})
+
+		valid("localhost:5000/app", container_pool.ImageReference{
+			Registry:   "localhost:5000",
+			Repository: "app",
+			Tag:        "latest",
+		})
+	})
+
+	It("parses a registry host without a port", func() {
+		valid("registry.example.com/team/app", container_pool.ImageReference{
+			Registry:   "registry.example.com",
+			Repository: "team/app",
+			Tag:        "latest",
+		})
+
+		valid("localhost/app", container_pool.ImageReference{
+			Registry:   "localhost",
+			Repository: "app",
+			Tag:        "latest",
+		})
+	})
+
+	It("parses a digest, with or without a tag", func() {
+		valid("localhost:5000/team/app@"+digest, container_pool.ImageReference{
+			Registry:   "localhost:5000",
+			Repository: "team/app",
+			Digest:     digest,
+		})
+
+		valid("team/app:v2@"+digest, container_pool.ImageReference{
+			Repository: "team/app",
+			Tag:        "v2",
+			Digest:     digest,
+		})
+	})
+
+	It("rejects malformed references", func() {
+		invalid("")
+		invalid("localhost:5000/")
+		invalid("Team/App")
+		invalid("team//app")
+		invalid("team/app:")
+		invalid("team/app:bad/tag")
+		invalid("team/app@sha256:nothex")
+		invalid("team/app@" + digest[:20])
+	})
+
+	Describe("ImageReference", func() {
+		var ref container_pool.ImageReference
+
+		BeforeEach(func() {
+			ref = container_pool.ImageReference{
+				Registry:   "localhost:5000",
+				Repository: "team/app",
+				Tag:        "v2",
+			}
+		})
+
+		It("qualifies its name with the registry", func() {
+			Expect(ref.Name()).To(Equal("localhost:5000/team/app"))
+			Expect(ref.String()).To(Equal("localhost:5000/team/app:v2"))
+		})
+
+		It("refers to the tag, unless pinned to a digest", func() {
+			Expect(ref.Reference()).To(Equal("v2"))
+
+			ref.Digest = digest
+			Expect(ref.Reference()).To(Equal(digest))
+		})
+	})
+})
@@ -0,0 +1,131 @@
+package container_pool
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// ImageUserError is returned when running a process as its image's user is
+// not possible, or not permitted.
+type ImageUserError struct {
+	User   string
+	Reason string
+}
+
+func (err ImageUserError) Error() string {
+	return fmt.Sprintf("cannot run as image user %q: %s", err.User, err.Reason)
+}
+
+// imageUser is an image's user, resolved against the image's passwd file.
+type imageUser struct {
+	Name string
+	UID  int
+}
+
+// resolveImageUser resolves an image's user, in any of the forms docker
+// allows (user, uid, user:group, uid:gid, and so on), against the passwd and
+// group files of its root filesystem.
+//
+// Processes are switched to the user with su, which only knows the user's
+// name and primary group, so a uid with no passwd entry, or a group other
+// than the user's primary group, is an error.
+func resolveImageUser(rootFSPath string, user string) (imageUser, error) {
+	switch user {
+	case "root", "0", "root:root", "0:0":
+		return imageUser{Name: "root", UID: 0}, nil
+	}
+
+	segs := strings.SplitN(user, ":", 2)
+
+	name := segs[0]
+
+	passwd, err := readColonFile(path.Join(rootFSPath, "etc", "passwd"))
+	if err != nil {
+		return imageUser{}, ImageUserError{User: user, Reason: err.Error()}
+	}
+
+	var entry []string
+
+	for _, fields := range passwd {
+		if len(fields) < 4 {
+			continue
+		}
+
+		if fields[0] == name || (isNumeric(name) && fields[2] == name) {
+			entry = fields
+			break
+		}
+	}
+
+	if entry == nil {
+		return imageUser{}, ImageUserError{User: user, Reason: "no such user in the image's /etc/passwd"}
+	}
+
+	uid, err := strconv.Atoi(entry[2])
+	if err != nil {
+		return imageUser{}, ImageUserError{User: user, Reason: "malformed uid in the image's /etc/passwd"}
+	}
+
+	if len(segs) == 2 {
+		gid := segs[1]
+
+		if !isNumeric(gid) {
+			groups, err := readColonFile(path.Join(rootFSPath, "etc", "group"))
+			if err != nil {
+				return imageUser{}, ImageUserError{User: user, Reason: err.Error()}
+			}
+
+			gid = ""
+
+			for _, fields := range groups {
+				if len(fields) >= 3 && fields[0] == segs[1] {
+					gid = fields[2]
+					break
+				}
+			}
+
+			if gid == "" {
+				return imageUser{}, ImageUserError{User: user, Reason: "no such group in the image's /etc/group"}
+			}
+		}
+
+		if gid != entry[3] {
+			return imageUser{}, ImageUserError{User: user, Reason: "only the user's primary group is supported"}
+		}
+	}
+
+	return imageUser{Name: entry[0], UID: uid}, nil
+}
+
+// readColonFile reads a passwd(5)-style file into its lines' fields.
+func readColonFile(filePath string) ([][]string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	lines := [][]string{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		lines = append(lines, strings.Split(line, ":"))
+	}
+
+	return lines, scanner.Err()
+}
+
+func isNumeric(str string) bool {
+	_, err := strconv.Atoi(str)
+	return err == nil
+}
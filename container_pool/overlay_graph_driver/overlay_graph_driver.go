@@ -0,0 +1,620 @@
+package overlay_graph_driver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/pkg/mount"
+	"github.com/dotcloud/docker/pkg/system"
+	"github.com/dotcloud/docker/utils"
+)
+
+var ErrNotSupported = errors.New("overlay is not supported by the kernel")
+
+func init() {
+	graphdriver.Register("overlay", Init)
+}
+
+// Driver stores layers using the kernel's overlay filesystem, which, unlike
+// aufs, ships with stock kernels.
+//
+// Overlay only stacks a single read-only layer under a writable one, so each
+// image layer is kept whole, in its "root" directory: it's made by hard
+// linking its parent's files and applying its diff on top. Layers created from
+// an image layer, i.e. containers' layers, are mounted as an overlay: their
+// changes go to their "upper" directory, on top of their image's root,
+// identified by their "lower-id" file.
+type Driver struct {
+	home string
+
+	// "overlay" as of linux 3.18, or "overlayfs" on kernels carrying it as a
+	// patch, e.g. ubuntu's, which takes no work directory
+	fsType string
+
+	// how many times each mounted layer has been gotten and not put
+	mounts      map[string]int
+	mountsMutex *sync.Mutex
+}
+
+func Init(home string) (graphdriver.Driver, error) {
+	fsType, err := supportedFilesystem()
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(home, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Driver{
+		home:   home,
+		fsType: fsType,
+
+		mounts:      make(map[string]int),
+		mountsMutex: new(sync.Mutex),
+	}, nil
+}
+
+func supportedFilesystem() (string, error) {
+	// overlay may be built as a module that isn't loaded yet
+	exec.Command("modprobe", "overlay").Run()
+
+	filesystems, err := os.Open("/proc/filesystems")
+	if err != nil {
+		return "", err
+	}
+
+	defer filesystems.Close()
+
+	supported := map[string]bool{}
+
+	scanner := bufio.NewScanner(filesystems)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 0 {
+			supported[fields[len(fields)-1]] = true
+		}
+	}
+
+	for _, fsType := range []string{"overlay", "overlayfs"} {
+		if supported[fsType] {
+			return fsType, nil
+		}
+	}
+
+	return "", ErrNotSupported
+}
+
+func (d *Driver) String() string {
+	return "overlay"
+}
+
+func (d *Driver) Status() [][2]string {
+	return [][2]string{
+		{"Filesystem", d.fsType},
+	}
+}
+
+func (d *Driver) Cleanup() error {
+	return nil
+}
+
+func (d *Driver) Create(id string, parent string) error {
+	dir := d.dir(id)
+
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		return err
+	}
+
+	created := false
+	defer func() {
+		if !created {
+			os.RemoveAll(dir)
+		}
+	}()
+
+	if parent == "" {
+		err := os.Mkdir(path.Join(dir, "root"), 0755)
+		if err != nil {
+			return err
+		}
+
+		created = true
+		return nil
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, "parent"), []byte(parent), 0600)
+	if err != nil {
+		return err
+	}
+
+	parentDir := d.dir(parent)
+
+	lowerID := parent
+	parentUpper := ""
+
+	if !d.isMounted(parent) {
+		if _, err := os.Stat(parentDir); err != nil {
+			return err
+		}
+	} else {
+		// the parent is itself mounted over an image layer; overlay won't
+		// stack another layer on top, so start with a copy of its changes
+		// over the same image layer
+		lowerID, err = d.lowerID(parent)
+		if err != nil {
+			return err
+		}
+
+		parentUpper = path.Join(parentDir, "upper")
+	}
+
+	for _, subdir := range []string{"upper", "work", "merged"} {
+		err := os.Mkdir(path.Join(dir, subdir), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	if parentUpper != "" {
+		err := copyDir(parentUpper, path.Join(dir, "upper"))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, "lower-id"), []byte(lowerID), 0600)
+	if err != nil {
+		return err
+	}
+
+	created = true
+	return nil
+}
+
+func (d *Driver) Remove(id string) error {
+	dir := d.dir(id)
+
+	if _, err := os.Stat(dir); err != nil {
+		return err
+	}
+
+	// the layer may still be mounted from before a restart
+	merged := path.Join(dir, "merged")
+	if mounted, _ := mount.Mounted(merged); mounted {
+		err := mount.Unmount(merged)
+		if err != nil {
+			return err
+		}
+	}
+
+	d.mountsMutex.Lock()
+	delete(d.mounts, id)
+	d.mountsMutex.Unlock()
+
+	return os.RemoveAll(dir)
+}
+
+func (d *Driver) Get(id string, mountLabel string) (string, error) {
+	dir := d.dir(id)
+
+	if _, err := os.Stat(dir); err != nil {
+		return "", err
+	}
+
+	if !d.isMounted(id) {
+		return path.Join(dir, "root"), nil
+	}
+
+	d.mountsMutex.Lock()
+	defer d.mountsMutex.Unlock()
+
+	merged := path.Join(dir, "merged")
+
+	if d.mounts[id] == 0 {
+		// the layer may still be mounted from before a restart
+		mounted, err := mount.Mounted(merged)
+		if err != nil {
+			return "", err
+		}
+
+		if !mounted {
+			err := d.mount(id, merged)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	d.mounts[id]++
+
+	return merged, nil
+}
+
+func (d *Driver) Put(id string) {
+	d.mountsMutex.Lock()
+	defer d.mountsMutex.Unlock()
+
+	count, found := d.mounts[id]
+	if !found {
+		return
+	}
+
+	if count > 1 {
+		d.mounts[id] = count - 1
+		return
+	}
+
+	delete(d.mounts, id)
+
+	err := mount.Unmount(path.Join(d.dir(id), "merged"))
+	if err != nil {
+		utils.Debugf("failed to unmount %s: %s", id, err)
+	}
+}
+
+func (d *Driver) Exists(id string) bool {
+	_, err := os.Stat(d.dir(id))
+	return err == nil
+}
+
+// ApplyDiff unpacks an image layer's diff. A layer created from an image
+// layer becomes an image layer itself, whose root is a hard-linked copy of its
+// parent's; this relies on diffs replacing files rather than writing to them.
+func (d *Driver) ApplyDiff(id string, diff archive.ArchiveReader) error {
+	dir := d.dir(id)
+
+	if !d.isMounted(id) {
+		return archive.ApplyLayer(path.Join(dir, "root"), diff)
+	}
+
+	lowerID, err := d.lowerID(id)
+	if err != nil {
+		return err
+	}
+
+	upperEntries, err := ioutil.ReadDir(path.Join(dir, "upper"))
+	if err != nil {
+		return err
+	}
+
+	if len(upperEntries) > 0 {
+		// the layer has changes of its own, e.g. it was created from a
+		// container's layer; apply the diff over them
+		merged, err := d.Get(id, "")
+		if err != nil {
+			return err
+		}
+
+		defer d.Put(id)
+
+		return archive.ApplyLayer(merged, diff)
+	}
+
+	root, err := ioutil.TempDir(dir, "root")
+	if err != nil {
+		return err
+	}
+
+	err = linkDir(path.Join(d.dir(lowerID), "root"), root)
+	if err != nil {
+		os.RemoveAll(root)
+		return err
+	}
+
+	err = archive.ApplyLayer(root, diff)
+	if err != nil {
+		os.RemoveAll(root)
+		return err
+	}
+
+	err = os.Rename(root, path.Join(dir, "root"))
+	if err != nil {
+		os.RemoveAll(root)
+		return err
+	}
+
+	for _, name := range []string{"upper", "work", "merged", "lower-id"} {
+		err := os.RemoveAll(path.Join(dir, name))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Diff archives the layer's changes from its parent: for a mounted layer,
+// its upper directory, with overlay's whiteouts converted to aufs-style
+// ".wh." files; for an image layer, the difference between its root and its
+// parent's.
+func (d *Driver) Diff(id string) (archive.Archive, error) {
+	if d.isMounted(id) {
+		changes, err := d.upperChanges(id)
+		if err != nil {
+			return nil, err
+		}
+
+		return archive.ExportChanges(path.Join(d.dir(id), "upper"), changes)
+	}
+
+	root := path.Join(d.dir(id), "root")
+
+	parent, err := d.parent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent == "" {
+		return archive.Tar(root, archive.Uncompressed)
+	}
+
+	parentFS, err := d.Get(parent, "")
+	if err != nil {
+		return nil, err
+	}
+
+	changes, err := archive.ChangesDirs(root, parentFS)
+	if err != nil {
+		d.Put(parent)
+		return nil, err
+	}
+
+	exported, err := archive.ExportChanges(root, changes)
+	if err != nil {
+		d.Put(parent)
+		return nil, err
+	}
+
+	// keep the parent mounted until the archive has been read
+	return utils.NewReadCloserWrapper(exported, func() error {
+		err := exported.Close()
+		d.Put(parent)
+		return err
+	}), nil
+}
+
+func (d *Driver) Changes(id string) ([]archive.Change, error) {
+	if d.isMounted(id) {
+		return d.upperChanges(id)
+	}
+
+	root := path.Join(d.dir(id), "root")
+
+	parent, err := d.parent(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if parent == "" {
+		return addedChanges(root)
+	}
+
+	parentFS, err := d.Get(parent, "")
+	if err != nil {
+		return nil, err
+	}
+
+	defer d.Put(parent)
+
+	return archive.ChangesDirs(root, parentFS)
+}
+
+func (d *Driver) DiffSize(id string) (int64, error) {
+	changes, err := d.Changes(id)
+	if err != nil {
+		return 0, err
+	}
+
+	changed := path.Join(d.dir(id), "root")
+	if d.isMounted(id) {
+		changed = path.Join(d.dir(id), "upper")
+	}
+
+	return archive.ChangesSize(changed, changes), nil
+}
+
+func (d *Driver) dir(id string) string {
+	return path.Join(d.home, path.Base(id))
+}
+
+// isMounted determines whether the layer is mounted over an image layer,
+// rather than having a root of its own.
+func (d *Driver) isMounted(id string) bool {
+	_, err := os.Stat(path.Join(d.dir(id), "lower-id"))
+	return err == nil
+}
+
+func (d *Driver) lowerID(id string) (string, error) {
+	lowerID, err := ioutil.ReadFile(path.Join(d.dir(id), "lower-id"))
+	if err != nil {
+		return "", err
+	}
+
+	return string(lowerID), nil
+}
+
+func (d *Driver) parent(id string) (string, error) {
+	parent, err := ioutil.ReadFile(path.Join(d.dir(id), "parent"))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return string(parent), nil
+}
+
+func (d *Driver) mount(id string, merged string) error {
+	lowerID, err := d.lowerID(id)
+	if err != nil {
+		return err
+	}
+
+	dir := d.dir(id)
+
+	options := fmt.Sprintf(
+		"lowerdir=%s,upperdir=%s",
+		path.Join(d.dir(lowerID), "root"),
+		path.Join(dir, "upper"),
+	)
+
+	if d.fsType == "overlay" {
+		options += ",workdir=" + path.Join(dir, "work")
+	}
+
+	return mount.Mount("overlay", merged, d.fsType, options)
+}
+
+// upperChanges lists the changes in a mounted layer's upper directory,
+// parent directories first. A whiteout is a deletion, and an opaque directory,
+// which hides everything under it in the image layer, deletes each of the
+// image layer's entries before its own are added. Both overlay and the legacy
+// overlayfs mark opaque directories with the same attribute.
+func (d *Driver) upperChanges(id string) ([]archive.Change, error) {
+	lowerID, err := d.lowerID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	upper := path.Join(d.dir(id), "upper")
+	lower := path.Join(d.dir(lowerID), "root")
+
+	changes := []archive.Change{}
+
+	err = filepath.Walk(upper, func(upperPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		changePath, err := filepath.Rel(upper, upperPath)
+		if err != nil {
+			return err
+		}
+
+		if changePath == "." {
+			return nil
+		}
+
+		changePath = "/" + changePath
+
+		if isWhiteout(upperPath, info) {
+			changes = append(changes, archive.Change{Path: changePath, Kind: archive.ChangeDelete})
+			return nil
+		}
+
+		var kind archive.ChangeType = archive.ChangeModify
+		if _, err := os.Lstat(filepath.Join(lower, changePath)); os.IsNotExist(err) {
+			kind = archive.ChangeAdd
+		}
+
+		changes = append(changes, archive.Change{Path: changePath, Kind: kind})
+
+		if info.IsDir() && isOpaque(upperPath) {
+			hidden, err := ioutil.ReadDir(filepath.Join(lower, changePath))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			for _, entry := range hidden {
+				changes = append(changes, archive.Change{
+					Path: path.Join(changePath, entry.Name()),
+					Kind: archive.ChangeDelete,
+				})
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// addedChanges lists everything in a layer without a parent as added.
+func addedChanges(root string) ([]archive.Change, error) {
+	changes := []archive.Change{}
+
+	err := filepath.Walk(root, func(rootPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		changePath, err := filepath.Rel(root, rootPath)
+		if err != nil {
+			return err
+		}
+
+		if changePath != "." {
+			changes = append(changes, archive.Change{Path: "/" + changePath, Kind: archive.ChangeAdd})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return changes, nil
+}
+
+// isWhiteout determines whether an entry in an upper directory marks a
+// deletion: overlay's whiteouts are 0/0 character devices, whereas the legacy
+// overlayfs's are symlinks with the "trusted.overlay.whiteout" attribute.
+func isWhiteout(entryPath string, info os.FileInfo) bool {
+	switch {
+	case info.Mode()&os.ModeCharDevice != 0:
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		return ok && stat.Rdev == 0
+
+	case info.Mode()&os.ModeSymlink != 0:
+		value, err := system.Lgetxattr(entryPath, "trusted.overlay.whiteout")
+		return err == nil && string(value) == "y"
+	}
+
+	return false
+}
+
+func isOpaque(dir string) bool {
+	value := make([]byte, 1)
+
+	size, err := syscall.Getxattr(dir, "trusted.overlay.opaque", value)
+	return err == nil && size == 1 && value[0] == 'y'
+}
+
+// linkDir copies the directory tree, hard linking its files.
+func linkDir(src string, dst string) error {
+	return cp("-alT", src, dst)
+}
+
+// copyDir copies the directory tree, including whiteouts and the attributes
+// marking opaque directories.
+func copyDir(src string, dst string) error {
+	return cp("-aT", src, dst)
+}
+
+func cp(flags string, src string, dst string) error {
+	output, err := exec.Command("cp", flags, src, dst).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("copying %s to %s: %s (%s)", src, dst, err, output)
+	}
+
+	return nil
+}
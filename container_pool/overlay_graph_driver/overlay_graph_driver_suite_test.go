@@ -0,0 +1,13 @@
+package overlay_graph_driver_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestOverlayGraphDriver(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Overlay Graph Driver Suite")
+}
@@ -0,0 +1,498 @@
+package overlay_graph_driver_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/daemon/graphdriver"
+	"github.com/dotcloud/docker/pkg/mount"
+	"github.com/dotcloud/docker/pkg/system"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/overlay_graph_driver"
+)
+
+type layerFile struct {
+	name     string
+	contents string
+	dir      bool
+}
+
+func layerTar(files ...layerFile) archive.ArchiveReader {
+	buf := new(bytes.Buffer)
+	w := tar.NewWriter(buf)
+
+	for _, file := range files {
+		header := &tar.Header{
+			Name:     file.name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(file.contents)),
+		}
+
+		if file.dir {
+			header.Typeflag = tar.TypeDir
+			header.Mode = 0755
+			header.Size = 0
+		}
+
+		Ω(w.WriteHeader(header)).ShouldNot(HaveOccurred())
+
+		_, err := w.Write([]byte(file.contents))
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	Ω(w.Close()).ShouldNot(HaveOccurred())
+
+	return buf
+}
+
+func tarEntries(archive io.ReadCloser) map[string]string {
+	defer archive.Close()
+
+	entries := map[string]string{}
+
+	r := tar.NewReader(archive)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+
+		Ω(err).ShouldNot(HaveOccurred())
+
+		contents, err := ioutil.ReadAll(r)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		entries[header.Name] = string(contents)
+	}
+
+	return entries
+}
+
+func changeStrings(changes []archive.Change) []string {
+	strs := []string{}
+	for _, change := range changes {
+		strs = append(strs, change.String())
+	}
+
+	sort.Strings(strs)
+
+	return strs
+}
+
+func overlaySupported() bool {
+	if os.Getuid() != 0 {
+		return false
+	}
+
+	home, err := ioutil.TempDir("", "overlay-supported")
+	if err != nil {
+		return false
+	}
+
+	defer os.RemoveAll(home)
+
+	_, err = Init(home)
+	return err == nil
+}
+
+var _ = Describe("Driver", func() {
+	// mounting requires root and a kernel with overlay
+	if !overlaySupported() {
+		return
+	}
+
+	var home string
+	var driver graphdriver.Driver
+	var differ graphdriver.Differ
+
+	BeforeEach(func() {
+		var err error
+
+		home, err = ioutil.TempDir("", "overlay-graph-driver")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		driver, err = graphdriver.GetDriver("overlay", home)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		differ = driver.(graphdriver.Differ)
+	})
+
+	AfterEach(func() {
+		for _, id := range []string{"container", "committed", "nested"} {
+			if driver.Exists(id) {
+				driver.Remove(id)
+			}
+		}
+
+		os.RemoveAll(home)
+	})
+
+	createBase := func() {
+		Ω(driver.Create("base", "")).ShouldNot(HaveOccurred())
+
+		Ω(differ.ApplyDiff("base", layerTar(
+			layerFile{name: "etc/", dir: true},
+			layerFile{name: "etc/hostname", contents: "base"},
+			layerFile{name: "etc/motd", contents: "hello"},
+			layerFile{name: "var/", dir: true},
+			layerFile{name: "var/lib/", dir: true},
+			layerFile{name: "var/lib/a", contents: "a"},
+			layerFile{name: "var/lib/b", contents: "b"},
+		))).ShouldNot(HaveOccurred())
+	}
+
+	createChild := func() {
+		Ω(driver.Create("child", "base")).ShouldNot(HaveOccurred())
+
+		Ω(differ.ApplyDiff("child", layerTar(
+			layerFile{name: "etc/", dir: true},
+			layerFile{name: "etc/hostname", contents: "child"},
+			layerFile{name: "etc/.wh.motd"},
+			layerFile{name: "bin/", dir: true},
+			layerFile{name: "bin/app", contents: "app"},
+		))).ShouldNot(HaveOccurred())
+	}
+
+	It("is named overlay", func() {
+		Ω(driver.String()).Should(Equal("overlay"))
+		Ω(driver.Status()[0][0]).Should(Equal("Filesystem"))
+	})
+
+	Describe("image layers", func() {
+		BeforeEach(func() {
+			createBase()
+			createChild()
+		})
+
+		It("applies each layer over its parent's files", func() {
+			root, err := driver.Get("child", "")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer driver.Put("child")
+
+			hostname, err := ioutil.ReadFile(path.Join(root, "etc", "hostname"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(hostname)).Should(Equal("child"))
+
+			app, err := ioutil.ReadFile(path.Join(root, "bin", "app"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(app)).Should(Equal("app"))
+
+			_, err = os.Stat(path.Join(root, "etc", "motd"))
+			Ω(os.IsNotExist(err)).Should(BeTrue())
+		})
+
+		It("leaves the parent's files as they were", func() {
+			root, err := driver.Get("base", "")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer driver.Put("base")
+
+			hostname, err := ioutil.ReadFile(path.Join(root, "etc", "hostname"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(hostname)).Should(Equal("base"))
+
+			_, err = os.Stat(path.Join(root, "etc", "motd"))
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("shares unchanged files with the parent", func() {
+			childRoot, err := driver.Get("child", "")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer driver.Put("child")
+
+			baseRoot, err := driver.Get("base", "")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			defer driver.Put("base")
+
+			childInfo, err := os.Stat(path.Join(childRoot, "var", "lib", "a"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			baseInfo, err := os.Stat(path.Join(baseRoot, "var", "lib", "a"))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(os.SameFile(childInfo, baseInfo)).Should(BeTrue())
+		})
+
+		It("diffs a layer against its parent", func() {
+			changes, err := differ.Changes("child")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(changeStrings(changes)).Should(Equal([]string{
+				"A /bin",
+				"A /bin/app",
+				"C /etc/hostname",
+				"D /etc/motd",
+			}))
+
+			diff, err := differ.Diff("child")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			entries := tarEntries(diff)
+			Ω(entries["etc/hostname"]).Should(Equal("child"))
+			Ω(entries["bin/app"]).Should(Equal("app"))
+			Ω(entries).Should(HaveKey("etc/.wh.motd"))
+			Ω(entries).ShouldNot(HaveKey("var/lib/a"))
+		})
+
+		It("diffs a layer without a parent as all of its files", func() {
+			diff, err := differ.Diff("base")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			entries := tarEntries(diff)
+			Ω(entries["etc/motd"]).Should(Equal("hello"))
+			Ω(entries["var/lib/b"]).Should(Equal("b"))
+
+			size, err := differ.DiffSize("base")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(size).Should(Equal(int64(len("base") + len("hello") + len("a") + len("b"))))
+		})
+	})
+
+	Describe("a container's layer", func() {
+		var root string
+
+		BeforeEach(func() {
+			createBase()
+			createChild()
+
+			Ω(driver.Create("container", "child")).ShouldNot(HaveOccurred())
+
+			var err error
+
+			root, err = driver.Get("container", "")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		AfterEach(func() {
+			driver.Put("container")
+		})
+
+		It("is mounted over its image's layer", func() {
+			mounted, err := mount.Mounted(root)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mounted).Should(BeTrue())
+
+			app, err := ioutil.ReadFile(path.Join(root, "bin", "app"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(app)).Should(Equal("app"))
+		})
+
+		It("stays mounted until put as many times as it was gotten", func() {
+			again, err := driver.Get("container", "")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(again).Should(Equal(root))
+
+			driver.Put("container")
+
+			mounted, err := mount.Mounted(root)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mounted).Should(BeTrue())
+
+			driver.Put("container")
+
+			mounted, err = mount.Mounted(root)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(mounted).Should(BeFalse())
+
+			_, err = driver.Get("container", "")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		Context("when files are changed", func() {
+			BeforeEach(func() {
+				Ω(ioutil.WriteFile(path.Join(root, "etc", "hostname"), []byte("container"), 0644)).ShouldNot(HaveOccurred())
+				Ω(ioutil.WriteFile(path.Join(root, "new-file"), []byte("new"), 0644)).ShouldNot(HaveOccurred())
+				Ω(os.Remove(path.Join(root, "var", "lib", "a"))).ShouldNot(HaveOccurred())
+			})
+
+			It("does not change the image's layer", func() {
+				imageRoot, err := driver.Get("child", "")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				defer driver.Put("child")
+
+				hostname, err := ioutil.ReadFile(path.Join(imageRoot, "etc", "hostname"))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(hostname)).Should(Equal("child"))
+
+				_, err = os.Stat(path.Join(imageRoot, "var", "lib", "a"))
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+
+			It("reports the changes", func() {
+				changes, err := differ.Changes("container")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(changeStrings(changes)).Should(Equal([]string{
+					"A /new-file",
+					"C /etc",
+					"C /etc/hostname",
+					"C /var",
+					"C /var/lib",
+					"D /var/lib/a",
+				}))
+			})
+
+			It("diffs the changes with whiteouts for deleted files", func() {
+				diff, err := differ.Diff("container")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				entries := tarEntries(diff)
+				Ω(entries["etc/hostname"]).Should(Equal("container"))
+				Ω(entries["new-file"]).Should(Equal("new"))
+				Ω(entries).Should(HaveKey("var/lib/.wh.a"))
+				Ω(entries).ShouldNot(HaveKey("var/lib/b"))
+
+				size, err := differ.DiffSize("container")
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(size).Should(Equal(int64(len("container") + len("new"))))
+			})
+
+			Context("and committed as a new image layer", func() {
+				BeforeEach(func() {
+					diff, err := differ.Diff("container")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					defer diff.Close()
+
+					Ω(driver.Create("committed", "child")).ShouldNot(HaveOccurred())
+					Ω(differ.ApplyDiff("committed", diff)).ShouldNot(HaveOccurred())
+				})
+
+				It("has the container's files", func() {
+					committedRoot, err := driver.Get("committed", "")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					defer driver.Put("committed")
+
+					mounted, err := mount.Mounted(committedRoot)
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(mounted).Should(BeFalse())
+
+					hostname, err := ioutil.ReadFile(path.Join(committedRoot, "etc", "hostname"))
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(string(hostname)).Should(Equal("container"))
+
+					_, err = os.Stat(path.Join(committedRoot, "var", "lib", "a"))
+					Ω(os.IsNotExist(err)).Should(BeTrue())
+
+					_, err = os.Stat(path.Join(committedRoot, "var", "lib", "b"))
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+			})
+
+			Context("and a layer is created from it", func() {
+				BeforeEach(func() {
+					Ω(driver.Create("nested", "container")).ShouldNot(HaveOccurred())
+				})
+
+				It("starts with the container's changes", func() {
+					nestedRoot, err := driver.Get("nested", "")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					defer driver.Put("nested")
+
+					hostname, err := ioutil.ReadFile(path.Join(nestedRoot, "etc", "hostname"))
+					Ω(err).ShouldNot(HaveOccurred())
+					Ω(string(hostname)).Should(Equal("container"))
+
+					_, err = os.Stat(path.Join(nestedRoot, "var", "lib", "a"))
+					Ω(os.IsNotExist(err)).Should(BeTrue())
+				})
+			})
+		})
+
+		Context("when the legacy overlayfs has whited out a file", func() {
+			BeforeEach(func() {
+				// overlayfs marks deletions with a symlink, rather than a
+				// character device
+				whiteout := path.Join(home, "overlay", "container", "upper", "var", "lib", "a")
+
+				Ω(os.MkdirAll(path.Dir(whiteout), 0755)).ShouldNot(HaveOccurred())
+				Ω(os.Symlink("(overlay-whiteout)", whiteout)).ShouldNot(HaveOccurred())
+				Ω(system.Lsetxattr(whiteout, "trusted.overlay.whiteout", []byte("y"), 0)).ShouldNot(HaveOccurred())
+			})
+
+			It("reports it as deleted", func() {
+				changes, err := differ.Changes("container")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(changeStrings(changes)).Should(Equal([]string{
+					"C /var",
+					"C /var/lib",
+					"D /var/lib/a",
+				}))
+			})
+
+			It("diffs it as a whiteout", func() {
+				diff, err := differ.Diff("container")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				entries := tarEntries(diff)
+				Ω(entries).Should(HaveKey("var/lib/.wh.a"))
+				Ω(entries).ShouldNot(HaveKey("var/lib/a"))
+			})
+		})
+
+		Context("when a directory is replaced", func() {
+			BeforeEach(func() {
+				Ω(os.RemoveAll(path.Join(root, "var", "lib"))).ShouldNot(HaveOccurred())
+				Ω(os.Mkdir(path.Join(root, "var", "lib"), 0755)).ShouldNot(HaveOccurred())
+				Ω(ioutil.WriteFile(path.Join(root, "var", "lib", "c"), []byte("c"), 0644)).ShouldNot(HaveOccurred())
+			})
+
+			It("deletes everything that was in it before adding its new files", func() {
+				changes, err := differ.Changes("container")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(changeStrings(changes)).Should(Equal([]string{
+					"A /var/lib/c",
+					"C /var",
+					"C /var/lib",
+					"D /var/lib/a",
+					"D /var/lib/b",
+				}))
+			})
+		})
+
+		Describe("removing it", func() {
+			It("unmounts it and removes its files", func() {
+				Ω(driver.Remove("container")).ShouldNot(HaveOccurred())
+
+				mounted, err := mount.Mounted(root)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(mounted).Should(BeFalse())
+
+				Ω(driver.Exists("container")).Should(BeFalse())
+
+				_, err = os.Stat(path.Join(home, "overlay", "container"))
+				Ω(os.IsNotExist(err)).Should(BeTrue())
+			})
+		})
+	})
+
+	Context("when the layer does not exist", func() {
+		It("fails to get it", func() {
+			_, err := driver.Get("bogus", "")
+			Ω(err).Should(HaveOccurred())
+		})
+
+		It("fails to create a layer from it", func() {
+			err := driver.Create("orphan", "bogus")
+			Ω(err).Should(HaveOccurred())
+			Ω(driver.Exists("orphan")).Should(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,96 @@
+package repository_fetcher
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/utils"
+)
+
+const (
+	tarsumPrefix = "tarsum+sha256:"
+	sha256Prefix = "sha256:"
+)
+
+// ChecksumMismatchError is returned when a downloaded layer does not match
+// the checksum or digest the registry advertised for it.
+type ChecksumMismatchError struct {
+	LayerID  string
+	Expected string
+	Actual   string
+}
+
+func (e ChecksumMismatchError) Error() string {
+	return fmt.Sprintf(
+		"checksum mismatch for layer %s: expected %s, got %s",
+		e.LayerID,
+		e.Expected,
+		e.Actual,
+	)
+}
+
+// verifyTarsum checks a v1 layer against the tarsum the index lists for it,
+// which covers the image JSON and the uncompressed contents of the layer.
+func verifyTarsum(layerID string, expected string, imgJSON []byte, layer io.Reader) error {
+	if !strings.HasPrefix(expected, tarsumPrefix) {
+		log.Println("cannot verify layer", layerID, "with checksum", expected)
+		return nil
+	}
+
+	decompressed, err := archive.DecompressStream(layer)
+	if err != nil {
+		return err
+	}
+
+	defer decompressed.Close()
+
+	tarsum := &utils.TarSum{Reader: decompressed, DisableCompression: true}
+
+	_, err = io.Copy(ioutil.Discard, tarsum)
+	if err != nil {
+		return err
+	}
+
+	actual := tarsum.Sum(imgJSON)
+	if actual != expected {
+		return ChecksumMismatchError{
+			LayerID:  layerID,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+
+	return nil
+}
+
+// verifyDigest checks a v2 blob against the content digest it was fetched
+// by.
+func verifyDigest(layerID string, expected string, blob io.Reader) error {
+	if !strings.HasPrefix(expected, sha256Prefix) {
+		return fmt.Errorf("unsupported digest for layer %s: %s", layerID, expected)
+	}
+
+	hash := sha256.New()
+
+	_, err := io.Copy(hash, blob)
+	if err != nil {
+		return err
+	}
+
+	actual := sha256Prefix + hex.EncodeToString(hash.Sum(nil))
+	if actual != expected {
+		return ChecksumMismatchError{
+			LayerID:  layerID,
+			Expected: expected,
+			Actual:   actual,
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,136 @@
+package repository_fetcher
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"strings"
+)
+
+// Credentials authenticate against a registry, either with a username and
+// password or with a pre-issued bearer token.
+type Credentials struct {
+	Username string
+	Password string
+
+	RegistryToken string
+}
+
+// Keychain maps registry hosts to the credentials to use for them.
+type Keychain map[string]Credentials
+
+// dockerAuth is an entry in a docker config.json or .dockercfg file.
+type dockerAuth struct {
+	Auth     string `json:"auth"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	RegistryToken string `json:"registrytoken"`
+}
+
+// hosts that the official index's credentials apply to
+var indexHosts = []string{
+	"index.docker.io",
+	"registry-1.docker.io",
+	"docker.io",
+}
+
+// LoadKeychain reads credentials from a docker config.json file, or from a
+// legacy .dockercfg file, which is the same without the "auths" wrapper.
+func LoadKeychain(path string) (Keychain, error) {
+	configJSON, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config struct {
+		Auths map[string]dockerAuth `json:"auths"`
+	}
+
+	err = json.Unmarshal(configJSON, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	auths := config.Auths
+	if auths == nil {
+		err := json.Unmarshal(configJSON, &auths)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	keychain := Keychain{}
+
+	for server, auth := range auths {
+		credentials := Credentials{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			RegistryToken: auth.RegistryToken,
+		}
+
+		if auth.Auth != "" {
+			credentials.Username, credentials.Password, err = decodeAuth(auth.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for %s: %s", server, err)
+			}
+		}
+
+		keychain[registryHost(server)] = credentials
+	}
+
+	return keychain, nil
+}
+
+// Lookup returns the credentials for the registry at the given endpoint,
+// which may be a host or a URL.
+func (keychain Keychain) Lookup(endpoint string) (Credentials, bool) {
+	host := registryHost(endpoint)
+
+	credentials, found := keychain[host]
+	if found {
+		return credentials, true
+	}
+
+	for _, indexHost := range indexHosts {
+		if host != indexHost {
+			continue
+		}
+
+		for _, alias := range indexHosts {
+			credentials, found := keychain[alias]
+			if found {
+				return credentials, true
+			}
+		}
+	}
+
+	return Credentials{}, false
+}
+
+func registryHost(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		parsed, err := url.Parse(endpoint)
+		if err == nil {
+			return parsed.Host
+		}
+	}
+
+	return strings.SplitN(endpoint, "/", 2)[0]
+}
+
+func decodeAuth(auth string) (string, string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return "", "", err
+	}
+
+	segs := strings.SplitN(string(decoded), ":", 2)
+	if len(segs) != 2 {
+		return "", "", fmt.Errorf("expected username:password")
+	}
+
+	return segs[0], segs[1], nil
+}
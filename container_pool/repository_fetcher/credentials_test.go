@@ -0,0 +1,121 @@
+package repository_fetcher_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
+
+var _ = Describe("Keychain", func() {
+	var configPath string
+
+	BeforeEach(func() {
+		tmpdir, err := ioutil.TempDir("", "keychain")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		configPath = path.Join(tmpdir, "config.json")
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(path.Dir(configPath))
+	})
+
+	writeConfig := func(config string) {
+		err := ioutil.WriteFile(configPath, []byte(config), 0600)
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	Describe("LoadKeychain", func() {
+		Context("with a config.json file", func() {
+			BeforeEach(func() {
+				// c29tZS11c2VyOnNvbWUtcGFzc3dvcmQ= is some-user:some-password
+				writeConfig(`{
+					"auths": {
+						"https://index.docker.io/v1/": {"auth": "c29tZS11c2VyOnNvbWUtcGFzc3dvcmQ="},
+						"localhost:5000": {"username": "other-user", "password": "other-password"},
+						"registry.example.com": {"registrytoken": "some-token"}
+					}
+				}`)
+			})
+
+			It("loads credentials keyed by registry host", func() {
+				keychain, err := LoadKeychain(configPath)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(keychain).Should(Equal(Keychain{
+					"index.docker.io":      {Username: "some-user", Password: "some-password"},
+					"localhost:5000":       {Username: "other-user", Password: "other-password"},
+					"registry.example.com": {RegistryToken: "some-token"},
+				}))
+			})
+		})
+
+		Context("with a legacy .dockercfg file", func() {
+			BeforeEach(func() {
+				writeConfig(`{
+					"https://index.docker.io/v1/": {"auth": "c29tZS11c2VyOnNvbWUtcGFzc3dvcmQ=", "email": "x@example.com"}
+				}`)
+			})
+
+			It("loads the credentials", func() {
+				keychain, err := LoadKeychain(configPath)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(keychain).Should(Equal(Keychain{
+					"index.docker.io": {Username: "some-user", Password: "some-password"},
+				}))
+			})
+		})
+
+		Context("when an auth entry is malformed", func() {
+			BeforeEach(func() {
+				writeConfig(`{"auths": {"localhost:5000": {"auth": "bm9jb2xvbg=="}}}`)
+			})
+
+			It("returns an error", func() {
+				_, err := LoadKeychain(configPath)
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+
+		Context("when the file does not exist", func() {
+			It("returns an error", func() {
+				_, err := LoadKeychain(path.Join(path.Dir(configPath), "bogus"))
+				Ω(err).Should(HaveOccurred())
+			})
+		})
+	})
+
+	Describe("Lookup", func() {
+		keychain := Keychain{
+			"index.docker.io": {Username: "hub-user"},
+			"localhost:5000":  {Username: "local-user"},
+		}
+
+		It("looks up credentials by host or URL", func() {
+			credentials, found := keychain.Lookup("http://localhost:5000/v1/")
+			Ω(found).Should(BeTrue())
+			Ω(credentials.Username).Should(Equal("local-user"))
+
+			credentials, found = keychain.Lookup("localhost:5000")
+			Ω(found).Should(BeTrue())
+			Ω(credentials.Username).Should(Equal("local-user"))
+		})
+
+		It("applies the official index's credentials to its v2 registry", func() {
+			credentials, found := keychain.Lookup("https://registry-1.docker.io")
+			Ω(found).Should(BeTrue())
+			Ω(credentials.Username).Should(Equal("hub-user"))
+		})
+
+		It("returns false for unknown registries", func() {
+			_, found := keychain.Lookup("https://registry.example.com")
+			Ω(found).Should(BeFalse())
+		})
+	})
+})
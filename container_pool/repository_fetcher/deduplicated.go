@@ -0,0 +1,74 @@
+package repository_fetcher
+
+import "sync"
+
+// Deduplicated coalesces concurrent fetches of the same repository and tag,
+// so that a burst of containers created from one image pulls it only once.
+// Everyone waiting on a fetch gets its result, or its error, and its
+// progress.
+type Deduplicated struct {
+	RepositoryFetcher
+
+	fetches *inflight
+
+	broadcasts      map[string]*progressBroadcast
+	broadcastsMutex *sync.Mutex
+}
+
+func NewDeduplicated(fetcher RepositoryFetcher) *Deduplicated {
+	return &Deduplicated{
+		RepositoryFetcher: fetcher,
+
+		fetches: newInflight(),
+
+		broadcasts:      make(map[string]*progressBroadcast),
+		broadcastsMutex: new(sync.Mutex),
+	}
+}
+
+func (deduplicated *Deduplicated) Fetch(repoName string, tag string) (*Image, error) {
+	return deduplicated.FetchWithProgress(repoName, tag, nil)
+}
+
+func (deduplicated *Deduplicated) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	key := repoName + ":" + tag
+
+	broadcast := deduplicated.joinBroadcast(key, progress)
+
+	result, err := deduplicated.fetches.do(key, func() (interface{}, error) {
+		defer deduplicated.endBroadcast(key, broadcast)
+
+		return fetchWithProgress(deduplicated.RepositoryFetcher, repoName, tag, broadcast)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.(*Image), nil
+}
+
+func (deduplicated *Deduplicated) joinBroadcast(key string, progress ProgressReporter) *progressBroadcast {
+	deduplicated.broadcastsMutex.Lock()
+	defer deduplicated.broadcastsMutex.Unlock()
+
+	broadcast, found := deduplicated.broadcasts[key]
+	if !found {
+		broadcast = newProgressBroadcast()
+		deduplicated.broadcasts[key] = broadcast
+	}
+
+	if progress != nil {
+		broadcast.join(progress)
+	}
+
+	return broadcast
+}
+
+func (deduplicated *Deduplicated) endBroadcast(key string, broadcast *progressBroadcast) {
+	deduplicated.broadcastsMutex.Lock()
+	defer deduplicated.broadcastsMutex.Unlock()
+
+	if deduplicated.broadcasts[key] == broadcast {
+		delete(deduplicated.broadcasts, key)
+	}
+}
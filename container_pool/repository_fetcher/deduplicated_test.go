@@ -0,0 +1,145 @@
+package repository_fetcher_test
+
+import (
+	"errors"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+)
+
+var _ = Describe("Deduplicated", func() {
+	var wrapped *fake_repository_fetcher.FakeRepositoryFetcher
+	var fetcher RepositoryFetcher
+
+	var fetching chan struct{}
+	var release chan struct{}
+
+	BeforeEach(func() {
+		fetching = make(chan struct{}, 10)
+		release = make(chan struct{})
+
+		wrapped = fake_repository_fetcher.New()
+		wrapped.FetchResult = "some-image-id"
+		wrapped.WhenFetching = func(string, string) {
+			fetching <- struct{}{}
+			<-release
+		}
+
+		fetcher = NewDeduplicated(wrapped)
+	})
+
+	fetchConcurrently := func(repoName string, tag string, count int) ([]*Image, []error) {
+		images := make([]*Image, count)
+		errs := make([]error, count)
+
+		wg := new(sync.WaitGroup)
+
+		for i := 0; i < count; i++ {
+			wg.Add(1)
+
+			go func(i int) {
+				defer wg.Done()
+				images[i], errs[i] = fetcher.Fetch(repoName, tag)
+			}(i)
+		}
+
+		Eventually(fetching).Should(Receive())
+		close(release)
+
+		wg.Wait()
+
+		return images, errs
+	}
+
+	It("fetches the same repository and tag only once at a time", func() {
+		images, errs := fetchConcurrently("some-repo", "some-tag", 5)
+
+		for i := range images {
+			Ω(errs[i]).ShouldNot(HaveOccurred())
+			Ω(images[i].ID).Should(Equal("some-image-id"))
+		}
+
+		Ω(len(wrapped.Fetched())).Should(BeNumerically("<", 5))
+	})
+
+	It("fetches again once the previous fetch has completed", func() {
+		close(release)
+
+		_, err := fetcher.Fetch("some-repo", "some-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = fetcher.Fetch("some-repo", "some-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(wrapped.Fetched()).Should(HaveLen(2))
+	})
+
+	It("fetches different tags independently", func() {
+		close(release)
+
+		_, err := fetcher.Fetch("some-repo", "some-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = fetcher.Fetch("some-repo", "some-other-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(wrapped.Fetched()).Should(Equal([]fake_repository_fetcher.FetchSpec{
+			{Repository: "some-repo", Tag: "some-tag"},
+			{Repository: "some-repo", Tag: "some-other-tag"},
+		}))
+	})
+
+	It("shares the fetch's progress with everyone waiting on it", func() {
+		wrapped.FetchProgress = []LayerProgress{
+			{LayerID: "some-layer", Cached: true, Complete: true},
+			{LayerID: "some-other-layer", Current: 1, Total: 2},
+		}
+
+		progresses := make([]*PullProgress, 5)
+
+		wg := new(sync.WaitGroup)
+
+		for i := range progresses {
+			progresses[i] = NewPullProgress()
+
+			wg.Add(1)
+
+			go func(progress *PullProgress) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				_, err := fetcher.(ProgressFetcher).FetchWithProgress("some-repo", "some-tag", progress)
+				Ω(err).ShouldNot(HaveOccurred())
+			}(progresses[i])
+		}
+
+		Eventually(fetching).Should(Receive())
+		close(release)
+
+		wg.Wait()
+
+		for _, progress := range progresses {
+			Ω(progress.Layers()).Should(Equal(wrapped.FetchProgress))
+		}
+	})
+
+	Context("when the fetch fails", func() {
+		disaster := errors.New("oh no!")
+
+		BeforeEach(func() {
+			wrapped.FetchError = disaster
+		})
+
+		It("returns its error to everyone waiting on it", func() {
+			_, errs := fetchConcurrently("some-repo", "some-tag", 5)
+
+			for _, err := range errs {
+				Ω(err).Should(Equal(disaster))
+			}
+		})
+	})
+})
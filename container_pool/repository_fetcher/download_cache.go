@@ -0,0 +1,452 @@
+package repository_fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// resumeAttempts bounds how many times a download is resumed after being cut
+// off part way, before the fetch fails; the partial download is kept for the
+// next fetch to resume.
+const resumeAttempts = 5
+
+// partialDownloadTTL is how long a partial download is kept without being
+// resumed.
+const partialDownloadTTL = 7 * 24 * time.Hour
+
+const downloadIndexFile = "index.json"
+
+// DownloadCache spools layer downloads to disk. When a download is cut off,
+// what was downloaded so far is kept, and the download resumes from where it
+// stopped with an HTTP range request, rather than starting over.
+//
+// An index of the partial downloads records the validator (ETag or
+// Last-Modified) of what each was downloading, so that the registry only
+// sends the rest of it if it hasn't changed, and the whole of it otherwise.
+type DownloadCache struct {
+	dir string
+
+	// limits the layers downloaded at once, and their bandwidth
+	throttle *Throttle
+
+	index      map[string]partialDownload
+	indexMutex *sync.Mutex
+
+	// downloads in flight, by key; a key is only downloaded by one fetch at
+	// a time
+	inflight      map[string]chan struct{}
+	inflightMutex *sync.Mutex
+}
+
+type partialDownload struct {
+	Validator string    `json:"validator,omitempty"`
+	Total     int64     `json:"total,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// rangeRequester requests a download from the given offset, sending the
+// validator of what was downloaded so far, if known, as If-Range. It returns
+// the response if its status is 200, 206, or 416.
+type rangeRequester func(offset int64, validator string) (*http.Response, error)
+
+// NewDownloadCache constructs a cache in the given directory, resuming the
+// partial downloads left there. Partial downloads missing from the index, or
+// not resumed for partialDownloadTTL, are removed.
+//
+// Downloads are limited by the throttle, which may be nil for no limits.
+func NewDownloadCache(dir string, throttle *Throttle) (*DownloadCache, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	cache := &DownloadCache{
+		dir: dir,
+
+		throttle: throttle,
+
+		index:      make(map[string]partialDownload),
+		indexMutex: new(sync.Mutex),
+
+		inflight:      make(map[string]chan struct{}),
+		inflightMutex: new(sync.Mutex),
+	}
+
+	indexJSON, err := ioutil.ReadFile(filepath.Join(dir, downloadIndexFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if err == nil {
+		err := json.Unmarshal(indexJSON, &cache.index)
+		if err != nil {
+			log.Println("discarding partial downloads with unreadable index:", err)
+			cache.index = make(map[string]partialDownload)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	partials := map[string]bool{}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if name == downloadIndexFile {
+			continue
+		}
+
+		key := strings.TrimSuffix(name, ".partial")
+
+		partial, found := cache.index[key]
+
+		if name == key || !found || time.Since(partial.UpdatedAt) > partialDownloadTTL {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+
+		partials[key] = true
+	}
+
+	for key := range cache.index {
+		if !partials[key] {
+			delete(cache.index, key)
+		}
+	}
+
+	err = cache.saveIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	return cache, nil
+}
+
+// download spools the download named by the key, resuming a partial
+// download of it if there is one. It returns the complete download, rewound,
+// which the caller removes once done with it.
+func (cache *DownloadCache) download(key string, request rangeRequester, download *progressReader) (*os.File, error) {
+	key = strings.Replace(key, ":", "-", -1)
+
+	cache.acquire(key)
+	defer cache.release(key)
+
+	// only take a turn once no one else is downloading the same thing, so
+	// that waiting for them doesn't hold up anyone else
+	cache.throttle.acquireLayer()
+	defer cache.throttle.releaseLayer()
+
+	file, err := os.OpenFile(cache.partialPath(key), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	for attempt := 1; ; attempt++ {
+		err = cache.resume(key, file, request, download)
+		if err == nil {
+			break
+		}
+
+		// failed requests are left to the caller to retry; only a download cut
+		// off part way is resumed here
+		cutOff, isCutOff := err.(cutOffError)
+		if !isCutOff {
+			return nil, err
+		}
+
+		if attempt >= resumeAttempts {
+			return nil, cutOff.err
+		}
+
+		log.Println("download of", key, "cut off after", download.layer.Current, "bytes; resuming:", cutOff.err)
+	}
+
+	cache.forget(key)
+
+	// move it out of the way of the next download of the same key, which may
+	// start before the caller is done with this one
+	complete, err := ioutil.TempFile(cache.dir, key+"-")
+	if err != nil {
+		return nil, err
+	}
+
+	complete.Close()
+
+	err = os.Rename(file.Name(), complete.Name())
+	if err != nil {
+		os.Remove(complete.Name())
+		return nil, err
+	}
+
+	return os.Open(complete.Name())
+}
+
+// resume downloads the rest of the partial download, appending to it.
+func (cache *DownloadCache) resume(key string, file *os.File, request rangeRequester, download *progressReader) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	offset := info.Size()
+
+	partial := cache.partial(key)
+
+	response, err := request(offset, partial.Validator)
+	if err != nil {
+		return err
+	}
+
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+
+		if start != offset {
+			// start over
+			file.Truncate(0)
+			return cutOffError{fmt.Errorf("requested %s from byte %d, but got it from byte %d", key, offset, start)}
+		}
+
+		if total > 0 {
+			partial.Total = total
+		}
+
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial download may already be complete
+		_, total, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err == nil && offset > 0 && total == offset {
+			download.layer.Current = offset
+			return nil
+		}
+
+		// start over
+		file.Truncate(0)
+		return cutOffError{fmt.Errorf("cannot resume %s from byte %d", key, offset)}
+
+	default:
+		// the server sent all of it, either because it can't send a range, or
+		// because what was partially downloaded has changed
+		if offset > 0 {
+			log.Println("restarting download of", key)
+
+			err := file.Truncate(0)
+			if err != nil {
+				return err
+			}
+
+			offset = 0
+		}
+
+		partial = partialDownload{Validator: validator(response)}
+
+		if response.ContentLength > 0 {
+			partial.Total = response.ContentLength
+		}
+	}
+
+	err = cache.record(key, partial)
+	if err != nil {
+		return err
+	}
+
+	download.Reader = cache.throttle.reader(response.Body)
+	download.layer.Current = offset
+
+	if download.layer.Total == 0 {
+		download.layer.Total = partial.Total
+	}
+
+	download.progress.ReportLayer(download.layer)
+
+	_, err = io.Copy(file, download)
+	if err != nil {
+		return cutOffError{err}
+	}
+
+	if partial.Total > 0 && download.layer.Current < partial.Total {
+		return cutOffError{io.ErrUnexpectedEOF}
+	}
+
+	return nil
+}
+
+// cutOffError is returned when a download stops part way through its body, or
+// can't be resumed where it stopped, and is worth resuming or restarting
+// straight away.
+type cutOffError struct {
+	err error
+}
+
+func (err cutOffError) Error() string {
+	return err.err.Error()
+}
+
+func (cache *DownloadCache) partialPath(key string) string {
+	return filepath.Join(cache.dir, key+".partial")
+}
+
+func (cache *DownloadCache) acquire(key string) {
+	for {
+		cache.inflightMutex.Lock()
+
+		done, busy := cache.inflight[key]
+		if !busy {
+			cache.inflight[key] = make(chan struct{})
+			cache.inflightMutex.Unlock()
+			return
+		}
+
+		cache.inflightMutex.Unlock()
+
+		<-done
+	}
+}
+
+func (cache *DownloadCache) release(key string) {
+	cache.inflightMutex.Lock()
+	defer cache.inflightMutex.Unlock()
+
+	close(cache.inflight[key])
+	delete(cache.inflight, key)
+}
+
+func (cache *DownloadCache) partial(key string) partialDownload {
+	cache.indexMutex.Lock()
+	defer cache.indexMutex.Unlock()
+
+	return cache.index[key]
+}
+
+func (cache *DownloadCache) record(key string, partial partialDownload) error {
+	cache.indexMutex.Lock()
+	defer cache.indexMutex.Unlock()
+
+	partial.UpdatedAt = time.Now()
+
+	cache.index[key] = partial
+
+	return cache.saveIndex()
+}
+
+func (cache *DownloadCache) forget(key string) {
+	cache.indexMutex.Lock()
+	defer cache.indexMutex.Unlock()
+
+	delete(cache.index, key)
+
+	err := cache.saveIndex()
+	if err != nil {
+		log.Println("failed to save download index:", err)
+	}
+}
+
+// saveIndex writes the index to a temporary file and moves it into place, so
+// that it is never left half-written.
+func (cache *DownloadCache) saveIndex() error {
+	indexJSON, err := json.Marshal(cache.index)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(cache.dir, downloadIndexFile+"-")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(indexJSON)
+
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), filepath.Join(cache.dir, downloadIndexFile))
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+
+	return err
+}
+
+// validator identifies what the response is of, for resuming it with
+// If-Range.
+func validator(response *http.Response) string {
+	etag := response.Header.Get("ETag")
+
+	// a weak ETag can't be used to resume
+	if etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+
+	return response.Header.Get("Last-Modified")
+}
+
+// setRange asks for the response from the offset, if the offset is past the
+// start, and only if it still matches the validator, if there is one.
+func setRange(request *http.Request, offset int64, validator string) {
+	if offset == 0 {
+		return
+	}
+
+	request.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+
+	if validator != "" {
+		request.Header.Set("If-Range", validator)
+	}
+}
+
+// parseContentRange parses "bytes <start>-<end>/<total>", or
+// "bytes */<total>"; the total is 0 if it's "*".
+func parseContentRange(contentRange string) (int64, int64, error) {
+	malformed := fmt.Errorf("malformed Content-Range: %q", contentRange)
+
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, malformed
+	}
+
+	segs := strings.SplitN(contentRange[len("bytes "):], "/", 2)
+	if len(segs) != 2 {
+		return 0, 0, malformed
+	}
+
+	var start, total int64
+	var err error
+
+	if segs[0] != "*" {
+		start, err = strconv.ParseInt(strings.SplitN(segs[0], "-", 2)[0], 10, 64)
+		if err != nil {
+			return 0, 0, malformed
+		}
+	}
+
+	if segs[1] != "*" {
+		total, err = strconv.ParseInt(segs[1], 10, 64)
+		if err != nil {
+			return 0, 0, malformed
+		}
+	}
+
+	return start, total, nil
+}
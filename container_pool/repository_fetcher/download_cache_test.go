@@ -0,0 +1,391 @@
+package repository_fetcher_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/fake_graph"
+)
+
+// cutOffWriter writes only so many bytes of a response, after which the
+// handler cuts the connection.
+type cutOffWriter struct {
+	http.ResponseWriter
+
+	remaining int
+}
+
+func (w *cutOffWriter) Write(data []byte) (int, error) {
+	if len(data) > w.remaining {
+		data = data[:w.remaining]
+	}
+
+	n, err := w.ResponseWriter.Write(data)
+	w.remaining -= n
+
+	if err == nil && w.remaining == 0 {
+		err = fmt.Errorf("cut off")
+	}
+
+	return n, err
+}
+
+var _ = Describe("DownloadCache", func() {
+	var graph *fake_graph.FakeGraph
+	var fetcher RepositoryFetcher
+
+	var server *httptest.Server
+
+	var downloadsDir string
+	var downloads *DownloadCache
+
+	var blobData string
+	var blobDigest string
+
+	// each response to a blob request is cut off after this many bytes, if
+	// it's more than 0
+	var cutAfter int
+	var etag string
+
+	var requestedRanges []string
+	var requestedIfRanges []string
+	var requestsMutex *sync.Mutex
+
+	var registeredLayers []string
+
+	ranges := func() []string {
+		requestsMutex.Lock()
+		defer requestsMutex.Unlock()
+
+		return append([]string{}, requestedRanges...)
+	}
+
+	BeforeEach(func() {
+		graph = fake_graph.New()
+
+		blobData = strings.Repeat("some-layer-data-", 1024)
+
+		sum := sha256.Sum256([]byte(blobData))
+		blobDigest = "sha256:" + hex.EncodeToString(sum[:])
+
+		cutAfter = 4096
+		etag = `"some-etag"`
+
+		requestedRanges = []string{}
+		requestedIfRanges = []string{}
+		requestsMutex = new(sync.Mutex)
+
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if strings.Contains(req.URL.Path, "/manifests/") {
+				fmt.Fprintf(w, `{
+					"schemaVersion": 1,
+					"fsLayers": [{"blobSum": "%s"}],
+					"history": [{"v1Compatibility": "{\"id\":\"layer-1\"}"}]
+				}`, blobDigest)
+				return
+			}
+
+			requestsMutex.Lock()
+			requestedRanges = append(requestedRanges, req.Header.Get("Range"))
+			requestedIfRanges = append(requestedIfRanges, req.Header.Get("If-Range"))
+			requestsMutex.Unlock()
+
+			w.Header().Set("ETag", etag)
+
+			if cutAfter == 0 {
+				http.ServeContent(w, req, "", time.Time{}, strings.NewReader(blobData))
+				return
+			}
+
+			http.ServeContent(&cutOffWriter{w, cutAfter}, req, "", time.Time{}, strings.NewReader(blobData))
+
+			w.(http.Flusher).Flush()
+
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		}))
+
+		var err error
+
+		downloadsDir, err = ioutil.TempDir("", "downloads")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		downloads, err = NewDownloadCache(downloadsDir, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		registeredLayers = []string{}
+
+		graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, img *image.Image) error {
+			layerData, err := ioutil.ReadAll(layer)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			registeredLayers = append(registeredLayers, string(layerData))
+
+			return nil
+		}
+	})
+
+	JustBeforeEach(func() {
+		fetcher = NewV2(server.URL, Credentials{}, graph, downloads)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(downloadsDir)
+	})
+
+	partialFiles := func() []string {
+		entries, err := ioutil.ReadDir(downloadsDir)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		names := []string{}
+		for _, entry := range entries {
+			if strings.HasSuffix(entry.Name(), ".partial") {
+				names = append(names, entry.Name())
+			}
+		}
+
+		return names
+	}
+
+	Context("when the download is cut off", func() {
+		It("resumes it from where it stopped", func() {
+			_, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(ranges()).Should(Equal([]string{
+				"",
+				"bytes=4096-",
+				"bytes=8192-",
+				"bytes=12288-",
+			}))
+
+			Ω(requestedIfRanges[1:]).Should(Equal([]string{etag, etag, etag}))
+
+			Ω(registeredLayers).Should(Equal([]string{blobData}))
+		})
+
+		It("reports the progress of the whole download", func() {
+			progress := NewPullProgress()
+
+			_, err := fetcher.(ProgressFetcher).FetchWithProgress("some-repo", "some-tag", progress)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(progress.Layers()).Should(Equal([]LayerProgress{
+				{LayerID: "layer-1", Current: int64(len(blobData)), Total: int64(len(blobData)), Complete: true},
+			}))
+		})
+
+		It("leaves nothing behind once it's complete", func() {
+			_, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			entries, err := ioutil.ReadDir(downloadsDir)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(entries).Should(HaveLen(1))
+			Ω(entries[0].Name()).Should(Equal("index.json"))
+
+			index, err := ioutil.ReadFile(path.Join(downloadsDir, "index.json"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(index)).Should(Equal("{}"))
+		})
+
+		Context("and what was downloaded changes before it's resumed", func() {
+			BeforeEach(func() {
+				cutAfter = 1024
+			})
+
+			It("downloads it from the start", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(HaveOccurred())
+
+				cutAfter = 0
+				etag = `"some-other-etag"`
+
+				_, err = fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(ranges()[5]).Should(Equal("bytes=5120-"))
+				Ω(requestedIfRanges[5]).Should(Equal(`"some-etag"`))
+
+				Ω(registeredLayers).Should(Equal([]string{blobData}))
+			})
+		})
+
+		Context("more times than it's resumed", func() {
+			BeforeEach(func() {
+				cutAfter = 1024
+			})
+
+			It("fails, keeping what was downloaded", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(HaveOccurred())
+
+				Ω(ranges()).Should(HaveLen(5))
+
+				Ω(partialFiles()).Should(HaveLen(1))
+
+				partial, err := ioutil.ReadFile(path.Join(downloadsDir, partialFiles()[0]))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(partial)).Should(Equal(blobData[:5120]))
+			})
+
+			It("resumes it on the next fetch", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(HaveOccurred())
+
+				cutAfter = 0
+
+				_, err = fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(ranges()[5]).Should(Equal("bytes=5120-"))
+				Ω(requestedIfRanges[5]).Should(Equal(etag))
+
+				Ω(registeredLayers).Should(Equal([]string{blobData}))
+			})
+
+			It("resumes it after the cache is reloaded", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(HaveOccurred())
+
+				downloads, err = NewDownloadCache(downloadsDir, nil)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				cutAfter = 0
+
+				_, err = NewV2(server.URL, Credentials{}, graph, downloads).Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(ranges()[5]).Should(Equal("bytes=5120-"))
+
+				Ω(registeredLayers).Should(Equal([]string{blobData}))
+			})
+		})
+	})
+
+	Context("when the server does not support ranges", func() {
+		BeforeEach(func() {
+			cutAfter = 0
+
+			server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if strings.Contains(req.URL.Path, "/manifests/") {
+					fmt.Fprintf(w, `{
+						"schemaVersion": 1,
+						"fsLayers": [{"blobSum": "%s"}],
+						"history": [{"v1Compatibility": "{\"id\":\"layer-1\"}"}]
+					}`, blobDigest)
+					return
+				}
+
+				requestsMutex.Lock()
+				requestedRanges = append(requestedRanges, req.Header.Get("Range"))
+				requestsMutex.Unlock()
+
+				w.Write([]byte(blobData))
+			})
+
+			Ω(ioutil.WriteFile(
+				path.Join(downloadsDir, strings.Replace(blobDigest, ":", "-", -1)+".partial"),
+				[]byte(blobData[:100]),
+				0600,
+			)).ShouldNot(HaveOccurred())
+
+			Ω(ioutil.WriteFile(
+				path.Join(downloadsDir, "index.json"),
+				[]byte(fmt.Sprintf(`{%q:{"updated_at":%q}}`, strings.Replace(blobDigest, ":", "-", -1), time.Now().Format(time.RFC3339))),
+				0600,
+			)).ShouldNot(HaveOccurred())
+
+			var err error
+			downloads, err = NewDownloadCache(downloadsDir, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		It("downloads it from the start", func() {
+			_, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(ranges()).Should(Equal([]string{"bytes=100-"}))
+
+			Ω(registeredLayers).Should(Equal([]string{blobData}))
+		})
+	})
+
+	Describe("NewDownloadCache", func() {
+		write := func(name string, contents string) {
+			Ω(ioutil.WriteFile(path.Join(downloadsDir, name), []byte(contents), 0600)).ShouldNot(HaveOccurred())
+		}
+
+		exists := func(name string) bool {
+			_, err := os.Stat(path.Join(downloadsDir, name))
+			return err == nil
+		}
+
+		BeforeEach(func() {
+			write("index.json", fmt.Sprintf(
+				`{"fresh":{"updated_at":%q},"stale":{"updated_at":%q},"missing":{"updated_at":%q}}`,
+				time.Now().Format(time.RFC3339),
+				time.Now().Add(-30*24*time.Hour).Format(time.RFC3339),
+				time.Now().Format(time.RFC3339),
+			))
+
+			write("fresh.partial", "some-data")
+			write("stale.partial", "some-data")
+			write("unindexed.partial", "some-data")
+			write("fresh-123456", "a download that was complete")
+		})
+
+		It("keeps only the partial downloads that can be resumed", func() {
+			_, err := NewDownloadCache(downloadsDir, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(exists("fresh.partial")).Should(BeTrue())
+			Ω(exists("stale.partial")).Should(BeFalse())
+			Ω(exists("unindexed.partial")).Should(BeFalse())
+			Ω(exists("fresh-123456")).Should(BeFalse())
+
+			index, err := ioutil.ReadFile(path.Join(downloadsDir, "index.json"))
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(string(index)).Should(ContainSubstring(`"fresh"`))
+			Ω(string(index)).ShouldNot(ContainSubstring(`"stale"`))
+			Ω(string(index)).ShouldNot(ContainSubstring(`"missing"`))
+		})
+
+		Context("when the index can't be read", func() {
+			BeforeEach(func() {
+				write("index.json", "{")
+			})
+
+			It("discards the partial downloads", func() {
+				_, err := NewDownloadCache(downloadsDir, nil)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(exists("fresh.partial")).Should(BeFalse())
+
+				index, err := ioutil.ReadFile(path.Join(downloadsDir, "index.json"))
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(bytes.TrimSpace(index)).Should(Equal([]byte("{}")))
+			})
+		})
+	})
+})
@@ -1,18 +1,31 @@
 package fake_repository_fetcher
 
-import "sync"
+import (
+	"sync"
+
+	"github.com/dotcloud/docker/runconfig"
+
+	"github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
 
 type FakeRepositoryFetcher struct {
 	fetched     []FetchSpec
 	FetchResult string
+	FetchConfig *runconfig.Config
 	FetchError  error
 
+	// reported to the fetch's progress, if any, before it returns
+	FetchProgress []repository_fetcher.LayerProgress
+
+	WhenFetching func(repoName string, tag string)
+
 	mutex *sync.RWMutex
 }
 
 type FetchSpec struct {
 	Repository string
 	Tag        string
+	Policy     repository_fetcher.PullPolicy
 }
 
 func New() *FakeRepositoryFetcher {
@@ -21,16 +34,45 @@ func New() *FakeRepositoryFetcher {
 	}
 }
 
-func (fetcher *FakeRepositoryFetcher) Fetch(repoName string, tag string) (string, error) {
+func (fetcher *FakeRepositoryFetcher) Fetch(repoName string, tag string) (*repository_fetcher.Image, error) {
+	return fetcher.FetchWithPolicy(repoName, tag, "", nil)
+}
+
+func (fetcher *FakeRepositoryFetcher) FetchWithProgress(repoName string, tag string, progress repository_fetcher.ProgressReporter) (*repository_fetcher.Image, error) {
+	return fetcher.FetchWithPolicy(repoName, tag, "", progress)
+}
+
+func (fetcher *FakeRepositoryFetcher) FetchWithPolicy(repoName string, tag string, policy repository_fetcher.PullPolicy, progress repository_fetcher.ProgressReporter) (*repository_fetcher.Image, error) {
+	if progress != nil {
+		for _, layer := range fetcher.FetchProgress {
+			progress.ReportLayer(layer)
+		}
+	}
+
+	if fetcher.WhenFetching != nil {
+		fetcher.WhenFetching(repoName, tag)
+	}
+
 	if fetcher.FetchError != nil {
-		return "", fetcher.FetchError
+		return nil, fetcher.FetchError
 	}
 
 	fetcher.mutex.Lock()
-	fetcher.fetched = append(fetcher.fetched, FetchSpec{repoName, tag})
+	fetcher.fetched = append(fetcher.fetched, FetchSpec{repoName, tag, policy})
+	result := fetcher.FetchResult
 	fetcher.mutex.Unlock()
 
-	return fetcher.FetchResult, nil
+	return &repository_fetcher.Image{
+		ID:     result,
+		Config: fetcher.FetchConfig,
+	}, nil
+}
+
+// SetFetchResult changes the result while fetches may be in flight.
+func (fetcher *FakeRepositoryFetcher) SetFetchResult(imageID string) {
+	fetcher.mutex.Lock()
+	fetcher.FetchResult = imageID
+	fetcher.mutex.Unlock()
 }
 
 func (fetcher *FakeRepositoryFetcher) Fetched() []FetchSpec {
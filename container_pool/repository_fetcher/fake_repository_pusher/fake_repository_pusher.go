@@ -0,0 +1,41 @@
+package fake_repository_pusher
+
+import "sync"
+
+type FakeRepositoryPusher struct {
+	pushed    []PushSpec
+	PushError error
+
+	mutex *sync.RWMutex
+}
+
+type PushSpec struct {
+	Repository string
+	Tag        string
+	ImageID    string
+}
+
+func New() *FakeRepositoryPusher {
+	return &FakeRepositoryPusher{
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (pusher *FakeRepositoryPusher) Push(repoName string, tag string, imageID string) error {
+	if pusher.PushError != nil {
+		return pusher.PushError
+	}
+
+	pusher.mutex.Lock()
+	pusher.pushed = append(pusher.pushed, PushSpec{repoName, tag, imageID})
+	pusher.mutex.Unlock()
+
+	return nil
+}
+
+func (pusher *FakeRepositoryPusher) Pushed() []PushSpec {
+	pusher.mutex.RLock()
+	defer pusher.mutex.RUnlock()
+
+	return pusher.pushed
+}
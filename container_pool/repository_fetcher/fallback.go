@@ -0,0 +1,51 @@
+package repository_fetcher
+
+import "log"
+
+// Fallback fetches with Primary, falling back to Secondary only if Primary
+// cannot speak to the registry at all, e.g. to fall back to the v1 protocol
+// for registries that do not speak v2. Any other error from Primary, such as
+// an unknown tag or a checksum mismatch, is returned as it is.
+type Fallback struct {
+	Primary   RepositoryFetcher
+	Secondary RepositoryFetcher
+}
+
+func (fallback Fallback) Fetch(repoName string, tag string) (*Image, error) {
+	return fallback.FetchWithProgress(repoName, tag, nil)
+}
+
+func (fallback Fallback) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	img, err := fetchWithProgress(fallback.Primary, repoName, tag, progress)
+	if !isUnsupported(err) {
+		return img, err
+	}
+
+	log.Println("primary fetch unsupported; falling back:", err)
+
+	return fetchWithProgress(fallback.Secondary, repoName, tag, progress)
+}
+
+// isUnsupported is true if the error means the registry does not support the
+// protocol, rather than that the fetch failed.
+func isUnsupported(err error) bool {
+	return err == ErrV2Unsupported || err == ErrUnsupportedManifest
+}
+
+// PushFallback pushes with Primary, falling back to Secondary only if the
+// registry does not support Primary's protocol, as Fallback does for fetches.
+type PushFallback struct {
+	Primary   RepositoryPusher
+	Secondary RepositoryPusher
+}
+
+func (fallback PushFallback) Push(repoName string, tag string, imageID string) error {
+	err := fallback.Primary.Push(repoName, tag, imageID)
+	if !isUnsupported(err) {
+		return err
+	}
+
+	log.Println("primary push unsupported; falling back:", err)
+
+	return fallback.Secondary.Push(repoName, tag, imageID)
+}
@@ -0,0 +1,147 @@
+package repository_fetcher_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_pusher"
+)
+
+var _ = Describe("Fallback", func() {
+	var primary *fake_repository_fetcher.FakeRepositoryFetcher
+	var secondary *fake_repository_fetcher.FakeRepositoryFetcher
+	var fetcher RepositoryFetcher
+
+	BeforeEach(func() {
+		primary = fake_repository_fetcher.New()
+		primary.FetchResult = "primary-image-id"
+
+		secondary = fake_repository_fetcher.New()
+		secondary.FetchResult = "secondary-image-id"
+
+		fetcher = Fallback{Primary: primary, Secondary: secondary}
+	})
+
+	It("fetches with the primary fetcher", func() {
+		img, err := fetcher.Fetch("some-repo", "some-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(img.ID).Should(Equal("primary-image-id"))
+		Ω(secondary.Fetched()).Should(BeEmpty())
+	})
+
+	Context("when the registry does not support the primary fetcher's protocol", func() {
+		BeforeEach(func() {
+			primary.FetchError = ErrV2Unsupported
+		})
+
+		It("fetches with the secondary fetcher", func() {
+			img, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(img.ID).Should(Equal("secondary-image-id"))
+			Ω(secondary.Fetched()).Should(Equal([]fake_repository_fetcher.FetchSpec{
+				{Repository: "some-repo", Tag: "some-tag"},
+			}))
+		})
+
+		Context("and the secondary fetcher fails too", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				secondary.FetchError = disaster
+			})
+
+			It("returns its error", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+	})
+
+	Context("when the registry serves a manifest the primary fetcher does not support", func() {
+		BeforeEach(func() {
+			primary.FetchError = ErrUnsupportedManifest
+		})
+
+		It("fetches with the secondary fetcher", func() {
+			img, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(img.ID).Should(Equal("secondary-image-id"))
+		})
+	})
+
+	Context("when the primary fetcher fails", func() {
+		disaster := UnexpectedStatusError{URL: "some-url", StatusCode: 401}
+
+		BeforeEach(func() {
+			primary.FetchError = disaster
+		})
+
+		It("returns its error without falling back", func() {
+			_, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).Should(Equal(disaster))
+
+			Ω(secondary.Fetched()).Should(BeEmpty())
+		})
+	})
+})
+
+var _ = Describe("PushFallback", func() {
+	var primary *fake_repository_pusher.FakeRepositoryPusher
+	var secondary *fake_repository_pusher.FakeRepositoryPusher
+	var pusher RepositoryPusher
+
+	BeforeEach(func() {
+		primary = fake_repository_pusher.New()
+		secondary = fake_repository_pusher.New()
+
+		pusher = PushFallback{Primary: primary, Secondary: secondary}
+	})
+
+	It("pushes with the primary pusher", func() {
+		err := pusher.Push("some-repo", "some-tag", "some-image-id")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(primary.Pushed()).Should(Equal([]fake_repository_pusher.PushSpec{
+			{Repository: "some-repo", Tag: "some-tag", ImageID: "some-image-id"},
+		}))
+
+		Ω(secondary.Pushed()).Should(BeEmpty())
+	})
+
+	Context("when the registry does not support the primary pusher's protocol", func() {
+		BeforeEach(func() {
+			primary.PushError = ErrV2Unsupported
+		})
+
+		It("pushes with the secondary pusher", func() {
+			err := pusher.Push("some-repo", "some-tag", "some-image-id")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(secondary.Pushed()).Should(Equal([]fake_repository_pusher.PushSpec{
+				{Repository: "some-repo", Tag: "some-tag", ImageID: "some-image-id"},
+			}))
+		})
+	})
+
+	Context("when the primary pusher fails", func() {
+		disaster := UnexpectedStatusError{URL: "some-url", StatusCode: 401}
+
+		BeforeEach(func() {
+			primary.PushError = disaster
+		})
+
+		It("returns its error without falling back", func() {
+			err := pusher.Push("some-repo", "some-tag", "some-image-id")
+			Ω(err).Should(Equal(disaster))
+
+			Ω(secondary.Pushed()).Should(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,188 @@
+package repository_fetcher
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/dotcloud/docker/image"
+)
+
+// Importer registers images from tarballs in the format written by `docker
+// save`, so that hosts without access to a registry can still create
+// containers from images. A tarball contains a directory per layer, holding
+// its json and layer.tar, and a repositories file mapping tags to layers.
+type Importer struct {
+	graph Graph
+	tags  TagStore
+}
+
+func NewImporter(graph Graph, tags TagStore) *Importer {
+	return &Importer{
+		graph: graph,
+		tags:  tags,
+	}
+}
+
+func (importer *Importer) Import(tarball io.Reader) error {
+	dir, err := ioutil.TempDir("", "import")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(dir)
+
+	err = untar(tarball, dir)
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		err := importer.register(dir, entry.Name())
+		if err != nil {
+			return err
+		}
+	}
+
+	return importer.tag(dir)
+}
+
+// register registers the layer, after registering its parents.
+func (importer *Importer) register(dir string, id string) error {
+	if importer.graph.Exists(id) {
+		return nil
+	}
+
+	imgJSON, err := ioutil.ReadFile(filepath.Join(dir, id, "json"))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("layer not found in graph or tarball: %s", id)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	img, err := image.NewImgJSON(imgJSON)
+	if err != nil {
+		return err
+	}
+
+	if img.ID != id {
+		return fmt.Errorf("layer %s has mismatched id: %s", id, img.ID)
+	}
+
+	if img.Parent != "" {
+		err := importer.register(dir, img.Parent)
+		if err != nil {
+			return err
+		}
+	}
+
+	return registerOnce(importer.graph, id, func() error {
+		layer, err := os.Open(filepath.Join(dir, id, "layer.tar"))
+		if err != nil {
+			return err
+		}
+
+		defer layer.Close()
+
+		log.Println("importing layer:", id)
+
+		return importer.graph.Register(imgJSON, layer, img)
+	})
+}
+
+func (importer *Importer) tag(dir string) error {
+	repositoriesJSON, err := ioutil.ReadFile(filepath.Join(dir, "repositories"))
+	if os.IsNotExist(err) {
+		// images saved by ID are not tagged
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	var repositories map[string]map[string]string
+
+	err = json.Unmarshal(repositoriesJSON, &repositories)
+	if err != nil {
+		return err
+	}
+
+	for repoName, tags := range repositories {
+		for tag, imgID := range tags {
+			log.Println("tagging imported image", imgID, "as", repoName+":"+tag)
+
+			err := importer.tags.Set(repoName, tag, imgID, true)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// untar extracts the regular files and directories of the tarball into dir;
+// nothing in a saved image needs anything more.
+func untar(tarball io.Reader, dir string) error {
+	reader := tar.NewReader(tarball)
+
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// rooting the name before joining keeps it from escaping dir
+		path := filepath.Join(dir, filepath.Clean("/"+header.Name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+
+		case tar.TypeReg, tar.TypeRegA:
+			err = extractFile(reader, path)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractFile(reader io.Reader, path string) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	_, err = io.Copy(file, reader)
+	return err
+}
@@ -0,0 +1,167 @@
+package repository_fetcher_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io/ioutil"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/fake_graph"
+	"github.com/vito/warden-docker/fake_tag_store"
+)
+
+var _ = Describe("Importer", func() {
+	var graph *fake_graph.FakeGraph
+	var tags *fake_tag_store.FakeTagStore
+	var importer *Importer
+
+	var registered []string
+	var layers []string
+
+	BeforeEach(func() {
+		graph = fake_graph.New()
+		tags = fake_tag_store.New()
+
+		importer = NewImporter(graph, tags)
+
+		registered = []string{}
+		layers = []string{}
+
+		graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, img *image.Image) error {
+			layerData, err := ioutil.ReadAll(layer)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			registered = append(registered, img.ID)
+			layers = append(layers, string(layerData))
+
+			return nil
+		}
+	})
+
+	tarball := func(files map[string]string, order ...string) *bytes.Buffer {
+		buf := new(bytes.Buffer)
+
+		writer := tar.NewWriter(buf)
+
+		for _, name := range order {
+			err := writer.WriteHeader(&tar.Header{
+				Name: name,
+				Mode: 0644,
+				Size: int64(len(files[name])),
+			})
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = writer.Write([]byte(files[name]))
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		err := writer.Close()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return buf
+	}
+
+	savedImage := func() *bytes.Buffer {
+		files := map[string]string{
+			"layer-2/json":      `{"id":"layer-2","parent":"layer-1"}`,
+			"layer-2/layer.tar": "layer-2-data",
+			"layer-1/json":      `{"id":"layer-1"}`,
+			"layer-1/layer.tar": "layer-1-data",
+			"repositories":      `{"some-repo":{"some-tag":"layer-2"}}`,
+		}
+
+		// layers listed child-first, to make sure order isn't relied upon
+		return tarball(
+			files,
+			"layer-2/json",
+			"layer-2/layer.tar",
+			"layer-1/json",
+			"layer-1/layer.tar",
+			"repositories",
+		)
+	}
+
+	It("registers each layer parent-first", func() {
+		err := importer.Import(savedImage())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(registered).Should(Equal([]string{"layer-1", "layer-2"}))
+		Ω(layers).Should(Equal([]string{"layer-1-data", "layer-2-data"}))
+	})
+
+	It("tags the images listed in the repositories file", func() {
+		err := importer.Import(savedImage())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(tags.Tagged("some-repo", "some-tag")).Should(Equal("layer-2"))
+	})
+
+	Context("when a layer already exists in the graph", func() {
+		BeforeEach(func() {
+			graph.SetExists("layer-1", true)
+		})
+
+		It("does not register it again", func() {
+			err := importer.Import(savedImage())
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(registered).Should(Equal([]string{"layer-2"}))
+		})
+	})
+
+	Context("when a layer's parent is not in the tarball or the graph", func() {
+		It("returns an error", func() {
+			err := importer.Import(tarball(
+				map[string]string{
+					"layer-2/json":      `{"id":"layer-2","parent":"layer-1"}`,
+					"layer-2/layer.tar": "layer-2-data",
+				},
+				"layer-2/json",
+				"layer-2/layer.tar",
+			))
+			Ω(err).Should(HaveOccurred())
+
+			Ω(registered).Should(BeEmpty())
+		})
+	})
+
+	Context("when the tarball has no repositories file", func() {
+		It("registers the layers without tagging them", func() {
+			err := importer.Import(tarball(
+				map[string]string{
+					"layer-1/json":      `{"id":"layer-1"}`,
+					"layer-1/layer.tar": "layer-1-data",
+				},
+				"layer-1/json",
+				"layer-1/layer.tar",
+			))
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(registered).Should(Equal([]string{"layer-1"}))
+		})
+	})
+
+	Context("when registering fails", func() {
+		disaster := errors.New("oh no!")
+
+		BeforeEach(func() {
+			graph.WhenRegistering = func([]byte, archive.ArchiveReader, *image.Image) error {
+				return disaster
+			}
+		})
+
+		It("returns the error without tagging", func() {
+			err := importer.Import(savedImage())
+			Ω(err).Should(Equal(disaster))
+
+			Ω(tags.Tagged("some-repo", "some-tag")).Should(BeEmpty())
+		})
+	})
+})
@@ -0,0 +1,73 @@
+package repository_fetcher
+
+import "sync"
+
+// inflight coalesces concurrent calls for the same key: while a call is in
+// flight, anyone else asking for the same key waits for it and shares its
+// result, rather than doing the work again.
+type inflight struct {
+	calls map[string]*inflightCall
+	mutex *sync.Mutex
+}
+
+type inflightCall struct {
+	done chan struct{}
+
+	result interface{}
+	err    error
+}
+
+func newInflight() *inflight {
+	return &inflight{
+		calls: make(map[string]*inflightCall),
+		mutex: new(sync.Mutex),
+	}
+}
+
+func (group *inflight) do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	group.mutex.Lock()
+
+	call, found := group.calls[key]
+	if found {
+		group.mutex.Unlock()
+
+		<-call.done
+
+		return call.result, call.err
+	}
+
+	call = &inflightCall{done: make(chan struct{})}
+
+	group.calls[key] = call
+
+	group.mutex.Unlock()
+
+	call.result, call.err = fn()
+
+	group.mutex.Lock()
+	delete(group.calls, key)
+	group.mutex.Unlock()
+
+	close(call.done)
+
+	return call.result, call.err
+}
+
+// layerFetches coalesces downloading and registering layers across every
+// fetcher in the process, as they all register into the same graph and
+// images commonly share layers.
+var layerFetches = newInflight()
+
+// registerOnce runs register for the layer unless it is already in the graph
+// or is being registered by someone else, in which case it waits for them.
+func registerOnce(graph Graph, layerID string, register func() error) error {
+	_, err := layerFetches.do(layerID, func() (interface{}, error) {
+		if graph.Exists(layerID) {
+			return nil, nil
+		}
+
+		return nil, register()
+	})
+
+	return err
+}
@@ -0,0 +1,231 @@
+package repository_fetcher
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+
+	"github.com/dotcloud/docker/graph"
+)
+
+// PullPolicy determines whether an image is pulled from its registry, or
+// resolved from the images already in the graph.
+type PullPolicy string
+
+const (
+	// always pull, so that tags pick up new images as they are pushed
+	PullAlways PullPolicy = "always"
+
+	// only pull if the tag has not been pulled before
+	PullIfNotPresent PullPolicy = "if-not-present"
+
+	// never pull; only use images already in the graph
+	PullNever PullPolicy = "never"
+)
+
+func ParsePullPolicy(policy string) (PullPolicy, error) {
+	switch PullPolicy(policy) {
+	case PullAlways, PullIfNotPresent, PullNever:
+		return PullPolicy(policy), nil
+	default:
+		return "", fmt.Errorf("unknown pull policy: %s", policy)
+	}
+}
+
+type ImageNotPresentError struct {
+	Repository string
+	Tag        string
+}
+
+func (e ImageNotPresentError) Error() string {
+	return fmt.Sprintf("image not present locally: %s:%s", e.Repository, e.Tag)
+}
+
+// PolicyFetcher is a RepositoryFetcher whose pull policy can be chosen per
+// fetch.
+type PolicyFetcher interface {
+	ProgressFetcher
+
+	FetchWithPolicy(repoName string, tag string, policy PullPolicy, progress ProgressReporter) (*Image, error)
+}
+
+// apes docker's *graph.TagStore
+type TagStore interface {
+	Get(repoName string) (graph.Repository, error)
+	Set(repoName string, tag string, imageName string, force bool) error
+	Delete(repoName string, tag string) (bool, error)
+	ByID() map[string][]string
+}
+
+// LockedTagStore serializes access to a TagStore, as docker's is not safe
+// for concurrent use.
+type LockedTagStore struct {
+	store TagStore
+	mutex *sync.Mutex
+}
+
+func NewLockedTagStore(store TagStore) *LockedTagStore {
+	return &LockedTagStore{
+		store: store,
+		mutex: new(sync.Mutex),
+	}
+}
+
+func (locked *LockedTagStore) Get(repoName string) (graph.Repository, error) {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+
+	repo, err := locked.store.Get(repoName)
+	if err != nil {
+		return nil, err
+	}
+
+	// copy, so that callers can use it without the lock
+	copied := graph.Repository{}
+	for tag, imgID := range repo {
+		copied[tag] = imgID
+	}
+
+	return copied, nil
+}
+
+func (locked *LockedTagStore) Set(repoName string, tag string, imageName string, force bool) error {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+
+	return locked.store.Set(repoName, tag, imageName, force)
+}
+
+func (locked *LockedTagStore) Delete(repoName string, tag string) (bool, error) {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+
+	return locked.store.Delete(repoName, tag)
+}
+
+func (locked *LockedTagStore) ByID() map[string][]string {
+	locked.mutex.Lock()
+	defer locked.mutex.Unlock()
+
+	return locked.store.ByID()
+}
+
+// Local records which image each tag resolved to when it was pulled, so that
+// images already in the graph can be used without asking the registry, e.g.
+// while it is unreachable.
+//
+// Images referenced by digest are always pulled (unless the policy is
+// PullNever), as only tags are recorded.
+//
+// The tags of images committed on this host are kept apart from those that
+// were pulled. They exist nowhere else, so they are resolved from the graph
+// whatever the policy, shadowing any tag of the same name on the registry.
+//
+// Both TagStores must be safe for concurrent use, e.g. a LockedTagStore.
+type Local struct {
+	RepositoryFetcher
+
+	tags      TagStore
+	committed TagStore
+	graph     Graph
+	policy    PullPolicy
+}
+
+func NewLocal(fetcher RepositoryFetcher, tags TagStore, committed TagStore, graph Graph, policy PullPolicy) *Local {
+	return &Local{
+		RepositoryFetcher: fetcher,
+
+		tags:      tags,
+		committed: committed,
+		graph:     graph,
+		policy:    policy,
+	}
+}
+
+func (local *Local) Fetch(repoName string, tag string) (*Image, error) {
+	return local.FetchWithPolicy(repoName, tag, local.policy, nil)
+}
+
+func (local *Local) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	return local.FetchWithPolicy(repoName, tag, local.policy, progress)
+}
+
+func (local *Local) FetchWithPolicy(repoName string, tag string, policy PullPolicy, progress ProgressReporter) (*Image, error) {
+	img, found := local.lookup(local.committed, repoName, tag)
+	if found {
+		log.Println("using committed image for", repoName+":"+tag+":", img.ID)
+		reportLocal(progress, img)
+		return img, nil
+	}
+
+	if policy != PullAlways {
+		img, found = local.lookup(local.tags, repoName, tag)
+		if found {
+			log.Println("using local image for", repoName+":"+tag+":", img.ID)
+			reportLocal(progress, img)
+			return img, nil
+		}
+
+		if policy == PullNever {
+			return nil, ImageNotPresentError{Repository: repoName, Tag: tag}
+		}
+	}
+
+	img, err := fetchWithProgress(local.RepositoryFetcher, repoName, tag, progress)
+	if err != nil {
+		return nil, err
+	}
+
+	local.record(repoName, tag, img.ID)
+
+	return img, nil
+}
+
+func (local *Local) lookup(tags TagStore, repoName string, tag string) (*Image, bool) {
+	repo, err := tags.Get(repoName)
+	if err != nil {
+		log.Println("failed to look up local tags for", repoName+":", err)
+		return nil, false
+	}
+
+	imgID, found := repo[tag]
+	if !found {
+		return nil, false
+	}
+
+	// the image may have been collected since it was tagged
+	if !local.graph.Exists(imgID) {
+		return nil, false
+	}
+
+	img, err := local.graph.Get(imgID)
+	if err != nil {
+		return nil, false
+	}
+
+	return &Image{ID: imgID, Config: img.Config}, true
+}
+
+func reportLocal(progress ProgressReporter, img *Image) {
+	progressOrDiscard(progress).ReportLayer(LayerProgress{
+		LayerID:  img.ID,
+		Cached:   true,
+		Complete: true,
+	})
+}
+
+func (local *Local) record(repoName string, tag string, imgID string) {
+	if isDigest(tag) {
+		return
+	}
+
+	err := local.tags.Set(repoName, tag, imgID, true)
+	if err != nil {
+		log.Println("failed to record tag", repoName+":"+tag+":", err)
+	}
+}
+
+func isDigest(reference string) bool {
+	return strings.Contains(reference, ":")
+}
@@ -0,0 +1,314 @@
+package repository_fetcher_test
+
+import (
+	"errors"
+
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/runconfig"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+	"github.com/vito/warden-docker/fake_graph"
+	"github.com/vito/warden-docker/fake_tag_store"
+)
+
+var _ = Describe("Local", func() {
+	var remote *fake_repository_fetcher.FakeRepositoryFetcher
+	var tags *fake_tag_store.FakeTagStore
+	var committed *fake_tag_store.FakeTagStore
+	var graph *fake_graph.FakeGraph
+
+	var policy PullPolicy
+	var fetcher *Local
+
+	BeforeEach(func() {
+		remote = fake_repository_fetcher.New()
+		remote.FetchResult = "remote-image-id"
+
+		tags = fake_tag_store.New()
+		committed = fake_tag_store.New()
+		graph = fake_graph.New()
+
+		policy = PullAlways
+	})
+
+	JustBeforeEach(func() {
+		fetcher = NewLocal(remote, tags, committed, graph, policy)
+	})
+
+	tagLocally := func() {
+		err := tags.Set("some-repo", "some-tag", "local-image-id", true)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		graph.SetExists("local-image-id", true)
+		graph.SetImage(&image.Image{
+			ID:     "local-image-id",
+			Config: &runconfig.Config{Env: []string{"FOO=bar"}},
+		})
+	}
+
+	Describe("ParsePullPolicy", func() {
+		It("parses known policies", func() {
+			Ω(ParsePullPolicy("always")).Should(Equal(PullAlways))
+			Ω(ParsePullPolicy("if-not-present")).Should(Equal(PullIfNotPresent))
+			Ω(ParsePullPolicy("never")).Should(Equal(PullNever))
+		})
+
+		It("rejects unknown policies", func() {
+			_, err := ParsePullPolicy("sometimes")
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+
+	Context("with the always policy", func() {
+		BeforeEach(func() {
+			tagLocally()
+		})
+
+		It("pulls, and records the tag", func() {
+			img, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(img.ID).Should(Equal("remote-image-id"))
+			Ω(remote.Fetched()).Should(HaveLen(1))
+
+			Ω(tags.Tagged("some-repo", "some-tag")).Should(Equal("remote-image-id"))
+		})
+
+		Context("when pulling fails", func() {
+			disaster := errors.New("oh no!")
+
+			BeforeEach(func() {
+				remote.FetchError = disaster
+			})
+
+			It("returns the error", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(disaster))
+			})
+		})
+
+		Context("when fetching by digest", func() {
+			It("does not record it as a tag", func() {
+				_, err := fetcher.Fetch("some-repo", "sha256:abc")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(tags.Tagged("some-repo", "sha256:abc")).Should(BeEmpty())
+			})
+		})
+	})
+
+	Context("when the tag was committed on this host", func() {
+		BeforeEach(func() {
+			err := committed.Set("some-repo", "some-tag", "committed-image-id", true)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			graph.SetExists("committed-image-id", true)
+			graph.SetImage(&image.Image{
+				ID:     "committed-image-id",
+				Config: &runconfig.Config{Env: []string{"FOO=committed"}},
+			})
+		})
+
+		for _, p := range []PullPolicy{PullAlways, PullIfNotPresent, PullNever} {
+			p := p
+
+			Context("with the "+string(p)+" policy", func() {
+				BeforeEach(func() {
+					policy = p
+				})
+
+				It("returns the committed image without pulling", func() {
+					img, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(img.ID).Should(Equal("committed-image-id"))
+					Ω(img.Config.Env).Should(Equal([]string{"FOO=committed"}))
+
+					Ω(remote.Fetched()).Should(BeEmpty())
+				})
+			})
+		}
+
+		Context("but the image is no longer in the graph", func() {
+			BeforeEach(func() {
+				graph.SetExists("committed-image-id", false)
+			})
+
+			It("pulls", func() {
+				img, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(img.ID).Should(Equal("remote-image-id"))
+			})
+		})
+	})
+
+	Context("with the if-not-present policy", func() {
+		BeforeEach(func() {
+			policy = PullIfNotPresent
+		})
+
+		Context("when the tag has been pulled before", func() {
+			BeforeEach(func() {
+				tagLocally()
+			})
+
+			It("returns the local image without pulling", func() {
+				img, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(img.ID).Should(Equal("local-image-id"))
+				Ω(img.Config.Env).Should(Equal([]string{"FOO=bar"}))
+
+				Ω(remote.Fetched()).Should(BeEmpty())
+			})
+
+			It("reports the image as cached", func() {
+				progress := NewPullProgress()
+
+				_, err := fetcher.FetchWithProgress("some-repo", "some-tag", progress)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(progress.Layers()).Should(Equal([]LayerProgress{
+					{LayerID: "local-image-id", Cached: true, Complete: true},
+				}))
+			})
+
+			Context("but the image is no longer in the graph", func() {
+				BeforeEach(func() {
+					graph.SetExists("local-image-id", false)
+				})
+
+				It("pulls it again", func() {
+					img, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(img.ID).Should(Equal("remote-image-id"))
+				})
+			})
+
+			Context("but a pull is requested explicitly", func() {
+				It("pulls", func() {
+					img, err := fetcher.FetchWithPolicy("some-repo", "some-tag", PullAlways, nil)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(img.ID).Should(Equal("remote-image-id"))
+				})
+			})
+		})
+
+		Context("when the tag has not been pulled before", func() {
+			It("pulls, and records the tag", func() {
+				img, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(img.ID).Should(Equal("remote-image-id"))
+				Ω(tags.Tagged("some-repo", "some-tag")).Should(Equal("remote-image-id"))
+			})
+
+			It("reports the pull's progress", func() {
+				remote.FetchProgress = []LayerProgress{
+					{LayerID: "some-layer", Current: 1, Total: 2},
+				}
+
+				progress := NewPullProgress()
+
+				_, err := fetcher.FetchWithProgress("some-repo", "some-tag", progress)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(progress.Layers()).Should(Equal(remote.FetchProgress))
+			})
+		})
+
+		Context("when looking up the tag fails", func() {
+			BeforeEach(func() {
+				tags.GetError = errors.New("oh no!")
+			})
+
+			It("pulls", func() {
+				img, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(img.ID).Should(Equal("remote-image-id"))
+			})
+		})
+	})
+
+	Context("with the never policy", func() {
+		BeforeEach(func() {
+			policy = PullNever
+		})
+
+		Context("when the tag has been pulled before", func() {
+			BeforeEach(func() {
+				tagLocally()
+			})
+
+			It("returns the local image", func() {
+				img, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(img.ID).Should(Equal("local-image-id"))
+			})
+		})
+
+		Context("when the tag has not been pulled before", func() {
+			It("returns an error without pulling", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(ImageNotPresentError{Repository: "some-repo", Tag: "some-tag"}))
+
+				Ω(remote.Fetched()).Should(BeEmpty())
+			})
+		})
+	})
+})
+
+var _ = Describe("LockedTagStore", func() {
+	var store *fake_tag_store.FakeTagStore
+	var locked *LockedTagStore
+
+	BeforeEach(func() {
+		store = fake_tag_store.New()
+		locked = NewLockedTagStore(store)
+	})
+
+	It("sets and gets tags from the store", func() {
+		err := locked.Set("some-repo", "some-tag", "some-image-id", true)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(store.Tagged("some-repo", "some-tag")).Should(Equal("some-image-id"))
+
+		repo, err := locked.Get("some-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(repo["some-tag"]).Should(Equal("some-image-id"))
+	})
+
+	It("returns copies of repositories, which may be used without the lock", func() {
+		err := locked.Set("some-repo", "some-tag", "some-image-id", true)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		repo, err := locked.Get("some-repo")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		repo["some-tag"] = "bogus"
+
+		Ω(store.Tagged("some-repo", "some-tag")).Should(Equal("some-image-id"))
+	})
+
+	It("looks up and deletes tags by image", func() {
+		err := locked.Set("some-repo", "some-tag", "some-image-id", true)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(locked.ByID()["some-image-id"]).Should(Equal([]string{"some-repo:some-tag"}))
+
+		deleted, err := locked.Delete("some-repo", "some-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+		Ω(deleted).Should(BeTrue())
+
+		Ω(store.Tagged("some-repo", "some-tag")).Should(BeEmpty())
+	})
+})
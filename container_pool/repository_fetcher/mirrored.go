@@ -0,0 +1,132 @@
+package repository_fetcher
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+var ErrNoMirrorsAvailable = errors.New("no registry mirrors available")
+
+// Mirror is a registry that serves the same repositories as an upstream
+// registry, e.g. a pull-through cache in the local data center.
+type Mirror struct {
+	Endpoint string
+	Fetcher  RepositoryFetcher
+}
+
+// Mirrored fetches from an ordered list of mirrors of a registry, trying each
+// in turn, and from the upstream registry itself only if every mirror fails
+// and falling back to it is allowed.
+//
+// A mirror that fails with a transient error (see Retryable) is skipped for
+// the cooldown, so that fetches don't wait on it while it's down; if every
+// mirror is being skipped, and the upstream is not allowed, they're tried
+// anyway.
+type Mirrored struct {
+	upstream      RepositoryFetcher
+	mirrors       []Mirror
+	allowUpstream bool
+	cooldown      time.Duration
+
+	// when each mirror (by endpoint) may be tried again after failing
+	unhealthyUntil map[string]time.Time
+	healthMutex    *sync.Mutex
+}
+
+func NewMirrored(
+	upstream RepositoryFetcher,
+	mirrors []Mirror,
+	allowUpstream bool,
+	cooldown time.Duration,
+) *Mirrored {
+	return &Mirrored{
+		upstream:      upstream,
+		mirrors:       mirrors,
+		allowUpstream: allowUpstream,
+		cooldown:      cooldown,
+
+		unhealthyUntil: make(map[string]time.Time),
+		healthMutex:    new(sync.Mutex),
+	}
+}
+
+func (mirrored *Mirrored) Fetch(repoName string, tag string) (*Image, error) {
+	return mirrored.FetchWithProgress(repoName, tag, nil)
+}
+
+func (mirrored *Mirrored) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	healthy, unhealthy := mirrored.partition()
+
+	mirrors := healthy
+	if !mirrored.allowUpstream {
+		mirrors = append(mirrors, unhealthy...)
+	}
+
+	var err error = ErrNoMirrorsAvailable
+
+	for _, mirror := range mirrors {
+		var img *Image
+
+		img, err = fetchWithProgress(mirror.Fetcher, repoName, tag, progress)
+		if err == nil {
+			mirrored.markHealthy(mirror)
+			return img, nil
+		}
+
+		log.Println("mirror", mirror.Endpoint, "failed to fetch", repoName+":"+tag+":", err)
+
+		// e.g. a tag that the mirror doesn't have says nothing about its
+		// health
+		if !isPermanent(err) {
+			mirrored.markUnhealthy(mirror)
+		}
+	}
+
+	if !mirrored.allowUpstream {
+		return nil, AllEndpointsFailedError{Err: err}
+	}
+
+	log.Println("fetching", repoName+":"+tag, "from upstream")
+
+	return fetchWithProgress(mirrored.upstream, repoName, tag, progress)
+}
+
+// partition splits the mirrors into those that may be tried and those that
+// failed within the cooldown, preserving their order.
+func (mirrored *Mirrored) partition() ([]Mirror, []Mirror) {
+	mirrored.healthMutex.Lock()
+	defer mirrored.healthMutex.Unlock()
+
+	now := time.Now()
+
+	healthy := []Mirror{}
+	unhealthy := []Mirror{}
+
+	for _, mirror := range mirrored.mirrors {
+		if now.Before(mirrored.unhealthyUntil[mirror.Endpoint]) {
+			unhealthy = append(unhealthy, mirror)
+		} else {
+			healthy = append(healthy, mirror)
+		}
+	}
+
+	return healthy, unhealthy
+}
+
+func (mirrored *Mirrored) markHealthy(mirror Mirror) {
+	mirrored.healthMutex.Lock()
+	defer mirrored.healthMutex.Unlock()
+
+	delete(mirrored.unhealthyUntil, mirror.Endpoint)
+}
+
+func (mirrored *Mirrored) markUnhealthy(mirror Mirror) {
+	mirrored.healthMutex.Lock()
+	defer mirrored.healthMutex.Unlock()
+
+	log.Println("skipping mirror", mirror.Endpoint, "for", mirrored.cooldown)
+
+	mirrored.unhealthyUntil[mirror.Endpoint] = time.Now().Add(mirrored.cooldown)
+}
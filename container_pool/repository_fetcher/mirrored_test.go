@@ -0,0 +1,189 @@
+package repository_fetcher_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+)
+
+var _ = Describe("Mirrored", func() {
+	var upstream *fake_repository_fetcher.FakeRepositoryFetcher
+	var mirror1 *fake_repository_fetcher.FakeRepositoryFetcher
+	var mirror2 *fake_repository_fetcher.FakeRepositoryFetcher
+
+	var allowUpstream bool
+	var cooldown time.Duration
+
+	var fetcher RepositoryFetcher
+
+	disaster := errors.New("connection refused")
+
+	BeforeEach(func() {
+		upstream = fake_repository_fetcher.New()
+		upstream.FetchResult = "upstream-image-id"
+
+		mirror1 = fake_repository_fetcher.New()
+		mirror1.FetchResult = "mirror-1-image-id"
+
+		mirror2 = fake_repository_fetcher.New()
+		mirror2.FetchResult = "mirror-2-image-id"
+
+		allowUpstream = true
+		cooldown = time.Hour
+	})
+
+	JustBeforeEach(func() {
+		fetcher = NewMirrored(
+			upstream,
+			[]Mirror{
+				{Endpoint: "mirror-1", Fetcher: mirror1},
+				{Endpoint: "mirror-2", Fetcher: mirror2},
+			},
+			allowUpstream,
+			cooldown,
+		)
+	})
+
+	It("fetches from the first mirror", func() {
+		img, err := fetcher.Fetch("some-repo", "some-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(img.ID).Should(Equal("mirror-1-image-id"))
+
+		Ω(mirror2.Fetched()).Should(BeEmpty())
+		Ω(upstream.Fetched()).Should(BeEmpty())
+	})
+
+	Context("when a mirror fails with a transient error", func() {
+		var mirror1Attempts int
+
+		BeforeEach(func() {
+			mirror1Attempts = 0
+
+			mirror1.FetchError = disaster
+			mirror1.WhenFetching = func(string, string) {
+				mirror1Attempts++
+			}
+		})
+
+		It("fetches from the next one", func() {
+			img, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(img.ID).Should(Equal("mirror-2-image-id"))
+		})
+
+		It("skips it for subsequent fetches", func() {
+			_, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			_, err = fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(mirror1Attempts).Should(Equal(1))
+			Ω(mirror2.Fetched()).Should(HaveLen(2))
+		})
+
+		Context("and the cooldown has passed", func() {
+			BeforeEach(func() {
+				cooldown = 10 * time.Millisecond
+			})
+
+			It("tries it again", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				time.Sleep(20 * time.Millisecond)
+
+				mirror1.FetchError = nil
+
+				img, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(img.ID).Should(Equal("mirror-1-image-id"))
+				Ω(mirror1Attempts).Should(Equal(2))
+			})
+		})
+	})
+
+	Context("when a mirror fails permanently, e.g. it has no such tag", func() {
+		var mirror1Attempts int
+
+		BeforeEach(func() {
+			mirror1Attempts = 0
+
+			mirror1.FetchError = UnknownTagError{Repository: "some-repo", Tag: "some-tag"}
+			mirror1.WhenFetching = func(string, string) {
+				mirror1Attempts++
+			}
+		})
+
+		It("fetches from the next one, but does not skip it for subsequent fetches", func() {
+			img, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(img.ID).Should(Equal("mirror-2-image-id"))
+
+			_, err = fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(mirror1Attempts).Should(Equal(2))
+		})
+	})
+
+	Context("when every mirror fails", func() {
+		BeforeEach(func() {
+			mirror1.FetchError = disaster
+			mirror2.FetchError = disaster
+		})
+
+		It("falls back to the upstream registry", func() {
+			img, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(img.ID).Should(Equal("upstream-image-id"))
+		})
+
+		Context("and falling back to the upstream is not allowed", func() {
+			BeforeEach(func() {
+				allowUpstream = false
+			})
+
+			It("returns the last mirror's error without fetching from the upstream", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(AllEndpointsFailedError{Err: disaster}))
+
+				Ω(upstream.Fetched()).Should(BeEmpty())
+			})
+
+			It("keeps trying the mirrors, rather than skipping them all", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(HaveOccurred())
+
+				mirror2.FetchError = nil
+
+				img, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(img.ID).Should(Equal("mirror-2-image-id"))
+			})
+		})
+	})
+
+	Context("with progress", func() {
+		It("reports the progress of the mirror it fetches from", func() {
+			mirror1.FetchProgress = []LayerProgress{{LayerID: "some-layer", Current: 1, Total: 2}}
+
+			progress := NewPullProgress()
+
+			_, err := fetcher.(ProgressFetcher).FetchWithProgress("some-repo", "some-tag", progress)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(progress.Layers()).Should(Equal(mirror1.FetchProgress))
+		})
+	})
+})
@@ -0,0 +1,192 @@
+package repository_fetcher
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// LayerProgress is the state of one layer of a fetch. Each report carries
+// the layer's full state, not just what changed since the last one.
+type LayerProgress struct {
+	LayerID string
+
+	// already in the graph (or being fetched by someone else), so not
+	// downloaded by this fetch
+	Cached bool
+
+	// bytes downloaded so far, and the layer's size, or 0 if the registry
+	// did not say
+	Current int64
+	Total   int64
+
+	// downloaded and registered into the graph
+	Complete bool
+}
+
+// ProgressReporter receives progress as a fetch proceeds. Layers are
+// downloaded concurrently, so it must be safe for concurrent use.
+type ProgressReporter interface {
+	ReportLayer(LayerProgress)
+}
+
+// ProgressFetcher is a RepositoryFetcher that can report the progress of a
+// fetch, layer by layer.
+type ProgressFetcher interface {
+	RepositoryFetcher
+
+	FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error)
+}
+
+// fetchWithProgress fetches with progress if the fetcher supports it, and
+// without it otherwise.
+func fetchWithProgress(fetcher RepositoryFetcher, repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	if progressFetcher, ok := fetcher.(ProgressFetcher); ok && progress != nil {
+		return progressFetcher.FetchWithProgress(repoName, tag, progress)
+	}
+
+	return fetcher.Fetch(repoName, tag)
+}
+
+type discardProgress struct{}
+
+func (discardProgress) ReportLayer(LayerProgress) {}
+
+// progressOrDiscard returns the reporter, or one that discards progress if
+// none was given.
+func progressOrDiscard(progress ProgressReporter) ProgressReporter {
+	if progress == nil {
+		return discardProgress{}
+	}
+
+	return progress
+}
+
+// progressReader reports the bytes read through it as a layer's progress.
+type progressReader struct {
+	io.Reader
+
+	progress ProgressReporter
+	layer    LayerProgress
+}
+
+func (reader *progressReader) Read(buf []byte) (int, error) {
+	n, err := reader.Reader.Read(buf)
+	if n > 0 {
+		reader.layer.Current += int64(n)
+		reader.progress.ReportLayer(reader.layer)
+	}
+
+	return n, err
+}
+
+// PullProgress records the progress of a fetch so that it can be queried
+// while the fetch is in flight, and summarized once it is done.
+type PullProgress struct {
+	started time.Time
+
+	layers map[string]LayerProgress
+	order  []string
+
+	mutex *sync.RWMutex
+}
+
+func NewPullProgress() *PullProgress {
+	return &PullProgress{
+		started: time.Now(),
+
+		layers: make(map[string]LayerProgress),
+
+		mutex: new(sync.RWMutex),
+	}
+}
+
+func (pull *PullProgress) ReportLayer(layer LayerProgress) {
+	pull.mutex.Lock()
+	defer pull.mutex.Unlock()
+
+	if _, found := pull.layers[layer.LayerID]; !found {
+		pull.order = append(pull.order, layer.LayerID)
+	}
+
+	pull.layers[layer.LayerID] = layer
+}
+
+// Layers returns the progress of each layer, in the order they were first
+// reported.
+func (pull *PullProgress) Layers() []LayerProgress {
+	pull.mutex.RLock()
+	defer pull.mutex.RUnlock()
+
+	layers := make([]LayerProgress, len(pull.order))
+	for i, id := range pull.order {
+		layers[i] = pull.layers[id]
+	}
+
+	return layers
+}
+
+// Summary describes the fetch in a line, e.g. for a container's events.
+func (pull *PullProgress) Summary() string {
+	downloaded := 0
+	cached := 0
+
+	var bytes int64
+
+	for _, layer := range pull.Layers() {
+		if layer.Cached {
+			cached++
+			continue
+		}
+
+		downloaded++
+		bytes += layer.Current
+	}
+
+	return fmt.Sprintf(
+		"%d layers downloaded (%d bytes), %d cached, in %s",
+		downloaded,
+		bytes,
+		cached,
+		time.Since(pull.started),
+	)
+}
+
+// progressBroadcast forwards progress to everyone waiting on a fetch,
+// replaying the latest state of each layer to those who join late.
+type progressBroadcast struct {
+	reporters []ProgressReporter
+	latest    *PullProgress
+
+	mutex *sync.Mutex
+}
+
+func newProgressBroadcast() *progressBroadcast {
+	return &progressBroadcast{
+		latest: NewPullProgress(),
+		mutex:  new(sync.Mutex),
+	}
+}
+
+func (broadcast *progressBroadcast) join(progress ProgressReporter) {
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+
+	for _, layer := range broadcast.latest.Layers() {
+		progress.ReportLayer(layer)
+	}
+
+	broadcast.reporters = append(broadcast.reporters, progress)
+}
+
+func (broadcast *progressBroadcast) ReportLayer(layer LayerProgress) {
+	broadcast.mutex.Lock()
+	defer broadcast.mutex.Unlock()
+
+	broadcast.latest.ReportLayer(layer)
+
+	for _, progress := range broadcast.reporters {
+		progress.ReportLayer(layer)
+	}
+}
@@ -0,0 +1,37 @@
+package repository_fetcher_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
+
+var _ = Describe("PullProgress", func() {
+	var progress *PullProgress
+
+	BeforeEach(func() {
+		progress = NewPullProgress()
+	})
+
+	It("keeps the latest progress of each layer, in the order they were first reported", func() {
+		progress.ReportLayer(LayerProgress{LayerID: "layer-1", Total: 10})
+		progress.ReportLayer(LayerProgress{LayerID: "layer-2", Cached: true, Complete: true})
+		progress.ReportLayer(LayerProgress{LayerID: "layer-1", Current: 5, Total: 10})
+
+		Ω(progress.Layers()).Should(Equal([]LayerProgress{
+			{LayerID: "layer-1", Current: 5, Total: 10},
+			{LayerID: "layer-2", Cached: true, Complete: true},
+		}))
+	})
+
+	Describe("Summary", func() {
+		It("counts the layers downloaded and cached, and the bytes downloaded", func() {
+			progress.ReportLayer(LayerProgress{LayerID: "layer-1", Current: 10, Total: 10, Complete: true})
+			progress.ReportLayer(LayerProgress{LayerID: "layer-2", Cached: true, Complete: true})
+			progress.ReportLayer(LayerProgress{LayerID: "layer-3", Current: 5, Complete: true})
+
+			Ω(progress.Summary()).Should(MatchRegexp(`^2 layers downloaded \(15 bytes\), 1 cached, in \S+$`))
+		})
+	})
+})
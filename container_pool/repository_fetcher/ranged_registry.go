@@ -0,0 +1,64 @@
+package repository_fetcher
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+)
+
+// RangedDockerRegistry is docker's *registry.Registry, extended to request
+// layers from an offset. Layers are requested as GetRemoteImageLayer requests
+// them: through the request factory the registry was constructed with, which
+// carries its credentials, and with the repository's token.
+type RangedDockerRegistry struct {
+	*registry.Registry
+
+	factory *utils.HTTPRequestFactory
+	client  *http.Client
+}
+
+func NewRangedDockerRegistry(reg *registry.Registry, factory *utils.HTTPRequestFactory) *RangedDockerRegistry {
+	return &RangedDockerRegistry{
+		Registry: reg,
+
+		factory: factory,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DisableKeepAlives: true,
+				Proxy:             http.ProxyFromEnvironment,
+			},
+		},
+	}
+}
+
+func (reg *RangedDockerRegistry) GetRemoteImageLayerFrom(imageID string, endpoint string, token []string, offset int64, validator string) (*http.Response, error) {
+	request, err := reg.factory.NewRequest("GET", endpoint+"images/"+imageID+"/layer", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if request.Header.Get("Authorization") == "" {
+		request.Header.Set("Authorization", "Token "+strings.Join(token, ","))
+	}
+
+	setRange(request, offset, validator)
+
+	response, err := reg.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	switch response.StatusCode {
+	case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+		return response, nil
+	}
+
+	response.Body.Close()
+
+	return nil, UnexpectedStatusError{
+		URL:        request.URL.String(),
+		StatusCode: response.StatusCode,
+	}
+}
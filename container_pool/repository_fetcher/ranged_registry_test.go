@@ -0,0 +1,110 @@
+package repository_fetcher_test
+
+import (
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dotcloud/docker/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
+
+var _ = Describe("RangedDockerRegistry", func() {
+	var server *ghttp.Server
+	var reg *RangedDockerRegistry
+
+	BeforeEach(func() {
+		server = ghttp.NewServer()
+
+		factory := registry.HTTPRequestFactory(nil)
+
+		dockerRegistry, err := registry.NewRegistry(nil, factory, server.URL()+"/v1/")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		reg = NewRangedDockerRegistry(dockerRegistry, factory)
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	Describe("GetRemoteImageLayerFrom", func() {
+		Context("from the start", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v1/images/some-image/layer"),
+						ghttp.VerifyHeader(http.Header{
+							"Authorization": []string{"Token token-1,token-2"},
+						}),
+						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+							Ω(req.Header.Get("Range")).Should(BeEmpty())
+							Ω(req.Header.Get("If-Range")).Should(BeEmpty())
+
+							w.Write([]byte("some-layer-data"))
+						}),
+					),
+				)
+			})
+
+			It("requests the whole layer with the token", func() {
+				response, err := reg.GetRemoteImageLayerFrom("some-image", server.URL()+"/v1/", []string{"token-1", "token-2"}, 0, "")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				defer response.Body.Close()
+
+				Ω(response.StatusCode).Should(Equal(http.StatusOK))
+
+				body, err := ioutil.ReadAll(response.Body)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(string(body)).Should(Equal("some-layer-data"))
+			})
+		})
+
+		Context("from an offset", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v1/images/some-image/layer"),
+						ghttp.VerifyHeader(http.Header{
+							"Range":    []string{"bytes=5-"},
+							"If-Range": []string{`"some-etag"`},
+						}),
+						ghttp.RespondWith(http.StatusPartialContent, "layer-data", http.Header{
+							"Content-Range": []string{"bytes 5-14/15"},
+						}),
+					),
+				)
+			})
+
+			It("requests the rest of the layer, if it hasn't changed", func() {
+				response, err := reg.GetRemoteImageLayerFrom("some-image", server.URL()+"/v1/", []string{"some-token"}, 5, `"some-etag"`)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				defer response.Body.Close()
+
+				Ω(response.StatusCode).Should(Equal(http.StatusPartialContent))
+			})
+		})
+
+		Context("when the registry fails", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.RespondWith(http.StatusNotFound, ""),
+				)
+			})
+
+			It("returns an UnexpectedStatusError", func() {
+				_, err := reg.GetRemoteImageLayerFrom("some-image", server.URL()+"/v1/", []string{"some-token"}, 0, "")
+				Ω(err).Should(Equal(UnexpectedStatusError{
+					URL:        server.URL() + "/v1/images/some-image/layer",
+					StatusCode: http.StatusNotFound,
+				}))
+			})
+		})
+	})
+})
@@ -1,17 +1,53 @@
 package repository_fetcher
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net/http"
+	"os"
 
 	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/image"
 	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/runconfig"
 )
 
+// layerDownloadWorkers bounds how many layers of a single image are
+// downloaded at once.
+const layerDownloadWorkers = 4
+
+var errDownloadAborted = errors.New("layer download aborted")
+
+type UnknownTagError struct {
+	Repository string
+	Tag        string
+}
+
+func (e UnknownTagError) Error() string {
+	return fmt.Sprintf("unknown tag: %s:%s", e.Repository, e.Tag)
+}
+
+// AllEndpointsFailedError is returned when none of a repository's endpoints
+// could serve an image; Err is the last endpoint's error.
+type AllEndpointsFailedError struct {
+	Err error
+}
+
+func (e AllEndpointsFailedError) Error() string {
+	return fmt.Sprintf("all endpoints failed: %s", e.Err)
+}
+
 type RepositoryFetcher interface {
-	Fetch(repoName string, tag string) (imageID string, err error)
+	Fetch(repoName string, tag string) (*Image, error)
+}
+
+// Image is the result of a fetch: the ID of the image in the graph and the
+// configuration (env, working dir, command, etc.) it was built with.
+type Image struct {
+	ID     string
+	Config *runconfig.Config
 }
 
 // apes docker's *registry.Registry
@@ -24,93 +60,307 @@ type Registry interface {
 	GetRemoteImageLayer(imageID string, registry string, token []string) (io.ReadCloser, error)
 }
 
+// RangedRegistry is a Registry that can request a layer from an offset, so
+// that a download that was cut off can be resumed. It returns the response if
+// its status is 200, 206, or 416.
+type RangedRegistry interface {
+	Registry
+
+	GetRemoteImageLayerFrom(imageID string, registry string, token []string, offset int64, validator string) (*http.Response, error)
+}
+
 // apes docker's *graph.Graph
 type Graph interface {
 	Exists(imageID string) bool
+	Get(imageID string) (*image.Image, error)
 	Register(imageJSON []byte, layer archive.ArchiveReader, image *image.Image) error
 }
 
 type DockerRepositoryFetcher struct {
-	registry Registry
-	graph    Graph
+	registry  Registry
+	graph     Graph
+	downloads *DownloadCache
 }
 
-func New(registry Registry, graph Graph) RepositoryFetcher {
+func New(registry Registry, graph Graph, downloads *DownloadCache) RepositoryFetcher {
 	return &DockerRepositoryFetcher{
-		registry: registry,
-		graph:    graph,
+		registry:  registry,
+		graph:     graph,
+		downloads: downloads,
 	}
 }
 
-func (fetcher *DockerRepositoryFetcher) Fetch(repoName string, tag string) (string, error) {
+func (fetcher *DockerRepositoryFetcher) Fetch(repoName string, tag string) (*Image, error) {
+	return fetcher.FetchWithProgress(repoName, tag, nil)
+}
+
+func (fetcher *DockerRepositoryFetcher) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
 	log.Println("fetching", repoName+":"+tag)
 
 	repoData, err := fetcher.registry.GetRepositoryData(repoName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	tagsList, err := fetcher.registry.GetRemoteTags(repoData.Endpoints, repoName, repoData.Tokens)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	imgID, ok := tagsList[tag]
 	if !ok {
-		return "", fmt.Errorf("unknown tag: %s:%s", repoName, tag)
+		return nil, UnknownTagError{Repository: repoName, Tag: tag}
 	}
 
 	token := repoData.Tokens
 
+	progress = progressOrDiscard(progress)
+
 	for _, endpoint := range repoData.Endpoints {
 		log.Println("trying endpoint", endpoint, "for", imgID)
-		err = fetcher.fetchFromEndpoint(endpoint, imgID, token)
+
+		var img *image.Image
+
+		img, err = fetcher.fetchFromEndpoint(endpoint, imgID, token, repoData.ImgList, progress)
 		if err == nil {
-			return imgID, nil
+			return &Image{ID: imgID, Config: img.Config}, nil
 		}
 	}
 
-	return "", fmt.Errorf("all endpoints failed: %s", err)
+	return nil, AllEndpointsFailedError{Err: err}
 }
 
-func (fetcher *DockerRepositoryFetcher) fetchFromEndpoint(endpoint string, imgID string, token []string) error {
+func (fetcher *DockerRepositoryFetcher) fetchFromEndpoint(endpoint string, imgID string, token []string, checksums map[string]*registry.ImgData, progress ProgressReporter) (*image.Image, error) {
 	history, err := fetcher.registry.GetRemoteHistory(imgID, endpoint, token)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if len(history) == 0 {
+		return nil, fmt.Errorf("empty history for image: %s", imgID)
 	}
 
+	missing := []string{}
+
 	for i := len(history) - 1; i >= 0; i-- {
 		id := history[i]
 
 		if fetcher.graph.Exists(id) {
 			log.Println("already exists:", id)
+			progress.ReportLayer(LayerProgress{LayerID: id, Cached: true, Complete: true})
 			continue
 		}
 
-		imgJSON, _, err := fetcher.registry.GetRemoteImageJSON(id, endpoint, token)
+		missing = append(missing, id)
+	}
+
+	downloads := fetcher.downloadLayers(endpoint, missing, token, checksums, progress)
+	defer downloads.close()
+
+	// layers are downloaded concurrently, but must be registered parent-first
+	for i, id := range missing {
+		// if someone else registers the layer first, this fetch didn't need
+		// to download it after all
+		registered := LayerProgress{LayerID: id, Cached: true, Complete: true}
+
+		err := registerOnce(fetcher.graph, id, func() error {
+			layer := downloads.take(i)
+			defer layer.cleanup()
+
+			if layer.err != nil {
+				return layer.err
+			}
+
+			registered = layer.progress
+			registered.Complete = true
+
+			return fetcher.graph.Register(layer.imgJSON, layer.file, layer.img)
+		})
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		progress.ReportLayer(registered)
+	}
+
+	// the first entry in the history is the image itself; its config is the
+	// one the image was committed with
+	return fetcher.graph.Get(history[0])
+}
+
+// downloadLayers starts downloading the given layers in the background,
+// spooling each to a temporary file and verifying it against the checksum
+// listed for it, with at most layerDownloadWorkers downloads in flight.
+// Layers are started in the order given.
+func (fetcher *DockerRepositoryFetcher) downloadLayers(endpoint string, layerIDs []string, token []string, checksums map[string]*registry.ImgData, progress ProgressReporter) *layerDownloads {
+	downloads := &layerDownloads{
+		results: make([]chan *spooledLayer, len(layerIDs)),
+		abort:   make(chan struct{}),
+	}
+
+	jobs := make(chan int, len(layerIDs))
+
+	for i := range layerIDs {
+		downloads.results[i] = make(chan *spooledLayer, 1)
+		jobs <- i
+	}
+
+	close(jobs)
+
+	workers := layerDownloadWorkers
+	if len(layerIDs) < workers {
+		workers = len(layerIDs)
+	}
+
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range jobs {
+				select {
+				case <-downloads.abort:
+					downloads.results[i] <- &spooledLayer{err: errDownloadAborted}
+				default:
+					checksum := ""
+					if data, found := checksums[layerIDs[i]]; found {
+						checksum = data.Checksum
+					}
+
+					downloads.results[i] <- fetcher.spoolLayer(endpoint, layerIDs[i], token, checksum, progress)
+				}
+			}
+		}()
+	}
+
+	return downloads
+}
+
+func (fetcher *DockerRepositoryFetcher) spoolLayer(endpoint string, layerID string, token []string, checksum string, progress ProgressReporter) *spooledLayer {
+	imgJSON, size, err := fetcher.registry.GetRemoteImageJSON(layerID, endpoint, token)
+	if err != nil {
+		return &spooledLayer{err: err}
+	}
+
+	img, err := image.NewImgJSON(imgJSON)
+	if err != nil {
+		return &spooledLayer{err: err}
+	}
+
+	log.Println("downloading layer:", layerID)
+
+	download := &progressReader{
+		progress: progress,
+		layer:    LayerProgress{LayerID: layerID, Total: int64(size)},
+	}
+
+	file, err := fetcher.downloads.download("v1-"+img.ID, fetcher.layerRequester(img.ID, endpoint, token), download)
+	if err != nil {
+		return &spooledLayer{err: err}
+	}
+
+	spooled := &spooledLayer{
+		imgJSON: imgJSON,
+		img:     img,
+		file:    file,
+	}
+
+	err = verifySpooled(file, layerID, checksum, imgJSON)
+	if err != nil {
+		spooled.cleanup()
+		return &spooledLayer{err: err}
+	}
+
+	spooled.progress = download.layer
+
+	return spooled
+}
+
+// layerRequester requests the layer from an offset, if the registry can;
+// otherwise, the whole layer is requested each time.
+func (fetcher *DockerRepositoryFetcher) layerRequester(imgID string, endpoint string, token []string) rangeRequester {
+	if ranged, ok := fetcher.registry.(RangedRegistry); ok {
+		return func(offset int64, validator string) (*http.Response, error) {
+			return ranged.GetRemoteImageLayerFrom(imgID, endpoint, token, offset, validator)
 		}
+	}
 
-		img, err := image.NewImgJSON(imgJSON)
+	return func(int64, string) (*http.Response, error) {
+		layer, err := fetcher.registry.GetRemoteImageLayer(imgID, endpoint, token)
+		if err != nil {
+			return nil, err
+		}
+
+		return &http.Response{StatusCode: http.StatusOK, Body: layer, ContentLength: -1}, nil
+	}
+}
+
+// verifySpooled checks the spooled layer against its checksum, if the index
+// listed one, and rewinds it for registering.
+func verifySpooled(file *os.File, layerID string, checksum string, imgJSON []byte) error {
+	if checksum != "" {
+		_, err := file.Seek(0, 0)
 		if err != nil {
 			return err
 		}
 
-		layer, err := fetcher.registry.GetRemoteImageLayer(img.ID, endpoint, token)
+		err = verifyTarsum(layerID, checksum, imgJSON, file)
 		if err != nil {
 			return err
 		}
+	} else {
+		log.Println("no checksum listed for layer:", layerID)
+	}
 
-		defer layer.Close()
+	_, err := file.Seek(0, 0)
+	return err
+}
 
-		log.Println("downloading layer:", id)
+// spooledLayer is a downloaded layer, ready to be registered, or the error
+// that prevented downloading it.
+type spooledLayer struct {
+	imgJSON []byte
+	img     *image.Image
+	file    *os.File
 
-		err = fetcher.graph.Register(imgJSON, layer, img)
-		if err != nil {
-			return err
+	progress LayerProgress
+
+	err error
+}
+
+func (layer *spooledLayer) cleanup() {
+	if layer.file == nil {
+		return
+	}
+
+	layer.file.Close()
+	os.Remove(layer.file.Name())
+}
+
+type layerDownloads struct {
+	results []chan *spooledLayer
+	abort   chan struct{}
+}
+
+// take waits for the i'th layer to finish downloading.
+func (downloads *layerDownloads) take(i int) *spooledLayer {
+	layer := <-downloads.results[i]
+	downloads.results[i] = nil
+	return layer
+}
+
+// close stops starting new downloads and cleans up any that were never
+// taken, e.g. because registering an earlier layer failed.
+func (downloads *layerDownloads) close() {
+	close(downloads.abort)
+
+	remaining := []chan *spooledLayer{}
+	for _, result := range downloads.results {
+		if result != nil {
+			remaining = append(remaining, result)
 		}
 	}
 
-	return nil
+	go func() {
+		for _, result := range remaining {
+			(<-result).cleanup()
+		}
+	}()
 }
@@ -1,13 +1,19 @@
 package repository_fetcher_test
 
 import (
+	"archive/tar"
+	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 
 	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/image"
 	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/runconfig"
+	"github.com/dotcloud/docker/utils"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -25,6 +31,8 @@ var _ = Describe("RepositoryFetcher", func() {
 	var endpoint1 *ghttp.Server
 	var endpoint2 *ghttp.Server
 
+	var downloadsDir string
+
 	BeforeEach(func() {
 		graph = fake_graph.New()
 
@@ -36,51 +44,60 @@ var _ = Describe("RepositoryFetcher", func() {
 		registry, err := registry.NewRegistry(nil, nil, server.URL()+"/v1/")
 		Ω(err).ShouldNot(HaveOccurred())
 
-		fetcher = New(registry, graph)
+		downloadsDir, err = ioutil.TempDir("", "downloads")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		downloads, err := NewDownloadCache(downloadsDir, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fetcher = New(registry, graph, downloads)
 	})
 
-	setupSuccessfulFetch := func(endpoint *ghttp.Server) {
-		endpoint.AppendHandlers(
-			ghttp.CombineHandlers(
-				ghttp.VerifyRequest("GET", "/v1/images/layer-3/json"),
-				http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-					w.Header().Add("X-Docker-Size", "123")
-					w.Write([]byte(`{"id":"layer-3","parent":"parent-3"}`))
-				}),
-			),
-			ghttp.CombineHandlers(
-				ghttp.VerifyRequest("GET", "/v1/images/layer-3/layer"),
-				http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-					w.Write([]byte(`layer-3-data`))
-				}),
-			),
-			ghttp.CombineHandlers(
-				ghttp.VerifyRequest("GET", "/v1/images/layer-2/json"),
-				http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-					w.Header().Add("X-Docker-Size", "456")
-					w.Write([]byte(`{"id":"layer-2","parent":"parent-2"}`))
-				}),
-			),
-			ghttp.CombineHandlers(
-				ghttp.VerifyRequest("GET", "/v1/images/layer-2/layer"),
-				http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-					w.Write([]byte(`layer-2-data`))
-				}),
-			),
-			ghttp.CombineHandlers(
-				ghttp.VerifyRequest("GET", "/v1/images/layer-1/json"),
-				http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-					w.Header().Add("X-Docker-Size", "789")
-					w.Write([]byte(`{"id":"layer-1","parent":"parent-1"}`))
-				}),
-			),
-			ghttp.CombineHandlers(
-				ghttp.VerifyRequest("GET", "/v1/images/layer-1/layer"),
-				http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-					w.Write([]byte(`layer-1-data`))
-				}),
-			),
-		)
+	AfterEach(func() {
+		os.RemoveAll(downloadsDir)
+	})
+
+	layerJSON := func(id string, size string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Add("X-Docker-Size", size)
+			w.Write([]byte(fmt.Sprintf(`{"id":"%s","parent":"parent-%s"}`, id, id[len("layer-"):])))
+		}
+	}
+
+	layerData := func(id string) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte(id + "-data"))
+		}
+	}
+
+	// layers are downloaded concurrently, so requests for them are routed by
+	// path rather than expected in order
+	appendRoutes := func(endpoint *ghttp.Server, routes map[string]http.HandlerFunc) {
+		router := func(w http.ResponseWriter, req *http.Request) {
+			handler, found := routes[req.URL.Path]
+			Ω(found).Should(BeTrue(), "unexpected request: "+req.URL.Path)
+
+			handler(w, req)
+		}
+
+		for i := 0; i < len(routes); i++ {
+			endpoint.AppendHandlers(router)
+		}
+	}
+
+	setupSuccessfulFetch := func(endpoint *ghttp.Server) map[string]http.HandlerFunc {
+		routes := map[string]http.HandlerFunc{
+			"/v1/images/layer-3/json":  layerJSON("layer-3", "123"),
+			"/v1/images/layer-3/layer": layerData("layer-3"),
+			"/v1/images/layer-2/json":  layerJSON("layer-2", "456"),
+			"/v1/images/layer-2/layer": layerData("layer-2"),
+			"/v1/images/layer-1/json":  layerJSON("layer-1", "789"),
+			"/v1/images/layer-1/layer": layerData("layer-1"),
+		}
+
+		appendRoutes(endpoint, routes)
+
+		return routes
 	}
 
 	Describe("Fetch", func() {
@@ -120,8 +137,10 @@ var _ = Describe("RepositoryFetcher", func() {
 		})
 
 		Context("when none of the layers already exist", func() {
+			var routes map[string]http.HandlerFunc
+
 			BeforeEach(func() {
-				setupSuccessfulFetch(endpoint1)
+				routes = setupSuccessfulFetch(endpoint1)
 			})
 
 			It("downloads all layers of the given tag of a repository and returns its image id", func() {
@@ -146,10 +165,32 @@ var _ = Describe("RepositoryFetcher", func() {
 					return nil
 				}
 
-				imageID, err := fetcher.Fetch("some-repo", "some-tag")
+				fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
 				Ω(err).ShouldNot(HaveOccurred())
 
-				Ω(imageID).Should(Equal("id-1"))
+				Ω(fetchedImage.ID).Should(Equal("id-1"))
+			})
+
+			Context("when the image has a config", func() {
+				BeforeEach(func() {
+					routes["/v1/images/layer-1/json"] = func(w http.ResponseWriter, req *http.Request) {
+						w.Header().Add("X-Docker-Size", "789")
+						w.Write([]byte(`{
+							"id":"layer-1",
+							"parent":"parent-1",
+							"config":{"Env":["PATH=/usr/bin:/bin"],"WorkingDir":"/app"}
+						}`))
+					}
+				})
+
+				It("returns it with the image", func() {
+					fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fetchedImage.Config).ShouldNot(BeNil())
+					Ω(fetchedImage.Config.Env).Should(Equal([]string{"PATH=/usr/bin:/bin"}))
+					Ω(fetchedImage.Config.WorkingDir).Should(Equal("/app"))
+				})
 			})
 
 			Context("when the first endpoint fails", func() {
@@ -171,10 +212,10 @@ var _ = Describe("RepositoryFetcher", func() {
 				})
 
 				It("retries with the next endpoint", func() {
-					imageID, err := fetcher.Fetch("some-repo", "some-tag")
+					fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
 					Ω(err).ShouldNot(HaveOccurred())
 
-					Ω(imageID).Should(Equal("id-1"))
+					Ω(fetchedImage.ID).Should(Equal("id-1"))
 				})
 
 				Context("and the rest also fail", func() {
@@ -190,40 +231,188 @@ var _ = Describe("RepositoryFetcher", func() {
 					})
 				})
 			})
+			Context("when downloading a layer fails", func() {
+				BeforeEach(func() {
+					routes["/v1/images/layer-2/layer"] = func(w http.ResponseWriter, req *http.Request) {
+						w.WriteHeader(500)
+					}
+
+					endpoint2.AllowUnhandledRequests = true
+				})
+
+				It("registers the layers below it, but not above it", func() {
+					registered := []string{}
+
+					graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, image *image.Image) error {
+						registered = append(registered, image.ID)
+						return nil
+					}
+
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).Should(HaveOccurred())
+
+					Ω(registered).Should(Equal([]string{"layer-3"}))
+				})
+			})
+
+			Context("when the index lists a checksum for a layer", func() {
+				var layer2Tar []byte
+				var layer2Checksum string
+
+				BeforeEach(func() {
+					buf := new(bytes.Buffer)
+
+					writer := tar.NewWriter(buf)
+
+					err := writer.WriteHeader(&tar.Header{
+						Name: "some-file",
+						Mode: 0644,
+						Size: int64(len("some-contents")),
+					})
+					Ω(err).ShouldNot(HaveOccurred())
+
+					_, err = writer.Write([]byte("some-contents"))
+					Ω(err).ShouldNot(HaveOccurred())
+
+					err = writer.Close()
+					Ω(err).ShouldNot(HaveOccurred())
+
+					layer2Tar = buf.Bytes()
+
+					tarsum := &utils.TarSum{Reader: bytes.NewReader(layer2Tar), DisableCompression: true}
+
+					_, err = io.Copy(ioutil.Discard, tarsum)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					layer2Checksum = tarsum.Sum([]byte(`{"id":"layer-2","parent":"parent-2"}`))
+
+					server.SetHandler(0, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						w.Header().Set("X-Docker-Token", "token-1,token-2")
+						w.Header().Add("X-Docker-Endpoints", endpoint1.HTTPTestServer.Listener.Addr().String())
+						w.Header().Add("X-Docker-Endpoints", endpoint2.HTTPTestServer.Listener.Addr().String())
+						w.Write([]byte(fmt.Sprintf(`[
+							{"id": "id-1", "checksum": "sha-1"},
+							{"id": "layer-2", "checksum": "%s"}
+						]`, layer2Checksum)))
+					}))
+
+					routes["/v1/images/layer-2/layer"] = func(w http.ResponseWriter, req *http.Request) {
+						w.Write(layer2Tar)
+					}
+				})
+
+				It("registers the layer once it has been verified", func() {
+					registered := []string{}
+
+					graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, image *image.Image) error {
+						if image.ID == "layer-2" {
+							layerData, err := ioutil.ReadAll(layer)
+							Ω(err).ShouldNot(HaveOccurred())
+							Ω(layerData).Should(Equal(layer2Tar))
+						}
+
+						registered = append(registered, image.ID)
+						return nil
+					}
+
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(registered).Should(Equal([]string{"layer-3", "layer-2", "layer-1"}))
+				})
+
+				Context("and the layer does not match it", func() {
+					BeforeEach(func() {
+						routes["/v1/images/layer-2/layer"] = func(w http.ResponseWriter, req *http.Request) {
+							w.Write(bytes.Replace(layer2Tar, []byte("some-contents"), []byte("bad-contents!"), 1))
+						}
+
+						endpoint2.AllowUnhandledRequests = true
+					})
+
+					It("fails without registering the layer or anything above it", func() {
+						registered := []string{}
+
+						graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, image *image.Image) error {
+							registered = append(registered, image.ID)
+							return nil
+						}
+
+						_, err := fetcher.Fetch("some-repo", "some-tag")
+						Ω(err).Should(HaveOccurred())
+
+						Ω(registered).Should(Equal([]string{"layer-3"}))
+					})
+				})
+			})
+
+			Context("when the layers are slow to download", func() {
+				var inFlight chan struct{}
+				var release chan struct{}
+
+				BeforeEach(func() {
+					inFlight = make(chan struct{}, 3)
+					release = make(chan struct{})
+
+					for _, id := range []string{"layer-1", "layer-2", "layer-3"} {
+						data := layerData(id)
+
+						routes["/v1/images/"+id+"/layer"] = func(w http.ResponseWriter, req *http.Request) {
+							inFlight <- struct{}{}
+							<-release
+
+							data(w, req)
+						}
+					}
+
+					// ghttp serves one request at a time, so serve them concurrently
+					// from a plain server instead
+					endpoint1.HTTPTestServer.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						handler, found := routes[req.URL.Path]
+						if !found {
+							endpoint1.ServeHTTP(w, req)
+							return
+						}
+
+						handler(w, req)
+					})
+				})
+
+				It("downloads them concurrently, and registers them parent-first", func() {
+					registered := []string{}
+
+					graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, image *image.Image) error {
+						registered = append(registered, image.ID)
+						return nil
+					}
+
+					go func() {
+						defer GinkgoRecover()
+						defer close(release)
+
+						for i := 0; i < 3; i++ {
+							Eventually(inFlight).Should(Receive())
+						}
+					}()
+
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(registered).Should(Equal([]string{"layer-3", "layer-2", "layer-1"}))
+				})
+			})
 		})
 
 		Context("when an image already exists in the graph", func() {
 			BeforeEach(func() {
 				graph.SetExists("layer-2", true)
 
-				endpoint1.AppendHandlers(
-					ghttp.CombineHandlers(
-						ghttp.VerifyRequest("GET", "/v1/images/layer-3/json"),
-						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-							w.Header().Add("X-Docker-Size", "123")
-							w.Write([]byte(`{"id":"layer-3","parent":"parent-3"}`))
-						}),
-					),
-					ghttp.CombineHandlers(
-						ghttp.VerifyRequest("GET", "/v1/images/layer-3/layer"),
-						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-							w.Write([]byte(`layer-3-data`))
-						}),
-					),
-					ghttp.CombineHandlers(
-						ghttp.VerifyRequest("GET", "/v1/images/layer-1/json"),
-						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-							w.Header().Add("X-Docker-Size", "789")
-							w.Write([]byte(`{"id":"layer-1","parent":"parent-1"}`))
-						}),
-					),
-					ghttp.CombineHandlers(
-						ghttp.VerifyRequest("GET", "/v1/images/layer-1/layer"),
-						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-							w.Write([]byte(`layer-1-data`))
-						}),
-					),
-				)
+				appendRoutes(endpoint1, map[string]http.HandlerFunc{
+					"/v1/images/layer-3/json":  layerJSON("layer-3", "123"),
+					"/v1/images/layer-3/layer": layerData("layer-3"),
+					"/v1/images/layer-1/json":  layerJSON("layer-1", "789"),
+					"/v1/images/layer-1/layer": layerData("layer-1"),
+				})
 			})
 
 			It("does not fetch it", func() {
@@ -251,10 +440,55 @@ var _ = Describe("RepositoryFetcher", func() {
 					return nil
 				}
 
-				imageID, err := fetcher.Fetch("some-repo", "some-tag")
+				fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fetchedImage.ID).Should(Equal("id-1"))
+			})
+
+			It("reports it as cached, and the rest as downloaded", func() {
+				progress := NewPullProgress()
+
+				_, err := fetcher.(ProgressFetcher).FetchWithProgress("some-repo", "some-tag", progress)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				layers := progress.Layers()
+				Ω(layers).Should(HaveLen(3))
+
+				Ω(layers[0]).Should(Equal(LayerProgress{LayerID: "layer-2", Cached: true, Complete: true}))
+
+				// the rest are downloaded concurrently, so may be reported in
+				// either order
+				Ω(layers).Should(ContainElement(LayerProgress{LayerID: "layer-3", Current: 12, Total: 123, Complete: true}))
+				Ω(layers).Should(ContainElement(LayerProgress{LayerID: "layer-1", Current: 12, Total: 789, Complete: true}))
+			})
+		})
+
+		Context("when every layer already exists in the graph", func() {
+			BeforeEach(func() {
+				graph.SetExists("layer-1", true)
+				graph.SetExists("layer-2", true)
+				graph.SetExists("layer-3", true)
+
+				graph.SetImage(&image.Image{
+					ID: "layer-1",
+					Config: &runconfig.Config{
+						Env: []string{"FOO=bar"},
+					},
+				})
+			})
+
+			It("returns the config of the existing image without registering anything", func() {
+				graph.WhenRegistering = func([]byte, archive.ArchiveReader, *image.Image) error {
+					Fail("should not have registered")
+					return nil
+				}
+
+				fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
 				Ω(err).ShouldNot(HaveOccurred())
 
-				Ω(imageID).Should(Equal("id-1"))
+				Ω(fetchedImage.ID).Should(Equal("id-1"))
+				Ω(fetchedImage.Config.Env).Should(Equal([]string{"FOO=bar"}))
 			})
 		})
 
@@ -0,0 +1,145 @@
+package repository_fetcher
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+)
+
+type RepositoryPusher interface {
+	Push(repoName string, tag string, imageID string) error
+}
+
+// apes docker's *registry.Registry
+type PushRegistry interface {
+	PushImageJSONIndex(remote string, imgList []*registry.ImgData, validate bool, regs []string) (*registry.RepositoryData, error)
+
+	LookupRemoteImage(imgID string, registry string, token []string) bool
+
+	PushImageJSONRegistry(imgData *registry.ImgData, jsonRaw []byte, registry string, token []string) error
+	PushImageLayerRegistry(imgID string, layer io.Reader, registry string, token []string, jsonRaw []byte) (string, string, error)
+	PushImageChecksumRegistry(imgData *registry.ImgData, registry string, token []string) error
+	PushRegistryTag(remote string, revision string, tag string, registry string, token []string) error
+}
+
+// apes docker's *graph.Graph
+type LayerGraph interface {
+	Get(imageID string) (*image.Image, error)
+	TempLayerArchive(id string, compression archive.Compression, sf *utils.StreamFormatter, output io.Writer) (*archive.TempArchive, error)
+}
+
+// DockerRepositoryPusher pushes images from the graph to a registry speaking
+// the v1 protocol, the same way docker does: the image's ancestry is
+// announced to the index, layers the registry does not already have are
+// uploaded along with their checksums, and the tag is pointed at the image.
+type DockerRepositoryPusher struct {
+	registry PushRegistry
+	graph    LayerGraph
+}
+
+func NewPusher(registry PushRegistry, graph LayerGraph) RepositoryPusher {
+	return &DockerRepositoryPusher{
+		registry: registry,
+		graph:    graph,
+	}
+}
+
+func (pusher *DockerRepositoryPusher) Push(repoName string, tag string, imageID string) error {
+	log.Println("pushing", imageID, "as", repoName+":"+tag)
+
+	history, err := imageHistory(pusher.graph, imageID)
+	if err != nil {
+		return err
+	}
+
+	imgList := make([]*registry.ImgData, len(history))
+	for i, img := range history {
+		imgList[i] = &registry.ImgData{ID: img.ID}
+	}
+
+	imgList[len(imgList)-1].Tag = tag
+
+	repoData, err := pusher.registry.PushImageJSONIndex(repoName, imgList, false, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, endpoint := range repoData.Endpoints {
+		for _, imgData := range imgList {
+			if pusher.registry.LookupRemoteImage(imgData.ID, endpoint, repoData.Tokens) {
+				log.Println("already pushed:", imgData.ID)
+				continue
+			}
+
+			err := pusher.pushLayer(imgData, endpoint, repoData.Tokens)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := pusher.registry.PushRegistryTag(repoName, imageID, tag, endpoint, repoData.Tokens)
+		if err != nil {
+			return err
+		}
+	}
+
+	// let the index validate the checksums of everything pushed
+	_, err = pusher.registry.PushImageJSONIndex(repoName, imgList, true, repoData.Endpoints)
+	return err
+}
+
+func (pusher *DockerRepositoryPusher) pushLayer(imgData *registry.ImgData, endpoint string, token []string) error {
+	img, err := pusher.graph.Get(imgData.ID)
+	if err != nil {
+		return err
+	}
+
+	imgJSON, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+
+	err = pusher.registry.PushImageJSONRegistry(imgData, imgJSON, endpoint, token)
+	if err == registry.ErrAlreadyExists {
+		log.Println("already pushed:", imgData.ID)
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	layer, err := pusher.graph.TempLayerArchive(
+		imgData.ID,
+		archive.Uncompressed,
+		utils.NewStreamFormatter(false),
+		ioutil.Discard,
+	)
+	if err != nil {
+		return err
+	}
+
+	// the archive removes itself once read in full, but not if the upload
+	// fails part way
+	defer layer.Close()
+	defer os.Remove(layer.Name())
+
+	log.Println("uploading layer:", imgData.ID)
+
+	checksum, checksumPayload, err := pusher.registry.PushImageLayerRegistry(imgData.ID, layer, endpoint, token, imgJSON)
+	if err != nil {
+		return err
+	}
+
+	imgData.Checksum = checksum
+	imgData.ChecksumPayload = checksumPayload
+
+	return pusher.registry.PushImageChecksumRegistry(imgData, endpoint, token)
+}
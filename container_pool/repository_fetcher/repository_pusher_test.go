@@ -0,0 +1,237 @@
+package repository_fetcher_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/registry"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/fake_graph"
+)
+
+var _ = Describe("RepositoryPusher", func() {
+	var graph *fake_graph.FakeGraph
+	var pusher RepositoryPusher
+
+	var index *ghttp.Server
+	var endpoint *ghttp.Server
+
+	BeforeEach(func() {
+		graph = fake_graph.New()
+
+		index = ghttp.NewServer()
+		endpoint = ghttp.NewServer()
+
+		registry, err := registry.NewRegistry(&registry.AuthConfig{}, nil, index.URL()+"/v1/")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		pusher = NewPusher(registry, graph)
+
+		buf := new(bytes.Buffer)
+		writer := tar.NewWriter(buf)
+
+		err = writer.WriteHeader(&tar.Header{Name: "some-file", Mode: 0644, Size: 4})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = writer.Write([]byte("data"))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = writer.Close()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		graph.SetImage(&image.Image{ID: "layer-1"})
+		graph.SetImage(&image.Image{ID: "layer-2", Parent: "layer-1"})
+		graph.SetLayer("layer-2", buf.String())
+	})
+
+	AfterEach(func() {
+		index.Close()
+		endpoint.Close()
+	})
+
+	status := func(code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(code)
+		}
+	}
+
+	Describe("Push", func() {
+		BeforeEach(func() {
+			index.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/repositories/some-user/some-repo/"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						var imgList []registry.ImgData
+						err := json.NewDecoder(req.Body).Decode(&imgList)
+						Ω(err).ShouldNot(HaveOccurred())
+
+						Ω(imgList).Should(Equal([]registry.ImgData{
+							{ID: "layer-1"},
+							{ID: "layer-2", Tag: "some-tag"},
+						}))
+
+						w.Header().Set("X-Docker-Token", "some-token")
+						w.Header().Set("X-Docker-Endpoints", endpoint.HTTPTestServer.Listener.Addr().String())
+						w.WriteHeader(200)
+					}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/repositories/some-user/some-repo/images"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						var imgList []registry.ImgData
+						err := json.NewDecoder(req.Body).Decode(&imgList)
+						Ω(err).ShouldNot(HaveOccurred())
+
+						// only pushed layers have checksums to validate
+						Ω(imgList).Should(HaveLen(1))
+						Ω(imgList[0].ID).Should(Equal("layer-2"))
+						Ω(imgList[0].Checksum).ShouldNot(BeEmpty())
+
+						w.WriteHeader(204)
+					}),
+				),
+			)
+
+			endpoint.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/v1/images/layer-1/json"),
+					status(200),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/v1/images/layer-2/json"),
+					status(404),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/images/layer-2/json"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						var img image.Image
+						err := json.NewDecoder(req.Body).Decode(&img)
+						Ω(err).ShouldNot(HaveOccurred())
+
+						Ω(img.ID).Should(Equal("layer-2"))
+						Ω(img.Parent).Should(Equal("layer-1"))
+					}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/images/layer-2/layer"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						// docker compresses layers as it checksums them
+						decompressed, err := gzip.NewReader(req.Body)
+						Ω(err).ShouldNot(HaveOccurred())
+
+						layer := tar.NewReader(decompressed)
+
+						header, err := layer.Next()
+						Ω(err).ShouldNot(HaveOccurred())
+						Ω(header.Name).Should(Equal("some-file"))
+
+						content, err := ioutil.ReadAll(layer)
+						Ω(err).ShouldNot(HaveOccurred())
+						Ω(string(content)).Should(Equal("data"))
+					}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/images/layer-2/checksum"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						Ω(req.Header.Get("X-Docker-Checksum")).Should(MatchRegexp("^tarsum\\+sha256:"))
+						Ω(req.Header.Get("X-Docker-Checksum-Payload")).Should(MatchRegexp("^sha256:"))
+					}),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/repositories/some-user/some-repo/tags/some-tag"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						body, err := ioutil.ReadAll(req.Body)
+						Ω(err).ShouldNot(HaveOccurred())
+
+						Ω(string(body)).Should(Equal(`"layer-2"`))
+					}),
+				),
+			)
+		})
+
+		It("uploads the layers the registry does not have, and tags the image", func() {
+			err := pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(endpoint.ReceivedRequests()).Should(HaveLen(6))
+			Ω(index.ReceivedRequests()).Should(HaveLen(2))
+		})
+
+		Context("when the registry already has the image's json", func() {
+			BeforeEach(func() {
+				endpoint.SetHandler(2, ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/images/layer-2/json"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						w.WriteHeader(400)
+						w.Write([]byte(`{"error":"Image already exists"}`))
+					}),
+				))
+
+				endpoint.SetHandler(3, ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/repositories/some-user/some-repo/tags/some-tag"),
+					status(200),
+				))
+
+				index.SetHandler(1, ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/repositories/some-user/some-repo/images"),
+					status(204),
+				))
+			})
+
+			It("skips uploading its layer", func() {
+				err := pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(endpoint.ReceivedRequests()).Should(HaveLen(4))
+			})
+		})
+
+		Context("when uploading a layer fails", func() {
+			BeforeEach(func() {
+				endpoint.SetHandler(3, ghttp.CombineHandlers(
+					ghttp.VerifyRequest("PUT", "/v1/images/layer-2/layer"),
+					status(500),
+				))
+			})
+
+			It("returns an error without tagging", func() {
+				err := pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+				Ω(err).Should(HaveOccurred())
+
+				Ω(endpoint.ReceivedRequests()).Should(HaveLen(4))
+			})
+		})
+
+		Context("when the index rejects the push", func() {
+			BeforeEach(func() {
+				index.SetHandler(0, status(403))
+			})
+
+			It("returns an error without uploading anything", func() {
+				err := pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+				Ω(err).Should(HaveOccurred())
+
+				Ω(endpoint.ReceivedRequests()).Should(BeEmpty())
+			})
+		})
+
+		Context("when the image is not in the graph", func() {
+			It("returns an error", func() {
+				err := pusher.Push("some-user/some-repo", "some-tag", "bogus-id")
+				Ω(err).Should(HaveOccurred())
+
+				Ω(index.ReceivedRequests()).Should(BeEmpty())
+			})
+		})
+	})
+})
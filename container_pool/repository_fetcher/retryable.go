@@ -1,23 +1,149 @@
 package repository_fetcher
 
-import "log"
+import (
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
 
+	"github.com/dotcloud/docker/utils"
+)
+
+// RetryPolicy determines how often, and for how long, a failed fetch is
+// retried.
+type RetryPolicy struct {
+	// attempts to make in total, including the first
+	MaxAttempts int
+
+	// wait before the first retry, doubling for each retry after it up to
+	// MaxBackoff; each wait is jittered so that fetches that failed together
+	// don't all retry together
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// time to spend on a fetch, across all attempts, before giving up; 0 for
+	// no limit
+	Deadline time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+}
+
+// backoff returns how long to wait before the given retry (the first retry
+// being 1): half of the exponential backoff, plus up to half again at random.
+func (policy RetryPolicy) backoff(retry int) time.Duration {
+	backoff := policy.InitialBackoff
+
+	for i := 1; i < retry && backoff < policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+		backoff = policy.MaxBackoff
+	}
+
+	half := int64(backoff / 2)
+	if half == 0 {
+		return backoff
+	}
+
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Retryable retries fetches that fail with transient errors, e.g. network
+// errors or 5xx responses, according to its Policy (DefaultRetryPolicy if
+// unset). Errors that retrying won't fix, e.g. an unknown tag or a 4xx
+// response, fail immediately.
+//
+// Layers registered before a fetch failed are kept, so each retry picks up
+// from the layer that failed.
 type Retryable struct {
 	RepositoryFetcher
+
+	Policy RetryPolicy
 }
 
-func (retryable Retryable) Fetch(repoName string, tag string) (string, error) {
-	var res string
+func (retryable Retryable) Fetch(repoName string, tag string) (*Image, error) {
+	return retryable.FetchWithProgress(repoName, tag, nil)
+}
+
+func (retryable Retryable) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	policy := retryable.Policy
+	if policy == (RetryPolicy{}) {
+		policy = DefaultRetryPolicy
+	}
+
+	started := time.Now()
+
+	var res *Image
 	var err error
 
-	for attempt := 1; attempt <= 3; attempt++ {
-		res, err = retryable.RepositoryFetcher.Fetch(repoName, tag)
+	for attempt := 1; ; attempt++ {
+		res, err = fetchWithProgress(retryable.RepositoryFetcher, repoName, tag, progress)
 		if err == nil {
-			break
+			return res, nil
+		}
+
+		if isPermanent(err) {
+			log.Println("attempt", attempt, "failed permanently:", err)
+			return nil, err
+		}
+
+		if attempt >= policy.MaxAttempts {
+			log.Println("attempt", attempt, "of", policy.MaxAttempts, "failed; giving up:", err)
+			return nil, err
 		}
 
-		log.Println("attempt", attempt, "of 3 failed:", err)
+		backoff := policy.backoff(attempt)
+
+		if policy.Deadline > 0 && time.Since(started)+backoff > policy.Deadline {
+			log.Println("attempt", attempt, "failed; giving up at deadline:", err)
+			return nil, err
+		}
+
+		log.Println("attempt", attempt, "of", policy.MaxAttempts, "failed; retrying in", backoff.String()+":", err)
+
+		time.Sleep(backoff)
+	}
+}
+
+// isPermanent determines whether a fetch failed in a way that retrying won't
+// fix.
+func isPermanent(err error) bool {
+	switch e := err.(type) {
+	case UnknownTagError, ImageNotPresentError:
+		return true
+	case AllEndpointsFailedError:
+		return isPermanent(e.Err)
+	case UnexpectedStatusError:
+		return isClientError(e.StatusCode)
+	case *utils.JSONError:
+		return isClientError(e.Code)
+	}
+
+	return err == ErrUnsupportedManifest || isV1LoginRequired(err)
+}
+
+// v1LoginRequired is the message of the error docker's v1 registry client
+// returns when the registry responds 401, which it does not export.
+const v1LoginRequired = "Authentication is required."
+
+// isV1LoginRequired determines whether the error is the v1 registry client
+// being refused for lack of (or bad) credentials, which retrying won't fix.
+func isV1LoginRequired(err error) bool {
+	return err != nil && err.Error() == v1LoginRequired
+}
+
+// isClientError determines whether a response status means the request
+// itself was wrong; timeouts and rate limiting are worth waiting out.
+func isClientError(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
 	}
 
-	return res, err
+	return status >= 400 && status < 500
 }
@@ -0,0 +1,279 @@
+package repository_fetcher_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/registry"
+	"github.com/dotcloud/docker/utils"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+	"github.com/vito/warden-docker/fake_graph"
+)
+
+var _ = Describe("Retryable", func() {
+	var wrapped *fake_repository_fetcher.FakeRepositoryFetcher
+	var policy RetryPolicy
+	var fetcher RepositoryFetcher
+
+	var attempts int
+
+	BeforeEach(func() {
+		wrapped = fake_repository_fetcher.New()
+		wrapped.FetchResult = "some-image-id"
+
+		policy = RetryPolicy{
+			MaxAttempts:    3,
+			InitialBackoff: 20 * time.Millisecond,
+			MaxBackoff:     time.Second,
+		}
+
+		attempts = 0
+	})
+
+	JustBeforeEach(func() {
+		fetcher = Retryable{RepositoryFetcher: wrapped, Policy: policy}
+	})
+
+	// failTimes makes the wrapped fetcher fail with the error the given
+	// number of times before succeeding
+	failTimes := func(times int, err error) {
+		wrapped.FetchError = err
+		wrapped.WhenFetching = func(string, string) {
+			attempts++
+
+			if attempts > times {
+				wrapped.FetchError = nil
+			}
+		}
+	}
+
+	Context("when the fetch fails with a transient error", func() {
+		disaster := errors.New("connection reset by peer")
+
+		It("retries it, backing off between attempts", func() {
+			failTimes(2, disaster)
+
+			started := time.Now()
+
+			img, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(img.ID).Should(Equal("some-image-id"))
+
+			Ω(attempts).Should(Equal(3))
+
+			// at least half of 20ms, then half of 40ms
+			Ω(time.Since(started)).Should(BeNumerically(">=", 30*time.Millisecond))
+		})
+
+		Context("on every attempt", func() {
+			It("gives up after the policy's max attempts", func() {
+				failTimes(10, disaster)
+
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(disaster))
+
+				Ω(attempts).Should(Equal(3))
+			})
+		})
+
+		Context("and the next attempt would pass the deadline", func() {
+			BeforeEach(func() {
+				policy.Deadline = 5 * time.Millisecond
+			})
+
+			It("gives up without waiting", func() {
+				failTimes(10, disaster)
+
+				started := time.Now()
+
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(disaster))
+
+				Ω(attempts).Should(Equal(1))
+				Ω(time.Since(started)).Should(BeNumerically("<", 10*time.Millisecond))
+			})
+		})
+	})
+
+	Context("when the registry responds with a server error", func() {
+		It("retries", func() {
+			failTimes(1, UnexpectedStatusError{URL: "some-url", StatusCode: 503})
+
+			_, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(attempts).Should(Equal(2))
+		})
+	})
+
+	Context("when the registry is rate limiting", func() {
+		It("retries", func() {
+			failTimes(1, UnexpectedStatusError{URL: "some-url", StatusCode: 429})
+
+			_, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(attempts).Should(Equal(2))
+		})
+	})
+
+	for _, permanent := range []error{
+		UnknownTagError{Repository: "some-repo", Tag: "some-tag"},
+		UnexpectedStatusError{URL: "some-url", StatusCode: 404},
+		&utils.JSONError{Code: 403, Message: "forbidden"},
+		AllEndpointsFailedError{Err: &utils.JSONError{Code: 404, Message: "not found"}},
+		ErrUnsupportedManifest,
+	} {
+		permanent := permanent
+
+		Context(fmt.Sprintf("when the fetch fails with %T (%s)", permanent, permanent), func() {
+			It("fails immediately", func() {
+				failTimes(1, permanent)
+
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(permanent))
+
+				Ω(attempts).Should(Equal(1))
+			})
+		})
+	}
+
+	Context("when a v1 registry requires authentication", func() {
+		var server *ghttp.Server
+		var downloadsDir string
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+
+			server.AppendHandlers(
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/v1/repositories/some-repo/images"),
+					ghttp.RespondWith(401, ""),
+				),
+			)
+
+			var err error
+
+			downloadsDir, err = ioutil.TempDir("", "downloads")
+			Ω(err).ShouldNot(HaveOccurred())
+		})
+
+		JustBeforeEach(func() {
+			reg, err := registry.NewRegistry(&registry.AuthConfig{}, registry.HTTPRequestFactory(nil), server.URL()+"/v1/")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			downloads, err := NewDownloadCache(downloadsDir, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			fetcher = Retryable{RepositoryFetcher: New(reg, fake_graph.New(), downloads), Policy: policy}
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(downloadsDir)
+		})
+
+		It("fails immediately", func() {
+			_, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).Should(HaveOccurred())
+
+			Ω(server.ReceivedRequests()).Should(HaveLen(1))
+		})
+	})
+
+	Context("when retrying a fetch that registered some layers", func() {
+		var server *ghttp.Server
+		var graph *fake_graph.FakeGraph
+
+		var downloadsDir string
+		var downloads *DownloadCache
+
+		digest := func(data string) string {
+			sum := sha256.Sum256([]byte(data))
+			return "sha256:" + hex.EncodeToString(sum[:])
+		}
+
+		BeforeEach(func() {
+			server = ghttp.NewServer()
+			graph = fake_graph.New()
+
+			var err error
+
+			downloadsDir, err = ioutil.TempDir("", "downloads")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			downloads, err = NewDownloadCache(downloadsDir, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			manifest := ghttp.RespondWith(200, fmt.Sprintf(`{
+				"schemaVersion": 1,
+				"fsLayers": [{"blobSum": "%s"}, {"blobSum": "%s"}],
+				"history": [
+					{"v1Compatibility": "{\"id\":\"layer-2\",\"parent\":\"layer-1\"}"},
+					{"v1Compatibility": "{\"id\":\"layer-1\"}"}
+				]
+			}`, digest("top-data"), digest("base-data")))
+
+			server.AppendHandlers(
+				manifest,
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/v2/some-repo/blobs/"+digest("base-data")),
+					ghttp.RespondWith(200, "base-data"),
+				),
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/v2/some-repo/blobs/"+digest("top-data")),
+					ghttp.RespondWith(500, ""),
+				),
+				manifest,
+				ghttp.CombineHandlers(
+					ghttp.VerifyRequest("GET", "/v2/some-repo/blobs/"+digest("top-data")),
+					ghttp.RespondWith(200, "top-data"),
+				),
+			)
+		})
+
+		JustBeforeEach(func() {
+			fetcher = Retryable{
+				RepositoryFetcher: NewV2(server.URL(), Credentials{}, graph, downloads),
+				Policy:            policy,
+			}
+		})
+
+		AfterEach(func() {
+			server.Close()
+			os.RemoveAll(downloadsDir)
+		})
+
+		It("resumes from the layer that failed", func() {
+			registered := []string{}
+
+			graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, img *image.Image) error {
+				_, err := ioutil.ReadAll(layer)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				registered = append(registered, img.ID)
+				return nil
+			}
+
+			img, err := fetcher.Fetch("some-repo", "some-tag")
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(img.ID).Should(Equal("layer-2"))
+
+			Ω(registered).Should(Equal([]string{"layer-1", "layer-2"}))
+			Ω(server.ReceivedRequests()).Should(HaveLen(5))
+		})
+	})
+})
@@ -0,0 +1,141 @@
+package repository_fetcher
+
+import (
+	"strings"
+	"sync"
+)
+
+// Router fetches repositories whose names begin with a registry host (e.g.
+// localhost:5000/team/app) from that registry, and all others from the
+// default registry.
+type Router struct {
+	defaultFetcher RepositoryFetcher
+	newFetcher     func(registryHost string) (RepositoryFetcher, error)
+
+	fetchers      map[string]RepositoryFetcher
+	fetchersMutex *sync.Mutex
+}
+
+func NewRouter(
+	defaultFetcher RepositoryFetcher,
+	newFetcher func(registryHost string) (RepositoryFetcher, error),
+) *Router {
+	return &Router{
+		defaultFetcher: defaultFetcher,
+		newFetcher:     newFetcher,
+
+		fetchers:      make(map[string]RepositoryFetcher),
+		fetchersMutex: new(sync.Mutex),
+	}
+}
+
+func (router *Router) Fetch(repoName string, tag string) (*Image, error) {
+	return router.FetchWithProgress(repoName, tag, nil)
+}
+
+func (router *Router) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	host, remoteName := SplitRegistryHost(repoName)
+	if host == "" {
+		return fetchWithProgress(router.defaultFetcher, repoName, tag, progress)
+	}
+
+	fetcher, err := router.fetcherFor(host)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetchWithProgress(fetcher, remoteName, tag, progress)
+}
+
+func (router *Router) fetcherFor(host string) (RepositoryFetcher, error) {
+	router.fetchersMutex.Lock()
+	defer router.fetchersMutex.Unlock()
+
+	fetcher, found := router.fetchers[host]
+	if found {
+		return fetcher, nil
+	}
+
+	fetcher, err := router.newFetcher(host)
+	if err != nil {
+		return nil, err
+	}
+
+	router.fetchers[host] = fetcher
+
+	return fetcher, nil
+}
+
+// PushRouter pushes repositories whose names begin with a registry host to
+// that registry, and all others to the default registry, as Router does for
+// fetches.
+type PushRouter struct {
+	defaultPusher RepositoryPusher
+	newPusher     func(registryHost string) (RepositoryPusher, error)
+
+	pushers      map[string]RepositoryPusher
+	pushersMutex *sync.Mutex
+}
+
+func NewPushRouter(
+	defaultPusher RepositoryPusher,
+	newPusher func(registryHost string) (RepositoryPusher, error),
+) *PushRouter {
+	return &PushRouter{
+		defaultPusher: defaultPusher,
+		newPusher:     newPusher,
+
+		pushers:      make(map[string]RepositoryPusher),
+		pushersMutex: new(sync.Mutex),
+	}
+}
+
+func (router *PushRouter) Push(repoName string, tag string, imageID string) error {
+	host, remoteName := SplitRegistryHost(repoName)
+	if host == "" {
+		return router.defaultPusher.Push(repoName, tag, imageID)
+	}
+
+	pusher, err := router.pusherFor(host)
+	if err != nil {
+		return err
+	}
+
+	return pusher.Push(remoteName, tag, imageID)
+}
+
+func (router *PushRouter) pusherFor(host string) (RepositoryPusher, error) {
+	router.pushersMutex.Lock()
+	defer router.pushersMutex.Unlock()
+
+	pusher, found := router.pushers[host]
+	if found {
+		return pusher, nil
+	}
+
+	pusher, err := router.newPusher(host)
+	if err != nil {
+		return nil, err
+	}
+
+	router.pushers[host] = pusher
+
+	return pusher, nil
+}
+
+// SplitRegistryHost splits the registry host off of a repository name, using
+// the same rules as docker: the first path segment is a host if it contains
+// a '.' or a ':', or is "localhost". The host is empty for repositories on the
+// default registry.
+func SplitRegistryHost(repoName string) (string, string) {
+	segs := strings.SplitN(repoName, "/", 2)
+	if len(segs) == 1 {
+		return "", repoName
+	}
+
+	if !strings.ContainsAny(segs[0], ".:") && segs[0] != "localhost" {
+		return "", repoName
+	}
+
+	return segs[0], segs[1]
+}
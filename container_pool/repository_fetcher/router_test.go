@@ -0,0 +1,144 @@
+package repository_fetcher_test
+
+import (
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_pusher"
+)
+
+var _ = Describe("Router", func() {
+	var defaultFetcher *fake_repository_fetcher.FakeRepositoryFetcher
+	var registryFetchers map[string]*fake_repository_fetcher.FakeRepositoryFetcher
+	var newFetcherError error
+	var created []string
+
+	var router *Router
+
+	BeforeEach(func() {
+		defaultFetcher = fake_repository_fetcher.New()
+		registryFetchers = map[string]*fake_repository_fetcher.FakeRepositoryFetcher{}
+		newFetcherError = nil
+		created = []string{}
+
+		router = NewRouter(defaultFetcher, func(host string) (RepositoryFetcher, error) {
+			if newFetcherError != nil {
+				return nil, newFetcherError
+			}
+
+			created = append(created, host)
+
+			fetcher := fake_repository_fetcher.New()
+			registryFetchers[host] = fetcher
+
+			return fetcher, nil
+		})
+	})
+
+	It("fetches unqualified repositories with the default fetcher", func() {
+		_, err := router.Fetch("team/app", "some-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(defaultFetcher.Fetched()).Should(Equal([]fake_repository_fetcher.FetchSpec{
+			{Repository: "team/app", Tag: "some-tag"},
+		}))
+	})
+
+	It("fetches qualified repositories from a fetcher for their registry", func() {
+		_, err := router.Fetch("localhost:5000/team/app", "some-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = router.Fetch("localhost:5000/other-app", "other-tag")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(defaultFetcher.Fetched()).Should(BeEmpty())
+
+		Ω(created).Should(Equal([]string{"localhost:5000"}))
+		Ω(registryFetchers["localhost:5000"].Fetched()).Should(Equal([]fake_repository_fetcher.FetchSpec{
+			{Repository: "team/app", Tag: "some-tag"},
+			{Repository: "other-app", Tag: "other-tag"},
+		}))
+	})
+
+	Context("when creating the registry's fetcher fails", func() {
+		disaster := errors.New("oh no!")
+
+		BeforeEach(func() {
+			newFetcherError = disaster
+		})
+
+		It("returns the error", func() {
+			_, err := router.Fetch("localhost:5000/team/app", "some-tag")
+			Ω(err).Should(Equal(disaster))
+		})
+	})
+
+	Describe("SplitRegistryHost", func() {
+		It("splits off hosts with a dot, a port, or named localhost", func() {
+			host, name := SplitRegistryHost("registry.example.com/team/app")
+			Ω(host).Should(Equal("registry.example.com"))
+			Ω(name).Should(Equal("team/app"))
+
+			host, name = SplitRegistryHost("localhost:5000/app")
+			Ω(host).Should(Equal("localhost:5000"))
+			Ω(name).Should(Equal("app"))
+
+			host, name = SplitRegistryHost("localhost/app")
+			Ω(host).Should(Equal("localhost"))
+			Ω(name).Should(Equal("app"))
+		})
+
+		It("leaves names on the default registry alone", func() {
+			host, name := SplitRegistryHost("team/app")
+			Ω(host).Should(BeEmpty())
+			Ω(name).Should(Equal("team/app"))
+
+			host, name = SplitRegistryHost("app")
+			Ω(host).Should(BeEmpty())
+			Ω(name).Should(Equal("app"))
+		})
+	})
+})
+
+var _ = Describe("PushRouter", func() {
+	var defaultPusher *fake_repository_pusher.FakeRepositoryPusher
+	var registryPushers map[string]*fake_repository_pusher.FakeRepositoryPusher
+
+	var router *PushRouter
+
+	BeforeEach(func() {
+		defaultPusher = fake_repository_pusher.New()
+		registryPushers = map[string]*fake_repository_pusher.FakeRepositoryPusher{}
+
+		router = NewPushRouter(defaultPusher, func(host string) (RepositoryPusher, error) {
+			pusher := fake_repository_pusher.New()
+			registryPushers[host] = pusher
+
+			return pusher, nil
+		})
+	})
+
+	It("pushes unqualified repositories with the default pusher", func() {
+		err := router.Push("team/app", "some-tag", "some-image-id")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(defaultPusher.Pushed()).Should(Equal([]fake_repository_pusher.PushSpec{
+			{Repository: "team/app", Tag: "some-tag", ImageID: "some-image-id"},
+		}))
+	})
+
+	It("pushes qualified repositories with a pusher for their registry", func() {
+		err := router.Push("localhost:5000/team/app", "some-tag", "some-image-id")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(defaultPusher.Pushed()).Should(BeEmpty())
+
+		Ω(registryPushers["localhost:5000"].Pushed()).Should(Equal([]fake_repository_pusher.PushSpec{
+			{Repository: "team/app", Tag: "some-tag", ImageID: "some-image-id"},
+		}))
+	})
+})
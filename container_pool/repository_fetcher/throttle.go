@@ -0,0 +1,240 @@
+package repository_fetcher
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// PullLimits bounds how much of the host pulling images may take up, so that
+// a burst of pulls can't saturate its network and starve the containers
+// running on it. A limit of 0 is no limit.
+type PullLimits struct {
+	// repositories fetched at once
+	MaxRepositories int
+
+	// layers downloaded at once, across every fetch
+	MaxLayers int
+
+	// bytes per second downloaded, across every layer
+	BytesPerSecond int64
+}
+
+// Throttle enforces PullLimits across every fetcher in the process. Fetches
+// and downloads waiting for their turn are let through in the order they
+// arrived, and the bandwidth is shared evenly between the layers being
+// downloaded.
+//
+// A nil *Throttle enforces no limits.
+type Throttle struct {
+	repositories *fairSemaphore
+	layers       *fairSemaphore
+	bandwidth    *bandwidth
+}
+
+func NewThrottle(limits PullLimits) *Throttle {
+	throttle := &Throttle{
+		repositories: newFairSemaphore(limits.MaxRepositories),
+		layers:       newFairSemaphore(limits.MaxLayers),
+	}
+
+	if limits.BytesPerSecond > 0 {
+		throttle.bandwidth = &bandwidth{
+			bytesPerSecond: limits.BytesPerSecond,
+			mutex:          new(sync.Mutex),
+		}
+	}
+
+	return throttle
+}
+
+func (throttle *Throttle) acquireRepository() {
+	if throttle != nil {
+		throttle.repositories.acquire()
+	}
+}
+
+func (throttle *Throttle) releaseRepository() {
+	if throttle != nil {
+		throttle.repositories.release()
+	}
+}
+
+func (throttle *Throttle) acquireLayer() {
+	if throttle != nil {
+		throttle.layers.acquire()
+	}
+}
+
+func (throttle *Throttle) releaseLayer() {
+	if throttle != nil {
+		throttle.layers.release()
+	}
+}
+
+// reader limits reading from the reader to the throttle's share of the
+// bandwidth.
+func (throttle *Throttle) reader(reader io.Reader) io.Reader {
+	if throttle == nil || throttle.bandwidth == nil {
+		return reader
+	}
+
+	return &throttledReader{
+		Reader:    reader,
+		bandwidth: throttle.bandwidth,
+	}
+}
+
+// Throttled limits how many repositories are fetched at once, queueing the
+// rest in the order they were asked for. Layer downloads and bandwidth are
+// limited by the DownloadCache, which is given the same Throttle.
+//
+// It goes inside Retryable, so that a fetch waiting to be retried gives up
+// its turn to the fetches queued behind it.
+type Throttled struct {
+	RepositoryFetcher
+
+	throttle *Throttle
+}
+
+func NewThrottled(fetcher RepositoryFetcher, throttle *Throttle) *Throttled {
+	return &Throttled{
+		RepositoryFetcher: fetcher,
+
+		throttle: throttle,
+	}
+}
+
+func (throttled *Throttled) Fetch(repoName string, tag string) (*Image, error) {
+	return throttled.FetchWithProgress(repoName, tag, nil)
+}
+
+func (throttled *Throttled) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	throttled.throttle.acquireRepository()
+	defer throttled.throttle.releaseRepository()
+
+	return fetchWithProgress(throttled.RepositoryFetcher, repoName, tag, progress)
+}
+
+// fairSemaphore lets through so many at once, and the rest in the order they
+// arrived. A nil *fairSemaphore lets everyone through.
+type fairSemaphore struct {
+	available int
+	waiting   []chan struct{}
+
+	mutex *sync.Mutex
+}
+
+func newFairSemaphore(size int) *fairSemaphore {
+	if size <= 0 {
+		return nil
+	}
+
+	return &fairSemaphore{
+		available: size,
+		mutex:     new(sync.Mutex),
+	}
+}
+
+func (sem *fairSemaphore) acquire() {
+	if sem == nil {
+		return
+	}
+
+	sem.mutex.Lock()
+
+	if sem.available > 0 {
+		sem.available--
+		sem.mutex.Unlock()
+		return
+	}
+
+	turn := make(chan struct{})
+	sem.waiting = append(sem.waiting, turn)
+
+	sem.mutex.Unlock()
+
+	<-turn
+}
+
+func (sem *fairSemaphore) release() {
+	if sem == nil {
+		return
+	}
+
+	sem.mutex.Lock()
+	defer sem.mutex.Unlock()
+
+	// hand the turn straight to the next in line, so that no one arriving in
+	// the meantime can take it first
+	if len(sem.waiting) > 0 {
+		close(sem.waiting[0])
+		sem.waiting = sem.waiting[1:]
+		return
+	}
+
+	sem.available++
+}
+
+// bandwidth schedules reads one after another at the rate, each taking up
+// the time its bytes take at that rate; readers are scheduled in the order
+// they read, so that each gets an even share.
+type bandwidth struct {
+	bytesPerSecond int64
+
+	// when the bytes scheduled so far will have been read
+	next time.Time
+
+	mutex *sync.Mutex
+}
+
+// chunk is how much one read may take at a time, so that readers take turns
+// often: a twentieth of a second's worth, but at least 1KB.
+func (bandwidth *bandwidth) chunk() int {
+	chunk := bandwidth.bytesPerSecond / 20
+	if chunk < 1024 {
+		chunk = 1024
+	}
+
+	return int(chunk)
+}
+
+// schedule reserves the time for the bytes, returning how long to wait until
+// it starts.
+func (bandwidth *bandwidth) schedule(bytes int) time.Duration {
+	bandwidth.mutex.Lock()
+	defer bandwidth.mutex.Unlock()
+
+	now := time.Now()
+
+	// time spent idle isn't saved up for a burst later
+	if bandwidth.next.Before(now) {
+		bandwidth.next = now
+	}
+
+	wait := bandwidth.next.Sub(now)
+
+	bandwidth.next = bandwidth.next.Add(time.Duration(int64(bytes) * int64(time.Second) / bandwidth.bytesPerSecond))
+
+	return wait
+}
+
+type throttledReader struct {
+	io.Reader
+
+	bandwidth *bandwidth
+}
+
+func (reader *throttledReader) Read(p []byte) (int, error) {
+	if chunk := reader.bandwidth.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+
+	n, err := reader.Reader.Read(p)
+
+	if n > 0 {
+		time.Sleep(reader.bandwidth.schedule(n))
+	}
+
+	return n, err
+}
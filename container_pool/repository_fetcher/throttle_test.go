@@ -0,0 +1,309 @@
+package repository_fetcher_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+	"github.com/vito/warden-docker/fake_graph"
+)
+
+var _ = Describe("Throttled", func() {
+	var wrapped *fake_repository_fetcher.FakeRepositoryFetcher
+	var fetcher RepositoryFetcher
+
+	var release chan struct{}
+
+	var running int
+	var maxRunning int
+	var started []string
+	var runningMutex *sync.Mutex
+
+	BeforeEach(func() {
+		wrapped = fake_repository_fetcher.New()
+
+		release = make(chan struct{})
+
+		running = 0
+		maxRunning = 0
+		started = []string{}
+		runningMutex = new(sync.Mutex)
+
+		wrapped.WhenFetching = func(repoName string, tag string) {
+			runningMutex.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			started = append(started, repoName)
+			runningMutex.Unlock()
+
+			<-release
+
+			runningMutex.Lock()
+			running--
+			runningMutex.Unlock()
+		}
+	})
+
+	currentlyRunning := func() int {
+		runningMutex.Lock()
+		defer runningMutex.Unlock()
+
+		return running
+	}
+
+	fetchInBackground := func(repoName string) chan error {
+		errs := make(chan error, 1)
+
+		go func() {
+			_, err := fetcher.Fetch(repoName, "some-tag")
+			errs <- err
+		}()
+
+		return errs
+	}
+
+	Context("with a limit on repositories", func() {
+		BeforeEach(func() {
+			fetcher = NewThrottled(wrapped, NewThrottle(PullLimits{MaxRepositories: 2}))
+		})
+
+		It("fetches only so many at once", func() {
+			results := []chan error{}
+			for i := 0; i < 5; i++ {
+				results = append(results, fetchInBackground(fmt.Sprintf("repo-%d", i)))
+			}
+
+			Eventually(currentlyRunning).Should(Equal(2))
+			Consistently(currentlyRunning).Should(Equal(2))
+
+			close(release)
+
+			for _, errs := range results {
+				Eventually(errs).Should(Receive(BeNil()))
+			}
+
+			Ω(maxRunning).Should(Equal(2))
+			Ω(wrapped.Fetched()).Should(HaveLen(5))
+		})
+
+		It("lets the waiting fetches through in the order they arrived", func() {
+			releases := map[string]chan struct{}{}
+			for i := 0; i < 5; i++ {
+				releases[fmt.Sprintf("repo-%d", i)] = make(chan struct{})
+			}
+
+			wrapped.WhenFetching = func(repoName string, tag string) {
+				runningMutex.Lock()
+				started = append(started, repoName)
+				runningMutex.Unlock()
+
+				<-releases[repoName]
+			}
+
+			startedSoFar := func() []string {
+				runningMutex.Lock()
+				defer runningMutex.Unlock()
+
+				return append([]string{}, started...)
+			}
+
+			results := []chan error{}
+
+			results = append(results, fetchInBackground("repo-0"))
+			results = append(results, fetchInBackground("repo-1"))
+
+			Eventually(startedSoFar).Should(HaveLen(2))
+
+			// the rest queue up behind the two running; give each a moment to
+			// queue up before the next
+			for i := 2; i < 5; i++ {
+				results = append(results, fetchInBackground(fmt.Sprintf("repo-%d", i)))
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			Consistently(startedSoFar).Should(HaveLen(2))
+
+			// free one slot at a time, letting each through before the next
+			first := startedSoFar()
+			close(releases[first[0]])
+			Eventually(startedSoFar).Should(HaveLen(3))
+
+			close(releases[first[1]])
+			Eventually(startedSoFar).Should(HaveLen(4))
+
+			close(releases["repo-2"])
+			Eventually(startedSoFar).Should(HaveLen(5))
+
+			close(releases["repo-3"])
+			close(releases["repo-4"])
+
+			for _, errs := range results {
+				Eventually(errs).Should(Receive(BeNil()))
+			}
+
+			Ω(startedSoFar()[2:]).Should(Equal([]string{"repo-2", "repo-3", "repo-4"}))
+		})
+	})
+
+	Context("without a throttle", func() {
+		BeforeEach(func() {
+			fetcher = NewThrottled(wrapped, nil)
+		})
+
+		It("fetches everything at once", func() {
+			results := []chan error{}
+			for i := 0; i < 5; i++ {
+				results = append(results, fetchInBackground(fmt.Sprintf("repo-%d", i)))
+			}
+
+			Eventually(currentlyRunning).Should(Equal(5))
+
+			close(release)
+
+			for _, errs := range results {
+				Eventually(errs).Should(Receive(BeNil()))
+			}
+		})
+	})
+})
+
+var _ = Describe("Throttle", func() {
+	var server *httptest.Server
+	var graph *fake_graph.FakeGraph
+
+	var downloadsDir string
+
+	var blobDelay time.Duration
+
+	var downloading int
+	var maxDownloading int
+	var downloadingMutex *sync.Mutex
+
+	blobData := func(repoName string) string {
+		return strings.Repeat(repoName+"-data-", 512)
+	}
+
+	blobDigest := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	BeforeEach(func() {
+		graph = fake_graph.New()
+
+		graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, img *image.Image) error {
+			_, err := ioutil.ReadAll(layer)
+			return err
+		}
+
+		blobDelay = 0
+
+		downloading = 0
+		maxDownloading = 0
+		downloadingMutex = new(sync.Mutex)
+
+		// serves /v2/<repo>/manifests/some-tag, listing one layer, and that
+		// layer's blob
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			segs := strings.Split(req.URL.Path, "/")
+			repoName := segs[2]
+
+			if segs[3] == "manifests" {
+				fmt.Fprintf(w, `{
+					"schemaVersion": 1,
+					"fsLayers": [{"blobSum": "%s"}],
+					"history": [{"v1Compatibility": "{\"id\":\"%s-layer\"}"}]
+				}`, blobDigest(blobData(repoName)), repoName)
+				return
+			}
+
+			downloadingMutex.Lock()
+			downloading++
+			if downloading > maxDownloading {
+				maxDownloading = downloading
+			}
+			downloadingMutex.Unlock()
+
+			time.Sleep(blobDelay)
+
+			downloadingMutex.Lock()
+			downloading--
+			downloadingMutex.Unlock()
+
+			w.Write([]byte(blobData(repoName)))
+		}))
+
+		var err error
+
+		downloadsDir, err = ioutil.TempDir("", "downloads")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(downloadsDir)
+	})
+
+	fetchAll := func(throttle *Throttle, repoNames ...string) {
+		downloads, err := NewDownloadCache(downloadsDir, throttle)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fetcher := NewV2(server.URL, Credentials{}, graph, downloads)
+
+		wg := new(sync.WaitGroup)
+
+		for _, repoName := range repoNames {
+			wg.Add(1)
+
+			go func(repoName string) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				_, err := fetcher.Fetch(repoName, "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+			}(repoName)
+		}
+
+		wg.Wait()
+	}
+
+	Context("with a limit on layers", func() {
+		BeforeEach(func() {
+			blobDelay = 20 * time.Millisecond
+		})
+
+		It("downloads only so many at once, across every fetch", func() {
+			fetchAll(NewThrottle(PullLimits{MaxLayers: 1}), "repo-a", "repo-b", "repo-c")
+
+			Ω(maxDownloading).Should(Equal(1))
+		})
+	})
+
+	Context("with a limit on bandwidth", func() {
+		It("downloads no faster than it", func() {
+			started := time.Now()
+
+			// 2 layers of 6KB at 32KB/s
+			fetchAll(NewThrottle(PullLimits{BytesPerSecond: 32 * 1024}), "repo-a", "repo-b")
+
+			Ω(time.Since(started)).Should(BeNumerically(">=", 250*time.Millisecond))
+		})
+	})
+})
@@ -0,0 +1,297 @@
+package repository_fetcher
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// UntrustedImageError is returned when the TrustPolicy rejects an image.
+type UntrustedImageError struct {
+	Repository string
+	Reference  string
+	Reason     string
+}
+
+func (e UntrustedImageError) Error() string {
+	separator := ":"
+	if isDigest(e.Reference) {
+		separator = "@"
+	}
+
+	return fmt.Sprintf("untrusted image %s%s%s: %s", e.Repository, separator, e.Reference, e.Reason)
+}
+
+// TrustPolicy restricts which images may be fetched. Each restriction is
+// skipped if left empty.
+type TrustPolicy struct {
+	// registry host that repositories without one are on, e.g.
+	// index.docker.io
+	DefaultRegistry string
+
+	// registry hosts that images may be fetched from
+	AllowedRegistries []string
+
+	// patterns (see path.Match) of the repositories that images may be
+	// fetched from, excluding the registry host, e.g. "team/*"
+	AllowedRepositories []string
+
+	// tags that images may not be fetched by, e.g. "latest"
+	DeniedTags []string
+
+	// whether images must be fetched by digest, rather than a tag that may
+	// move
+	RequireDigest bool
+
+	// keys that an image's digest must be signed with, one of which must
+	// have made one of its Signatures; this requires images to be fetched
+	// by digest, as nothing else can be signed
+	TrustedKeys []crypto.PublicKey
+	Signatures  SignatureStore
+}
+
+// SignatureStore looks up the signatures made of an image's digest. The
+// signed message is "<registry>/<repository>@<digest>", hashed with SHA-256
+// and signed with RSA (PKCS #1 v1.5) or ECDSA (ASN.1) keys.
+type SignatureStore interface {
+	Signatures(registry string, repository string, digest string) ([][]byte, error)
+}
+
+// SignatureDir is a SignatureStore kept on disk, laid out as:
+//
+//	<dir>/<registry>/<repository>@<algorithm>=<hex>/signature-<n>
+type SignatureDir string
+
+func (dir SignatureDir) Signatures(registry string, repository string, digest string) ([][]byte, error) {
+	signaturesPath := filepath.Join(
+		string(dir),
+		registry,
+		filepath.FromSlash(repository)+"@"+strings.Replace(digest, ":", "=", 1),
+	)
+
+	signatures := [][]byte{}
+
+	for n := 1; ; n++ {
+		signature, err := ioutil.ReadFile(filepath.Join(signaturesPath, fmt.Sprintf("signature-%d", n)))
+		if os.IsNotExist(err) {
+			return signatures, nil
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		signatures = append(signatures, signature)
+	}
+}
+
+// LoadTrustedKeys reads the PEM-encoded public keys in the file.
+func LoadTrustedKeys(path string) ([]crypto.PublicKey, error) {
+	keysPEM, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []crypto.PublicKey{}
+
+	for {
+		var block *pem.Block
+
+		block, keysPEM = pem.Decode(keysPEM)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "PUBLIC KEY" {
+			continue
+		}
+
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported key type in %s: %T", path, key)
+		}
+
+		keys = append(keys, key)
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no public keys in %s", path)
+	}
+
+	return keys, nil
+}
+
+// Trusted rejects fetches of images that its TrustPolicy does not allow,
+// before anything is fetched or resolved locally.
+type Trusted struct {
+	fetcher PolicyFetcher
+	policy  TrustPolicy
+}
+
+func NewTrusted(fetcher PolicyFetcher, policy TrustPolicy) *Trusted {
+	return &Trusted{
+		fetcher: fetcher,
+		policy:  policy,
+	}
+}
+
+func (trusted *Trusted) Fetch(repoName string, tag string) (*Image, error) {
+	err := trusted.check(repoName, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return trusted.fetcher.Fetch(repoName, tag)
+}
+
+func (trusted *Trusted) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	err := trusted.check(repoName, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return trusted.fetcher.FetchWithProgress(repoName, tag, progress)
+}
+
+func (trusted *Trusted) FetchWithPolicy(repoName string, tag string, policy PullPolicy, progress ProgressReporter) (*Image, error) {
+	err := trusted.check(repoName, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return trusted.fetcher.FetchWithPolicy(repoName, tag, policy, progress)
+}
+
+func (trusted *Trusted) check(repoName string, tag string) error {
+	policy := trusted.policy
+
+	untrusted := func(reason string, args ...interface{}) error {
+		return UntrustedImageError{
+			Repository: repoName,
+			Reference:  tag,
+			Reason:     fmt.Sprintf(reason, args...),
+		}
+	}
+
+	registry, repository := SplitRegistryHost(repoName)
+	if registry == "" {
+		registry = policy.DefaultRegistry
+	}
+
+	if len(policy.AllowedRegistries) > 0 && !contains(policy.AllowedRegistries, registry) {
+		return untrusted("registry %s is not allowed", registry)
+	}
+
+	if len(policy.AllowedRepositories) > 0 && !matchesAny(policy.AllowedRepositories, repository) {
+		return untrusted("repository %s is not allowed", repository)
+	}
+
+	if !isDigest(tag) {
+		if policy.RequireDigest {
+			return untrusted("images must be pinned to a digest")
+		}
+
+		if len(policy.TrustedKeys) > 0 {
+			return untrusted("images must be pinned to a digest to verify their signatures")
+		}
+
+		if contains(policy.DeniedTags, tag) {
+			return untrusted("tag %s is not allowed", tag)
+		}
+
+		return nil
+	}
+
+	if len(policy.TrustedKeys) > 0 {
+		return trusted.verifySignatures(registry, repository, tag, untrusted)
+	}
+
+	return nil
+}
+
+func (trusted *Trusted) verifySignatures(
+	registry string,
+	repository string,
+	digest string,
+	untrusted func(string, ...interface{}) error,
+) error {
+	signatures, err := trusted.policy.Signatures.Signatures(registry, repository, digest)
+	if err != nil {
+		return err
+	}
+
+	if len(signatures) == 0 {
+		return untrusted("no signatures found")
+	}
+
+	hash := sha256.Sum256([]byte(path.Join(registry, repository) + "@" + digest))
+
+	for _, signature := range signatures {
+		for _, key := range trusted.policy.TrustedKeys {
+			if verifySignature(key, hash[:], signature) {
+				return nil
+			}
+		}
+	}
+
+	return untrusted("no signature was made with a trusted key")
+}
+
+func verifySignature(key crypto.PublicKey, hash []byte, signature []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash, signature) == nil
+
+	case *ecdsa.PublicKey:
+		var sig struct {
+			R, S *big.Int
+		}
+
+		_, err := asn1.Unmarshal(signature, &sig)
+		if err != nil {
+			return false
+		}
+
+		return ecdsa.Verify(k, hash, sig.R, sig.S)
+	}
+
+	return false
+}
+
+func contains(list []string, str string) bool {
+	for _, s := range list {
+		if s == str {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchesAny(patterns []string, str string) bool {
+	for _, pattern := range patterns {
+		matched, err := path.Match(pattern, str)
+		if err == nil && matched {
+			return true
+		}
+	}
+
+	return false
+}
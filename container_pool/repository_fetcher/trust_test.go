@@ -0,0 +1,275 @@
+package repository_fetcher_test
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher/fake_repository_fetcher"
+)
+
+var _ = Describe("Trusted", func() {
+	var wrapped *fake_repository_fetcher.FakeRepositoryFetcher
+	var policy TrustPolicy
+	var fetcher *Trusted
+
+	someDigest := "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+	BeforeEach(func() {
+		wrapped = fake_repository_fetcher.New()
+		wrapped.FetchResult = "some-image-id"
+
+		policy = TrustPolicy{DefaultRegistry: "index.docker.io"}
+	})
+
+	JustBeforeEach(func() {
+		fetcher = NewTrusted(wrapped, policy)
+	})
+
+	itRejects := func(repoName string, tag string, reason string) {
+		It("rejects "+repoName+" "+tag+" without fetching it", func() {
+			_, err := fetcher.Fetch(repoName, tag)
+			Ω(err).Should(Equal(UntrustedImageError{
+				Repository: repoName,
+				Reference:  tag,
+				Reason:     reason,
+			}))
+
+			_, err = fetcher.FetchWithPolicy(repoName, tag, PullNever, nil)
+			Ω(err).Should(BeAssignableToTypeOf(UntrustedImageError{}))
+
+			Ω(wrapped.Fetched()).Should(BeEmpty())
+		})
+	}
+
+	itAllows := func(repoName string, tag string) {
+		It("allows "+repoName+" "+tag, func() {
+			img, err := fetcher.Fetch(repoName, tag)
+			Ω(err).ShouldNot(HaveOccurred())
+			Ω(img.ID).Should(Equal("some-image-id"))
+		})
+	}
+
+	Context("with an empty policy", func() {
+		itAllows("some-repo", "latest")
+		itAllows("localhost:5000/team/app", someDigest)
+
+		It("fetches with the given pull policy", func() {
+			_, err := fetcher.FetchWithPolicy("some-repo", "some-tag", PullNever, nil)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(wrapped.Fetched()).Should(Equal([]fake_repository_fetcher.FetchSpec{
+				{Repository: "some-repo", Tag: "some-tag", Policy: PullNever},
+			}))
+		})
+	})
+
+	Context("with allowed registries", func() {
+		BeforeEach(func() {
+			policy.AllowedRegistries = []string{"localhost:5000"}
+		})
+
+		itAllows("localhost:5000/team/app", "v2")
+		itRejects("registry.example.com/team/app", "v2", "registry registry.example.com is not allowed")
+		itRejects("some-repo", "some-tag", "registry index.docker.io is not allowed")
+
+		Context("including the default registry", func() {
+			BeforeEach(func() {
+				policy.AllowedRegistries = append(policy.AllowedRegistries, "index.docker.io")
+			})
+
+			itAllows("some-repo", "some-tag")
+		})
+	})
+
+	Context("with allowed repositories", func() {
+		BeforeEach(func() {
+			policy.AllowedRepositories = []string{"team/*", "ubuntu"}
+		})
+
+		itAllows("team/app", "v2")
+		itAllows("localhost:5000/team/app", "v2")
+		itAllows("ubuntu", "14.04")
+		itRejects("other-team/app", "v2", "repository other-team/app is not allowed")
+		itRejects("team/app/nested", "v2", "repository team/app/nested is not allowed")
+	})
+
+	Context("with denied tags", func() {
+		BeforeEach(func() {
+			policy.DeniedTags = []string{"latest"}
+		})
+
+		itAllows("some-repo", "some-tag")
+		itAllows("some-repo", someDigest)
+		itRejects("some-repo", "latest", "tag latest is not allowed")
+	})
+
+	Context("when digests are required", func() {
+		BeforeEach(func() {
+			policy.RequireDigest = true
+		})
+
+		itAllows("some-repo", someDigest)
+		itRejects("some-repo", "some-tag", "images must be pinned to a digest")
+	})
+
+	Context("with trusted keys", func() {
+		var signaturesDir string
+
+		var trustedKey *ecdsa.PrivateKey
+		var otherTrustedKey *rsa.PrivateKey
+		var untrustedKey *ecdsa.PrivateKey
+
+		// signs the digest for the named repository, storing the signature
+		// with localhost:5000/team/app's
+		signFor := func(key crypto.Signer, name string, n string) {
+			hash := sha256.Sum256([]byte(name + "@" + someDigest))
+
+			signature, err := key.Sign(rand.Reader, hash[:], crypto.SHA256)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			dir := filepath.Join(signaturesDir, "localhost:5000", "team", "app@sha256=0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef")
+
+			err = os.MkdirAll(dir, 0755)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			err = ioutil.WriteFile(filepath.Join(dir, "signature-"+n), signature, 0644)
+			Ω(err).ShouldNot(HaveOccurred())
+		}
+
+		sign := func(key crypto.Signer, n string) {
+			signFor(key, "localhost:5000/team/app", n)
+		}
+
+		BeforeEach(func() {
+			var err error
+
+			signaturesDir, err = ioutil.TempDir("", "signatures")
+			Ω(err).ShouldNot(HaveOccurred())
+
+			trustedKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			otherTrustedKey, err = rsa.GenerateKey(rand.Reader, 1024)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			untrustedKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			policy.TrustedKeys = []crypto.PublicKey{trustedKey.Public(), otherTrustedKey.Public()}
+			policy.Signatures = SignatureDir(signaturesDir)
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(signaturesDir)
+		})
+
+		Context("when the digest is signed with a trusted key", func() {
+			BeforeEach(func() {
+				sign(untrustedKey, "1")
+				sign(trustedKey, "2")
+			})
+
+			itAllows("localhost:5000/team/app", someDigest)
+		})
+
+		Context("when the digest is signed with another trusted key", func() {
+			BeforeEach(func() {
+				sign(otherTrustedKey, "1")
+			})
+
+			itAllows("localhost:5000/team/app", someDigest)
+		})
+
+		Context("when the digest is signed for another repository", func() {
+			BeforeEach(func() {
+				signFor(trustedKey, "localhost:5000/other-team/app", "1")
+			})
+
+			itRejects("localhost:5000/team/app", someDigest, "no signature was made with a trusted key")
+		})
+
+		Context("when the digest is only signed with an untrusted key", func() {
+			BeforeEach(func() {
+				sign(untrustedKey, "1")
+			})
+
+			itRejects("localhost:5000/team/app", someDigest, "no signature was made with a trusted key")
+		})
+
+		Context("when the digest is not signed", func() {
+			itRejects("localhost:5000/team/app", someDigest, "no signatures found")
+		})
+
+		Context("when fetching by tag", func() {
+			itRejects("localhost:5000/team/app", "v2", "images must be pinned to a digest to verify their signatures")
+		})
+	})
+
+	Describe("UntrustedImageError", func() {
+		It("names the image by tag or digest", func() {
+			Ω(UntrustedImageError{Repository: "some-repo", Reference: "some-tag", Reason: "nope"}.Error()).Should(Equal("untrusted image some-repo:some-tag: nope"))
+			Ω(UntrustedImageError{Repository: "some-repo", Reference: someDigest, Reason: "nope"}.Error()).Should(Equal("untrusted image some-repo@" + someDigest + ": nope"))
+		})
+	})
+})
+
+var _ = Describe("LoadTrustedKeys", func() {
+	var keysFile *os.File
+
+	BeforeEach(func() {
+		var err error
+
+		keysFile, err = ioutil.TempFile("", "trusted-keys")
+		Ω(err).ShouldNot(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.Remove(keysFile.Name())
+	})
+
+	writeKey := func(key crypto.PublicKey) {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = pem.Encode(keysFile, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		Ω(err).ShouldNot(HaveOccurred())
+	}
+
+	It("loads every public key in the file", func() {
+		ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		writeKey(ecdsaKey.Public())
+		writeKey(rsaKey.Public())
+
+		keys, err := LoadTrustedKeys(keysFile.Name())
+		Ω(err).ShouldNot(HaveOccurred())
+
+		Ω(keys).Should(HaveLen(2))
+		Ω(keys[0]).Should(Equal(ecdsaKey.Public()))
+		Ω(keys[1]).Should(Equal(rsaKey.Public()))
+	})
+
+	Context("when the file has no public keys", func() {
+		It("returns an error", func() {
+			_, err := LoadTrustedKeys(keysFile.Name())
+			Ω(err).Should(HaveOccurred())
+		})
+	})
+})
@@ -0,0 +1,184 @@
+package repository_fetcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type tokenResponse struct {
+	Token       string `json:"token"`
+	AccessToken string `json:"access_token"`
+}
+
+// authorize adds the Authorization header negotiated for the repository, or
+// the configured registry token, if any.
+func (fetcher *V2RepositoryFetcher) authorize(repoName string, request *http.Request) {
+	fetcher.authorizationsMutex.RLock()
+	authorization, found := fetcher.authorizations[repoName]
+	fetcher.authorizationsMutex.RUnlock()
+
+	if !found && fetcher.credentials.RegistryToken != "" {
+		authorization = "Bearer " + fetcher.credentials.RegistryToken
+	}
+
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+}
+
+// authenticate responds to a WWW-Authenticate challenge, either by using
+// basic auth or by requesting a bearer token from the challenge's realm.
+func (fetcher *V2RepositoryFetcher) authenticate(repoName string, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+
+	var authorization string
+
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if fetcher.credentials.Username == "" {
+			return fmt.Errorf("registry requires credentials: %s", fetcher.endpoint)
+		}
+
+		request := &http.Request{Header: http.Header{}}
+		request.SetBasicAuth(fetcher.credentials.Username, fetcher.credentials.Password)
+
+		authorization = request.Header.Get("Authorization")
+
+	case "bearer":
+		token, err := fetcher.fetchToken(params)
+		if err != nil {
+			return err
+		}
+
+		authorization = "Bearer " + token
+
+	default:
+		return fmt.Errorf("unsupported auth challenge: %q", challenge)
+	}
+
+	fetcher.authorizationsMutex.Lock()
+	fetcher.authorizations[repoName] = authorization
+	fetcher.authorizationsMutex.Unlock()
+
+	return nil
+}
+
+func (fetcher *V2RepositoryFetcher) fetchToken(params map[string]string) (string, error) {
+	realm, found := params["realm"]
+	if !found {
+		return "", fmt.Errorf("bearer challenge has no realm")
+	}
+
+	tokenURL, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+
+	query := tokenURL.Query()
+
+	for _, param := range []string{"service", "scope"} {
+		value, found := params[param]
+		if found {
+			query.Set(param, value)
+		}
+	}
+
+	tokenURL.RawQuery = query.Encode()
+
+	request, err := http.NewRequest("GET", tokenURL.String(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if fetcher.credentials.Username != "" {
+		request.SetBasicAuth(fetcher.credentials.Username, fetcher.credentials.Password)
+	}
+
+	response, err := fetcher.client.Do(request)
+	if err != nil {
+		return "", err
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", UnexpectedStatusError{
+			URL:        tokenURL.String(),
+			StatusCode: response.StatusCode,
+		}
+	}
+
+	var token tokenResponse
+
+	err = json.NewDecoder(response.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+
+	if token.Token != "" {
+		return token.Token, nil
+	}
+
+	if token.AccessToken != "" {
+		return token.AccessToken, nil
+	}
+
+	return "", fmt.Errorf("no token returned from %s", realm)
+}
+
+// parseChallenge parses a WWW-Authenticate header of the form:
+//
+//	Bearer realm="https://auth.example.com/token",service="registry",scope="..."
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+
+	segs := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+
+	scheme := segs[0]
+	if len(segs) == 1 {
+		return scheme, params
+	}
+
+	rest := segs[1]
+
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
+		}
+
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+
+		var value string
+
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				value = rest[1:]
+				rest = ""
+			} else {
+				value = rest[1 : end+1]
+				rest = rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				value = rest
+				rest = ""
+			} else {
+				value = rest[:end]
+				rest = rest[end:]
+			}
+		}
+
+		params[key] = value
+
+		rest = strings.TrimLeft(rest, ", ")
+	}
+
+	return scheme, params
+}
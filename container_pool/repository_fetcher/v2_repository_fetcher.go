@@ -0,0 +1,597 @@
+package repository_fetcher
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/runconfig"
+)
+
+const (
+	manifestV1MediaType       = "application/vnd.docker.distribution.manifest.v1+json"
+	manifestV1SignedMediaType = "application/vnd.docker.distribution.manifest.v1+prettyjws"
+	manifestV2MediaType       = "application/vnd.docker.distribution.manifest.v2+json"
+)
+
+// IndexV2Endpoint is the v2 API endpoint of the official index, whose
+// unqualified repositories live in the "library" namespace.
+const IndexV2Endpoint = "https://registry-1.docker.io"
+
+var ErrUnsupportedManifest = errors.New("unsupported manifest schema version")
+
+// ErrV2Unsupported is returned when the registry does not serve the v2 API
+// at all, as opposed to not having the image.
+var ErrV2Unsupported = errors.New("registry does not support the v2 API")
+
+type UnexpectedStatusError struct {
+	URL        string
+	StatusCode int
+}
+
+func (e UnexpectedStatusError) Error() string {
+	return fmt.Sprintf("unexpected status %d from %s", e.StatusCode, e.URL)
+}
+
+// V2RepositoryFetcher fetches images from registries speaking the Docker
+// Registry HTTP API v2, registering each content-addressed layer blob into
+// the graph as a v1-style image.
+type V2RepositoryFetcher struct {
+	endpoint    string
+	credentials Credentials
+	client      *http.Client
+	graph       Graph
+	downloads   *DownloadCache
+
+	// whether the registry is (or mirrors) the official index, whose
+	// unqualified repositories live in the "library" namespace
+	official bool
+
+	// Authorization headers to send, per repository, as negotiated with
+	// the registry's auth challenge
+	authorizations      map[string]string
+	authorizationsMutex *sync.RWMutex
+}
+
+// v2Layer is a single layer to register, along with the blob containing its
+// filesystem changes.
+type v2Layer struct {
+	ID     string
+	JSON   []byte
+	Digest string
+
+	// size of the blob, if the manifest says
+	Size int64
+}
+
+type manifestVersion struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+}
+
+type schema1Manifest struct {
+	FSLayers []struct {
+		BlobSum string `json:"blobSum"`
+	} `json:"fsLayers"`
+
+	History []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// signedManifest is a schema 1 manifest signed with JSON web signatures,
+// whose protected headers describe how to recover the signed payload.
+type signedManifest struct {
+	Signatures []struct {
+		Protected string `json:"protected"`
+	} `json:"signatures"`
+}
+
+type jwsProtectedHeader struct {
+	FormatLength int    `json:"formatLength"`
+	FormatTail   string `json:"formatTail"`
+}
+
+type schema2Manifest struct {
+	SchemaVersion int    `json:"schemaVersion"`
+	MediaType     string `json:"mediaType"`
+
+	Config schema2Descriptor `json:"config"`
+
+	Layers []schema2Descriptor `json:"layers"`
+}
+
+type schema2Descriptor struct {
+	MediaType string `json:"mediaType"`
+	Size      int64  `json:"size"`
+	Digest    string `json:"digest"`
+}
+
+type schema2Config struct {
+	Created      time.Time         `json:"created"`
+	Architecture string            `json:"architecture,omitempty"`
+	OS           string            `json:"os,omitempty"`
+	Config       *runconfig.Config `json:"config,omitempty"`
+
+	// only needed when pushing; the layers' digests come from the manifest
+	RootFS  *schema2RootFS   `json:"rootfs,omitempty"`
+	History []schema2History `json:"history,omitempty"`
+}
+
+type schema2RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+type schema2History struct {
+	Created time.Time `json:"created"`
+	Author  string    `json:"author,omitempty"`
+	Comment string    `json:"comment,omitempty"`
+}
+
+// v1Image is the JSON registered into the graph for layers converted from a
+// schema 2 manifest.
+type v1Image struct {
+	ID           string            `json:"id"`
+	Parent       string            `json:"parent,omitempty"`
+	Created      time.Time         `json:"created"`
+	Architecture string            `json:"architecture,omitempty"`
+	OS           string            `json:"os,omitempty"`
+	Config       *runconfig.Config `json:"config,omitempty"`
+}
+
+func NewV2(endpoint string, credentials Credentials, graph Graph, downloads *DownloadCache) RepositoryFetcher {
+	return NewV2Mirror(endpoint, endpoint, credentials, graph, downloads)
+}
+
+// NewV2Mirror constructs a fetcher for a registry that mirrors the upstream
+// registry's repositories.
+func NewV2Mirror(endpoint string, upstream string, credentials Credentials, graph Graph, downloads *DownloadCache) RepositoryFetcher {
+	return &V2RepositoryFetcher{
+		endpoint:    strings.TrimRight(endpoint, "/"),
+		credentials: credentials,
+		client:      &http.Client{},
+		graph:       graph,
+		downloads:   downloads,
+
+		official: strings.TrimRight(upstream, "/") == IndexV2Endpoint,
+
+		authorizations:      make(map[string]string),
+		authorizationsMutex: new(sync.RWMutex),
+	}
+}
+
+func (fetcher *V2RepositoryFetcher) Fetch(repoName string, tag string) (*Image, error) {
+	return fetcher.FetchWithProgress(repoName, tag, nil)
+}
+
+func (fetcher *V2RepositoryFetcher) FetchWithProgress(repoName string, tag string, progress ProgressReporter) (*Image, error) {
+	if fetcher.official && !strings.Contains(repoName, "/") {
+		repoName = "library/" + repoName
+	}
+
+	log.Println("fetching", repoName+":"+tag, "via v2 from", fetcher.endpoint)
+
+	layers, err := fetcher.fetchLayers(repoName, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("no layers in manifest: %s:%s", repoName, tag)
+	}
+
+	progress = progressOrDiscard(progress)
+
+	for _, layer := range layers {
+		if fetcher.graph.Exists(layer.ID) {
+			log.Println("already exists:", layer.ID)
+			progress.ReportLayer(LayerProgress{LayerID: layer.ID, Cached: true, Complete: true})
+			continue
+		}
+
+		// if someone else registers the layer first, this fetch didn't need
+		// to download it after all
+		registered := LayerProgress{LayerID: layer.ID, Cached: true, Complete: true}
+
+		err := registerOnce(fetcher.graph, layer.ID, func() error {
+			var err error
+			registered, err = fetcher.registerLayer(repoName, layer, progress)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		progress.ReportLayer(registered)
+	}
+
+	imgID := layers[len(layers)-1].ID
+
+	img, err := fetcher.graph.Get(imgID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Image{ID: imgID, Config: img.Config}, nil
+}
+
+// supportsV2 checks the registry's API version endpoint, which v2 registries
+// answer with 200, or 401 if they require authentication. If the check
+// itself fails the registry is given the benefit of the doubt, so that the
+// error from the request that prompted it is the one returned.
+func (fetcher *V2RepositoryFetcher) supportsV2() bool {
+	response, err := fetcher.client.Get(fetcher.endpoint + "/v2/")
+	if err != nil {
+		return true
+	}
+
+	response.Body.Close()
+
+	return response.StatusCode != http.StatusNotFound
+}
+
+// fetchLayers resolves the manifest for the given tag and returns its layers
+// in parent-first order.
+func (fetcher *V2RepositoryFetcher) fetchLayers(repoName string, tag string) ([]v2Layer, error) {
+	manifestURL := fetcher.endpoint + "/v2/" + repoName + "/manifests/" + tag
+
+	request, err := http.NewRequest("GET", manifestURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Add("Accept", manifestV2MediaType)
+	request.Header.Add("Accept", manifestV1SignedMediaType)
+	request.Header.Add("Accept", manifestV1MediaType)
+
+	body, err := fetcher.get(repoName, request)
+	if statusErr, ok := err.(UnexpectedStatusError); ok && statusErr.StatusCode == http.StatusNotFound {
+		if !fetcher.supportsV2() {
+			return nil, ErrV2Unsupported
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer body.Close()
+
+	manifestJSON, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	// the registry must serve the manifest that a digest names, or pinning
+	// images to digests means nothing
+	if isDigest(tag) {
+		payload, err := manifestPayload(manifestJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		err = verifyDigest("manifest", tag, bytes.NewReader(payload))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var version manifestVersion
+
+	err = json.Unmarshal(manifestJSON, &version)
+	if err != nil {
+		return nil, err
+	}
+
+	switch version.SchemaVersion {
+	case 1:
+		return schema1Layers(manifestJSON)
+	case 2:
+		return fetcher.schema2Layers(repoName, manifestJSON)
+	default:
+		return nil, ErrUnsupportedManifest
+	}
+}
+
+// manifestPayload returns the part of the manifest that its digest covers:
+// all of it, unless it is a signed schema 1 manifest, whose signatures are
+// excluded.
+func manifestPayload(manifestJSON []byte) ([]byte, error) {
+	var signed signedManifest
+
+	err := json.Unmarshal(manifestJSON, &signed)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(signed.Signatures) == 0 {
+		return manifestJSON, nil
+	}
+
+	// every signature's protected header describes the same payload
+	protectedJSON, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(signed.Signatures[0].Protected, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	var protected jwsProtectedHeader
+
+	err = json.Unmarshal(protectedJSON, &protected)
+	if err != nil {
+		return nil, err
+	}
+
+	tail, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(protected.FormatTail, "="))
+	if err != nil {
+		return nil, err
+	}
+
+	if protected.FormatLength < 0 || protected.FormatLength > len(manifestJSON) {
+		return nil, fmt.Errorf("malformed manifest signature: format length %d", protected.FormatLength)
+	}
+
+	return append(append([]byte{}, manifestJSON[:protected.FormatLength]...), tail...), nil
+}
+
+func schema1Layers(manifestJSON []byte) ([]v2Layer, error) {
+	var manifest schema1Manifest
+
+	err := json.Unmarshal(manifestJSON, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(manifest.FSLayers) != len(manifest.History) {
+		return nil, fmt.Errorf(
+			"manifest has %d layers but %d history entries",
+			len(manifest.FSLayers),
+			len(manifest.History),
+		)
+	}
+
+	layers := []v2Layer{}
+
+	// schema 1 lists layers from the top down
+	for i := len(manifest.FSLayers) - 1; i >= 0; i-- {
+		imgJSON := []byte(manifest.History[i].V1Compatibility)
+
+		img, err := image.NewImgJSON(imgJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		layers = append(layers, v2Layer{
+			ID:     img.ID,
+			JSON:   imgJSON,
+			Digest: manifest.FSLayers[i].BlobSum,
+		})
+	}
+
+	return layers, nil
+}
+
+func (fetcher *V2RepositoryFetcher) schema2Layers(repoName string, manifestJSON []byte) ([]v2Layer, error) {
+	var manifest schema2Manifest
+
+	err := json.Unmarshal(manifestJSON, &manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	configBlob, err := fetcher.fetchBlob(repoName, manifest.Config.Digest)
+	if err != nil {
+		return nil, err
+	}
+
+	defer configBlob.Close()
+
+	configJSON, err := ioutil.ReadAll(configBlob)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyDigest("config", manifest.Config.Digest, bytes.NewReader(configJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	var config schema2Config
+
+	err = json.Unmarshal(configJSON, &config)
+	if err != nil {
+		return nil, err
+	}
+
+	layers := []v2Layer{}
+
+	parent := ""
+
+	for i, layer := range manifest.Layers {
+		img := v1Image{
+			ID:      v1ID(parent, layer.Digest),
+			Parent:  parent,
+			Created: config.Created,
+		}
+
+		if i == len(manifest.Layers)-1 {
+			// the top layer is the image itself; it's identified by its config
+			// as well as its content, and carries the config along
+			img.ID = v1ID(img.ID, manifest.Config.Digest)
+			img.Architecture = config.Architecture
+			img.OS = config.OS
+			img.Config = config.Config
+		}
+
+		imgJSON, err := json.Marshal(img)
+		if err != nil {
+			return nil, err
+		}
+
+		layers = append(layers, v2Layer{
+			ID:     img.ID,
+			JSON:   imgJSON,
+			Digest: layer.Digest,
+			Size:   layer.Size,
+		})
+
+		parent = img.ID
+	}
+
+	return layers, nil
+}
+
+// registerLayer downloads and registers the layer, returning its final
+// progress.
+func (fetcher *V2RepositoryFetcher) registerLayer(repoName string, layer v2Layer, progress ProgressReporter) (LayerProgress, error) {
+	download := &progressReader{
+		progress: progress,
+		layer:    LayerProgress{LayerID: layer.ID, Total: layer.Size},
+	}
+
+	img, err := image.NewImgJSON(layer.JSON)
+	if err != nil {
+		return download.layer, err
+	}
+
+	log.Println("downloading layer:", layer.ID, "from blob", layer.Digest)
+
+	// the blob is spooled to disk so that it can be verified in full before
+	// any of it is committed to the graph, and so that it can be resumed if
+	// the download is cut off
+	file, err := fetcher.downloads.download(layer.Digest, fetcher.blobRequester(repoName, layer.Digest), download)
+	if err != nil {
+		return download.layer, err
+	}
+
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	err = verifyDigest(layer.ID, layer.Digest, file)
+	if err != nil {
+		return download.layer, err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return download.layer, err
+	}
+
+	completed := download.layer
+	completed.Complete = true
+
+	return completed, fetcher.graph.Register(layer.JSON, file, img)
+}
+
+func (fetcher *V2RepositoryFetcher) fetchBlob(repoName string, digest string) (io.ReadCloser, error) {
+	request, err := http.NewRequest("GET", fetcher.endpoint+"/v2/"+repoName+"/blobs/"+digest, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetcher.get(repoName, request)
+}
+
+// blobRequester requests the blob from an offset, to resume downloading it.
+func (fetcher *V2RepositoryFetcher) blobRequester(repoName string, digest string) rangeRequester {
+	return func(offset int64, validator string) (*http.Response, error) {
+		request, err := http.NewRequest("GET", fetcher.endpoint+"/v2/"+repoName+"/blobs/"+digest, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		setRange(request, offset, validator)
+
+		response, err := fetcher.do(repoName, request)
+		if err != nil {
+			return nil, err
+		}
+
+		switch response.StatusCode {
+		case http.StatusOK, http.StatusPartialContent, http.StatusRequestedRangeNotSatisfiable:
+			return response, nil
+		}
+
+		response.Body.Close()
+
+		return nil, UnexpectedStatusError{
+			URL:        request.URL.String(),
+			StatusCode: response.StatusCode,
+		}
+	}
+}
+
+func (fetcher *V2RepositoryFetcher) get(repoName string, request *http.Request) (io.ReadCloser, error) {
+	response, err := fetcher.do(repoName, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+
+		return nil, UnexpectedStatusError{
+			URL:        request.URL.String(),
+			StatusCode: response.StatusCode,
+		}
+	}
+
+	return response.Body, nil
+}
+
+// do makes the request, authenticating with the registry if it asks.
+func (fetcher *V2RepositoryFetcher) do(repoName string, request *http.Request) (*http.Response, error) {
+	fetcher.authorize(repoName, request)
+
+	response, err := fetcher.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode == http.StatusUnauthorized {
+		challenge := response.Header.Get("WWW-Authenticate")
+
+		response.Body.Close()
+
+		err := fetcher.authenticate(repoName, challenge)
+		if err != nil {
+			return nil, err
+		}
+
+		fetcher.authorize(repoName, request)
+
+		if request.GetBody != nil {
+			request.Body, err = request.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		response, err = fetcher.client.Do(request)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return response, nil
+}
+
+// v1ID derives a stable graph ID for a layer from its parent and its content
+// digest, so that layers shared between images map to the same graph entry.
+func v1ID(parent string, digest string) string {
+	sum := sha256.Sum256([]byte(parent + " " + digest))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,612 @@
+package repository_fetcher_test
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/runconfig"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/fake_graph"
+)
+
+var _ = Describe("V2RepositoryFetcher", func() {
+	var graph *fake_graph.FakeGraph
+	var fetcher RepositoryFetcher
+
+	var server *ghttp.Server
+
+	var downloadsDir string
+	var downloads *DownloadCache
+
+	BeforeEach(func() {
+		graph = fake_graph.New()
+
+		server = ghttp.NewServer()
+
+		var err error
+
+		downloadsDir, err = ioutil.TempDir("", "downloads")
+		Ω(err).ShouldNot(HaveOccurred())
+
+		downloads, err = NewDownloadCache(downloadsDir, nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		fetcher = NewV2(server.URL(), Credentials{}, graph, downloads)
+	})
+
+	AfterEach(func() {
+		server.Close()
+		os.RemoveAll(downloadsDir)
+	})
+
+	blob := func(path string, data string) http.HandlerFunc {
+		return ghttp.CombineHandlers(
+			ghttp.VerifyRequest("GET", path),
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Write([]byte(data))
+			}),
+		)
+	}
+
+	digest := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	baseDigest := digest("base-data")
+	topDigest := digest("top-data")
+
+	registered := func() (*[]string, *[]string) {
+		ids := []string{}
+		layers := []string{}
+
+		graph.WhenRegistering = func(imageJSON []byte, layer archive.ArchiveReader, img *image.Image) error {
+			layerData, err := ioutil.ReadAll(layer)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			ids = append(ids, img.ID)
+			layers = append(layers, string(layerData))
+
+			return nil
+		}
+
+		return &ids, &layers
+	}
+
+	Describe("Fetch", func() {
+		Context("when the registry serves a schema 1 manifest", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/some-tag"),
+						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+							Ω(req.Header["Accept"]).Should(ContainElement("application/vnd.docker.distribution.manifest.v1+prettyjws"))
+
+							w.Write([]byte(fmt.Sprintf(`{
+								"schemaVersion": 1,
+								"name": "some-repo",
+								"tag": "some-tag",
+								"fsLayers": [
+									{"blobSum": "%s"},
+									{"blobSum": "%s"}
+								],
+								"history": [
+									{"v1Compatibility": "{\"id\":\"layer-2\",\"parent\":\"layer-1\",\"config\":{\"Env\":[\"FOO=bar\"]}}"},
+									{"v1Compatibility": "{\"id\":\"layer-1\"}"}
+								]
+							}`, topDigest, baseDigest)))
+						}),
+					),
+					blob("/v2/some-repo/blobs/"+baseDigest, "base-data"),
+					blob("/v2/some-repo/blobs/"+topDigest, "top-data"),
+				)
+			})
+
+			It("registers each layer parent-first and returns the top image", func() {
+				ids, layers := registered()
+
+				fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(*ids).Should(Equal([]string{"layer-1", "layer-2"}))
+				Ω(*layers).Should(Equal([]string{"base-data", "top-data"}))
+
+				Ω(fetchedImage.ID).Should(Equal("layer-2"))
+				Ω(fetchedImage.Config.Env).Should(Equal([]string{"FOO=bar"}))
+			})
+
+			Context("when a layer already exists in the graph", func() {
+				BeforeEach(func() {
+					graph.SetExists("layer-1", true)
+
+					server.SetHandler(1, blob("/v2/some-repo/blobs/"+topDigest, "top-data"))
+				})
+
+				It("does not download it", func() {
+					ids, _ := registered()
+
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(*ids).Should(Equal([]string{"layer-2"}))
+				})
+
+				It("reports it as cached", func() {
+					progress := NewPullProgress()
+
+					_, err := fetcher.(ProgressFetcher).FetchWithProgress("some-repo", "some-tag", progress)
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(progress.Layers()).Should(Equal([]LayerProgress{
+						{LayerID: "layer-1", Cached: true, Complete: true},
+						{LayerID: "layer-2", Current: 8, Total: 8, Complete: true},
+					}))
+				})
+			})
+
+			Context("when a blob does not match its digest", func() {
+				BeforeEach(func() {
+					server.SetHandler(2, blob("/v2/some-repo/blobs/"+topDigest, "tampered-data"))
+				})
+
+				It("returns a ChecksumMismatchError without registering the layer", func() {
+					ids, _ := registered()
+
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).Should(Equal(ChecksumMismatchError{
+						LayerID:  "layer-2",
+						Expected: topDigest,
+						Actual:   digest("tampered-data"),
+					}))
+
+					Ω(*ids).Should(Equal([]string{"layer-1"}))
+				})
+			})
+		})
+
+		Context("when the registry serves a schema 2 manifest", func() {
+			configJSON := `{
+				"architecture": "amd64",
+				"os": "linux",
+				"config": {"Env": ["FOO=bar"], "WorkingDir": "/app"},
+				"rootfs": {"type": "layers", "diff_ids": ["sha256:a", "sha256:b"]}
+			}`
+
+			configDigest := digest(configJSON)
+
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/some-tag"),
+						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+							Ω(req.Header["Accept"]).Should(ContainElement("application/vnd.docker.distribution.manifest.v2+json"))
+
+							w.Header().Set("Content-Type", "application/vnd.docker.distribution.manifest.v2+json")
+							w.Write([]byte(fmt.Sprintf(`{
+								"schemaVersion": 2,
+								"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+								"config": {
+									"mediaType": "application/vnd.docker.container.image.v1+json",
+									"size": 123,
+									"digest": "%s"
+								},
+								"layers": [
+									{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 9, "digest": "%s"},
+									{"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip", "size": 8, "digest": "%s"}
+								]
+							}`, configDigest, baseDigest, topDigest)))
+						}),
+					),
+					blob("/v2/some-repo/blobs/"+configDigest, configJSON),
+					blob("/v2/some-repo/blobs/"+baseDigest, "base-data"),
+					blob("/v2/some-repo/blobs/"+topDigest, "top-data"),
+				)
+			})
+
+			id := func(parent, digest string) string {
+				sum := sha256.Sum256([]byte(parent + " " + digest))
+				return hex.EncodeToString(sum[:])
+			}
+
+			It("registers a chain of layers carrying the image config", func() {
+				ids, layers := registered()
+
+				fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				baseID := id("", baseDigest)
+				topID := id(id(baseID, topDigest), configDigest)
+
+				Ω(*ids).Should(Equal([]string{baseID, topID}))
+				Ω(*layers).Should(Equal([]string{"base-data", "top-data"}))
+
+				Ω(fetchedImage.ID).Should(Equal(topID))
+				Ω(fetchedImage.Config).Should(Equal(&runconfig.Config{
+					Env:        []string{"FOO=bar"},
+					WorkingDir: "/app",
+				}))
+
+				top, err := graph.Get(topID)
+				Ω(err).ShouldNot(HaveOccurred())
+				Ω(top.Parent).Should(Equal(baseID))
+				Ω(top.Architecture).Should(Equal("amd64"))
+			})
+
+			It("reports the progress of each layer against its size in the manifest", func() {
+				progress := NewPullProgress()
+
+				_, err := fetcher.(ProgressFetcher).FetchWithProgress("some-repo", "some-tag", progress)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				baseID := id("", baseDigest)
+				topID := id(id(baseID, topDigest), configDigest)
+
+				Ω(progress.Layers()).Should(Equal([]LayerProgress{
+					{LayerID: baseID, Current: 9, Total: 9, Complete: true},
+					{LayerID: topID, Current: 8, Total: 8, Complete: true},
+				}))
+			})
+
+			Context("when the config does not match its digest", func() {
+				BeforeEach(func() {
+					server.SetHandler(1, blob("/v2/some-repo/blobs/"+configDigest, `{"os": "linux"}`))
+				})
+
+				It("returns a ChecksumMismatchError without registering anything", func() {
+					ids, _ := registered()
+
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).Should(BeAssignableToTypeOf(ChecksumMismatchError{}))
+
+					Ω(*ids).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the registry requires a bearer token", func() {
+			var authServer *ghttp.Server
+
+			schema1Manifest := fmt.Sprintf(`{
+				"schemaVersion": 1,
+				"fsLayers": [{"blobSum": "%s"}],
+				"history": [{"v1Compatibility": "{\"id\":\"layer-1\"}"}]
+			}`, baseDigest)
+
+			BeforeEach(func() {
+				authServer = ghttp.NewServer()
+
+				challenge := http.Header{}
+				challenge.Set(
+					"WWW-Authenticate",
+					fmt.Sprintf(
+						`Bearer realm="%s/token",service="some-registry",scope="repository:some-repo:pull"`,
+						authServer.URL(),
+					),
+				)
+
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/some-tag"),
+						ghttp.RespondWith(401, "", challenge),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/some-tag"),
+						ghttp.VerifyHeader(http.Header{"Authorization": []string{"Bearer some-token"}}),
+						ghttp.RespondWith(200, schema1Manifest),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/some-repo/blobs/"+baseDigest),
+						ghttp.VerifyHeader(http.Header{"Authorization": []string{"Bearer some-token"}}),
+						ghttp.RespondWith(200, "base-data"),
+					),
+				)
+			})
+
+			AfterEach(func() {
+				authServer.Close()
+			})
+
+			Context("and no credentials are configured", func() {
+				BeforeEach(func() {
+					authServer.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/token", "scope=repository%3Asome-repo%3Apull&service=some-registry"),
+							http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+								Ω(req.Header.Get("Authorization")).Should(BeEmpty())
+							}),
+							ghttp.RespondWith(200, `{"token":"some-token"}`),
+						),
+					)
+				})
+
+				It("fetches an anonymous token and uses it for subsequent requests", func() {
+					fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).ShouldNot(HaveOccurred())
+
+					Ω(fetchedImage.ID).Should(Equal("layer-1"))
+				})
+			})
+
+			Context("and credentials are configured", func() {
+				BeforeEach(func() {
+					fetcher = NewV2(server.URL(), Credentials{
+						Username: "some-user",
+						Password: "some-password",
+					}, graph, downloads)
+
+					authServer.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/token"),
+							ghttp.VerifyBasicAuth("some-user", "some-password"),
+							ghttp.RespondWith(200, `{"access_token":"some-token"}`),
+						),
+					)
+				})
+
+				It("authenticates with them to get the token", func() {
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+			})
+
+			Context("and fetching the token fails", func() {
+				BeforeEach(func() {
+					authServer.AppendHandlers(
+						ghttp.RespondWith(403, ""),
+					)
+				})
+
+				It("returns an error", func() {
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).Should(HaveOccurred())
+				})
+			})
+		})
+
+		Context("when the registry requires basic auth", func() {
+			BeforeEach(func() {
+				fetcher = NewV2(server.URL(), Credentials{
+					Username: "some-user",
+					Password: "some-password",
+				}, graph, downloads)
+
+				challenge := http.Header{}
+				challenge.Set("WWW-Authenticate", `Basic realm="some-registry"`)
+
+				server.AppendHandlers(
+					ghttp.RespondWith(401, "", challenge),
+					ghttp.CombineHandlers(
+						ghttp.VerifyBasicAuth("some-user", "some-password"),
+						ghttp.RespondWith(200, fmt.Sprintf(`{
+							"schemaVersion": 1,
+							"fsLayers": [{"blobSum": "%s"}],
+							"history": [{"v1Compatibility": "{\"id\":\"layer-1\"}"}]
+						}`, baseDigest)),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyBasicAuth("some-user", "some-password"),
+						ghttp.RespondWith(200, "base-data"),
+					),
+				)
+			})
+
+			It("authenticates with the credentials", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when a registry token is configured", func() {
+			BeforeEach(func() {
+				fetcher = NewV2(server.URL(), Credentials{
+					RegistryToken: "some-registry-token",
+				}, graph, downloads)
+
+				bearer := ghttp.VerifyHeader(http.Header{
+					"Authorization": []string{"Bearer some-registry-token"},
+				})
+
+				server.AppendHandlers(
+					ghttp.CombineHandlers(bearer, ghttp.RespondWith(200, fmt.Sprintf(`{
+						"schemaVersion": 1,
+						"fsLayers": [{"blobSum": "%s"}],
+						"history": [{"v1Compatibility": "{\"id\":\"layer-1\"}"}]
+					}`, baseDigest))),
+					ghttp.CombineHandlers(bearer, ghttp.RespondWith(200, "base-data")),
+				)
+			})
+
+			It("sends it with every request", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+			})
+		})
+
+		Context("when the registry mirrors the official index", func() {
+			BeforeEach(func() {
+				fetcher = NewV2Mirror(server.URL(), IndexV2Endpoint, Credentials{}, graph, downloads)
+
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/library/some-repo/manifests/some-tag"),
+						ghttp.RespondWith(200, fmt.Sprintf(`{
+							"schemaVersion": 1,
+							"fsLayers": [{"blobSum": "%s"}],
+							"history": [{"v1Compatibility": "{\"id\":\"layer-1\"}"}]
+						}`, baseDigest)),
+					),
+					blob("/v2/library/some-repo/blobs/"+baseDigest, "base-data"),
+				)
+			})
+
+			It("fetches unqualified repositories from the library namespace", func() {
+				fetchedImage, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fetchedImage.ID).Should(Equal("layer-1"))
+			})
+		})
+
+		Context("when fetching by digest", func() {
+			manifest := fmt.Sprintf(`{
+				"schemaVersion": 1,
+				"fsLayers": [{"blobSum": "%s"}],
+				"history": [{"v1Compatibility": "{\"id\":\"layer-1\"}"}]
+			}`, baseDigest)
+
+			It("fetches the manifest it names", func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/"+digest(manifest)),
+						ghttp.RespondWith(200, manifest),
+					),
+					blob("/v2/some-repo/blobs/"+baseDigest, "base-data"),
+				)
+
+				fetchedImage, err := fetcher.Fetch("some-repo", digest(manifest))
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(fetchedImage.ID).Should(Equal("layer-1"))
+			})
+
+			Context("when the manifest is signed", func() {
+				It("verifies the digest of the signed payload", func() {
+					tail := "\n}"
+					payload := `{"schemaVersion": 1, "fsLayers": [{"blobSum": "` + baseDigest + `"}], "history": [{"v1Compatibility": "{\"id\":\"layer-1\"}"}]` + tail
+
+					formatLength := len(payload) - len(tail)
+
+					protected := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(
+						`{"formatLength":%d,"formatTail":"%s"}`,
+						formatLength,
+						base64.RawURLEncoding.EncodeToString([]byte(tail)),
+					)))
+
+					signed := payload[:formatLength] + `, "signatures": [{"protected": "` + protected + `", "signature": "c29tZS1zaWduYXR1cmU"}]` + tail
+
+					server.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/"+digest(payload)),
+							ghttp.RespondWith(200, signed),
+						),
+						blob("/v2/some-repo/blobs/"+baseDigest, "base-data"),
+					)
+
+					_, err := fetcher.Fetch("some-repo", digest(payload))
+					Ω(err).ShouldNot(HaveOccurred())
+				})
+			})
+
+			Context("when the registry serves a different manifest", func() {
+				It("returns a ChecksumMismatchError without registering anything", func() {
+					ids, _ := registered()
+
+					pinned := digest("some-other-manifest")
+
+					server.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/"+pinned),
+							ghttp.RespondWith(200, manifest),
+						),
+					)
+
+					_, err := fetcher.Fetch("some-repo", pinned)
+					Ω(err).Should(Equal(ChecksumMismatchError{
+						LayerID:  "manifest",
+						Expected: pinned,
+						Actual:   digest(manifest),
+					}))
+
+					Ω(*ids).Should(BeEmpty())
+				})
+			})
+		})
+
+		Context("when the manifest has an unknown schema version", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					blob("/v2/some-repo/manifests/some-tag", `{"schemaVersion": 3}`),
+				)
+			})
+
+			It("returns ErrUnsupportedManifest", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(ErrUnsupportedManifest))
+			})
+		})
+
+		Context("when fetching the manifest fails", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.RespondWith(500, ""),
+				)
+			})
+
+			It("returns an UnexpectedStatusError", func() {
+				_, err := fetcher.Fetch("some-repo", "some-tag")
+				Ω(err).Should(Equal(UnexpectedStatusError{
+					URL:        fmt.Sprintf("%s/v2/some-repo/manifests/some-tag", server.URL()),
+					StatusCode: 500,
+				}))
+			})
+		})
+
+		Context("when the manifest is not found", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/some-repo/manifests/some-tag"),
+						ghttp.RespondWith(404, ""),
+					),
+				)
+			})
+
+			Context("and the registry supports v2", func() {
+				BeforeEach(func() {
+					server.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/v2/"),
+							ghttp.RespondWith(401, ""),
+						),
+					)
+				})
+
+				It("returns an UnexpectedStatusError", func() {
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).Should(Equal(UnexpectedStatusError{
+						URL:        fmt.Sprintf("%s/v2/some-repo/manifests/some-tag", server.URL()),
+						StatusCode: 404,
+					}))
+				})
+			})
+
+			Context("and the registry does not support v2", func() {
+				BeforeEach(func() {
+					server.AppendHandlers(
+						ghttp.CombineHandlers(
+							ghttp.VerifyRequest("GET", "/v2/"),
+							ghttp.RespondWith(404, ""),
+						),
+					)
+				})
+
+				It("returns ErrV2Unsupported", func() {
+					_, err := fetcher.Fetch("some-repo", "some-tag")
+					Ω(err).Should(Equal(ErrV2Unsupported))
+				})
+			})
+		})
+	})
+})
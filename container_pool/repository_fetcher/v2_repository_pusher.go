@@ -0,0 +1,413 @@
+package repository_fetcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/dotcloud/docker/archive"
+	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/utils"
+)
+
+const (
+	layerMediaType  = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+	configMediaType = "application/vnd.docker.container.image.v1+json"
+)
+
+// V2RepositoryPusher pushes images from the graph to registries speaking the
+// Docker Registry HTTP API v2. Each layer is gzipped and uploaded as a blob,
+// unless the repository already has it or it can be mounted from another
+// repository on the registry that it was pushed to before. The image is then
+// tagged by putting a schema 2 manifest, whose config is converted from the
+// image's v1 JSON.
+type V2RepositoryPusher struct {
+	registry *V2RepositoryFetcher
+	graph    LayerGraph
+
+	// a repository on the registry that each blob is known to be in, to mount
+	// it from instead of uploading it again
+	blobRepos      map[string]string
+	blobReposMutex *sync.Mutex
+}
+
+func NewV2Pusher(endpoint string, credentials Credentials, graph LayerGraph) RepositoryPusher {
+	return &V2RepositoryPusher{
+		registry: NewV2(endpoint, credentials, nil, nil).(*V2RepositoryFetcher),
+		graph:    graph,
+
+		blobRepos:      make(map[string]string),
+		blobReposMutex: new(sync.Mutex),
+	}
+}
+
+func (pusher *V2RepositoryPusher) Push(repoName string, tag string, imageID string) error {
+	if pusher.registry.official && !strings.Contains(repoName, "/") {
+		repoName = "library/" + repoName
+	}
+
+	log.Println("pushing", imageID, "as", repoName+":"+tag, "via v2 to", pusher.registry.endpoint)
+
+	if !pusher.registry.supportsV2() {
+		return ErrV2Unsupported
+	}
+
+	history, err := imageHistory(pusher.graph, imageID)
+	if err != nil {
+		return err
+	}
+
+	manifest := schema2Manifest{
+		SchemaVersion: 2,
+		MediaType:     manifestV2MediaType,
+	}
+
+	config := schema2Config{
+		RootFS: &schema2RootFS{Type: "layers"},
+	}
+
+	for _, img := range history {
+		layer, diffID, err := pusher.pushLayer(repoName, img.ID)
+		if err != nil {
+			return err
+		}
+
+		manifest.Layers = append(manifest.Layers, layer)
+
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+		config.History = append(config.History, schema2History{
+			Created: img.Created,
+			Author:  img.Author,
+			Comment: img.Comment,
+		})
+	}
+
+	img := history[len(history)-1]
+
+	config.Created = img.Created
+	config.Architecture = img.Architecture
+	config.OS = img.OS
+	config.Config = img.Config
+
+	if config.Architecture == "" {
+		config.Architecture = runtime.GOARCH
+	}
+
+	if config.OS == "" {
+		config.OS = "linux"
+	}
+
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+
+	manifest.Config = schema2Descriptor{
+		MediaType: configMediaType,
+		Size:      int64(len(configJSON)),
+		Digest:    sha256Digest(configJSON),
+	}
+
+	err = pusher.pushBlob(repoName, manifest.Config.Digest, bytes.NewReader(configJSON), manifest.Config.Size)
+	if err != nil {
+		return err
+	}
+
+	return pusher.putManifest(repoName, tag, manifest)
+}
+
+// pushLayer pushes the image's layer, returning its descriptor for the
+// manifest along with the digest of its uncompressed content for the config.
+func (pusher *V2RepositoryPusher) pushLayer(repoName string, imageID string) (schema2Descriptor, string, error) {
+	layer, err := pusher.graph.TempLayerArchive(
+		imageID,
+		archive.Uncompressed,
+		utils.NewStreamFormatter(false),
+		ioutil.Discard,
+	)
+	if err != nil {
+		return schema2Descriptor{}, "", err
+	}
+
+	defer layer.Close()
+	defer os.Remove(layer.Name())
+
+	blob, digest, diffID, err := compressLayer(layer.File)
+	if err != nil {
+		return schema2Descriptor{}, "", err
+	}
+
+	defer blob.Close()
+	defer os.Remove(blob.Name())
+
+	info, err := blob.Stat()
+	if err != nil {
+		return schema2Descriptor{}, "", err
+	}
+
+	descriptor := schema2Descriptor{
+		MediaType: layerMediaType,
+		Size:      info.Size(),
+		Digest:    digest,
+	}
+
+	log.Println("pushing layer:", imageID, digest)
+
+	err = pusher.pushBlob(repoName, digest, blob, descriptor.Size)
+	if err != nil {
+		return schema2Descriptor{}, "", err
+	}
+
+	return descriptor, diffID, nil
+}
+
+// compressLayer gzips the layer into a temporary file next to it, returning
+// the file along with the digests of the blob and of the uncompressed layer.
+func compressLayer(layer *os.File) (*os.File, string, string, error) {
+	blob, err := ioutil.TempFile(filepath.Dir(layer.Name()), "blob")
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	blobSum := sha256.New()
+	diffSum := sha256.New()
+
+	compressor := gzip.NewWriter(io.MultiWriter(blob, blobSum))
+
+	_, err = io.Copy(compressor, io.TeeReader(layer, diffSum))
+	if err == nil {
+		err = compressor.Close()
+	}
+
+	if err == nil {
+		_, err = blob.Seek(0, 0)
+	}
+
+	if err != nil {
+		blob.Close()
+		os.Remove(blob.Name())
+		return nil, "", "", err
+	}
+
+	return blob,
+		"sha256:" + hex.EncodeToString(blobSum.Sum(nil)),
+		"sha256:" + hex.EncodeToString(diffSum.Sum(nil)),
+		nil
+}
+
+// pushBlob uploads the blob to the repository, unless it is already there or
+// can be mounted from another repository.
+func (pusher *V2RepositoryPusher) pushBlob(repoName string, digest string, blob io.ReadSeeker, size int64) error {
+	exists, err := pusher.blobExists(repoName, digest)
+	if err != nil {
+		return err
+	}
+
+	if exists {
+		log.Println("already pushed:", digest)
+		pusher.rememberBlob(digest, repoName)
+		return nil
+	}
+
+	location, mounted, err := pusher.startUpload(repoName, digest)
+	if err != nil {
+		return err
+	}
+
+	if !mounted {
+		err := pusher.upload(repoName, location, digest, blob, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	pusher.rememberBlob(digest, repoName)
+
+	return nil
+}
+
+func (pusher *V2RepositoryPusher) blobExists(repoName string, digest string) (bool, error) {
+	request, err := http.NewRequest("HEAD", pusher.registry.endpoint+"/v2/"+repoName+"/blobs/"+digest, nil)
+	if err != nil {
+		return false, err
+	}
+
+	response, err := pusher.registry.do(repoName, request)
+	if err != nil {
+		return false, err
+	}
+
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	}
+
+	return false, UnexpectedStatusError{
+		URL:        request.URL.String(),
+		StatusCode: response.StatusCode,
+	}
+}
+
+// startUpload starts an upload session for the blob, returning where to
+// upload it to. If the blob was pushed to another repository before, the
+// registry is first asked to mount it from there, in which case there is
+// nothing to upload. Registries that cannot mount it start a session instead.
+func (pusher *V2RepositoryPusher) startUpload(repoName string, digest string) (string, bool, error) {
+	uploadURL := pusher.registry.endpoint + "/v2/" + repoName + "/blobs/uploads/"
+
+	from, found := pusher.blobRepo(digest)
+	if found && from != repoName {
+		uploadURL += "?mount=" + digest + "&from=" + from
+	}
+
+	request, err := http.NewRequest("POST", uploadURL, nil)
+	if err != nil {
+		return "", false, err
+	}
+
+	response, err := pusher.registry.do(repoName, request)
+	if err != nil {
+		return "", false, err
+	}
+
+	response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusCreated:
+		log.Println("mounted blob:", digest, "from", from)
+		return "", true, nil
+
+	case http.StatusAccepted:
+		location, err := response.Request.URL.Parse(response.Header.Get("Location"))
+		if err != nil {
+			return "", false, err
+		}
+
+		return location.String(), false, nil
+	}
+
+	return "", false, UnexpectedStatusError{
+		URL:        request.URL.String(),
+		StatusCode: response.StatusCode,
+	}
+}
+
+// upload completes the upload session with the blob's content in a single
+// request.
+func (pusher *V2RepositoryPusher) upload(repoName string, location string, digest string, blob io.ReadSeeker, size int64) error {
+	request, err := http.NewRequest("PUT", location, ioutil.NopCloser(blob))
+	if err != nil {
+		return err
+	}
+
+	query := request.URL.Query()
+	query.Set("digest", digest)
+	request.URL.RawQuery = query.Encode()
+
+	request.ContentLength = size
+	request.Header.Set("Content-Type", "application/octet-stream")
+
+	// rewind the blob if the request is repeated to authenticate
+	request.GetBody = func() (io.ReadCloser, error) {
+		_, err := blob.Seek(0, 0)
+		return ioutil.NopCloser(blob), err
+	}
+
+	response, err := pusher.registry.do(repoName, request)
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return UnexpectedStatusError{
+			URL:        request.URL.String(),
+			StatusCode: response.StatusCode,
+		}
+	}
+
+	return nil
+}
+
+func (pusher *V2RepositoryPusher) putManifest(repoName string, tag string, manifest schema2Manifest) error {
+	manifestJSON, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("PUT", pusher.registry.endpoint+"/v2/"+repoName+"/manifests/"+tag, bytes.NewReader(manifestJSON))
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Content-Type", manifestV2MediaType)
+
+	response, err := pusher.registry.do(repoName, request)
+	if err != nil {
+		return err
+	}
+
+	response.Body.Close()
+
+	if response.StatusCode != http.StatusCreated {
+		return UnexpectedStatusError{
+			URL:        request.URL.String(),
+			StatusCode: response.StatusCode,
+		}
+	}
+
+	return nil
+}
+
+func (pusher *V2RepositoryPusher) blobRepo(digest string) (string, bool) {
+	pusher.blobReposMutex.Lock()
+	defer pusher.blobReposMutex.Unlock()
+
+	repoName, found := pusher.blobRepos[digest]
+	return repoName, found
+}
+
+func (pusher *V2RepositoryPusher) rememberBlob(digest string, repoName string) {
+	pusher.blobReposMutex.Lock()
+	pusher.blobRepos[digest] = repoName
+	pusher.blobReposMutex.Unlock()
+}
+
+func sha256Digest(data []byte) string {
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// imageHistory returns the image and its ancestors, parent-first.
+func imageHistory(graph LayerGraph, imageID string) ([]*image.Image, error) {
+	history := []*image.Image{}
+
+	for id := imageID; id != ""; {
+		img, err := graph.Get(id)
+		if err != nil {
+			return nil, err
+		}
+
+		history = append([]*image.Image{img}, history...)
+
+		id = img.Parent
+	}
+
+	return history, nil
+}
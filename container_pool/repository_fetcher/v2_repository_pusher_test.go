@@ -0,0 +1,371 @@
+package repository_fetcher_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/dotcloud/docker/image"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/onsi/gomega/ghttp"
+
+	. "github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/fake_graph"
+)
+
+var _ = Describe("V2RepositoryPusher", func() {
+	var graph *fake_graph.FakeGraph
+	var pusher RepositoryPusher
+
+	var server *ghttp.Server
+
+	layerTar := func(content string) string {
+		buf := new(bytes.Buffer)
+		writer := tar.NewWriter(buf)
+
+		err := writer.WriteHeader(&tar.Header{Name: "some-file", Mode: 0644, Size: int64(len(content))})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		_, err = writer.Write([]byte(content))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = writer.Close()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return buf.String()
+	}
+
+	gzipped := func(data string) string {
+		buf := new(bytes.Buffer)
+		writer := gzip.NewWriter(buf)
+
+		_, err := writer.Write([]byte(data))
+		Ω(err).ShouldNot(HaveOccurred())
+
+		err = writer.Close()
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return buf.String()
+	}
+
+	digest := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return "sha256:" + hex.EncodeToString(sum[:])
+	}
+
+	baseLayer := layerTar("base")
+	topLayer := layerTar("top")
+
+	baseDigest := digest(gzipped(baseLayer))
+	topDigest := digest(gzipped(topLayer))
+
+	var configDigest string
+
+	BeforeEach(func() {
+		graph = fake_graph.New()
+
+		server = ghttp.NewServer()
+
+		pusher = NewV2Pusher(server.URL(), Credentials{}, graph)
+
+		graph.SetImage(&image.Image{ID: "layer-1"})
+		graph.SetImage(&image.Image{ID: "layer-2", Parent: "layer-1", Author: "some-author"})
+		graph.SetLayer("layer-1", baseLayer)
+		graph.SetLayer("layer-2", topLayer)
+
+		configDigest = ""
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	status := func(code int) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(code)
+		}
+	}
+
+	versionCheck := func() http.HandlerFunc {
+		return ghttp.CombineHandlers(
+			ghttp.VerifyRequest("GET", "/v2/"),
+			status(200),
+		)
+	}
+
+	headBlob := func(repoName string, digest string, code int) http.HandlerFunc {
+		return ghttp.CombineHandlers(
+			ghttp.VerifyRequest("HEAD", "/v2/"+repoName+"/blobs/"+digest),
+			status(code),
+		)
+	}
+
+	// the config's digest is only known once it's uploaded
+	headConfig := func(repoName string, code int) http.HandlerFunc {
+		return ghttp.CombineHandlers(
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				Ω(req.Method).Should(Equal("HEAD"))
+				Ω(req.URL.Path).Should(MatchRegexp("^/v2/" + repoName + "/blobs/sha256:[0-9a-f]{64}$"))
+			}),
+			status(code),
+		)
+	}
+
+	startUpload := func(repoName string) http.HandlerFunc {
+		return ghttp.CombineHandlers(
+			ghttp.VerifyRequest("POST", "/v2/"+repoName+"/blobs/uploads/"),
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.Header().Set("Location", "/v2/"+repoName+"/blobs/uploads/some-uuid?_state=some-state")
+				w.WriteHeader(202)
+			}),
+		)
+	}
+
+	upload := func(repoName string, verify func(digest string, body []byte)) http.HandlerFunc {
+		return ghttp.CombineHandlers(
+			ghttp.VerifyRequest("PUT", "/v2/"+repoName+"/blobs/uploads/some-uuid"),
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				Ω(req.URL.Query().Get("_state")).Should(Equal("some-state"))
+
+				body, err := ioutil.ReadAll(req.Body)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				blobDigest := req.URL.Query().Get("digest")
+				Ω(blobDigest).Should(Equal(digest(string(body))))
+
+				verify(blobDigest, body)
+
+				w.WriteHeader(201)
+			}),
+		)
+	}
+
+	uploadLayer := func(repoName string, layer string) http.HandlerFunc {
+		return upload(repoName, func(blobDigest string, body []byte) {
+			Ω(string(body)).Should(Equal(gzipped(layer)))
+		})
+	}
+
+	uploadConfig := func(repoName string) http.HandlerFunc {
+		return upload(repoName, func(blobDigest string, body []byte) {
+			var config map[string]interface{}
+			err := json.Unmarshal(body, &config)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(config["os"]).Should(Equal("linux"))
+			Ω(config["rootfs"]).Should(Equal(map[string]interface{}{
+				"type":     "layers",
+				"diff_ids": []interface{}{digest(baseLayer), digest(topLayer)},
+			}))
+
+			history := config["history"].([]interface{})
+			Ω(history).Should(HaveLen(2))
+			Ω(history[1].(map[string]interface{})["author"]).Should(Equal("some-author"))
+
+			configDigest = blobDigest
+		})
+	}
+
+	putManifest := func(repoName string) http.HandlerFunc {
+		return ghttp.CombineHandlers(
+			ghttp.VerifyRequest("PUT", "/v2/"+repoName+"/manifests/some-tag"),
+			ghttp.VerifyContentType("application/vnd.docker.distribution.manifest.v2+json"),
+			http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				var manifest map[string]interface{}
+				err := json.NewDecoder(req.Body).Decode(&manifest)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(manifest["schemaVersion"]).Should(Equal(float64(2)))
+
+				config := manifest["config"].(map[string]interface{})
+				Ω(config["mediaType"]).Should(Equal("application/vnd.docker.container.image.v1+json"))
+				Ω(config["digest"]).Should(MatchRegexp("^sha256:[0-9a-f]{64}$"))
+
+				if configDigest != "" {
+					Ω(config["digest"]).Should(Equal(configDigest))
+				}
+
+				Ω(manifest["layers"]).Should(Equal([]interface{}{
+					map[string]interface{}{
+						"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+						"size":      float64(len(gzipped(baseLayer))),
+						"digest":    baseDigest,
+					},
+					map[string]interface{}{
+						"mediaType": "application/vnd.docker.image.rootfs.diff.tar.gzip",
+						"size":      float64(len(gzipped(topLayer))),
+						"digest":    topDigest,
+					},
+				}))
+
+				w.WriteHeader(201)
+			}),
+		)
+	}
+
+	Describe("Push", func() {
+		Context("when the registry is missing some of the image's blobs", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					versionCheck(),
+					headBlob("some-user/some-repo", baseDigest, 200),
+					headBlob("some-user/some-repo", topDigest, 404),
+					startUpload("some-user/some-repo"),
+					uploadLayer("some-user/some-repo", topLayer),
+					headConfig("some-user/some-repo", 404),
+					startUpload("some-user/some-repo"),
+					uploadConfig("some-user/some-repo"),
+					putManifest("some-user/some-repo"),
+				)
+			})
+
+			It("uploads them, and puts the manifest", func() {
+				err := pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(server.ReceivedRequests()).Should(HaveLen(9))
+				Ω(configDigest).ShouldNot(BeEmpty())
+			})
+
+			Context("and uploading one fails", func() {
+				BeforeEach(func() {
+					server.SetHandler(4, ghttp.CombineHandlers(
+						ghttp.VerifyRequest("PUT", "/v2/some-user/some-repo/blobs/uploads/some-uuid"),
+						status(500),
+					))
+				})
+
+				It("returns an error without putting the manifest", func() {
+					err := pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+					Ω(err).Should(HaveOccurred())
+
+					Ω(server.ReceivedRequests()).Should(HaveLen(5))
+				})
+			})
+		})
+
+		Context("when the registry requires authentication to upload", func() {
+			BeforeEach(func() {
+				pusher = NewV2Pusher(server.URL(), Credentials{
+					Username: "some-user",
+					Password: "some-password",
+				}, graph)
+
+				server.AppendHandlers(
+					versionCheck(),
+					headBlob("some-user/some-repo", baseDigest, 200),
+					headBlob("some-user/some-repo", topDigest, 404),
+					startUpload("some-user/some-repo"),
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("PUT", "/v2/some-user/some-repo/blobs/uploads/some-uuid"),
+						http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+							ioutil.ReadAll(req.Body)
+
+							w.Header().Set("WWW-Authenticate", `Basic realm="some-realm"`)
+							w.WriteHeader(401)
+						}),
+					),
+					ghttp.CombineHandlers(
+						ghttp.VerifyBasicAuth("some-user", "some-password"),
+						uploadLayer("some-user/some-repo", topLayer),
+					),
+					headConfig("some-user/some-repo", 404),
+					startUpload("some-user/some-repo"),
+					uploadConfig("some-user/some-repo"),
+					putManifest("some-user/some-repo"),
+				)
+			})
+
+			It("uploads the blob again once authenticated", func() {
+				err := pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(server.ReceivedRequests()).Should(HaveLen(10))
+			})
+		})
+
+		Context("when the image's blobs were pushed to another repository", func() {
+			mount := func(digest string) http.HandlerFunc {
+				return ghttp.CombineHandlers(
+					ghttp.VerifyRequest("POST", "/v2/some-user/some-repo/blobs/uploads/"),
+					http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+						Ω(req.URL.Query().Get("from")).Should(Equal("some-user/other-repo"))
+
+						if digest != "" {
+							Ω(req.URL.Query().Get("mount")).Should(Equal(digest))
+						}
+
+						w.WriteHeader(201)
+					}),
+				)
+			}
+
+			BeforeEach(func() {
+				server.AppendHandlers(
+					versionCheck(),
+					headBlob("some-user/other-repo", baseDigest, 200),
+					headBlob("some-user/other-repo", topDigest, 200),
+					headConfig("some-user/other-repo", 200),
+					putManifest("some-user/other-repo"),
+
+					versionCheck(),
+					headBlob("some-user/some-repo", baseDigest, 404),
+					mount(baseDigest),
+					headBlob("some-user/some-repo", topDigest, 404),
+					mount(topDigest),
+					headConfig("some-user/some-repo", 404),
+					mount(""),
+					putManifest("some-user/some-repo"),
+				)
+			})
+
+			It("mounts them from there instead of uploading them", func() {
+				err := pusher.Push("some-user/other-repo", "some-tag", "layer-2")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				err = pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(server.ReceivedRequests()).Should(HaveLen(13))
+			})
+		})
+
+		Context("when the registry does not speak v2", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(
+					ghttp.CombineHandlers(
+						ghttp.VerifyRequest("GET", "/v2/"),
+						status(404),
+					),
+				)
+			})
+
+			It("returns ErrV2Unsupported without pushing anything", func() {
+				err := pusher.Push("some-user/some-repo", "some-tag", "layer-2")
+				Ω(err).Should(Equal(ErrV2Unsupported))
+
+				Ω(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+
+		Context("when the image is not in the graph", func() {
+			BeforeEach(func() {
+				server.AppendHandlers(versionCheck())
+			})
+
+			It("returns an error", func() {
+				err := pusher.Push("some-user/some-repo", "some-tag", "bogus-id")
+				Ω(err).Should(HaveOccurred())
+
+				Ω(server.ReceivedRequests()).Should(HaveLen(1))
+			})
+		})
+	})
+})
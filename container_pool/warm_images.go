@@ -0,0 +1,150 @@
+package container_pool
+
+import (
+	"log"
+	"time"
+
+	"github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
+
+// WarmImage is an image that the pool keeps pulled, so that the first
+// container created from it doesn't wait on a pull.
+type WarmImage struct {
+	Reference string
+
+	// the image the reference resolved to when it was last pulled
+	ImageID  string
+	PulledAt time.Time
+
+	// whether the image has been pulled and is in the graph
+	Ready bool
+
+	// why the last pull failed, if it did; a ready image remains ready if
+	// re-pulling it fails
+	Error string
+}
+
+// WarmImages reports the state of each of the pool's warm images.
+func (p *LinuxContainerPool) WarmImages() []WarmImage {
+	p.warmImagesMutex.RLock()
+	defer p.warmImagesMutex.RUnlock()
+
+	images := make([]WarmImage, len(p.warmImages))
+	copy(images, p.warmImages)
+
+	return images
+}
+
+// parseWarmImages checks each warm image reference before anything is
+// pulled.
+func (p *LinuxContainerPool) parseWarmImages() ([]ImageReference, error) {
+	refs := []ImageReference{}
+
+	for _, image := range p.WarmImages() {
+		ref, err := ParseImageReference(image.Reference)
+		if err != nil {
+			return nil, err
+		}
+
+		refs = append(refs, ref)
+	}
+
+	return refs, nil
+}
+
+// warmUp pulls the warm images in the background, so that setting up the
+// pool doesn't wait on the registry, and then re-pulls them on the interval,
+// if there is one.
+func (p *LinuxContainerPool) warmUp(refs []ImageReference) {
+	p.pullWarmImages(refs, "")
+
+	if p.warmImageInterval > 0 {
+		p.refreshWarmImages(refs)
+	}
+}
+
+// pullWarmImages pulls each warm image; a pull that fails is logged and
+// reported, but does not stop the others.
+func (p *LinuxContainerPool) pullWarmImages(refs []ImageReference, policy repository_fetcher.PullPolicy) {
+	for i, ref := range refs {
+		log.Println("warming image", ref.String())
+
+		err := p.pullWarmImage(i, ref, policy)
+		if err != nil {
+			log.Println("failed to warm image", ref.String()+":", err)
+			p.recordWarmImageError(i, err)
+		}
+	}
+}
+
+// pullWarmImage pulls the image and records it as warm. An image collected
+// between being pulled and being retained is pulled again, as for
+// containers.
+func (p *LinuxContainerPool) pullWarmImage(i int, ref ImageReference, policy repository_fetcher.PullPolicy) error {
+	for attempt := 1; ; attempt++ {
+		var img *repository_fetcher.Image
+		var err error
+
+		if policy == "" {
+			img, err = p.repoFetcher.Fetch(ref.Name(), ref.Reference())
+		} else {
+			img, err = p.repoFetcher.FetchWithPolicy(ref.Name(), ref.Reference(), policy, nil)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		err = p.recordWarmImage(i, img)
+		if err == nil {
+			return nil
+		}
+
+		if attempt == maxRetainAttempts {
+			return err
+		}
+
+		log.Println("warming image", ref.String(), "again:", err)
+	}
+}
+
+func (p *LinuxContainerPool) recordWarmImage(i int, img *repository_fetcher.Image) error {
+	p.warmImagesMutex.Lock()
+	defer p.warmImagesMutex.Unlock()
+
+	warm := &p.warmImages[i]
+
+	// keep the image in the graph for as long as it's warm, and let the
+	// one it replaces be collected
+	if img.ID != warm.ImageID {
+		err := p.imageCollector.RetainFetched(img.ID)
+		if err != nil {
+			return err
+		}
+
+		if warm.ImageID != "" {
+			p.imageCollector.Release(warm.ImageID)
+		}
+	}
+
+	warm.ImageID = img.ID
+	warm.PulledAt = time.Now()
+	warm.Ready = true
+	warm.Error = ""
+
+	return nil
+}
+
+func (p *LinuxContainerPool) recordWarmImageError(i int, err error) {
+	p.warmImagesMutex.Lock()
+	p.warmImages[i].Error = err.Error()
+	p.warmImagesMutex.Unlock()
+}
+
+// refreshWarmImages re-pulls the warm images on an interval, so that they
+// track their tags.
+func (p *LinuxContainerPool) refreshWarmImages(refs []ImageReference) {
+	for range time.Tick(p.warmImageInterval) {
+		p.pullWarmImages(refs, repository_fetcher.PullAlways)
+	}
+}
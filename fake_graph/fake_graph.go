@@ -1,14 +1,24 @@
 package fake_graph
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
 	"sync"
 
 	"github.com/dotcloud/docker/archive"
 	"github.com/dotcloud/docker/image"
+	"github.com/dotcloud/docker/utils"
 )
 
 type FakeGraph struct {
 	exists map[string]bool
+	images map[string]*image.Image
+
+	deleted     []string
+	DeleteError error
+
+	layers map[string]string
 
 	WhenRegistering func(imageJSON []byte, layer archive.ArchiveReader, image *image.Image) error
 
@@ -18,6 +28,8 @@ type FakeGraph struct {
 func New() *FakeGraph {
 	return &FakeGraph{
 		exists: make(map[string]bool),
+		images: make(map[string]*image.Image),
+		layers: make(map[string]string),
 
 		mutex: &sync.RWMutex{},
 	}
@@ -36,10 +48,107 @@ func (graph *FakeGraph) SetExists(imageID string, exists bool) {
 	graph.mutex.Unlock()
 }
 
+func (graph *FakeGraph) Get(imageID string) (*image.Image, error) {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
+	img, found := graph.images[imageID]
+	if !found {
+		return nil, fmt.Errorf("image not found: %s", imageID)
+	}
+
+	return img, nil
+}
+
+func (graph *FakeGraph) SetImage(img *image.Image) {
+	graph.mutex.Lock()
+	graph.images[img.ID] = img
+	graph.mutex.Unlock()
+}
+
 func (graph *FakeGraph) Register(imageJSON []byte, layer archive.ArchiveReader, image *image.Image) error {
 	if graph.WhenRegistering != nil {
-		return graph.WhenRegistering(imageJSON, layer, image)
+		err := graph.WhenRegistering(imageJSON, layer, image)
+		if err != nil {
+			return err
+		}
+	}
+
+	graph.mutex.Lock()
+	graph.images[image.ID] = image
+	graph.exists[image.ID] = true
+	graph.mutex.Unlock()
+
+	return nil
+}
+
+func (graph *FakeGraph) Map() (map[string]*image.Image, error) {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
+	images := make(map[string]*image.Image)
+	for id, img := range graph.images {
+		images[id] = img
+	}
+
+	return images, nil
+}
+
+func (graph *FakeGraph) Delete(imageID string) error {
+	if graph.DeleteError != nil {
+		return graph.DeleteError
 	}
 
+	graph.mutex.Lock()
+	defer graph.mutex.Unlock()
+
+	delete(graph.images, imageID)
+	delete(graph.exists, imageID)
+
+	graph.deleted = append(graph.deleted, imageID)
+
 	return nil
 }
+
+func (graph *FakeGraph) Deleted() []string {
+	graph.mutex.RLock()
+	defer graph.mutex.RUnlock()
+
+	deleted := make([]string, len(graph.deleted))
+	copy(deleted, graph.deleted)
+
+	return deleted
+}
+
+func (graph *FakeGraph) SetLayer(imageID string, data string) {
+	graph.mutex.Lock()
+	graph.layers[imageID] = data
+	graph.mutex.Unlock()
+}
+
+func (graph *FakeGraph) TempLayerArchive(imageID string, compression archive.Compression, sf *utils.StreamFormatter, output io.Writer) (*archive.TempArchive, error) {
+	graph.mutex.RLock()
+	data, found := graph.layers[imageID]
+	graph.mutex.RUnlock()
+
+	if !found {
+		return nil, fmt.Errorf("layer not found: %s", imageID)
+	}
+
+	file, err := ioutil.TempFile("", "fake-layer")
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.WriteString(data)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = file.Seek(0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return &archive.TempArchive{File: file, Size: int64(len(data))}, nil
+}
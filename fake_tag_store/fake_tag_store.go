@@ -0,0 +1,106 @@
+package fake_tag_store
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/dotcloud/docker/graph"
+)
+
+type FakeTagStore struct {
+	repositories map[string]graph.Repository
+
+	GetError    error
+	SetError    error
+	DeleteError error
+
+	mutex *sync.RWMutex
+}
+
+func New() *FakeTagStore {
+	return &FakeTagStore{
+		repositories: make(map[string]graph.Repository),
+
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (store *FakeTagStore) Get(repoName string) (graph.Repository, error) {
+	if store.GetError != nil {
+		return nil, store.GetError
+	}
+
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.repositories[repoName], nil
+}
+
+func (store *FakeTagStore) Set(repoName string, tag string, imageName string, force bool) error {
+	if store.SetError != nil {
+		return store.SetError
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	repo, found := store.repositories[repoName]
+	if !found {
+		repo = make(graph.Repository)
+		store.repositories[repoName] = repo
+	}
+
+	repo[tag] = imageName
+
+	return nil
+}
+
+func (store *FakeTagStore) Delete(repoName string, tag string) (bool, error) {
+	if store.DeleteError != nil {
+		return false, store.DeleteError
+	}
+
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	repo, found := store.repositories[repoName]
+	if !found {
+		return false, nil
+	}
+
+	if _, found := repo[tag]; !found {
+		return false, nil
+	}
+
+	delete(repo, tag)
+
+	if len(repo) == 0 {
+		delete(store.repositories, repoName)
+	}
+
+	return true, nil
+}
+
+// ByID returns the "repo:tag" names of each image, like docker's.
+func (store *FakeTagStore) ByID() map[string][]string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	byID := make(map[string][]string)
+
+	for repoName, repo := range store.repositories {
+		for tag, id := range repo {
+			byID[id] = append(byID[id], repoName+":"+tag)
+			sort.Strings(byID[id])
+		}
+	}
+
+	return byID
+}
+
+func (store *FakeTagStore) Tagged(repoName string, tag string) string {
+	store.mutex.RLock()
+	defer store.mutex.RUnlock()
+
+	return store.repositories[repoName][tag]
+}
@@ -0,0 +1,12 @@
+//go:build linux && amd64 && btrfs
+// +build linux,amd64,btrfs
+
+package main
+
+// the btrfs driver needs btrfs-progs' headers to build, so it's only built in
+// with the btrfs tag
+import _ "github.com/dotcloud/docker/daemon/graphdriver/btrfs"
+
+func init() {
+	delete(unbuiltGraphDrivers, "btrfs")
+}
@@ -0,0 +1,39 @@
+//go:build linux && amd64 && devicemapper
+// +build linux,amd64,devicemapper
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/dotcloud/docker/daemon/graphdriver/devmapper"
+	"github.com/dotcloud/docker/utils"
+)
+
+// the devicemapper driver needs libdevmapper's headers to build, so it's only
+// built in with the devicemapper tag
+
+func init() {
+	delete(unbuiltGraphDrivers, "devicemapper")
+	graphDriverOptionSetters["devicemapper"] = setDevicemapperOption
+}
+
+func setDevicemapperOption(key string, value string) error {
+	size, err := utils.RAMInBytes(value)
+	if err != nil {
+		return fmt.Errorf("malformed size for %s: %s", key, value)
+	}
+
+	switch key {
+	case "dm.basesize":
+		devmapper.DefaultBaseFsSize = uint64(size)
+	case "dm.loopdatasize":
+		devmapper.DefaultDataLoopbackSize = size
+	case "dm.loopmetadatasize":
+		devmapper.DefaultMetaDataLoopbackSize = size
+	default:
+		return fmt.Errorf("unknown devicemapper option: %s", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,130 @@
+package fake_image_pool
+
+import (
+	"io"
+	"sync"
+
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
+
+	"github.com/vito/warden-docker/container_pool"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
+
+type FakeImagePool struct {
+	Pulls map[string][]repository_fetcher.LayerProgress
+
+	WarmImagesResult []container_pool.WarmImage
+
+	committed    []CommitSpec
+	CommitResult string
+	CommitError  error
+
+	pushed    []string
+	PushError error
+
+	exported    []ExportSpec
+	ExportData  string
+	ExportError error
+
+	mutex *sync.RWMutex
+}
+
+type CommitSpec struct {
+	Handle    string
+	Reference string
+}
+
+type ExportSpec struct {
+	Handle string
+
+	// only set for image exports
+	Image     bool
+	Reference string
+}
+
+func New() *FakeImagePool {
+	return &FakeImagePool{
+		Pulls: make(map[string][]repository_fetcher.LayerProgress),
+
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (pool *FakeImagePool) PullProgress(handle string) ([]repository_fetcher.LayerProgress, bool) {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	layers, found := pool.Pulls[handle]
+	return layers, found
+}
+
+func (pool *FakeImagePool) WarmImages() []container_pool.WarmImage {
+	return pool.WarmImagesResult
+}
+
+func (pool *FakeImagePool) Commit(container linux_backend.Container, reference string) (string, error) {
+	if pool.CommitError != nil {
+		return "", pool.CommitError
+	}
+
+	pool.mutex.Lock()
+	pool.committed = append(pool.committed, CommitSpec{container.Handle(), reference})
+	pool.mutex.Unlock()
+
+	return pool.CommitResult, nil
+}
+
+func (pool *FakeImagePool) Committed() []CommitSpec {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	return pool.committed
+}
+
+func (pool *FakeImagePool) Push(reference string) error {
+	if pool.PushError != nil {
+		return pool.PushError
+	}
+
+	pool.mutex.Lock()
+	pool.pushed = append(pool.pushed, reference)
+	pool.mutex.Unlock()
+
+	return nil
+}
+
+func (pool *FakeImagePool) Pushed() []string {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	return pool.pushed
+}
+
+func (pool *FakeImagePool) ExportRootFS(container linux_backend.Container, out io.Writer) error {
+	return pool.export(ExportSpec{Handle: container.Handle()}, out)
+}
+
+func (pool *FakeImagePool) ExportImage(container linux_backend.Container, reference string, out io.Writer) error {
+	return pool.export(ExportSpec{Handle: container.Handle(), Image: true, Reference: reference}, out)
+}
+
+func (pool *FakeImagePool) Exported() []ExportSpec {
+	pool.mutex.RLock()
+	defer pool.mutex.RUnlock()
+
+	return pool.exported
+}
+
+// export writes ExportData, and only then fails with ExportError, if any
+func (pool *FakeImagePool) export(spec ExportSpec, out io.Writer) error {
+	pool.mutex.Lock()
+	pool.exported = append(pool.exported, spec)
+	pool.mutex.Unlock()
+
+	_, err := io.WriteString(out, pool.ExportData)
+	if err != nil {
+		return err
+	}
+
+	return pool.ExportError
+}
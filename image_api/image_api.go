@@ -0,0 +1,218 @@
+package image_api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/cloudfoundry-incubator/garden/warden"
+	"github.com/cloudfoundry-incubator/warden-linux/linux_backend"
+
+	"github.com/vito/warden-docker/container_pool"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher"
+)
+
+// apes *container_pool.LinuxContainerPool
+type ImagePool interface {
+	PullProgress(handle string) ([]repository_fetcher.LayerProgress, bool)
+	WarmImages() []container_pool.WarmImage
+
+	Commit(container linux_backend.Container, reference string) (string, error)
+	Push(reference string) error
+
+	ExportRootFS(container linux_backend.Container, out io.Writer) error
+	ExportImage(container linux_backend.Container, reference string, out io.Writer) error
+}
+
+// apes *linux_backend.LinuxBackend
+type Backend interface {
+	Lookup(handle string) (warden.Container, error)
+}
+
+// ImageAPI serves the pool's image operations over HTTP, as the warden
+// protocol has no requests for them:
+//
+//	GET  /pulls/:handle              the pull for a container being created with :handle
+//	GET  /warm_images                the state of each warm image
+//	POST /containers/:handle/commit  commit a container as ?reference=
+//	GET  /containers/:handle/rootfs  tarball of a container's root filesystem
+//	GET  /containers/:handle/image   `docker save` tarball of a container's image
+//	POST /push                       push the image tagged ?reference=
+//
+// Pulls are only tracked for containers created with a handle, as a handle
+// generated for the container isn't known until its create returns. The image
+// tarball is tagged with ?reference=, if given. Errors are returned as plain
+// text.
+//
+// The API has no authentication of its own, so it is only served on a unix
+// socket that only the server's user can connect to.
+type ImageAPI struct {
+	pool    ImagePool
+	backend Backend
+}
+
+func New(pool ImagePool, backend Backend) *ImageAPI {
+	return &ImageAPI{
+		pool:    pool,
+		backend: backend,
+	}
+}
+
+// CommitResponse is the response to committing a container.
+type CommitResponse struct {
+	ImageID string
+}
+
+func (api *ImageAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	segs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(segs) == 2 && segs[0] == "pulls" && r.Method == "GET":
+		api.pullProgress(w, segs[1])
+
+	case len(segs) == 1 && segs[0] == "warm_images" && r.Method == "GET":
+		writeJSON(w, api.pool.WarmImages())
+
+	case len(segs) == 3 && segs[0] == "containers" && segs[2] == "commit" && r.Method == "POST":
+		api.commit(w, segs[1], r.FormValue("reference"))
+
+	case len(segs) == 3 && segs[0] == "containers" && segs[2] == "rootfs" && r.Method == "GET":
+		api.export(w, segs[1], func(container linux_backend.Container, out io.Writer) error {
+			return api.pool.ExportRootFS(container, out)
+		})
+
+	case len(segs) == 3 && segs[0] == "containers" && segs[2] == "image" && r.Method == "GET":
+		reference := r.FormValue("reference")
+
+		api.export(w, segs[1], func(container linux_backend.Container, out io.Writer) error {
+			return api.pool.ExportImage(container, reference, out)
+		})
+
+	case len(segs) == 1 && segs[0] == "push" && r.Method == "POST":
+		err := api.pool.Push(r.FormValue("reference"))
+		if err != nil {
+			writeError(w, statusFor(err), err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (api *ImageAPI) pullProgress(w http.ResponseWriter, handle string) {
+	layers, found := api.pool.PullProgress(handle)
+	if !found {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no pull in progress for container: %s", handle))
+		return
+	}
+
+	writeJSON(w, layers)
+}
+
+func (api *ImageAPI) commit(w http.ResponseWriter, handle string, reference string) {
+	container, err := api.lookup(handle)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	imageID, err := api.pool.Commit(container, reference)
+	if err != nil {
+		writeError(w, statusFor(err), err)
+		return
+	}
+
+	writeJSON(w, CommitResponse{ImageID: imageID})
+}
+
+// export streams a tarball written by the export function. The status is
+// only sent once it has written something, so that an export failing before
+// then is reported as an error; one failing after is only logged, and the
+// client is left with a truncated tarball.
+func (api *ImageAPI) export(w http.ResponseWriter, handle string, export func(linux_backend.Container, io.Writer) error) {
+	container, err := api.lookup(handle)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	out := &lazyResponse{ResponseWriter: w}
+
+	err = export(container, out)
+	if err == nil {
+		return
+	}
+
+	if out.started {
+		log.Println("export of", handle, "failed after it started:", err)
+		return
+	}
+
+	writeError(w, statusFor(err), err)
+}
+
+func (api *ImageAPI) lookup(handle string) (linux_backend.Container, error) {
+	container, err := api.backend.Lookup(handle)
+	if err != nil {
+		return nil, err
+	}
+
+	linuxContainer, ok := container.(linux_backend.Container)
+	if !ok {
+		return nil, fmt.Errorf("not a linux container: %s", handle)
+	}
+
+	return linuxContainer, nil
+}
+
+// statusFor distinguishes requests that can't be carried out from those that
+// failed.
+func statusFor(err error) int {
+	switch err {
+	case container_pool.ErrNotImageBased, container_pool.ErrPushDigest:
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(value)
+	if err != nil {
+		log.Println("failed to write response:", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	http.Error(w, err.Error(), status)
+}
+
+// lazyResponse sends the tarball's headers with its first write.
+type lazyResponse struct {
+	http.ResponseWriter
+
+	started bool
+}
+
+func (response *lazyResponse) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if !response.started {
+		response.started = true
+
+		response.Header().Set("Content-Type", "application/x-tar")
+		response.WriteHeader(http.StatusOK)
+	}
+
+	return response.ResponseWriter.Write(p)
+}
@@ -0,0 +1,13 @@
+package image_api_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"testing"
+)
+
+func TestImageAPI(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "ImageAPI Suite")
+}
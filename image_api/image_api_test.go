@@ -0,0 +1,276 @@
+package image_api_test
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	"github.com/cloudfoundry-incubator/garden/warden"
+	"github.com/cloudfoundry-incubator/garden/warden/fake_backend"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/vito/warden-docker/container_pool"
+	"github.com/vito/warden-docker/container_pool/repository_fetcher"
+	. "github.com/vito/warden-docker/image_api"
+	"github.com/vito/warden-docker/image_api/fake_image_pool"
+)
+
+var _ = Describe("ImageAPI", func() {
+	var pool *fake_image_pool.FakeImagePool
+	var backend *fake_backend.FakeBackend
+
+	var server *httptest.Server
+
+	BeforeEach(func() {
+		pool = fake_image_pool.New()
+		backend = fake_backend.New()
+
+		_, err := backend.Create(warden.ContainerSpec{Handle: "some-handle"})
+		Ω(err).ShouldNot(HaveOccurred())
+
+		server = httptest.NewServer(New(pool, backend))
+	})
+
+	AfterEach(func() {
+		server.Close()
+	})
+
+	request := func(method string, path string, params url.Values) (int, string) {
+		req, err := http.NewRequest(method, server.URL+path+"?"+params.Encode(), nil)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		resp, err := http.DefaultClient.Do(req)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		defer resp.Body.Close()
+
+		body, err := ioutil.ReadAll(resp.Body)
+		Ω(err).ShouldNot(HaveOccurred())
+
+		return resp.StatusCode, string(body)
+	}
+
+	Describe("GET /pulls/:handle", func() {
+		Context("while the container's image is being pulled", func() {
+			BeforeEach(func() {
+				pool.Pulls["pulling-handle"] = []repository_fetcher.LayerProgress{
+					{LayerID: "some-layer", Cached: true, Complete: true},
+					{LayerID: "some-other-layer", Current: 1, Total: 2},
+				}
+			})
+
+			It("returns the progress of each layer", func() {
+				status, body := request("GET", "/pulls/pulling-handle", nil)
+				Ω(status).Should(Equal(http.StatusOK))
+
+				var layers []repository_fetcher.LayerProgress
+
+				err := json.Unmarshal([]byte(body), &layers)
+				Ω(err).ShouldNot(HaveOccurred())
+
+				Ω(layers).Should(Equal(pool.Pulls["pulling-handle"]))
+			})
+		})
+
+		Context("when no pull is in progress for the container", func() {
+			It("returns 404", func() {
+				status, _ := request("GET", "/pulls/some-handle", nil)
+				Ω(status).Should(Equal(http.StatusNotFound))
+			})
+		})
+	})
+
+	Describe("GET /warm_images", func() {
+		BeforeEach(func() {
+			pool.WarmImagesResult = []container_pool.WarmImage{
+				{Reference: "some-repo:some-tag", ImageID: "some-image-id", Ready: true},
+				{Reference: "some-other-repo:latest", Error: "oh no!"},
+			}
+		})
+
+		It("returns the state of each warm image", func() {
+			status, body := request("GET", "/warm_images", nil)
+			Ω(status).Should(Equal(http.StatusOK))
+
+			var images []container_pool.WarmImage
+
+			err := json.Unmarshal([]byte(body), &images)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(images).Should(HaveLen(2))
+			Ω(images[0].Reference).Should(Equal("some-repo:some-tag"))
+			Ω(images[0].ImageID).Should(Equal("some-image-id"))
+			Ω(images[0].Ready).Should(BeTrue())
+			Ω(images[1].Error).Should(Equal("oh no!"))
+		})
+	})
+
+	Describe("POST /containers/:handle/commit", func() {
+		BeforeEach(func() {
+			pool.CommitResult = "committed-image-id"
+		})
+
+		It("commits the container with the reference, returning the image's ID", func() {
+			status, body := request("POST", "/containers/some-handle/commit", url.Values{
+				"reference": {"ourname:some-tag"},
+			})
+			Ω(status).Should(Equal(http.StatusOK))
+
+			var response CommitResponse
+
+			err := json.Unmarshal([]byte(body), &response)
+			Ω(err).ShouldNot(HaveOccurred())
+
+			Ω(response.ImageID).Should(Equal("committed-image-id"))
+
+			Ω(pool.Committed()).Should(Equal([]fake_image_pool.CommitSpec{
+				{Handle: "some-handle", Reference: "ourname:some-tag"},
+			}))
+		})
+
+		Context("when the container does not exist", func() {
+			It("returns 404", func() {
+				status, _ := request("POST", "/containers/bogus-handle/commit", nil)
+				Ω(status).Should(Equal(http.StatusNotFound))
+
+				Ω(pool.Committed()).Should(BeEmpty())
+			})
+		})
+
+		Context("when the container was not created from an image", func() {
+			BeforeEach(func() {
+				pool.CommitError = container_pool.ErrNotImageBased
+			})
+
+			It("returns 400 with the error", func() {
+				status, body := request("POST", "/containers/some-handle/commit", nil)
+				Ω(status).Should(Equal(http.StatusBadRequest))
+				Ω(body).Should(ContainSubstring(container_pool.ErrNotImageBased.Error()))
+			})
+		})
+
+		Context("when committing fails", func() {
+			BeforeEach(func() {
+				pool.CommitError = errors.New("oh no!")
+			})
+
+			It("returns 500 with the error", func() {
+				status, body := request("POST", "/containers/some-handle/commit", nil)
+				Ω(status).Should(Equal(http.StatusInternalServerError))
+				Ω(body).Should(ContainSubstring("oh no!"))
+			})
+		})
+	})
+
+	Describe("GET /containers/:handle/rootfs", func() {
+		BeforeEach(func() {
+			pool.ExportData = "some-tarball"
+		})
+
+		It("streams the container's root filesystem", func() {
+			status, body := request("GET", "/containers/some-handle/rootfs", nil)
+			Ω(status).Should(Equal(http.StatusOK))
+			Ω(body).Should(Equal("some-tarball"))
+
+			Ω(pool.Exported()).Should(Equal([]fake_image_pool.ExportSpec{
+				{Handle: "some-handle"},
+			}))
+		})
+
+		Context("when the container does not exist", func() {
+			It("returns 404", func() {
+				status, _ := request("GET", "/containers/bogus-handle/rootfs", nil)
+				Ω(status).Should(Equal(http.StatusNotFound))
+			})
+		})
+	})
+
+	Describe("GET /containers/:handle/image", func() {
+		BeforeEach(func() {
+			pool.ExportData = "some-tarball"
+		})
+
+		It("streams the container's image, tagged with the reference", func() {
+			status, body := request("GET", "/containers/some-handle/image", url.Values{
+				"reference": {"ourname:some-tag"},
+			})
+			Ω(status).Should(Equal(http.StatusOK))
+			Ω(body).Should(Equal("some-tarball"))
+
+			Ω(pool.Exported()).Should(Equal([]fake_image_pool.ExportSpec{
+				{Handle: "some-handle", Image: true, Reference: "ourname:some-tag"},
+			}))
+		})
+
+		Context("when exporting fails before writing anything", func() {
+			BeforeEach(func() {
+				pool.ExportData = ""
+				pool.ExportError = container_pool.ErrNotImageBased
+			})
+
+			It("returns the error", func() {
+				status, body := request("GET", "/containers/some-handle/image", nil)
+				Ω(status).Should(Equal(http.StatusBadRequest))
+				Ω(body).Should(ContainSubstring(container_pool.ErrNotImageBased.Error()))
+			})
+		})
+
+		Context("when exporting fails part way through", func() {
+			BeforeEach(func() {
+				pool.ExportError = errors.New("oh no!")
+			})
+
+			It("leaves the tarball truncated", func() {
+				status, body := request("GET", "/containers/some-handle/image", nil)
+				Ω(status).Should(Equal(http.StatusOK))
+				Ω(body).Should(Equal("some-tarball"))
+			})
+		})
+	})
+
+	Describe("POST /push", func() {
+		It("pushes the image tagged with the reference", func() {
+			status, _ := request("POST", "/push", url.Values{
+				"reference": {"registry.example.com/ourname:some-tag"},
+			})
+			Ω(status).Should(Equal(http.StatusNoContent))
+
+			Ω(pool.Pushed()).Should(Equal([]string{"registry.example.com/ourname:some-tag"}))
+		})
+
+		Context("when the reference is a digest", func() {
+			BeforeEach(func() {
+				pool.PushError = container_pool.ErrPushDigest
+			})
+
+			It("returns 400 with the error", func() {
+				status, _ := request("POST", "/push", nil)
+				Ω(status).Should(Equal(http.StatusBadRequest))
+			})
+		})
+
+		Context("when pushing fails", func() {
+			BeforeEach(func() {
+				pool.PushError = errors.New("oh no!")
+			})
+
+			It("returns 500 with the error", func() {
+				status, body := request("POST", "/push", nil)
+				Ω(status).Should(Equal(http.StatusInternalServerError))
+				Ω(body).Should(ContainSubstring("oh no!"))
+			})
+		})
+	})
+
+	Context("with an unknown route", func() {
+		It("returns 404", func() {
+			status, _ := request("GET", "/containers/some-handle/bogus", nil)
+			Ω(status).Should(Equal(http.StatusNotFound))
+		})
+	})
+})
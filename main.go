@@ -1,14 +1,22 @@
 package main
 
 import (
+	"errors"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/cloudfoundry-incubator/garden/server"
 	"github.com/cloudfoundry/gunk/command_runner/linux_command_runner"
@@ -25,7 +33,11 @@ import (
 	"github.com/cloudfoundry-incubator/warden-linux/linux_backend/uid_pool"
 	"github.com/cloudfoundry-incubator/warden-linux/system_info"
 	"github.com/vito/warden-docker/container_pool"
+	"github.com/vito/warden-docker/container_pool/graph_checker"
+	"github.com/vito/warden-docker/container_pool/image_collector"
+	_ "github.com/vito/warden-docker/container_pool/overlay_graph_driver"
 	"github.com/vito/warden-docker/container_pool/repository_fetcher"
+	"github.com/vito/warden-docker/image_api"
 )
 
 var listenNetwork = flag.String(
@@ -40,6 +52,12 @@ var listenAddr = flag.String(
 	"address to listen on",
 )
 
+var imageAPISocket = flag.String(
+	"imageAPISocket",
+	"",
+	"unix socket to serve the image API (pull progress, warm images, commit, push, and export) on, which only this user can connect to; disabled if empty",
+)
+
 var snapshotsPath = flag.String(
 	"snapshots",
 	"",
@@ -130,12 +148,198 @@ var graphRoot = flag.String(
 	"docker image graph",
 )
 
+var graphDriverName = flag.String(
+	"graphDriver",
+	"",
+	"graph driver to store images and containers' layers with (aufs, overlay, or vfs, or btrfs or devicemapper if built with their tags); detected if empty",
+)
+
+var graphDriverOptions = flag.String(
+	"graphDriverOptions",
+	"",
+	"comma-separated options for the graph driver, e.g. dm.basesize=20G,dm.loopdatasize=200G,dm.loopmetadatasize=4G for devicemapper",
+)
+
+var downloadCacheDir = flag.String(
+	"downloadCacheDir",
+	"",
+	"directory to keep partially downloaded layers in, so that their downloads resume where they stopped; defaults to _downloads in the graph",
+)
+
 var dockerRegistry = flag.String(
 	"registry",
 	registry.IndexServerAddress(),
 	"docker registry API endpoint",
 )
 
+var registryAPIVersion = flag.String(
+	"registryAPIVersion",
+	"auto",
+	"docker registry API version to pull and push with (v1, v2, or auto to try v2 and fall back to v1)",
+)
+
+var registryCredentials = flag.String(
+	"registryCredentials",
+	"",
+	"docker config.json or .dockercfg file with credentials for pulling from registries",
+)
+
+var insecureRegistries = flag.String(
+	"insecureRegistries",
+	"",
+	"comma-separated registry hosts (host:port) to pull from over plain HTTP",
+)
+
+var registryMirrors = flag.String(
+	"registryMirrors",
+	"",
+	"semicolon-separated mirrors of each registry to pull through, tried in order, e.g. index.docker.io=https://mirror-a,https://mirror-b;localhost:5000=http://mirror-c; mirrors must speak the v2 API",
+)
+
+var registryMirrorFallback = flag.Bool(
+	"registryMirrorFallback",
+	true,
+	"pull from the registry itself if all of its mirrors fail",
+)
+
+var registryMirrorCooldown = flag.Duration(
+	"registryMirrorCooldown",
+	time.Minute,
+	"how long to skip a mirror for after it fails",
+)
+
+var pullPolicy = flag.String(
+	"pullPolicy",
+	"always",
+	"when to pull images from their registry (always, if-not-present, or never); containers may override this with the pull_policy property",
+)
+
+var fetchAttempts = flag.Int(
+	"fetchAttempts",
+	repository_fetcher.DefaultRetryPolicy.MaxAttempts,
+	"attempts to make at fetching an image before giving up; only network errors and server errors are retried",
+)
+
+var fetchBackoff = flag.Duration(
+	"fetchBackoff",
+	repository_fetcher.DefaultRetryPolicy.InitialBackoff,
+	"time to wait before retrying a failed fetch, doubling (with jitter) for each retry after it",
+)
+
+var fetchMaxBackoff = flag.Duration(
+	"fetchMaxBackoff",
+	repository_fetcher.DefaultRetryPolicy.MaxBackoff,
+	"longest time to wait between attempts at fetching an image",
+)
+
+var fetchDeadline = flag.Duration(
+	"fetchDeadline",
+	0,
+	"time to spend retrying a failed fetch before giving up (0 for no limit)",
+)
+
+var maxConcurrentPulls = flag.Int(
+	"maxConcurrentPulls",
+	0,
+	"number of repositories to fetch at once; the rest wait their turn (0 for no limit)",
+)
+
+var maxConcurrentLayers = flag.Int(
+	"maxConcurrentLayers",
+	0,
+	"number of layers to download at once, across all fetches (0 for no limit)",
+)
+
+var maxPullBandwidth = flag.Int64(
+	"maxPullBandwidth",
+	0,
+	"bytes per second to download layers at, across all fetches (0 for no limit)",
+)
+
+var allowedRegistries = flag.String(
+	"allowedRegistries",
+	"",
+	"comma-separated registry hosts that images may be pulled from, including the default registry's (e.g. index.docker.io); any if empty",
+)
+
+var allowedRepositories = flag.String(
+	"allowedRepositories",
+	"",
+	"comma-separated patterns of repositories, without their registry host, that images may be pulled from, e.g. team/*,ubuntu; any if empty",
+)
+
+var deniedTags = flag.String(
+	"deniedTags",
+	"",
+	"comma-separated tags that images may not be pulled by, e.g. latest",
+)
+
+var requireImageDigests = flag.Bool(
+	"requireImageDigests",
+	false,
+	"only allow images pinned to a digest, e.g. ubuntu@sha256:...",
+)
+
+var trustedKeys = flag.String(
+	"trustedKeys",
+	"",
+	"file of PEM-encoded public keys, one of which must have signed each image's digest (see -imageSignatures); requires images to be pinned to digests",
+)
+
+var imageSignatures = flag.String(
+	"imageSignatures",
+	"",
+	"directory of image signatures, laid out as <registry>/<repository>@sha256=<hex>/signature-<n>",
+)
+
+var preloadImages = flag.String(
+	"preloadImages",
+	"",
+	"directory of docker save tarballs (*.tar) to import into the graph on startup, e.g. for hosts without registry access (see -pullPolicy)",
+)
+
+var warmImagesFlag = flag.String(
+	"warmImages",
+	"",
+	"comma-separated images (e.g. ubuntu:14.04) to pull in the background on startup, so that the first containers created from them don't wait on a pull",
+)
+
+var warmImagesFile = flag.String(
+	"warmImagesFile",
+	"",
+	"file listing images to pull on startup, one per line, in addition to -warmImages",
+)
+
+var warmImageInterval = flag.Duration(
+	"warmImageInterval",
+	time.Hour,
+	"how often to re-pull the warm images, so that they track their tags (0 to disable)",
+)
+
+var imageGCInterval = flag.Duration(
+	"imageGCInterval",
+	time.Hour,
+	"how often to delete unused images from the graph (0 to disable)",
+)
+
+var imageGCMaxSize = flag.Int64(
+	"imageGCMaxSize",
+	0,
+	"total size in bytes of images to keep in the graph before deleting unused ones (0 for no limit)",
+)
+
+var imageGCMinFree = flag.Uint64(
+	"imageGCMinFree",
+	0,
+	"free space in bytes to maintain on the graph's filesystem by deleting unused images",
+)
+
+var imageGCGracePeriod = flag.Duration(
+	"imageGCGracePeriod",
+	24*time.Hour,
+	"how long an image must go unused before it may be deleted",
+)
+
 func main() {
 	flag.Parse()
 
@@ -179,27 +383,191 @@ func main() {
 		quotaManager.Disable()
 	}
 
-	graphDriver, err := graphdriver.New(*graphRoot)
+	graphDriver, err := newGraphDriver(*graphDriverName, splitList(*graphDriverOptions), *graphRoot)
 	if err != nil {
 		log.Fatalln("error constructing graph driver:", err)
 	}
 
-	graph, err := graph.NewGraph(*graphRoot, graphDriver)
+	dockerGraph, err := graph.NewGraph(*graphRoot, graphDriver)
 	if err != nil {
 		log.Fatalln("error constructing graph:", err)
 	}
 
-	reg, err := registry.NewRegistry(nil, nil, *dockerRegistry)
+	defaultPullPolicy, err := repository_fetcher.ParsePullPolicy(*pullPolicy)
+	if err != nil {
+		log.Fatalln("error parsing pull policy:", err)
+	}
+
+	dockerTagStore, err := graph.NewTagStore(path.Join(*graphRoot, "repositories.json"), dockerGraph)
+	if err != nil {
+		log.Fatalln("error constructing tag store:", err)
+	}
+
+	tagStore := repository_fetcher.NewLockedTagStore(dockerTagStore)
+
+	// images committed from containers are tagged apart from pulled ones, so
+	// that their tags are never looked for on a registry
+	dockerCommittedTagStore, err := graph.NewTagStore(path.Join(*graphRoot, "committed.json"), dockerGraph)
+	if err != nil {
+		log.Fatalln("error constructing committed tag store:", err)
+	}
+
+	committedTagStore := repository_fetcher.NewLockedTagStore(dockerCommittedTagStore)
+
+	if *preloadImages != "" {
+		importer := repository_fetcher.NewImporter(dockerGraph, tagStore)
+
+		err := importImages(importer, *preloadImages)
+		if err != nil {
+			log.Fatalln("error preloading images:", err)
+		}
+	}
+
+	keychain := repository_fetcher.Keychain{}
+
+	if *registryCredentials != "" {
+		keychain, err = repository_fetcher.LoadKeychain(*registryCredentials)
+		if err != nil {
+			log.Fatalln("error loading registry credentials:", err)
+		}
+	}
+
+	mirrors, err := parseMirrors(*registryMirrors)
 	if err != nil {
-		log.Fatalln(err)
+		log.Fatalln("error parsing registry mirrors:", err)
 	}
 
+	downloadsPath := *downloadCacheDir
+	if downloadsPath == "" {
+		downloadsPath = path.Join(*graphRoot, "_downloads")
+	}
+
+	pullThrottle := repository_fetcher.NewThrottle(repository_fetcher.PullLimits{
+		MaxRepositories: *maxConcurrentPulls,
+		MaxLayers:       *maxConcurrentLayers,
+		BytesPerSecond:  *maxPullBandwidth,
+	})
+
+	downloads, err := repository_fetcher.NewDownloadCache(downloadsPath, pullThrottle)
+	if err != nil {
+		log.Fatalln("error constructing download cache:", err)
+	}
+
+	defaultFetcher, err := newRepositoryFetcher(
+		*dockerRegistry,
+		v2Endpoint(*dockerRegistry),
+		keychain,
+		dockerGraph,
+		downloads,
+	)
+	if err != nil {
+		log.Fatalln("error constructing repository fetcher:", err)
+	}
+
+	defaultFetcher = withMirrors(
+		defaultFetcher,
+		mirrors[registryHost(*dockerRegistry)],
+		v2Endpoint(*dockerRegistry),
+		keychain,
+		dockerGraph,
+		downloads,
+	)
+
+	insecure := map[string]bool{}
+	for _, host := range strings.Split(*insecureRegistries, ",") {
+		insecure[host] = true
+	}
+
+	repoFetcher := repository_fetcher.NewRouter(
+		defaultFetcher,
+		func(host string) (repository_fetcher.RepositoryFetcher, error) {
+			scheme := "https"
+			if insecure[host] {
+				scheme = "http"
+			}
+
+			fetcher, err := newRepositoryFetcher(
+				scheme+"://"+host+"/v1/",
+				scheme+"://"+host,
+				keychain,
+				dockerGraph,
+				downloads,
+			)
+			if err != nil {
+				return nil, err
+			}
+
+			return withMirrors(fetcher, mirrors[host], scheme+"://"+host, keychain, dockerGraph, downloads), nil
+		},
+	)
+
+	defaultPusher, err := newRepositoryPusher(*dockerRegistry, v2Endpoint(*dockerRegistry), keychain, dockerGraph)
+	if err != nil {
+		log.Fatalln("error constructing repository pusher:", err)
+	}
+
+	repoPusher := repository_fetcher.NewPushRouter(
+		defaultPusher,
+		func(host string) (repository_fetcher.RepositoryPusher, error) {
+			scheme := "https"
+			if insecure[host] {
+				scheme = "http"
+			}
+
+			return newRepositoryPusher(scheme+"://"+host+"/v1/", scheme+"://"+host, keychain, dockerGraph)
+		},
+	)
+
+	trustPolicy, err := loadTrustPolicy()
+	if err != nil {
+		log.Fatalln("error loading trust policy:", err)
+	}
+
+	warmImages, err := loadWarmImages(*warmImagesFlag, *warmImagesFile)
+	if err != nil {
+		log.Fatalln("error loading warm images:", err)
+	}
+
+	imageCollector := image_collector.New(dockerGraph, tagStore, *graphRoot, image_collector.Thresholds{
+		MaxSize:     *imageGCMaxSize,
+		MinFree:     *imageGCMinFree,
+		GracePeriod: *imageGCGracePeriod,
+	})
+
 	pool := container_pool.New(
 		*binPath,
 		*depotPath,
 		*rootFSPath,
-		repository_fetcher.Retryable{repository_fetcher.New(reg, graph)},
+		registryHost(*dockerRegistry),
+		repository_fetcher.NewTrusted(
+			repository_fetcher.NewLocal(
+				repository_fetcher.NewDeduplicated(
+					repository_fetcher.Retryable{
+						RepositoryFetcher: repository_fetcher.NewThrottled(repoFetcher, pullThrottle),
+						Policy: repository_fetcher.RetryPolicy{
+							MaxAttempts:    *fetchAttempts,
+							InitialBackoff: *fetchBackoff,
+							MaxBackoff:     *fetchMaxBackoff,
+							Deadline:       *fetchDeadline,
+						},
+					},
+				),
+				tagStore,
+				committedTagStore,
+				dockerGraph,
+				defaultPullPolicy,
+			),
+			trustPolicy,
+		),
+		repoPusher,
 		graphDriver,
+		dockerGraph,
+		tagStore,
+		committedTagStore,
+		imageCollector,
+		graph_checker.New(*graphRoot, graphDriver),
+		warmImages,
+		*warmImageInterval,
 		uidPool,
 		networkPool,
 		portPool,
@@ -220,6 +588,10 @@ func main() {
 		log.Fatalln("failed to set up backend:", err)
 	}
 
+	if *imageGCInterval > 0 {
+		go collectImages(imageCollector, *imageGCInterval)
+	}
+
 	log.Println("starting server; listening with", *listenNetwork, "on", *listenAddr)
 
 	graceTime := *containerGraceTime
@@ -231,6 +603,13 @@ func main() {
 		log.Fatalln("failed to start:", err)
 	}
 
+	if *imageAPISocket != "" {
+		err = serveImageAPI(image_api.New(pool, backend))
+		if err != nil {
+			log.Fatalln("failed to start image API:", err)
+		}
+	}
+
 	signals := make(chan os.Signal, 1)
 
 	go func() {
@@ -244,3 +623,428 @@ func main() {
 
 	select {}
 }
+
+// graphDriverOptionSetters apply -graphDriverOptions, by driver; drivers
+// built in with tags register theirs
+var graphDriverOptionSetters = map[string]func(key string, value string) error{}
+
+// serveImageAPI serves the image API on -imageAPISocket in the background.
+// The API has no authentication, so it is never served over the network, and
+// the socket is made accessible to this user alone before it's served.
+func serveImageAPI(api *image_api.ImageAPI) error {
+	// a socket left behind by a previous run would stop us listening
+	os.Remove(*imageAPISocket)
+
+	listener, err := net.Listen("unix", *imageAPISocket)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(*imageAPISocket, 0700)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	log.Println("serving image API on", *imageAPISocket)
+
+	go func() {
+		err := http.Serve(listener, api)
+		log.Println("image API stopped:", err)
+	}()
+
+	return nil
+}
+
+// unbuiltGraphDrivers names the build tag that each graph driver needing one
+// is built in with; the drivers built in remove themselves
+var unbuiltGraphDrivers = map[string]string{
+	"btrfs":        "btrfs",
+	"devicemapper": "devicemapper",
+}
+
+// graphDriverPriority is the order graph drivers are detected in; unlike
+// docker's, it tries overlay before falling back to vfs, which copies each
+// layer in full
+var graphDriverPriority = []string{
+	"aufs",
+	"btrfs",
+	"devicemapper",
+	"overlay",
+	"vfs",
+}
+
+// newGraphDriver constructs the named graph driver with its options, or
+// detects one if no name is given, and reports which is in use.
+func newGraphDriver(name string, options []string, root string) (graphdriver.Driver, error) {
+	var driver graphdriver.Driver
+	var err error
+
+	if name == "" {
+		if len(options) > 0 {
+			return nil, errors.New("-graphDriverOptions requires -graphDriver")
+		}
+
+		driver, err = detectGraphDriver(root)
+	} else {
+		tag, unbuilt := unbuiltGraphDrivers[name]
+		if unbuilt {
+			return nil, fmt.Errorf("graph driver %s is not built in; build with -tags %s", name, tag)
+		}
+
+		err = setGraphDriverOptions(name, options)
+		if err != nil {
+			return nil, err
+		}
+
+		driver, err = graphdriver.GetDriver(name, root)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("using graph driver:", driver.String())
+
+	for _, status := range driver.Status() {
+		log.Println("  "+status[0]+":", status[1])
+	}
+
+	return driver, nil
+}
+
+// detectGraphDriver constructs the first graph driver in graphDriverPriority
+// that's built in and supported, unless one is named by $DOCKER_DRIVER.
+func detectGraphDriver(root string) (graphdriver.Driver, error) {
+	if os.Getenv("DOCKER_DRIVER") != "" {
+		return graphdriver.New(root)
+	}
+
+	var err error
+
+	for _, name := range graphDriverPriority {
+		var driver graphdriver.Driver
+
+		driver, err = graphdriver.GetDriver(name, root)
+		if err == nil {
+			return driver, nil
+		}
+	}
+
+	return nil, err
+}
+
+func setGraphDriverOptions(name string, options []string) error {
+	if len(options) == 0 {
+		return nil
+	}
+
+	setter, found := graphDriverOptionSetters[name]
+	if !found {
+		return fmt.Errorf("graph driver %s takes no options", name)
+	}
+
+	for _, option := range options {
+		segs := strings.SplitN(option, "=", 2)
+		if len(segs) != 2 {
+			return fmt.Errorf("malformed graph driver option: %s", option)
+		}
+
+		err := setter(segs[0], segs[1])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newRepositoryFetcher constructs a fetcher for a registry, speaking the
+// protocol(s) selected by -registryAPIVersion.
+func newRepositoryFetcher(
+	v1Endpoint, v2Endpoint string,
+	keychain repository_fetcher.Keychain,
+	graph *graph.Graph,
+	downloads *repository_fetcher.DownloadCache,
+) (repository_fetcher.RepositoryFetcher, error) {
+	v2Credentials, _ := keychain.Lookup(v2Endpoint)
+
+	v2Fetcher := repository_fetcher.NewV2(v2Endpoint, v2Credentials, graph, downloads)
+
+	if *registryAPIVersion == "v2" {
+		return v2Fetcher, nil
+	}
+
+	v1Credentials, _ := keychain.Lookup(v1Endpoint)
+
+	requestFactory := registry.HTTPRequestFactory(nil)
+
+	reg, err := registry.NewRegistry(
+		&registry.AuthConfig{
+			Username: v1Credentials.Username,
+			Password: v1Credentials.Password,
+		},
+		requestFactory,
+		v1Endpoint,
+	)
+
+	switch *registryAPIVersion {
+	case "v1":
+		if err != nil {
+			return nil, err
+		}
+
+		return repository_fetcher.New(repository_fetcher.NewRangedDockerRegistry(reg, requestFactory), graph, downloads), nil
+
+	case "auto":
+		if err != nil {
+			log.Println("v1 registry unavailable; using v2 only:", v1Endpoint, err)
+			return v2Fetcher, nil
+		}
+
+		return repository_fetcher.Fallback{
+			Primary:   v2Fetcher,
+			Secondary: repository_fetcher.New(repository_fetcher.NewRangedDockerRegistry(reg, requestFactory), graph, downloads),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown registry API version: %s", *registryAPIVersion)
+	}
+}
+
+// withMirrors wraps the fetcher for a registry to pull through its mirrors,
+// if it has any.
+func withMirrors(
+	upstream repository_fetcher.RepositoryFetcher,
+	mirrorEndpoints []string,
+	upstreamV2Endpoint string,
+	keychain repository_fetcher.Keychain,
+	graph *graph.Graph,
+	downloads *repository_fetcher.DownloadCache,
+) repository_fetcher.RepositoryFetcher {
+	if len(mirrorEndpoints) == 0 {
+		return upstream
+	}
+
+	mirrors := []repository_fetcher.Mirror{}
+
+	for _, endpoint := range mirrorEndpoints {
+		credentials, _ := keychain.Lookup(endpoint)
+
+		mirrors = append(mirrors, repository_fetcher.Mirror{
+			Endpoint: endpoint,
+			Fetcher:  repository_fetcher.NewV2Mirror(endpoint, upstreamV2Endpoint, credentials, graph, downloads),
+		})
+	}
+
+	return repository_fetcher.NewMirrored(
+		upstream,
+		mirrors,
+		*registryMirrorFallback,
+		*registryMirrorCooldown,
+	)
+}
+
+// parseMirrors parses -registryMirrors into each registry host's mirror
+// endpoints.
+func parseMirrors(spec string) (map[string][]string, error) {
+	mirrors := map[string][]string{}
+
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		segs := strings.SplitN(entry, "=", 2)
+		if len(segs) != 2 || segs[0] == "" || segs[1] == "" {
+			return nil, fmt.Errorf("malformed mirror entry (expected host=mirror,...): %s", entry)
+		}
+
+		for _, endpoint := range strings.Split(segs[1], ",") {
+			mirrors[segs[0]] = append(mirrors[segs[0]], strings.TrimSpace(endpoint))
+		}
+	}
+
+	return mirrors, nil
+}
+
+// registryHost determines the host of a registry's endpoint URL.
+func registryHost(endpoint string) string {
+	parsed, err := url.Parse(endpoint)
+	if err != nil {
+		log.Fatalln("error parsing registry endpoint:", err)
+	}
+
+	return parsed.Host
+}
+
+// newRepositoryPusher constructs a pusher for a registry, speaking the
+// protocol(s) selected by -registryAPIVersion, as fetches do.
+func newRepositoryPusher(
+	v1Endpoint, v2Endpoint string,
+	keychain repository_fetcher.Keychain,
+	graph *graph.Graph,
+) (repository_fetcher.RepositoryPusher, error) {
+	v2Credentials, _ := keychain.Lookup(v2Endpoint)
+
+	v2Pusher := repository_fetcher.NewV2Pusher(v2Endpoint, v2Credentials, graph)
+
+	if *registryAPIVersion == "v2" {
+		return v2Pusher, nil
+	}
+
+	v1Credentials, _ := keychain.Lookup(v1Endpoint)
+
+	reg, err := registry.NewRegistry(
+		&registry.AuthConfig{
+			Username: v1Credentials.Username,
+			Password: v1Credentials.Password,
+		},
+		registry.HTTPRequestFactory(nil),
+		v1Endpoint,
+	)
+
+	switch *registryAPIVersion {
+	case "v1":
+		if err != nil {
+			return nil, err
+		}
+
+		return repository_fetcher.NewPusher(reg, graph), nil
+
+	case "auto":
+		if err != nil {
+			log.Println("v1 registry unavailable; pushing via v2 only:", v1Endpoint, err)
+			return v2Pusher, nil
+		}
+
+		return repository_fetcher.PushFallback{
+			Primary:   v2Pusher,
+			Secondary: repository_fetcher.NewPusher(reg, graph),
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown registry API version: %s", *registryAPIVersion)
+	}
+}
+
+// v2Endpoint determines the v2 API endpoint for the registry, given its v1
+// endpoint; the official index serves v2 from a different host.
+func v2Endpoint(v1Endpoint string) string {
+	if v1Endpoint == registry.IndexServerAddress() {
+		return repository_fetcher.IndexV2Endpoint
+	}
+
+	endpoint, err := url.Parse(v1Endpoint)
+	if err != nil {
+		log.Fatalln("error parsing registry endpoint:", err)
+	}
+
+	return endpoint.Scheme + "://" + endpoint.Host
+}
+
+// importImages imports every tarball in the directory.
+func importImages(importer *repository_fetcher.Importer, dir string) error {
+	tarballs, err := filepath.Glob(filepath.Join(dir, "*.tar"))
+	if err != nil {
+		return err
+	}
+
+	for _, path := range tarballs {
+		log.Println("importing images from", path)
+
+		tarball, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+
+		err = importer.Import(tarball)
+
+		tarball.Close()
+
+		if err != nil {
+			return fmt.Errorf("importing %s: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
+// loadWarmImages combines the images listed in -warmImages and
+// -warmImagesFile.
+func loadWarmImages(list string, file string) ([]string, error) {
+	images := splitList(list)
+
+	if file == "" {
+		return images, nil
+	}
+
+	contents, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(contents), "\n") {
+		image := strings.TrimSpace(line)
+		if image == "" || strings.HasPrefix(image, "#") {
+			continue
+		}
+
+		images = append(images, image)
+	}
+
+	return images, nil
+}
+
+// loadTrustPolicy builds the policy that images are checked against before
+// they're pulled.
+func loadTrustPolicy() (repository_fetcher.TrustPolicy, error) {
+	policy := repository_fetcher.TrustPolicy{
+		DefaultRegistry:     registryHost(*dockerRegistry),
+		AllowedRegistries:   splitList(*allowedRegistries),
+		AllowedRepositories: splitList(*allowedRepositories),
+		DeniedTags:          splitList(*deniedTags),
+		RequireDigest:       *requireImageDigests,
+	}
+
+	if *trustedKeys == "" {
+		return policy, nil
+	}
+
+	if *imageSignatures == "" {
+		return repository_fetcher.TrustPolicy{}, errors.New("-trustedKeys requires -imageSignatures")
+	}
+
+	keys, err := repository_fetcher.LoadTrustedKeys(*trustedKeys)
+	if err != nil {
+		return repository_fetcher.TrustPolicy{}, err
+	}
+
+	policy.TrustedKeys = keys
+	policy.Signatures = repository_fetcher.SignatureDir(*imageSignatures)
+
+	return policy, nil
+}
+
+// splitList splits a comma-separated flag, skipping empty entries.
+func splitList(list string) []string {
+	entries := []string{}
+
+	for _, entry := range strings.Split(list, ",") {
+		if entry != "" {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries
+}
+
+func collectImages(collector image_collector.ImageCollector, interval time.Duration) {
+	for range time.Tick(interval) {
+		err := collector.Collect()
+		if err != nil {
+			log.Println("failed to collect images:", err)
+		}
+	}
+}